@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/lrascao/kube-plex/pkg/ffmpeg"
+)
+
+// usageColumns is the header of the USAGE_CSV file
+var usageColumns = []string{
+	"start", "end", "session", "user", "client", "title", "input", "node",
+	"seconds", "cpu_requested_seconds", "cpu_used_seconds",
+	"memory_requested_bytes", "memory_peak_bytes", "gpus", "gpu_seconds", "result",
+}
+
+// sessionUsage accounts the resources a session requested and used, the
+// usage is sampled from the metrics API
+type sessionUsage struct {
+	mu sync.Mutex
+
+	start time.Time
+	// resources requested by the transcoder and the GPUs allocated to it
+	cpuRequested, memoryRequested int64
+	gpus                          int64
+	// CPU used, in core-seconds, and the memory working set peak
+	cpuUsed    float64
+	memoryPeak int64
+	node       string
+}
+
+// newSessionUsage starts accounting the session running in the pod
+func newSessionUsage(pod *corev1.Pod) *sessionUsage {
+	u := &sessionUsage{start: time.Now()}
+	c := pod.Spec.Containers[0]
+	u.cpuRequested = c.Resources.Requests.Cpu().MilliValue()
+	u.memoryRequested = c.Resources.Requests.Memory().Value()
+	for name, q := range c.Resources.Limits {
+		if isGPUResource(name) {
+			u.gpus += q.Value()
+		}
+	}
+	return u
+}
+
+// scale accounts the requests of n pods, for sessions split in parts each
+// running in a pod of the same spec
+func (u *sessionUsage) scale(n int) {
+	u.cpuRequested *= int64(n)
+	u.memoryRequested *= int64(n)
+	u.gpus *= int64(n)
+}
+
+// sample adds the usage of the pod every interval until ctx is cancelled
+func (u *sessionUsage) sample(ctx context.Context, cl kubernetes.Interface, pod *corev1.Pod, interval time.Duration) {
+	container := pod.Spec.Containers[0].Name
+	last := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+
+		var node string
+		if current, err := cl.CoreV1().Pods(pod.Namespace).Get(ctx, pod.Name, metav1.GetOptions{}); err == nil {
+			node = current.Spec.NodeName
+		}
+		usage, err := fetchPodMetrics(ctx, cl, pod, container)
+		now := time.Now()
+		if err != nil {
+			// the pod isn't scraped yet, or has just finished
+			last = now
+			continue
+		}
+		u.mu.Lock()
+		if node != "" {
+			u.node = node
+		}
+		u.cpuUsed += float64(usage.Cpu().MilliValue()) / 1000 * now.Sub(last).Seconds()
+		if m := usage.Memory().Value(); m > u.memoryPeak {
+			u.memoryPeak = m
+		}
+		u.mu.Unlock()
+		last = now
+	}
+}
+
+// report logs the usage of the ended session and appends it to USAGE_CSV
+func (u *sessionUsage) report(pod *corev1.Pod, inv ffmpeg.Invocation, sessionErr error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	end := time.Now()
+	seconds := end.Sub(u.start).Seconds()
+	cpuRequested := float64(u.cpuRequested) / 1000 * seconds
+	log.Printf("usage of pod %s: %.0fs, cpu requested=%.0fs used=%.0fs, memory requested=%d peak=%d, gpus=%d",
+		pod.Name, seconds, cpuRequested, u.cpuUsed, u.memoryRequested, u.memoryPeak, u.gpus)
+	if usageCSV == "" {
+		return
+	}
+
+	result := "completed"
+	if sessionErr != nil {
+		result = "failed"
+	}
+	var input string
+	if inputs := inv.LocalInputs(); len(inputs) > 0 {
+		input = inputs[0]
+	}
+	record := []string{
+		u.start.UTC().Format(time.RFC3339), end.UTC().Format(time.RFC3339),
+		inv.SessionID, pod.Annotations[userAnnotation], pod.Annotations[clientAnnotation], pod.Annotations[titleAnnotation], input, u.node,
+		formatSeconds(seconds), formatSeconds(cpuRequested), formatSeconds(u.cpuUsed),
+		strconv.FormatInt(u.memoryRequested, 10), strconv.FormatInt(u.memoryPeak, 10),
+		strconv.FormatInt(u.gpus, 10), formatSeconds(float64(u.gpus) * seconds), result,
+	}
+	if err := appendUsage(usageCSV, record); err != nil {
+		log.Printf("warning: unable to record usage of pod %q: %s", pod.Name, err)
+	}
+}
+
+// appendUsage appends the record to the CSV file, writing the header when
+// the file is created. Sessions run concurrently, each record is written at
+// once to an O_APPEND file so they don't interleave.
+func appendUsage(path string, record []string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	w := csv.NewWriter(f)
+	if info.Size() == 0 {
+		w.Write(usageColumns)
+	}
+	w.Write(record)
+	w.Flush()
+	return w.Error()
+}
+
+// isGPUResource reports whether the extended resource is a GPU, as
+// nvidia.com/gpu, amd.com/gpu or gpu.intel.com/i915
+func isGPUResource(name corev1.ResourceName) bool {
+	return strings.Contains(string(name), "gpu")
+}
+
+func formatSeconds(s float64) string {
+	return fmt.Sprintf("%.1f", s)
+}
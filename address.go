@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+)
+
+// plexPort is the port PMS listens on
+const plexPort = "32400"
+
+// derivePMSAddress sets PMS_INTERNAL_ADDRESS when unset, to the address of
+// PMS_SERVICE_NAME in the namespace or else of the PMS pod IP. Neither is
+// reachable from another cluster.
+func derivePMSAddress() {
+	switch {
+	case remoteCluster():
+		return
+	case pmsServiceName != "" && namespace != "":
+		setDefault("PMS_INTERNAL_ADDRESS", &pmsInternalAddress, fmt.Sprintf("http://%s.%s.svc:%s", pmsServiceName, namespace, plexPort))
+	case podIP != "":
+		setDefault("PMS_INTERNAL_ADDRESS", &pmsInternalAddress, "http://"+net.JoinHostPort(podIP, plexPort))
+	}
+}
+
+// validatePMSAddress checks the address transcode pods report progress to
+// is an http URL
+func validatePMSAddress(address string) error {
+	if address == "" && remoteCluster() {
+		return fmt.Errorf("must be set to an address of PMS reachable from the transcode cluster")
+	}
+	if address == "" {
+		return fmt.Errorf("not set and neither PMS_SERVICE_NAME nor POD_IP are set to derive it")
+	}
+	u, err := url.Parse(address)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%q is not an http URL, e.g. http://plex:32400", address)
+	}
+	return nil
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// adminServer is the HTTP API of the controller managing sessions:
+//
+//	GET    /sessions              list the sessions
+//	GET    /sessions/<id>/logs    follow the transcoder logs of a session
+//	DELETE /sessions/<id>         kill a session
+//	POST   /drain                 turn maintenance mode on
+//	DELETE /drain                 turn maintenance mode off
+//
+// Every request must carry the ADMIN_TOKEN as a bearer token. With
+// ADMIN_TLS_CERT the API is served over TLS, and with ADMIN_TLS_CLIENT_CA
+// clients must also present a certificate signed by that CA.
+type adminServer struct {
+	cfg   *rest.Config
+	cl    kubernetes.Interface
+	ns    string
+	token string
+	// ConfigMap holding the maintenance mode switch, draining is
+	// unavailable when unset
+	maintenance string
+}
+
+// adminSession is a session as returned by the admin API
+type adminSession struct {
+	Pod     string    `json:"pod"`
+	Session string    `json:"session,omitempty"`
+	User    string    `json:"user,omitempty"`
+	Client  string    `json:"client,omitempty"`
+	Title   string    `json:"title,omitempty"`
+	Node    string    `json:"node,omitempty"`
+	Phase   string    `json:"phase"`
+	Created time.Time `json:"created"`
+}
+
+// adminTLSConfig returns the TLS configuration of the admin API, nil when
+// it's served over plain HTTP
+func adminTLSConfig() (*tls.Config, error) {
+	if adminTLSCert == "" && adminTLSKey == "" {
+		if adminTLSClientCA != "" {
+			return nil, fmt.Errorf("ADMIN_TLS_CLIENT_CA requires ADMIN_TLS_CERT and ADMIN_TLS_KEY")
+		}
+		return nil, nil
+	}
+	if adminTLSCert == "" || adminTLSKey == "" {
+		return nil, fmt.Errorf("ADMIN_TLS_CERT and ADMIN_TLS_KEY must be set together")
+	}
+	cert, err := tls.LoadX509KeyPair(adminTLSCert, adminTLSKey)
+	if err != nil {
+		return nil, fmt.Errorf("error loading the admin API certificate: %w", err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if adminTLSClientCA != "" {
+		pem, err := os.ReadFile(adminTLSClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("error reading ADMIN_TLS_CLIENT_CA: %w", err)
+		}
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in ADMIN_TLS_CLIENT_CA %q", adminTLSClientCA)
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// serveAdmin serves the admin API on address until the context is done,
+// over TLS when tlsConfig isn't nil
+func serveAdmin(ctx context.Context, address string, tlsConfig *tls.Config, s *adminServer) {
+	srv := &http.Server{Addr: address, Handler: s, TLSConfig: tlsConfig}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	var err error
+	if tlsConfig != nil {
+		log.Printf("admin API listening on %s over TLS", address)
+		err = srv.ListenAndServeTLS("", "")
+	} else {
+		log.Printf("admin API listening on %s", address)
+		err = srv.ListenAndServe()
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Printf("error serving admin API: %s", err)
+	}
+}
+
+func (s *adminServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || s.token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) != 1 {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case len(parts) == 1 && parts[0] == "sessions" && r.Method == http.MethodGet:
+		s.listSessions(w, r)
+	case len(parts) == 2 && parts[0] == "sessions" && r.Method == http.MethodDelete:
+		s.killSession(w, r, parts[1])
+	case len(parts) == 3 && parts[0] == "sessions" && parts[2] == "logs" && r.Method == http.MethodGet:
+		s.sessionLogs(w, r, parts[1])
+	case len(parts) == 1 && parts[0] == "drain" && (r.Method == http.MethodPost || r.Method == http.MethodDelete):
+		s.drain(w, r, r.Method == http.MethodPost)
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+func (s *adminServer) listSessions(w http.ResponseWriter, r *http.Request) {
+	pods, err := sessionPods(r.Context(), s.cl, s.ns)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sessions := []adminSession{}
+	for _, pod := range pods {
+		sessions = append(sessions, adminSession{
+			Pod:     pod.Name,
+			Session: pod.Labels[sessionLabel],
+			User:    pod.Annotations[userAnnotation],
+			Client:  pod.Annotations[clientAnnotation],
+			Title:   pod.Annotations[titleAnnotation],
+			Node:    pod.Spec.NodeName,
+			Phase:   string(pod.Status.Phase),
+			Created: pod.CreationTimestamp.Time,
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sessions)
+}
+
+func (s *adminServer) killSession(w http.ResponseWriter, r *http.Request, id string) {
+	pod, ok := s.findSession(w, r, id)
+	if !ok {
+		return
+	}
+	if err := stopSession(r.Context(), s.cfg, s.cl, pod); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("killed session in pod %s through the admin API", pod.Name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *adminServer) sessionLogs(w http.ResponseWriter, r *http.Request, id string) {
+	pod, ok := s.findSession(w, r, id)
+	if !ok {
+		return
+	}
+	logs, err := s.cl.CoreV1().Pods(pod.Namespace).GetLogs(pod.Name, &corev1.PodLogOptions{
+		Container: pod.Spec.Containers[0].Name,
+		Follow:    r.URL.Query().Get("follow") == "true",
+	}).Stream(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer logs.Close()
+	w.Header().Set("Content-Type", "text/plain")
+	// the arguments the transcoder logs hold the tokens of PMS
+	redacted := &redactWriter{w: flushWriter{w}}
+	io.Copy(redacted, logs)
+	redacted.Close()
+}
+
+func (s *adminServer) drain(w http.ResponseWriter, r *http.Request, on bool) {
+	if s.maintenance == "" {
+		http.Error(w, "MAINTENANCE_CONFIGMAP is not set", http.StatusConflict)
+		return
+	}
+	if err := setMaintenance(r.Context(), s.cl, s.ns, s.maintenance, on); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("maintenance mode set to %t through the admin API", on)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// findSession looks the session up, replying with the error when it fails
+func (s *adminServer) findSession(w http.ResponseWriter, r *http.Request, id string) (*corev1.Pod, bool) {
+	pod, err := findSession(r.Context(), s.cl, s.ns, id)
+	if errors.Is(err, errSessionNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return nil, false
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+	return pod, true
+}
+
+// flushWriter flushes every write, so followed logs are streamed
+type flushWriter struct {
+	w http.ResponseWriter
+}
+
+func (f flushWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	if flusher, ok := f.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return n, err
+}
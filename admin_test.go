@@ -0,0 +1,206 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestAdminToken(t *testing.T) {
+	tests := []struct {
+		name          string
+		token         string
+		authorization string
+		want          int
+	}{
+		{name: "no token", token: "hunter2", want: http.StatusUnauthorized},
+		{name: "wrong token", token: "hunter2", authorization: "Bearer hunter3", want: http.StatusUnauthorized},
+		{name: "not a bearer token", token: "hunter2", authorization: "hunter2", want: http.StatusUnauthorized},
+		{name: "unset token", authorization: "Bearer ", want: http.StatusUnauthorized},
+		{name: "token", token: "hunter2", authorization: "Bearer hunter2", want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &adminServer{cl: fake.NewSimpleClientset(), ns: "plex", token: tt.token}
+			req := httptest.NewRequest(http.MethodGet, "/sessions", nil)
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("GET /sessions = %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+}
+
+// testCertificate returns a certificate signed by parent, self-signed when
+// parent is nil, and its key
+func testCertificate(t *testing.T, template *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.NotBefore, template.NotAfter = time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+// writePEM writes the certificate, and the key when not nil, as a PEM file
+func writePEM(t *testing.T, path string, cert *x509.Certificate, key *ecdsa.PrivateKey) {
+	t.Helper()
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	if key != nil {
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	}
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAdminMutualTLS(t *testing.T) {
+	defer func(cert, key, ca string) {
+		adminTLSCert, adminTLSKey, adminTLSClientCA = cert, key, ca
+	}(adminTLSCert, adminTLSKey, adminTLSClientCA)
+
+	ca, caKey := testCertificate(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "kube-plex test CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+	server, serverKey := testCertificate(t, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "kube-plex-controller"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca, caKey)
+	client, clientKey := testCertificate(t, &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "dashboard"},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, caKey)
+	untrusted, untrustedKey := testCertificate(t, &x509.Certificate{
+		SerialNumber: big.NewInt(4),
+		Subject:      pkix.Name{CommonName: "intruder"},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, nil, nil)
+
+	dir := t.TempDir()
+	adminTLSCert, adminTLSKey, adminTLSClientCA = filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key"), filepath.Join(dir, "ca.crt")
+	writePEM(t, adminTLSCert, server, nil)
+	writePEM(t, adminTLSKey, server, serverKey)
+	writePEM(t, adminTLSClientCA, ca, nil)
+
+	config, err := adminTLSConfig()
+	if err != nil {
+		t.Fatalf("adminTLSConfig() error = %s", err)
+	}
+	srv := httptest.NewUnstartedServer(&adminServer{cl: fake.NewSimpleClientset(), ns: "plex", token: "hunter2"})
+	srv.TLS = config
+	srv.StartTLS()
+	defer srv.Close()
+
+	keyPair := func(cert *x509.Certificate, key *ecdsa.PrivateKey) *tls.Certificate {
+		return &tls.Certificate{Certificate: [][]byte{cert.Raw}, PrivateKey: key}
+	}
+	tests := []struct {
+		name        string
+		certificate *tls.Certificate
+		wantErr     bool
+	}{
+		{name: "no client certificate", certificate: &tls.Certificate{}, wantErr: true},
+		{name: "untrusted client certificate", certificate: keyPair(untrusted, untrustedKey), wantErr: true},
+		{name: "client certificate", certificate: keyPair(client, clientKey)},
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			httpClient := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+				RootCAs: roots,
+				// presented whichever CAs the server accepts
+				GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+					return tt.certificate, nil
+				},
+			}}}
+			req, err := http.NewRequest(http.MethodGet, srv.URL+"/sessions", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Authorization", "Bearer hunter2")
+			resp, err := httpClient.Do(req)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("GET /sessions error = %v, want error %t", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("GET /sessions = %d, want %d", resp.StatusCode, http.StatusOK)
+			}
+		})
+	}
+}
+
+func TestAdminTLSConfigValidation(t *testing.T) {
+	defer func(cert, key, ca string) {
+		adminTLSCert, adminTLSKey, adminTLSClientCA = cert, key, ca
+	}(adminTLSCert, adminTLSKey, adminTLSClientCA)
+
+	tests := []struct {
+		name          string
+		cert, key, ca string
+		wantTLS       bool
+		wantErr       bool
+	}{
+		{name: "plain HTTP"},
+		{name: "certificate without key", cert: "tls.crt", wantErr: true},
+		{name: "client CA without certificate", ca: "ca.crt", wantErr: true},
+		{name: "missing files", cert: "missing.crt", key: "missing.key", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			adminTLSCert, adminTLSKey, adminTLSClientCA = tt.cert, tt.key, tt.ca
+			config, err := adminTLSConfig()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("adminTLSConfig() error = %v, want error %t", err, tt.wantErr)
+			}
+			if (config != nil) != tt.wantTLS {
+				t.Errorf("adminTLSConfig() = %v, want TLS %t", config, tt.wantTLS)
+			}
+		})
+	}
+}
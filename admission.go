@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/yaml"
+)
+
+// admissionPolicyKey is the ConfigMap key holding the admission policy
+const admissionPolicyKey = "policy.yaml"
+
+// errAdmissionDenied is returned when the policy doesn't allow the namespace
+// to transcode remotely
+var errAdmissionDenied = errors.New("remote transcoding denied by the admission policy")
+
+// admissionRule limits what transcode pods of a namespace may request
+type admissionRule struct {
+	// transcode every session locally
+	Deny bool `json:"deny,omitempty"`
+	// caps of the CPU and memory requests and limits
+	MaxCPU    *resource.Quantity `json:"maxCPU,omitempty"`
+	MaxMemory *resource.Quantity `json:"maxMemory,omitempty"`
+	// resources that may not be requested at all, e.g. nvidia.com/gpu
+	DeniedResources []corev1.ResourceName `json:"deniedResources,omitempty"`
+}
+
+// admissionPolicy is the cluster wide policy shims and the controller
+// enforce. Rules are looked up by the namespace of the transcode pod, which
+// RBAC confines a PMS to, rather than by anything the shim declares itself.
+// Namespaces without a rule of their own get the default one.
+type admissionPolicy struct {
+	Default    admissionRule            `json:"default"`
+	Namespaces map[string]admissionRule `json:"namespaces,omitempty"`
+}
+
+func (p *admissionPolicy) ruleFor(namespace string) admissionRule {
+	if rule, ok := p.Namespaces[namespace]; ok {
+		return rule
+	}
+	return p.Default
+}
+
+// readAdmissionPolicy reads the policy from the named ConfigMap, a missing
+// ConfigMap allows everything
+func readAdmissionPolicy(ctx context.Context, cl kubernetes.Interface, ns, name string) (*admissionPolicy, error) {
+	policy := &admissionPolicy{}
+	cm, err := cl.CoreV1().ConfigMaps(ns).Get(ctx, name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return policy, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := yaml.UnmarshalStrict([]byte(cm.Data[admissionPolicyKey]), policy); err != nil {
+		return nil, fmt.Errorf("invalid %s in ConfigMap %q: %w", admissionPolicyKey, name, err)
+	}
+	return policy, nil
+}
+
+// admit downgrades the pod to comply with the rule, returning what was
+// changed. Denied rules return errAdmissionDenied.
+func (r admissionRule) admit(pod *corev1.Pod) ([]string, error) {
+	if r.Deny {
+		return nil, errAdmissionDenied
+	}
+	var changes []string
+	for _, containers := range [][]corev1.Container{pod.Spec.InitContainers, pod.Spec.Containers} {
+		for i := range containers {
+			c := &containers[i]
+			for _, list := range []corev1.ResourceList{c.Resources.Requests, c.Resources.Limits} {
+				for _, name := range r.DeniedResources {
+					if _, ok := list[name]; ok {
+						delete(list, name)
+						changes = append(changes, fmt.Sprintf("removed %s from container %s", name, c.Name))
+					}
+				}
+				for name, max := range map[corev1.ResourceName]*resource.Quantity{corev1.ResourceCPU: r.MaxCPU, corev1.ResourceMemory: r.MaxMemory} {
+					if q, ok := list[name]; ok && max != nil && q.Cmp(*max) > 0 {
+						list[name] = max.DeepCopy()
+						changes = append(changes, fmt.Sprintf("capped %s of container %s from %s to %s", name, c.Name, q.String(), max.String()))
+					}
+				}
+			}
+		}
+	}
+	return changes, nil
+}
+
+// applyAdmissionPolicy downgrades the transcode pod according to the policy
+// of its namespace
+func applyAdmissionPolicy(ctx context.Context, cl kubernetes.Interface, pod *corev1.Pod) error {
+	policy, err := readAdmissionPolicy(ctx, cl, pod.Namespace, admissionPolicyConfigMap)
+	if err != nil {
+		return err
+	}
+	changes, err := policy.ruleFor(pod.Namespace).admit(pod)
+	for _, change := range changes {
+		log.Printf("admission policy: %s", change)
+	}
+	return err
+}
+
+// enforceAdmissionPolicy deletes the transcode pods of namespace ns, every
+// namespace when empty, violating the policy held by the ConfigMap name of
+// policyNS. Shims that don't apply the policy themselves can't get around
+// it, neither by creating pods that violate it nor by changing them once
+// admitted, so running pods are checked as well as pending ones.
+func enforceAdmissionPolicy(ctx context.Context, cl kubernetes.Interface, ns, policyNS, name string) error {
+	policy, err := readAdmissionPolicy(ctx, cl, policyNS, name)
+	if err != nil {
+		return err
+	}
+	pods, err := cl.CoreV1().Pods(ns).List(ctx, metav1.ListOptions{LabelSelector: managedPodSelector()})
+	if err != nil {
+		return err
+	}
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed || pod.DeletionTimestamp != nil || pod.Labels[poolLabel] != "" {
+			continue
+		}
+		changes, err := policy.ruleFor(pod.Namespace).admit(pod.DeepCopy())
+		if err == nil && len(changes) == 0 {
+			continue
+		}
+		if err == nil {
+			err = fmt.Errorf("%v", changes)
+		}
+		log.Printf("rejecting %s pod %s/%s violating the admission policy: %s", strings.ToLower(string(pod.Status.Phase)), pod.Namespace, pod.Name, err)
+		if err := cl.CoreV1().Pods(pod.Namespace).Delete(ctx, pod.Name, metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
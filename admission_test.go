@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// resourcePod returns a transcode pod whose transcoder requests and is
+// limited to resources
+func resourcePod(name, namespace string, phase corev1.PodPhase, resources corev1.ResourceList) *corev1.Pod {
+	pod := testPod(name, transcodeLabels(nil), phase)
+	pod.Namespace = namespace
+	pod.Spec.Containers = []corev1.Container{{
+		Name:      "plex",
+		Resources: corev1.ResourceRequirements{Requests: resources.DeepCopy(), Limits: resources.DeepCopy()},
+	}}
+	return pod
+}
+
+func TestAdmissionRuleAdmit(t *testing.T) {
+	two, oneGi := resource.MustParse("2"), resource.MustParse("1Gi")
+	gpu := corev1.ResourceName("nvidia.com/gpu")
+
+	tests := []struct {
+		name        string
+		rule        admissionRule
+		resources   corev1.ResourceList
+		wantErr     error
+		wantChanges int
+		want        corev1.ResourceList
+	}{
+		{
+			name:      "deny",
+			rule:      admissionRule{Deny: true},
+			resources: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("1")},
+			wantErr:   errAdmissionDenied,
+		},
+		{
+			name:      "within the caps",
+			rule:      admissionRule{MaxCPU: &two, MaxMemory: &oneGi},
+			resources: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("1500m"), corev1.ResourceMemory: resource.MustParse("512Mi")},
+			want:      corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("1500m"), corev1.ResourceMemory: resource.MustParse("512Mi")},
+		},
+		{
+			name:        "capped",
+			rule:        admissionRule{MaxCPU: &two, MaxMemory: &oneGi},
+			resources:   corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("4"), corev1.ResourceMemory: resource.MustParse("2Gi")},
+			wantChanges: 4,
+			want:        corev1.ResourceList{corev1.ResourceCPU: two, corev1.ResourceMemory: oneGi},
+		},
+		{
+			name:        "denied resource",
+			rule:        admissionRule{DeniedResources: []corev1.ResourceName{gpu}},
+			resources:   corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("1"), gpu: resource.MustParse("1")},
+			wantChanges: 2,
+			want:        corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("1")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := resourcePod("a", "plex", corev1.PodPending, tt.resources)
+			changes, err := tt.rule.admit(pod)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("admit() error = %v, want %v", err, tt.wantErr)
+			}
+			if len(changes) != tt.wantChanges {
+				t.Errorf("admit() = %v, want %d changes", changes, tt.wantChanges)
+			}
+			if tt.wantErr != nil {
+				return
+			}
+			for _, list := range []corev1.ResourceList{pod.Spec.Containers[0].Resources.Requests, pod.Spec.Containers[0].Resources.Limits} {
+				if len(list) != len(tt.want) {
+					t.Errorf("admitted resources %v, want %v", list, tt.want)
+				}
+				for name, want := range tt.want {
+					if q := list[name]; q.Cmp(want) != 0 {
+						t.Errorf("admitted %s = %s, want %s", name, q.String(), want.String())
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestAdmissionPolicyRuleFor(t *testing.T) {
+	policy, err := readAdmissionPolicy(context.Background(), fake.NewSimpleClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "kube-plex-policy", Namespace: "plex"},
+		Data: map[string]string{admissionPolicyKey: `default:
+  maxCPU: "2"
+namespaces:
+  kids:
+    deny: true
+`},
+	}), "plex", "kube-plex-policy")
+	if err != nil {
+		t.Fatalf("readAdmissionPolicy() error = %s", err)
+	}
+	if rule := policy.ruleFor("plex"); rule.Deny || rule.MaxCPU == nil || rule.MaxCPU.String() != "2" {
+		t.Errorf("ruleFor(plex) = %+v, want the default rule", rule)
+	}
+	if rule := policy.ruleFor("kids"); !rule.Deny || rule.MaxCPU != nil {
+		t.Errorf("ruleFor(kids) = %+v, want the namespace rule alone", rule)
+	}
+
+	// a missing policy allows everything
+	policy, err = readAdmissionPolicy(context.Background(), fake.NewSimpleClientset(), "plex", "kube-plex-policy")
+	if err != nil {
+		t.Fatalf("readAdmissionPolicy() without ConfigMap error = %s", err)
+	}
+	if changes, err := policy.ruleFor("plex").admit(resourcePod("a", "plex", corev1.PodPending, corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("64")})); err != nil || len(changes) != 0 {
+		t.Errorf("admit() without policy = %v, %v", changes, err)
+	}
+}
+
+func TestEnforceAdmissionPolicy(t *testing.T) {
+	policy := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "kube-plex-policy", Namespace: "kube-plex"},
+		Data: map[string]string{admissionPolicyKey: `default:
+  maxCPU: "2"
+namespaces:
+  kids:
+    deny: true
+`},
+	}
+	small := corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("1")}
+	large := corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("4")}
+	pool := resourcePod("pool", "plex", corev1.PodRunning, large)
+	pool.Labels[poolLabel] = poolIdle
+
+	cl := fake.NewSimpleClientset(
+		policy,
+		resourcePod("compliant", "plex", corev1.PodRunning, small),
+		resourcePod("violating", "plex", corev1.PodRunning, large),
+		resourcePod("pending", "plex", corev1.PodPending, large),
+		resourcePod("completed", "plex", corev1.PodSucceeded, large),
+		pool,
+		resourcePod("denied", "kids", corev1.PodRunning, small),
+	)
+	ctx := context.Background()
+	if err := enforceAdmissionPolicy(ctx, cl, metav1.NamespaceAll, "kube-plex", "kube-plex-policy"); err != nil {
+		t.Fatalf("enforceAdmissionPolicy() error = %s", err)
+	}
+
+	var deleted []string
+	for _, pod := range []struct{ namespace, name string }{
+		{"plex", "compliant"}, {"plex", "violating"}, {"plex", "pending"},
+		{"plex", "completed"}, {"plex", "pool"}, {"kids", "denied"},
+	} {
+		_, err := cl.CoreV1().Pods(pod.namespace).Get(ctx, pod.name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			deleted = append(deleted, pod.name)
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+	sort.Strings(deleted)
+	if want := "denied,pending,violating"; strings.Join(deleted, ",") != want {
+		t.Errorf("deleted pods %v, want %s", deleted, want)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// sessionStateFile records the pod of the session in the session directory,
+// for a later invocation to adopt
+const sessionStateFile = ".kube-plex-session.json"
+
+// sessionState is what an invocation needs to reattach to the pod a previous
+// one created
+type sessionState struct {
+	Pod       string `json:"pod"`
+	Namespace string `json:"namespace"`
+	Session   string `json:"session,omitempty"`
+	Job       string `json:"job,omitempty"`
+	Secret    string `json:"secret,omitempty"`
+	// Args is the hash of the transcoder arguments, so a pod is only
+	// adopted by an invocation doing the same
+	Args string `json:"args"`
+}
+
+// argsHash returns the hash of the transcoder arguments
+func argsHash(args []string) string {
+	h := sha256.Sum256([]byte(strings.Join(args, "\x00")))
+	return hex.EncodeToString(h[:])
+}
+
+// writeSessionState records the pod of the session in its directory
+func writeSessionState(dir string, state sessionState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, sessionStateFile+".*")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), filepath.Join(dir, sessionStateFile))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// removeSessionState forgets the pod of the session once it ended
+func removeSessionState(dir string) {
+	if err := os.Remove(filepath.Join(dir, sessionStateFile)); err != nil && !os.IsNotExist(err) {
+		log.Printf("warning: unable to remove session state: %s", err)
+	}
+}
+
+// adoptSession returns the pod a previous invocation of the shim created
+// for the same session with the same arguments, when it's still running,
+// e.g. after the shim crashed or PMS invoked the transcoder again
+func adoptSession(ctx context.Context, cl kubernetes.Interface, ns, dir string, args []string) (*corev1.Pod, *sessionState) {
+	data, err := os.ReadFile(filepath.Join(dir, sessionStateFile))
+	if err != nil {
+		return nil, nil
+	}
+	var state sessionState
+	if err := json.Unmarshal(data, &state); err != nil {
+		log.Printf("warning: ignoring invalid session state: %s", err)
+		return nil, nil
+	}
+	if state.Namespace != ns || state.Args != argsHash(args) {
+		return nil, nil
+	}
+	pod, err := cl.CoreV1().Pods(ns).Get(ctx, state.Pod, metav1.GetOptions{})
+	if err != nil {
+		if !apierrors.IsNotFound(err) {
+			log.Printf("warning: unable to get pod %q of the session state: %s", state.Pod, err)
+		}
+		return nil, nil
+	}
+	if pod.DeletionTimestamp != nil || pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+		return nil, nil
+	}
+	return pod, &state
+}
+
+// adoptedTemplate returns the spec an adopted pod is recreated from after a
+// disruption
+func adoptedTemplate(pod *corev1.Pod) *corev1.Pod {
+	template := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: pod.GenerateName,
+			Namespace:    pod.Namespace,
+			Labels:       pod.Labels,
+			Annotations:  pod.Annotations,
+		},
+		Spec: *pod.Spec.DeepCopy(),
+	}
+	template.Spec.NodeName = ""
+	return template
+}
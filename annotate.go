@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// nodeNameEnv is exposed to the transcoder through the downward API, the
+// kubelet expands references to it in the container command once the pod is
+// scheduled. Transcoders the kubelet doesn't start get them expanded by
+// expandNodeName.
+const nodeNameEnv = "KUBE_PLEX_NODE_NAME"
+
+func nodeNameEnvVar() corev1.EnvVar {
+	return corev1.EnvVar{
+		Name: nodeNameEnv,
+		ValueFrom: &corev1.EnvVarSource{
+			FieldRef: &corev1.ObjectFieldSelector{
+				FieldPath: "spec.nodeName",
+			},
+		},
+	}
+}
+
+// annotateProgressURL tags the progress callbacks the transcoder makes to PMS
+// with the node running it, so PMS request logs and anything proxying them
+// can tell the session was handled remotely by kube-plex
+func annotateProgressURL(in string) string {
+	u, err := url.Parse(in)
+	if err != nil {
+		return in
+	}
+	q := u.Query()
+	q.Set("kubeplex", "remote")
+	u.RawQuery = q.Encode()
+	// appended after encoding so the reference isn't escaped and gets
+	// expanded by the kubelet
+	return u.String() + "&kubeplexNode=$(" + nodeNameEnv + ")"
+}
+
+// expandNodeName replaces the references to nodeNameEnv in args with the
+// node, for the transcoders exec'd in pool pods or run by the local and ssh
+// backends, whose command lines the kubelet never sees
+func expandNodeName(args []string, node string) []string {
+	ref := "$(" + nodeNameEnv + ")"
+	out := make([]string, len(args))
+	for i, arg := range args {
+		// references are only made in the query of progress URLs
+		out[i] = strings.ReplaceAll(arg, ref, url.QueryEscape(node))
+	}
+	return out
+}
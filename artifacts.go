@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/yaml"
+)
+
+// transcoderLogTail is how much of TRANSCODER_LOG is kept with the failure
+// artifacts, it holds the output of every session
+const transcoderLogTail = 1 << 20
+
+// captureFailure copies the logs of every container of the failed pod, its
+// manifest and the end of the transcoder log PMS collects to a directory
+// named after the pod in FAILURE_ARTIFACTS_DIR, returning the directory
+func captureFailure(ctx context.Context, cl kubernetes.Interface, pod *corev1.Pod, sessionErr error) (string, error) {
+	dir := filepath.Join(failureArtifactsDir, pod.Name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "error.txt"), []byte(sessionErr.Error()+"\n"), 0644); err != nil {
+		return dir, err
+	}
+
+	// the pod the session followed may be stale
+	if latest, err := cl.CoreV1().Pods(pod.Namespace).Get(ctx, pod.Name, metav1.GetOptions{}); err == nil {
+		pod = latest
+	}
+	manifest, err := yaml.Marshal(sanitizePod(pod))
+	if err != nil {
+		return dir, err
+	}
+	if err := os.WriteFile(filepath.Join(dir, "pod.yaml"), manifest, 0644); err != nil {
+		return dir, err
+	}
+
+	containers := append(append([]corev1.Container(nil), pod.Spec.InitContainers...), pod.Spec.Containers...)
+	for _, c := range containers {
+		logs, err := cl.CoreV1().Pods(pod.Namespace).GetLogs(pod.Name, &corev1.PodLogOptions{Container: c.Name}).DoRaw(ctx)
+		if err != nil {
+			log.Printf("warning: unable to get logs of container %q: %s", c.Name, err)
+			continue
+		}
+		if err := os.WriteFile(filepath.Join(dir, c.Name+".log"), []byte(redact(string(logs))), 0644); err != nil {
+			return dir, err
+		}
+	}
+
+	if transcoderLog != "" {
+		if err := copyTail(transcoderLog, filepath.Join(dir, filepath.Base(transcoderLog)), transcoderLogTail); err != nil {
+			log.Printf("warning: unable to copy the transcoder log: %s", err)
+		}
+	}
+	return dir, nil
+}
+
+// copyTail copies the last n bytes of src to dst
+func copyTail(src, dst string, n int64) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Size() > n {
+		if _, err := in.Seek(-n, io.SeekEnd); err != nil {
+			return err
+		}
+	}
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return fmt.Errorf("copying %s: %w", src, err)
+	}
+	return out.Close()
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/lrascao/kube-plex/pkg/ffmpeg"
+)
+
+// auditSQLitePrefix selects an SQLite database as AUDIT_LOG sink
+const auditSQLitePrefix = "sqlite:"
+
+// auditRecord is the record of a session appended to AUDIT_LOG
+type auditRecord struct {
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+	Session   string    `json:"session,omitempty"`
+	User      string    `json:"user,omitempty"`
+	Client    string    `json:"client,omitempty"`
+	Title     string    `json:"title,omitempty"`
+	Media     []string  `json:"media,omitempty"`
+	ArgsHash  string    `json:"argsHash"`
+	Namespace string    `json:"namespace"`
+	Pod       string    `json:"pod"`
+	Node      string    `json:"node,omitempty"`
+	// completed, stopped or failed
+	Result   string `json:"result"`
+	ExitCode int    `json:"exitCode"`
+	Error    string `json:"error,omitempty"`
+	// resources requested by the transcoder and, when sampled, used
+	CPURequested    string  `json:"cpuRequested,omitempty"`
+	MemoryRequested string  `json:"memoryRequested,omitempty"`
+	GPUs            int64   `json:"gpus,omitempty"`
+	CPUUsedSeconds  float64 `json:"cpuUsedSeconds,omitempty"`
+	MemoryPeakBytes int64   `json:"memoryPeakBytes,omitempty"`
+}
+
+// validateAuditLog checks AUDIT_LOG names a file, an SQLite database or an
+// HTTP endpoint
+func validateAuditLog() error {
+	if auditLog == "" || strings.HasPrefix(auditLog, auditSQLitePrefix) {
+		return nil
+	}
+	u, err := url.Parse(auditLog)
+	if err != nil {
+		return err
+	}
+	switch u.Scheme {
+	case "", "http", "https":
+		return nil
+	}
+	return fmt.Errorf("unsupported scheme %q, expected a path, %s<path>, http or https", u.Scheme, auditSQLitePrefix)
+}
+
+// newAuditRecord describes the session that ran in the pod
+func newAuditRecord(pod *corev1.Pod, inv ffmpeg.Invocation, args []string, start time.Time, usage *sessionUsage, stopped bool, sessionErr error) auditRecord {
+	media := make([]string, len(inv.Inputs))
+	for i, input := range inv.Inputs {
+		media[i] = redact(input)
+	}
+	c := pod.Spec.Containers[0]
+	r := auditRecord{
+		Start:     start.UTC(),
+		End:       time.Now().UTC(),
+		Session:   inv.SessionID,
+		User:      pod.Annotations[userAnnotation],
+		Client:    pod.Annotations[clientAnnotation],
+		Title:     pod.Annotations[titleAnnotation],
+		Media:     media,
+		ArgsHash:  argsHash(args),
+		Namespace: pod.Namespace,
+		Pod:       pod.Name,
+		Node:      pod.Spec.NodeName,
+		Result:    "completed",
+		ExitCode:  exitCodeFor(sessionErr),
+	}
+	if q, ok := c.Resources.Requests[corev1.ResourceCPU]; ok {
+		r.CPURequested = q.String()
+	}
+	if q, ok := c.Resources.Requests[corev1.ResourceMemory]; ok {
+		r.MemoryRequested = q.String()
+	}
+	for name, q := range c.Resources.Limits {
+		if isGPUResource(name) {
+			r.GPUs += q.Value()
+		}
+	}
+	if usage != nil {
+		usage.mu.Lock()
+		r.CPUUsedSeconds = usage.cpuUsed
+		r.MemoryPeakBytes = usage.memoryPeak
+		if r.Node == "" {
+			r.Node = usage.node
+		}
+		usage.mu.Unlock()
+	}
+	switch {
+	case sessionErr != nil:
+		r.Result = "failed"
+		r.Error = sessionErr.Error()
+	case stopped:
+		r.Result = "stopped"
+	}
+	return r
+}
+
+// writeAudit appends the record to AUDIT_LOG
+func writeAudit(ctx context.Context, r auditRecord) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	switch {
+	case strings.HasPrefix(auditLog, auditSQLitePrefix):
+		return insertAudit(ctx, strings.TrimPrefix(auditLog, auditSQLitePrefix), r)
+	case strings.HasPrefix(auditLog, "http://"), strings.HasPrefix(auditLog, "https://"):
+		body, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		return postWebhook(ctx, auditLog, body)
+	}
+	return appendAudit(auditLog, r)
+}
+
+// appendAudit appends the record as a line of JSON to the file. As with
+// USAGE_CSV, the line is written at once to an O_APPEND file so those of
+// concurrent sessions don't interleave.
+func appendAudit(path string, r auditRecord) error {
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(line, '\n'))
+	return err
+}
+
+// auditSchema creates the table of the SQLite sink
+const auditSchema = `CREATE TABLE IF NOT EXISTS sessions (
+	start TEXT, end TEXT, session TEXT, user TEXT, client TEXT, title TEXT,
+	media TEXT, args_hash TEXT, namespace TEXT, pod TEXT, node TEXT,
+	result TEXT, exit_code INTEGER, error TEXT,
+	cpu_requested TEXT, memory_requested TEXT, gpus INTEGER,
+	cpu_used_seconds REAL, memory_peak_bytes INTEGER
+);`
+
+// insertAudit inserts the record in the SQLite database at path with the
+// sqlite3 shell of AUDIT_SQLITE, PMS ships one as "Plex SQLite", so kube-plex
+// needs no SQLite driver of its own
+func insertAudit(ctx context.Context, path string, r auditRecord) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	media, err := json.Marshal(r.Media)
+	if err != nil {
+		return err
+	}
+	values := []string{
+		sqlQuote(r.Start.Format(time.RFC3339)), sqlQuote(r.End.Format(time.RFC3339)),
+		sqlQuote(r.Session), sqlQuote(r.User), sqlQuote(r.Client), sqlQuote(r.Title),
+		sqlQuote(string(media)), sqlQuote(r.ArgsHash), sqlQuote(r.Namespace), sqlQuote(r.Pod), sqlQuote(r.Node),
+		sqlQuote(r.Result), fmt.Sprint(r.ExitCode), sqlQuote(r.Error),
+		sqlQuote(r.CPURequested), sqlQuote(r.MemoryRequested), fmt.Sprint(r.GPUs),
+		fmt.Sprintf("%.1f", r.CPUUsedSeconds), fmt.Sprint(r.MemoryPeakBytes),
+	}
+	// concurrent sessions wait for each other's writes
+	script := ".timeout 5000\n" + auditSchema + "\nINSERT INTO sessions VALUES (" + strings.Join(values, ", ") + ");\n"
+
+	cmd := exec.CommandContext(ctx, auditSQLite, "-bail", path)
+	cmd.Stdin = strings.NewReader(script)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return fmt.Errorf("%w: %s", err, msg)
+		}
+		return err
+	}
+	return nil
+}
+
+// sqlQuote quotes s as an SQL string literal
+func sqlQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// annotation honoured by Karpenter, the counterpart of safeToEvictAnnotation
+const doNotDisruptAnnotation = "karpenter.sh/do-not-disrupt"
+
+// parseNodePoolSelector parses the comma separated key=value labels of
+// NODE_POOL_SELECTOR
+func parseNodePoolSelector() (map[string]string, error) {
+	if nodePoolSelector == "" {
+		return nil, nil
+	}
+	selector := map[string]string{}
+	for _, entry := range strings.Split(nodePoolSelector, ",") {
+		k, v, ok := strings.Cut(entry, "=")
+		if k = strings.TrimSpace(k); !ok || k == "" {
+			return nil, fmt.Errorf("invalid node pool label %q, expected key=value", entry)
+		}
+		selector[k] = strings.TrimSpace(v)
+	}
+	return selector, nil
+}
+
+// parseNodePoolTaint parses the taint of NODE_POOL_TAINT into the
+// toleration of it
+func parseNodePoolTaint() (*corev1.Toleration, error) {
+	return parseToleration(nodePoolTaint)
+}
+
+// parseToleration parses a key[=value]:effect taint into the toleration of
+// it, returning nil when unset
+func parseToleration(taint string) (*corev1.Toleration, error) {
+	if taint == "" {
+		return nil, nil
+	}
+	kv, effect, ok := strings.Cut(taint, ":")
+	k, v, hasValue := strings.Cut(kv, "=")
+	if !ok || k == "" {
+		return nil, fmt.Errorf("invalid taint %q, expected key[=value]:effect", taint)
+	}
+	switch corev1.TaintEffect(effect) {
+	case corev1.TaintEffectNoSchedule, corev1.TaintEffectPreferNoSchedule, corev1.TaintEffectNoExecute:
+	default:
+		return nil, fmt.Errorf("invalid effect %q of taint %q", effect, taint)
+	}
+	toleration := &corev1.Toleration{Key: k, Operator: corev1.TolerationOpExists, Effect: corev1.TaintEffect(effect)}
+	if hasValue {
+		toleration.Operator = corev1.TolerationOpEqual
+		toleration.Value = v
+	}
+	return toleration, nil
+}
+
+// validateSafeToEvict checks SAFE_TO_EVICT is a boolean
+func validateSafeToEvict() error {
+	switch safeToEvict {
+	case "", "true", "false":
+		return nil
+	}
+	return fmt.Errorf("%q is not true or false", safeToEvict)
+}
+
+// placeOnNodePool schedules the pod on the dedicated transcode node pool,
+// adding its labels to the node selector and tolerating its taint, and tells
+// node autoscalers whether they may evict it to scale the pool down
+func placeOnNodePool(pod *corev1.Pod) {
+	// validated in main
+	selector, _ := parseNodePoolSelector()
+	toleration, _ := parseNodePoolTaint()
+	if len(selector) > 0 && pod.Spec.NodeSelector == nil {
+		pod.Spec.NodeSelector = map[string]string{}
+	}
+	for k, v := range selector {
+		pod.Spec.NodeSelector[k] = v
+	}
+	if toleration != nil {
+		pod.Spec.Tolerations = append(pod.Spec.Tolerations, *toleration)
+	}
+
+	if safeToEvict == "" {
+		return
+	}
+	if pod.Annotations == nil {
+		pod.Annotations = map[string]string{}
+	}
+	pod.Annotations[safeToEvictAnnotation] = safeToEvict
+	if safeToEvict == "false" {
+		pod.Annotations[doNotDisruptAnnotation] = "true"
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+)
+
+// execution backends, sessions run in transcode pods unless another
+// backend is selected
+const (
+	backendKubernetes = "kubernetes"
+	backendLocal      = "local"
+	backendSSH        = "ssh"
+)
+
+// Backend runs a transcoder session
+type Backend interface {
+	// Launch starts the transcoder in dir, the session directory
+	Launch(ctx context.Context, args, env []string, dir string) error
+	// Wait waits for the transcoder to exit and returns its exit code
+	Wait() (int, error)
+	// Logs copies the output of the transcoder to w until it exits
+	Logs(w io.Writer) error
+	// Kill asks the transcoder to exit
+	Kill() error
+}
+
+// newBackend returns the backend named by EXECUTION_BACKEND, the kubernetes
+// backend runs the pod of the session
+func newBackend(name string, session *podSession) (Backend, error) {
+	switch name {
+	case backendKubernetes:
+		if session == nil {
+			return nil, fmt.Errorf("no transcode pod to run")
+		}
+		return &kubernetesBackend{podSession: session, killed: make(chan struct{})}, nil
+	case backendLocal:
+		node, err := os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+		return &execBackend{command: localCommand, node: node}, nil
+	case backendSSH:
+		hosts, err := parseSSHHosts()
+		if err != nil {
+			return nil, err
+		}
+		// spread sessions over the hosts
+		host := hosts[rand.Intn(len(hosts))]
+		log.Printf("running session on %s", host)
+		return &execBackend{command: sshCommand(host), node: sshHostName(host)}, nil
+	}
+	return nil, fmt.Errorf("unknown execution backend %q", name)
+}
+
+// parseSSHHosts parses the comma separated hosts of SSH_HOSTS
+func parseSSHHosts() ([]string, error) {
+	if sshHosts == "" {
+		return nil, fmt.Errorf("SSH_HOSTS must be set")
+	}
+	var hosts []string
+	for _, host := range strings.Split(sshHosts, ",") {
+		host = strings.TrimSpace(host)
+		if host == "" {
+			return nil, fmt.Errorf("empty host in %q", sshHosts)
+		}
+		hosts = append(hosts, host)
+	}
+	return hosts, nil
+}
+
+// execBackend runs the transcoder as a child process of the shim
+type execBackend struct {
+	command func(ctx context.Context, args, env []string, dir string) (*exec.Cmd, error)
+	// node the transcoder runs on, reported in progress callbacks
+	node   string
+	cmd    *exec.Cmd
+	output *io.PipeReader
+	// closed once the process exited, with the error of cmd.Wait
+	done    chan struct{}
+	waitErr error
+}
+
+func (b *execBackend) Launch(ctx context.Context, args, env []string, dir string) error {
+	cmd, err := b.command(ctx, expandNodeName(args, b.node), env, dir)
+	if err != nil {
+		return err
+	}
+	pr, pw := io.Pipe()
+	b.cmd = cmd
+	b.cmd.Stdout = pw
+	b.cmd.Stderr = pw
+	b.output = pr
+	b.done = make(chan struct{})
+	if err := b.cmd.Start(); err != nil {
+		pw.Close()
+		return err
+	}
+	go func() {
+		b.waitErr = b.cmd.Wait()
+		pw.Close()
+		close(b.done)
+	}()
+	return nil
+}
+
+func (b *execBackend) Wait() (int, error) {
+	<-b.done
+	var exitErr *exec.ExitError
+	if b.waitErr != nil && !errors.As(b.waitErr, &exitErr) {
+		return 1, b.waitErr
+	}
+	return b.cmd.ProcessState.ExitCode(), nil
+}
+
+func (b *execBackend) Logs(w io.Writer) error {
+	_, err := io.Copy(w, b.output)
+	return err
+}
+
+func (b *execBackend) Kill() error {
+	return b.cmd.Process.Signal(syscall.SIGTERM)
+}
+
+// localCommand runs the original Plex Transcoder on the PMS host
+func localCommand(ctx context.Context, args, env []string, dir string) (*exec.Cmd, error) {
+	cmd := exec.CommandContext(ctx, localTranscoder, args[1:]...)
+	cmd.Env = env
+	cmd.Dir = dir
+	return cmd, nil
+}
+
+// sshCommand returns a function running the Plex Transcoder of the host over
+// SSH, like rffmpeg. The host must mount the media, config and transcode
+// directories at the same paths as PMS. A terminal is allocated so the
+// transcoder is hung up on when the connection drops.
+func sshCommand(host string) func(ctx context.Context, args, env []string, dir string) (*exec.Cmd, error) {
+	return func(ctx context.Context, args, env []string, dir string) (*exec.Cmd, error) {
+		envFile, err := sshUploadEnv(ctx, host, env)
+		if err != nil {
+			return nil, fmt.Errorf("error passing the environment to %s: %w", host, err)
+		}
+		// the file is removed whether or not it could be read
+		remote := []string{
+			".", shellQuote(envFile) + ";", "s=$?;", "rm", "-f", shellQuote(envFile) + ";",
+			"[", "$s", "-eq", "0", "]", "&&", "cd", shellQuote(dir), "&&",
+			"exec", shellQuote(sshTranscoder),
+		}
+		for _, arg := range args[1:] {
+			remote = append(remote, shellQuote(arg))
+		}
+		return exec.CommandContext(ctx, "ssh", append([]string{"-tt"}, sshArgs(host, strings.Join(remote, " "))...)...), nil
+	}
+}
+
+// sshUploadEnv writes the environment of the session to a private temporary
+// file of the host, returning its path. It's read by the remote shell rather
+// than passed on its command line, where tokens would show in the process
+// list of the host.
+func sshUploadEnv(ctx context.Context, host string, env []string) (string, error) {
+	var script strings.Builder
+	for _, kv := range filterEnv(env) {
+		name, value, _ := strings.Cut(kv, "=")
+		if sshHostEnv[name] || !shellNameRe.MatchString(name) {
+			continue
+		}
+		fmt.Fprintf(&script, "export %s=%s\n", name, shellQuote(value))
+	}
+	cmd := exec.CommandContext(ctx, "ssh", sshArgs(host, `f=$(mktemp) && cat > "$f" && echo "$f"`)...)
+	cmd.Stdin = strings.NewReader(script.String())
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("%w: %s", err, msg)
+		}
+		return "", err
+	}
+	path := strings.TrimSpace(string(out))
+	if path == "" {
+		return "", fmt.Errorf("no temporary file created")
+	}
+	return path, nil
+}
+
+// sshHostName returns the name of the host of an SSH_HOSTS entry, without
+// the user
+func sshHostName(host string) string {
+	if i := strings.LastIndex(host, "@"); i >= 0 {
+		return host[i+1:]
+	}
+	return host
+}
+
+// sshArgs returns the ssh arguments running the remote command on host
+func sshArgs(host, remote string) []string {
+	args := append([]string{"-o", "BatchMode=yes"}, strings.Fields(sshOptions)...)
+	return append(args, host, remote)
+}
+
+// sshHostEnv are the variables describing the PMS host, the SSH hosts keep
+// their own
+var sshHostEnv = map[string]bool{
+	"PATH":     true,
+	"HOME":     true,
+	"USER":     true,
+	"SHELL":    true,
+	"PWD":      true,
+	"HOSTNAME": true,
+}
+
+// shellQuote quotes s for a POSIX shell
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// runBackend runs the session with the backend, killing the transcoder when
+// PMS stops the session, and returns its exit code
+func runBackend(ctx context.Context, b Backend, args, env []string, dir string, stopCh <-chan struct{}) (int, error) {
+	if err := b.Launch(ctx, args, env, dir); err != nil {
+		return 1, err
+	}
+	return followBackend(b, stopCh)
+}
+
+// followBackend copies the output of the launched transcoder to stderr and
+// waits for it to exit, asking it to when stopCh is closed
+func followBackend(b Backend, stopCh <-chan struct{}) (int, error) {
+	logsDone := make(chan error, 1)
+	go func() { logsDone <- b.Logs(os.Stderr) }()
+
+	exited := make(chan struct{})
+	go func() {
+		select {
+		case <-stopCh:
+			log.Printf("exit requested.")
+			if err := b.Kill(); err != nil && !errors.Is(err, os.ErrProcessDone) {
+				log.Printf("warning: unable to kill transcoder: %s", err)
+			}
+		case <-exited:
+		}
+	}()
+	code, err := b.Wait()
+	close(exited)
+	<-logsDone
+	return code, err
+}
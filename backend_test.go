@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestParseSSHHosts(t *testing.T) {
+	defer func(hosts string) { sshHosts = hosts }(sshHosts)
+
+	tests := []struct {
+		hosts   string
+		want    []string
+		wantErr bool
+	}{
+		{hosts: "a", want: []string{"a"}},
+		{hosts: "a, b", want: []string{"a", "b"}},
+		{hosts: "", wantErr: true},
+		{hosts: ",", wantErr: true},
+		{hosts: "a,,b", wantErr: true},
+		{hosts: "a, ", wantErr: true},
+	}
+	for _, tt := range tests {
+		sshHosts = tt.hosts
+		got, err := parseSSHHosts()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseSSHHosts() of %q error = %v, want error %t", tt.hosts, err, tt.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseSSHHosts() of %q = %q, want %q", tt.hosts, got, tt.want)
+		}
+	}
+}
+
+func TestKubernetesBackend(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cl := newFakeCluster(ctx, "plex")
+
+	if _, err := newBackend(backendKubernetes, nil); err == nil {
+		t.Errorf("newBackend() without a session succeeded")
+	}
+	session := &podSession{
+		cl:        cl,
+		namespace: "plex",
+		template: &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{GenerateName: legacyPodPrefix, Namespace: "plex", Labels: transcodeLabels(nil)},
+			Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "plex", Image: "plexinc/pms-docker"}}},
+		},
+		waitOpts:      waitOptions{pollInterval: 10 * time.Millisecond},
+		createTimeout: time.Second,
+	}
+	backend, err := newBackend(backendKubernetes, session)
+	if err != nil {
+		t.Fatalf("newBackend() error = %s", err)
+	}
+	code, err := runBackend(ctx, backend, nil, nil, "", make(chan struct{}))
+	if code != 0 || err != nil {
+		t.Fatalf("runBackend() = %d, %v, want 0, nil", code, err)
+	}
+	if session.pod == nil || session.pod.Name == "" {
+		t.Fatalf("no pod created")
+	}
+
+	session.cleanup(ctx)
+	pods, err := cl.CoreV1().Pods("plex").List(ctx, metav1.ListOptions{LabelSelector: managedByLabel})
+	if err != nil {
+		t.Fatalf("error listing pods: %s", err)
+	}
+	if len(pods.Items) != 0 {
+		t.Errorf("%d pods left after cleanup, want 0", len(pods.Items))
+	}
+}
+
+func TestExecBackendExpandsNodeName(t *testing.T) {
+	defer func(transcoder string) { localTranscoder = transcoder }(localTranscoder)
+	localTranscoder = "/bin/echo"
+
+	tests := []struct {
+		name string
+		node string
+		want string
+	}{
+		{name: "local", node: "nas", want: "kubeplexNode=nas"},
+		{name: "ssh", node: sshHostName("plex@gpu-1.lan"), want: "kubeplexNode=gpu-1.lan"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &execBackend{command: localCommand, node: tt.node}
+			args := []string{"Plex Transcoder", "-progressurl", annotateProgressURL("http://plex:32400/video/:/transcode/session/a/progress")}
+			if err := b.Launch(context.Background(), args, nil, t.TempDir()); err != nil {
+				t.Fatalf("Launch() error = %s", err)
+			}
+			var out bytes.Buffer
+			if err := b.Logs(&out); err != nil {
+				t.Fatalf("Logs() error = %s", err)
+			}
+			if code, err := b.Wait(); code != 0 || err != nil {
+				t.Fatalf("Wait() = %d, %v", code, err)
+			}
+			if got := out.String(); !strings.Contains(got, tt.want) || strings.Contains(got, nodeNameEnv) {
+				t.Errorf("transcoder ran with %q, want %s", got, tt.want)
+			}
+		})
+	}
+}
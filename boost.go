@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+
+	corev1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// label used to select a single boosted pod from its disruption budget
+	boostLabel = "kube-plex/boosted-pod"
+
+	// annotation honoured by the cluster autoscaler when draining nodes
+	safeToEvictAnnotation = "cluster-autoscaler.kubernetes.io/safe-to-evict"
+)
+
+// boostPod protects a pod that is close to finishing from being evicted, it
+// marks it as not safe to evict for the cluster autoscaler and covers it
+// with a PodDisruptionBudget that is garbage collected along with the pod
+func boostPod(ctx context.Context, cl kubernetes.Interface, pod *corev1.Pod) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"labels": map[string]string{
+				boostLabel: pod.Name,
+			},
+			"annotations": map[string]string{
+				safeToEvictAnnotation: "false",
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := cl.CoreV1().Pods(pod.Namespace).Patch(ctx, pod.Name, types.MergePatchType, patch, metav1.PatchOptions{}); err != nil {
+		return err
+	}
+
+	minAvailable := intstr.FromInt(1)
+	pdb := &policyv1.PodDisruptionBudget{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: pod.Name,
+			OwnerReferences: []metav1.OwnerReference{
+				{
+					APIVersion: "v1",
+					Kind:       "Pod",
+					Name:       pod.Name,
+					UID:        pod.UID,
+				},
+			},
+		},
+		Spec: policyv1.PodDisruptionBudgetSpec{
+			MinAvailable: &minAvailable,
+			Selector: &metav1.LabelSelector{
+				MatchLabels: map[string]string{
+					boostLabel: pod.Name,
+				},
+			},
+		},
+	}
+	_, err = cl.PolicyV1().PodDisruptionBudgets(pod.Namespace).Create(ctx, pdb, metav1.CreateOptions{})
+	return err
+}
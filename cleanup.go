@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/lrascao/kube-plex/pkg/podtemplate"
+)
+
+const (
+	// label of the Jobs removing the session directories of ended sessions,
+	// they're not transcode pods
+	cleanupLabel = "kube-plex/cleanup"
+	// cleanupAfterAnnotation holds when a suspended cleanup Job is due, the
+	// controller resumes it then
+	cleanupAfterAnnotation = "kube-plex/cleanup-after"
+)
+
+// cleanupSession removes the session directory from the transcode volume
+// once the session ended. The shim removes it right away when it can, but
+// segments written by transcode pods running as another user, or which PMS
+// may still serve for delay, are removed by a Job running like the transcode
+// pod instead. Delayed Jobs are created suspended, the controller resumes
+// them once delay passed.
+func cleanupSession(ctx context.Context, cl kubernetes.Interface, pod *corev1.Pod, cwd string, delay time.Duration) {
+	if !isSessionDir(cwd) {
+		log.Printf("warning: not removing %s, it's not a session directory of %s", cwd, transcodeDir())
+		return
+	}
+	if delay == 0 {
+		err := os.RemoveAll(cwd)
+		if err == nil {
+			return
+		}
+		log.Printf("warning: unable to remove %s: %s, removing it from a Job", cwd, err)
+	}
+
+	var source *corev1.VolumeSource
+	for _, v := range pod.Spec.Volumes {
+		if v.Name == "transcode" {
+			source = &v.VolumeSource
+		}
+	}
+	// the segments of relayed sessions were written by the shim
+	if source == nil || source.EmptyDir != nil {
+		return
+	}
+
+	job := generateCleanupJob(pod, *source, cwd, delay)
+	created, err := cl.BatchV1().Jobs(pod.Namespace).Create(ctx, job, metav1.CreateOptions{})
+	if err != nil {
+		log.Printf("warning: unable to create the Job removing %s: %s", cwd, err)
+		return
+	}
+	log.Printf("removing %s in %s with job %s", cwd, delay, created.Name)
+}
+
+// startDueCleanups resumes the suspended cleanup Jobs whose delay passed
+func startDueCleanups(ctx context.Context, cl kubernetes.Interface, ns string) error {
+	jobs, err := cl.BatchV1().Jobs(ns).List(ctx, metav1.ListOptions{LabelSelector: cleanupLabel})
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, job := range jobs.Items {
+		if job.Spec.Suspend == nil || !*job.Spec.Suspend {
+			continue
+		}
+		// Jobs without a valid time are resumed rather than left behind
+		if after, err := time.Parse(time.RFC3339, job.Annotations[cleanupAfterAnnotation]); err == nil && now.Before(after) {
+			continue
+		}
+		log.Printf("starting cleanup job %s", job.Name)
+		patch := []byte(`{"spec":{"suspend":false}}`)
+		_, err := cl.BatchV1().Jobs(ns).Patch(ctx, job.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// isSessionDir reports whether dir is a strict subdirectory of the transcode
+// directory, the only directories sessions may remove
+func isSessionDir(dir string) bool {
+	base, err := filepath.Abs(transcodeDir())
+	if err != nil {
+		return false
+	}
+	dir, err = filepath.Abs(dir)
+	if err != nil {
+		return false
+	}
+	// symlinks mustn't lead out of the transcode directory
+	if resolved, err := filepath.EvalSymlinks(dir); err == nil {
+		dir = resolved
+	}
+	if resolved, err := filepath.EvalSymlinks(base); err == nil {
+		base = resolved
+	}
+	rel, err := filepath.Rel(base, dir)
+	return err == nil && rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// generateCleanupJob returns a Job removing the session directory, mounting
+// the transcode volume as transcode pods do, running as the same user on the
+// same nodes. Jobs removing it after delay are suspended until then.
+func generateCleanupJob(pod *corev1.Pod, source corev1.VolumeSource, cwd string, delay time.Duration) *batchv1.Job {
+	backoffLimit := int32(1)
+	ttl := int32(60)
+	cleanup := &corev1.Pod{
+		Spec: corev1.PodSpec{
+			RestartPolicy:      corev1.RestartPolicyNever,
+			SecurityContext:    pod.Spec.SecurityContext.DeepCopy(),
+			ImagePullSecrets:   pod.Spec.ImagePullSecrets,
+			ServiceAccountName: pod.Spec.ServiceAccountName,
+			NodeSelector:       transcodeNodeSelector(),
+			Tolerations:        pod.Spec.Tolerations,
+			Containers: []corev1.Container{{
+				Name:    "cleanup",
+				Image:   pod.Spec.Containers[0].Image,
+				Command: []string{"/bin/sh", "-c", `rm -rf "$0"`, cwd},
+			}},
+			Volumes: []corev1.Volume{{Name: "transcode", VolumeSource: source}},
+		},
+	}
+	// the whole transcode directory is mounted even when sessions are
+	// isolated, so the session directory itself can be removed
+	podtemplate.AddTranscodeMounts(cleanup, transcodeDir())
+	// validated in main
+	if opts, _ := parseMountOptions(transcodeMountOptions); opts != nil {
+		for i := range cleanup.Spec.Containers[0].VolumeMounts {
+			cleanup.Spec.Containers[0].VolumeMounts[i].SubPath = opts.subPath
+			cleanup.Spec.Containers[0].VolumeMounts[i].SubPathExpr = opts.subPathExpr
+		}
+	}
+	// hostPath volumes are only found on the node of the transcode pod
+	if source.HostPath != nil {
+		cleanup.Spec.NodeName = pod.Spec.NodeName
+	}
+	placeOnNodePool(cleanup)
+	hardenPod(cleanup)
+
+	labels := map[string]string{cleanupLabel: "true"}
+	job := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: "kube-plex-cleanup-",
+			Namespace:    pod.Namespace,
+			Labels:       labels,
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit:            &backoffLimit,
+			TTLSecondsAfterFinished: &ttl,
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: labels, Annotations: cleanup.Annotations},
+				Spec:       cleanup.Spec,
+			},
+		},
+	}
+	if delay > 0 {
+		suspend := true
+		job.Spec.Suspend = &suspend
+		job.Annotations = map[string]string{
+			cleanupAfterAnnotation: time.Now().Add(delay).UTC().Format(time.RFC3339),
+		}
+	}
+	return job
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestGenerateCleanupJob(t *testing.T) {
+	defer func(selector, taint, profile string) {
+		nodePoolSelector, nodePoolTaint, securityProfile = selector, taint, profile
+	}(nodePoolSelector, nodePoolTaint, securityProfile)
+	nodePoolSelector, nodePoolTaint, securityProfile = "pool=transcode", "dedicated=transcode:NoSchedule", securityProfileRestricted
+
+	uid := int64(1000)
+	pod := testPod("a", transcodeLabels(nil), corev1.PodSucceeded)
+	pod.Spec.SecurityContext = &corev1.PodSecurityContext{RunAsUser: &uid}
+	pod.Spec.Containers = []corev1.Container{{Name: "plex", Image: "plexinc/pms-docker"}}
+	source := corev1.VolumeSource{PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: "transcode"}}
+
+	tests := []struct {
+		name        string
+		delay       time.Duration
+		wantSuspend bool
+	}{
+		{name: "right away"},
+		{name: "delayed", delay: time.Hour, wantSuspend: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			job := generateCleanupJob(pod, source, "/transcode/session", tt.delay)
+			suspended := job.Spec.Suspend != nil && *job.Spec.Suspend
+			if suspended != tt.wantSuspend {
+				t.Errorf("suspended = %t, want %t", suspended, tt.wantSuspend)
+			}
+			if _, ok := job.Annotations[cleanupAfterAnnotation]; ok != tt.wantSuspend {
+				t.Errorf("%s annotation set = %t, want %t", cleanupAfterAnnotation, ok, tt.wantSuspend)
+			}
+
+			spec := job.Spec.Template.Spec
+			if command := strings.Join(spec.Containers[0].Command, " "); strings.Contains(command, "sleep") {
+				t.Errorf("cleanup command %q sleeps", command)
+			}
+			if spec.NodeSelector["pool"] != "transcode" || len(spec.Tolerations) != 1 {
+				t.Errorf("cleanup pod isn't placed on the node pool: %v, %v", spec.NodeSelector, spec.Tolerations)
+			}
+			if c := spec.Containers[0].SecurityContext; c == nil || c.ReadOnlyRootFilesystem == nil || !*c.ReadOnlyRootFilesystem {
+				t.Errorf("cleanup container isn't hardened: %v", c)
+			}
+			if *spec.SecurityContext.RunAsUser != uid {
+				t.Errorf("cleanup pod runs as %d, want %d", *spec.SecurityContext.RunAsUser, uid)
+			}
+		})
+	}
+	if pod.Spec.SecurityContext.RunAsNonRoot != nil {
+		t.Errorf("hardening the cleanup pod changed the transcode pod")
+	}
+}
+
+func TestStartDueCleanups(t *testing.T) {
+	suspendedJob := func(name string, after time.Time) *batchv1.Job {
+		suspend := true
+		return &batchv1.Job{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        name,
+				Namespace:   "plex",
+				Labels:      map[string]string{cleanupLabel: "true"},
+				Annotations: map[string]string{cleanupAfterAnnotation: after.UTC().Format(time.RFC3339)},
+			},
+			Spec: batchv1.JobSpec{Suspend: &suspend},
+		}
+	}
+	ctx := context.Background()
+	cl := fake.NewSimpleClientset([]runtime.Object{
+		suspendedJob("due", time.Now().Add(-time.Minute)),
+		suspendedJob("later", time.Now().Add(time.Hour)),
+	}...)
+	if err := startDueCleanups(ctx, cl, "plex"); err != nil {
+		t.Fatalf("startDueCleanups() error = %s", err)
+	}
+	for name, want := range map[string]bool{"due": false, "later": true} {
+		job, err := cl.BatchV1().Jobs("plex").Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("error getting job %s: %s", name, err)
+		}
+		if suspended := job.Spec.Suspend != nil && *job.Spec.Suspend; suspended != want {
+			t.Errorf("job %s suspended = %t, want %t", name, suspended, want)
+		}
+	}
+}
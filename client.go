@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/client-go/rest"
+)
+
+// configureClient applies KUBE_API_QPS, KUBE_API_BURST and KUBE_API_TIMEOUT
+// to the client configuration and identifies the process in its User-Agent,
+// so the API server's priority and fairness can tell kube-plex apart and a
+// slow API server doesn't hang sessions
+func configureClient(cfg *rest.Config) error {
+	if kubeAPIQPS != "" {
+		qps, err := strconv.ParseFloat(kubeAPIQPS, 32)
+		if err != nil || qps <= 0 {
+			return fmt.Errorf("KUBE_API_QPS: %q must be a positive number", kubeAPIQPS)
+		}
+		cfg.QPS = float32(qps)
+	}
+	if kubeAPIBurst != "" {
+		burst, err := strconv.Atoi(kubeAPIBurst)
+		if err != nil || burst <= 0 {
+			return fmt.Errorf("KUBE_API_BURST: %q must be a positive integer", kubeAPIBurst)
+		}
+		cfg.Burst = burst
+	}
+	if kubeAPITimeout != "" {
+		timeout, err := time.ParseDuration(kubeAPITimeout)
+		if err != nil || timeout < 0 {
+			return fmt.Errorf("KUBE_API_TIMEOUT: %q must be a duration", kubeAPITimeout)
+		}
+		// rest.Config.Timeout would also end log streams and watches
+		if timeout > 0 {
+			cfg.Wrap(func(rt http.RoundTripper) http.RoundTripper {
+				return &timeoutRoundTripper{rt: rt, timeout: timeout}
+			})
+		}
+	}
+	cfg.UserAgent = userAgent()
+	return nil
+}
+
+// userAgent names the kube-plex process making API requests: the transcoder
+// shim or the subcommand
+func userAgent() string {
+	role := "shim"
+	if args := os.Args; isCommandInvocation(args) && len(args) > 1 && !strings.HasPrefix(args[1], "-") {
+		role = args[1]
+	}
+	return fmt.Sprintf("kube-plex/%s (%s/%s)", role, runtime.GOOS, runtime.GOARCH)
+}
+
+// timeoutRoundTripper bounds the duration of API requests, except the long
+// running ones: watches, followed logs and upgraded connections
+type timeoutRoundTripper struct {
+	rt      http.RoundTripper
+	timeout time.Duration
+}
+
+func (t *timeoutRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	q := req.URL.Query()
+	if q.Get("watch") == "true" || q.Get("follow") == "true" || req.Header.Get("Upgrade") != "" {
+		return t.rt.RoundTrip(req)
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), t.timeout)
+	resp, err := t.rt.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	// the timeout covers reading the body
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
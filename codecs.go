@@ -0,0 +1,59 @@
+package main
+
+import (
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// codecs modes, either a shared writable claim or a per pod copy of the
+	// codecs PMS already downloaded
+	codecsModePVC  = "pvc"
+	codecsModeCopy = "copy"
+)
+
+// addCodecsVolume makes the Codecs directory writable in the transcode pod.
+// The transcoder downloads missing codecs into the config directory, which
+// is mounted read-only. A shared claim lets every pod reuse downloaded codecs,
+// while the copy mode seeds an emptyDir with the codecs PMS already has.
+func addCodecsVolume(pod *corev1.Pod) {
+	var source corev1.VolumeSource
+	switch codecsMode {
+	case codecsModePVC:
+		source.PersistentVolumeClaim = &corev1.PersistentVolumeClaimVolumeSource{
+			ClaimName: codecsPVC,
+		}
+	case codecsModeCopy:
+		source.EmptyDir = &corev1.EmptyDirVolumeSource{}
+	default:
+		return
+	}
+
+	pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{
+		Name:         "codecs",
+		VolumeSource: source,
+	})
+	container := &pod.Spec.Containers[0]
+	container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+		Name:      "codecs",
+		MountPath: codecsPath,
+	})
+
+	if codecsMode == codecsModeCopy {
+		pod.Spec.InitContainers = append(pod.Spec.InitContainers, corev1.Container{
+			Name:    "codecs",
+			Image:   container.Image,
+			Command: []string{"/bin/sh", "-c", `cp -a "$0"/. /codecs/ 2>/dev/null || true`, codecsPath},
+			VolumeMounts: []corev1.VolumeMount{
+				{
+					Name:      "config",
+					MountPath: "/config",
+					ReadOnly:  true,
+				},
+				{
+					Name:      "codecs",
+					MountPath: "/codecs",
+				},
+			},
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// commands maps the kube-plex subcommands to their implementation. They are
+// only reachable when the binary is invoked as kube-plex, when installed as
+// the Plex Transcoder every argument belongs to the transcoder.
+var commands = map[string]func(args []string) error{
+	"config":      runConfig,
+	"controller":  runController,
+	"doctor":      runDoctor,
+	"install":     runInstall,
+	"maintenance": runMaintenance,
+	"relay":       runRelay,
+	"sessions":    runSessions,
+}
+
+// isCommandInvocation reports whether the process was started as kube-plex
+// itself rather than as the Plex Transcoder replacement
+func isCommandInvocation(args []string) bool {
+	return len(args) > 0 && filepath.Base(args[0]) == "kube-plex"
+}
+
+func runCommand(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: kube-plex <command> [flags], available commands: %v", commandNames())
+	}
+	fn, ok := commands[args[0]]
+	if !ok {
+		return fmt.Errorf("unknown command %q, available commands: %v", args[0], commandNames())
+	}
+	return fn(args[1:])
+}
+
+func commandNames() []string {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// buildCommandConfig builds the client configuration of subcommands, which
+// unlike the transcoder shim usually run outside the cluster and honour
+// KUBECONFIG and ~/.kube/config
+func buildCommandConfig(kubeconfig string) (*rest.Config, string, error) {
+	cfg, ns, err := buildClusterConfig(kubeconfig, "")
+	if err != nil {
+		return nil, "", err
+	}
+	if err := configureClient(cfg); err != nil {
+		return nil, "", fmt.Errorf("error parsing %w", err)
+	}
+	return cfg, ns, nil
+}
+
+// buildClusterConfig builds the client configuration of a context of the
+// kubeconfig, the current one when empty, and returns its namespace
+func buildClusterConfig(kubeconfig, context string) (*rest.Config, string, error) {
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	if kubeconfig != "" {
+		rules.ExplicitPath = kubeconfig
+	}
+	clientConfig := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, &clientcmd.ConfigOverrides{CurrentContext: context})
+
+	cfg, err := clientConfig.ClientConfig()
+	if err != nil {
+		return nil, "", fmt.Errorf("error building kubeconfig: %w", err)
+	}
+	ns, _, err := clientConfig.Namespace()
+	if err != nil {
+		return nil, "", fmt.Errorf("error reading namespace from kubeconfig: %w", err)
+	}
+	return cfg, ns, nil
+}
+
+// buildCommandClient builds a kubernetes clientset for subcommands
+func buildCommandClient(kubeconfig string) (kubernetes.Interface, string, error) {
+	cfg, ns, err := buildCommandConfig(kubeconfig)
+	if err != nil {
+		return nil, "", err
+	}
+	cl, err := kubernetes.NewForConfig(cfg)
+	if err != nil {
+		return nil, "", fmt.Errorf("error building kubernetes clientset: %w", err)
+	}
+	return cl, ns, nil
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilrand "k8s.io/apimachinery/pkg/util/rand"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// concurrency policies applied when MAX_CONCURRENT_TRANSCODES is reached
+	concurrencyPolicyQueue  = "queue"
+	concurrencyPolicyLocal  = "local"
+	concurrencyPolicyReject = "reject"
+)
+
+const (
+	// slotLabel marks the Leases reserving a transcode slot until the pod
+	// of the session is created, valued by the limit they count against
+	slotLabel  = "kube-plex/slot"
+	slotGlobal = "global"
+	slotUser   = "user"
+	// reservations stop counting after slotTTL, when their shim died
+	// before creating its pod
+	slotTTL = 2 * time.Minute
+)
+
+var (
+	// errAtCapacity is returned when a session can't be started remotely
+	// because the concurrency limit has been reached
+	errAtCapacity = fmt.Errorf("maximum number of concurrent transcodes reached")
+	// errUserAtCapacity is returned when the user of the session has reached
+	// their quota
+	errUserAtCapacity = fmt.Errorf("maximum number of concurrent transcodes of the user reached")
+)
+
+// validateConcurrencyPolicy checks CONCURRENCY_POLICY is a known policy
+func validateConcurrencyPolicy() error {
+	switch concurrencyPolicy {
+	case concurrencyPolicyQueue, concurrencyPolicyLocal, concurrencyPolicyReject:
+		return nil
+	}
+	return fmt.Errorf("unknown concurrency policy %q, expected %s, %s or %s", concurrencyPolicy, concurrencyPolicyQueue, concurrencyPolicyLocal, concurrencyPolicyReject)
+}
+
+// countActiveTranscodes returns the number of transcode pods in the
+// namespace that haven't finished yet, only counting the pods of the user
+// when set
+func countActiveTranscodes(ctx context.Context, cl kubernetes.Interface, ns, user string) (int, error) {
+	pods, err := listManagedPods(ctx, cl, ns)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, pod := range pods {
+		if pod.DeletionTimestamp != nil || pod.Labels[poolLabel] == poolIdle {
+			continue
+		}
+		if pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+			continue
+		}
+		if user != "" && pod.Labels[userLabel] != labelValue(user) {
+			continue
+		}
+		n++
+	}
+	return n, nil
+}
+
+// slotSelector selects the reservations counted against the limit of the
+// user, or the global one when unset
+func slotSelector(user string) string {
+	if user == "" {
+		return slotLabel + "=" + slotGlobal
+	}
+	return slotLabel + "=" + slotUser + "," + userLabel + "=" + labelValue(user)
+}
+
+// reserveSlot creates the Lease reserving a transcode slot
+func reserveSlot(ctx context.Context, cl kubernetes.Interface, ns, user string) (*coordinationv1.Lease, error) {
+	labels := map[string]string{slotLabel: slotGlobal}
+	if user != "" {
+		labels[slotLabel] = slotUser
+		labels[userLabel] = labelValue(user)
+	}
+	duration := int32(slotTTL.Seconds())
+	now := metav1.NowMicro()
+	return cl.CoordinationV1().Leases(ns).Create(ctx, &coordinationv1.Lease{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "kube-plex-slot-" + utilrand.String(8),
+			Namespace: ns,
+			Labels:    labels,
+		},
+		Spec: coordinationv1.LeaseSpec{
+			LeaseDurationSeconds: &duration,
+			AcquireTime:          &now,
+			RenewTime:            &now,
+		},
+	}, metav1.CreateOptions{})
+}
+
+// slotExpired reports whether the reservation stopped counting
+func slotExpired(lease *coordinationv1.Lease, now time.Time) bool {
+	if lease.Spec.RenewTime == nil || lease.Spec.LeaseDurationSeconds == nil {
+		return true
+	}
+	return now.After(lease.Spec.RenewTime.Add(time.Duration(*lease.Spec.LeaseDurationSeconds) * time.Second))
+}
+
+// countSlotReservations returns the number of reservations counted against
+// the limit of the user, or the global one, besides own
+func countSlotReservations(ctx context.Context, cl kubernetes.Interface, ns, user, own string) (int, error) {
+	leases, err := cl.CoordinationV1().Leases(ns).List(ctx, metav1.ListOptions{LabelSelector: slotSelector(user)})
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	n := 0
+	for i := range leases.Items {
+		lease := &leases.Items[i]
+		if lease.Name != own && lease.DeletionTimestamp == nil && !slotExpired(lease, now) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// releaseSlot deletes the reservation
+func releaseSlot(cl kubernetes.Interface, lease *coordinationv1.Lease) {
+	err := cl.CoordinationV1().Leases(lease.Namespace).Delete(context.Background(), lease.Name, metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		log.Printf("warning: unable to release transcode slot %q: %s", lease.Name, err)
+	}
+}
+
+// acquireTranscodeSlot blocks until fewer than max transcodes are active when
+// the policy is to queue, with the local and reject policies it returns
+// errAtCapacity right away instead. When user is set only the transcodes of
+// the user are counted, and errUserAtCapacity is returned.
+//
+// The slot is reserved with a Lease before counting, so shims starting at
+// once see each other's reservations and at most max of them go ahead. The
+// returned function releases the reservation, to be called once the pod of
+// the session was created and counts instead.
+func acquireTranscodeSlot(ctx context.Context, cl kubernetes.Interface, ns, user string, max int, policy string, stopCh <-chan struct{}) (func(), error) {
+	for {
+		lease, err := reserveSlot(ctx, cl, ns, user)
+		if err != nil {
+			return nil, fmt.Errorf("error reserving a transcode slot: %w", err)
+		}
+		active, err := countActiveTranscodes(ctx, cl, ns, user)
+		if err == nil {
+			var reserved int
+			reserved, err = countSlotReservations(ctx, cl, ns, user, lease.Name)
+			active += reserved
+		}
+		if err != nil {
+			releaseSlot(cl, lease)
+			return nil, err
+		}
+		if active < max {
+			return func() { releaseSlot(cl, lease) }, nil
+		}
+		// back off, shims racing for the last slot may all have seen
+		// each other
+		releaseSlot(cl, lease)
+		if policy != concurrencyPolicyQueue {
+			if user != "" {
+				return nil, errUserAtCapacity
+			}
+			return nil, errAtCapacity
+		}
+
+		if user != "" {
+			log.Printf("%d of %d transcodes of %s active, waiting for a free slot", active, max, user)
+		} else {
+			log.Printf("%d of %d transcodes active, waiting for a free slot", active, max)
+		}
+		// jittered so racing shims don't keep colliding
+		wait := 5*time.Second + time.Duration(rand.Int63n(int64(2*time.Second)))
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-stopCh:
+			return nil, fmt.Errorf("exit requested while waiting for a free slot")
+		case <-time.After(wait):
+		}
+	}
+}
+
+// collectSlotReservations deletes the reservations of shims that died
+// before creating their pod
+func collectSlotReservations(ctx context.Context, cl kubernetes.Interface, ns string) error {
+	leases, err := cl.CoordinationV1().Leases(ns).List(ctx, metav1.ListOptions{LabelSelector: slotLabel})
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for i := range leases.Items {
+		lease := &leases.Items[i]
+		if !slotExpired(lease, now) {
+			continue
+		}
+		log.Printf("deleting expired transcode slot reservation %s", lease.Name)
+		err := cl.CoordinationV1().Leases(ns).Delete(ctx, lease.Name, metav1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
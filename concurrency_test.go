@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// testPod returns a pod of the plex namespace in the phase
+func testPod(name string, labels map[string]string, phase corev1.PodPhase) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "plex", Labels: labels},
+		Status:     corev1.PodStatus{Phase: phase},
+	}
+}
+
+// transcodeLabels returns the labels of a transcode pod, merged with extra
+func transcodeLabels(extra map[string]string) map[string]string {
+	labels := map[string]string{managedByLabel: managedByValue, schemaLabel: schemaVersion}
+	for k, v := range extra {
+		labels[k] = v
+	}
+	return labels
+}
+
+func TestCountActiveTranscodes(t *testing.T) {
+	now := metav1.Now()
+	deleting := testPod("deleting", transcodeLabels(nil), corev1.PodRunning)
+	deleting.DeletionTimestamp = &now
+	deleting.Finalizers = []string{"test"}
+
+	tests := []struct {
+		name string
+		pods []runtime.Object
+		user string
+		want int
+	}{
+		{
+			name: "running and pending",
+			pods: []runtime.Object{
+				testPod("a", transcodeLabels(nil), corev1.PodRunning),
+				testPod("b", transcodeLabels(nil), corev1.PodPending),
+			},
+			want: 2,
+		},
+		{
+			name: "finished",
+			pods: []runtime.Object{
+				testPod("a", transcodeLabels(nil), corev1.PodSucceeded),
+				testPod("b", transcodeLabels(nil), corev1.PodFailed),
+			},
+			want: 0,
+		},
+		{
+			name: "deleting",
+			pods: []runtime.Object{deleting},
+			want: 0,
+		},
+		{
+			name: "idle pool pod",
+			pods: []runtime.Object{
+				testPod("a", transcodeLabels(map[string]string{poolLabel: poolIdle}), corev1.PodRunning),
+			},
+			want: 0,
+		},
+		{
+			name: "pre-puller",
+			pods: []runtime.Object{
+				testPod("kube-plex-prepuller-x7k2p", generatePrepuller("plexinc/pms-docker").Spec.Template.Labels, corev1.PodRunning),
+				testPod("a", transcodeLabels(nil), corev1.PodRunning),
+			},
+			want: 1,
+		},
+		{
+			name: "unmanaged",
+			pods: []runtime.Object{
+				testPod("plex-0", map[string]string{"app": "plex"}, corev1.PodRunning),
+			},
+			want: 0,
+		},
+		{
+			name: "legacy",
+			pods: []runtime.Object{
+				testPod(legacyPodPrefix+"abc", nil, corev1.PodRunning),
+			},
+			want: 1,
+		},
+		{
+			name: "user",
+			pods: []runtime.Object{
+				testPod("a", transcodeLabels(map[string]string{userLabel: "alice"}), corev1.PodRunning),
+				testPod("b", transcodeLabels(map[string]string{userLabel: "bob"}), corev1.PodRunning),
+				testPod("c", transcodeLabels(nil), corev1.PodRunning),
+			},
+			user: "alice",
+			want: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cl := fake.NewSimpleClientset(tt.pods...)
+			got, err := countActiveTranscodes(context.Background(), cl, "plex", tt.user)
+			if err != nil {
+				t.Fatalf("countActiveTranscodes() error = %s", err)
+			}
+			if got != tt.want {
+				t.Errorf("countActiveTranscodes() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSessionPodsSkipsPrepuller(t *testing.T) {
+	cl := fake.NewSimpleClientset(
+		testPod("kube-plex-prepuller-x7k2p", generatePrepuller("plexinc/pms-docker").Spec.Template.Labels, corev1.PodRunning),
+		testPod("a", transcodeLabels(nil), corev1.PodRunning),
+	)
+	pods, err := sessionPods(context.Background(), cl, "plex")
+	if err != nil {
+		t.Fatalf("sessionPods() error = %s", err)
+	}
+	if len(pods) != 1 || pods[0].Name != "a" {
+		t.Errorf("sessionPods() = %d pods, want only a", len(pods))
+	}
+}
+
+// testSlot returns a reservation of the plex namespace renewed ago
+func testSlot(name string, labels map[string]string, ago time.Duration) *coordinationv1.Lease {
+	duration := int32(slotTTL.Seconds())
+	renewed := metav1.NewMicroTime(time.Now().Add(-ago))
+	return &coordinationv1.Lease{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "plex", Labels: labels},
+		Spec:       coordinationv1.LeaseSpec{LeaseDurationSeconds: &duration, RenewTime: &renewed},
+	}
+}
+
+func TestAcquireTranscodeSlot(t *testing.T) {
+	global := map[string]string{slotLabel: slotGlobal}
+	alice := map[string]string{slotLabel: slotUser, userLabel: "alice"}
+
+	tests := []struct {
+		name    string
+		objects []runtime.Object
+		user    string
+		max     int
+		wantErr error
+	}{
+		{
+			name: "free slot",
+			objects: []runtime.Object{
+				testPod("a", transcodeLabels(nil), corev1.PodRunning),
+			},
+			max: 2,
+		},
+		{
+			name: "pods at capacity",
+			objects: []runtime.Object{
+				testPod("a", transcodeLabels(nil), corev1.PodRunning),
+				testPod("b", transcodeLabels(nil), corev1.PodRunning),
+			},
+			max:     2,
+			wantErr: errAtCapacity,
+		},
+		{
+			name: "reserved by a concurrent session",
+			objects: []runtime.Object{
+				testPod("a", transcodeLabels(nil), corev1.PodRunning),
+				testSlot("kube-plex-slot-other", global, 0),
+			},
+			max:     2,
+			wantErr: errAtCapacity,
+		},
+		{
+			name: "expired reservation",
+			objects: []runtime.Object{
+				testPod("a", transcodeLabels(nil), corev1.PodRunning),
+				testSlot("kube-plex-slot-other", global, 2*slotTTL),
+			},
+			max: 2,
+		},
+		{
+			name: "user reservations don't count globally",
+			objects: []runtime.Object{
+				testSlot("kube-plex-slot-other", alice, 0),
+			},
+			max: 1,
+		},
+		{
+			name: "user at capacity",
+			objects: []runtime.Object{
+				testSlot("kube-plex-slot-other", alice, 0),
+			},
+			user:    "alice",
+			max:     1,
+			wantErr: errUserAtCapacity,
+		},
+		{
+			name: "other user",
+			objects: []runtime.Object{
+				testPod("a", transcodeLabels(map[string]string{userLabel: "alice"}), corev1.PodRunning),
+				testSlot("kube-plex-slot-other", alice, 0),
+			},
+			user: "bob",
+			max:  1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			cl := fake.NewSimpleClientset(tt.objects...)
+			before, err := cl.CoordinationV1().Leases("plex").List(ctx, metav1.ListOptions{})
+			if err != nil {
+				t.Fatalf("error listing leases: %s", err)
+			}
+
+			release, err := acquireTranscodeSlot(ctx, cl, "plex", tt.user, tt.max, concurrencyPolicyLocal, nil)
+			if err != tt.wantErr {
+				t.Fatalf("acquireTranscodeSlot() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil {
+				leases, _ := cl.CoordinationV1().Leases("plex").List(ctx, metav1.ListOptions{})
+				if len(leases.Items) != len(before.Items)+1 {
+					t.Errorf("%d leases while holding the slot, want %d", len(leases.Items), len(before.Items)+1)
+				}
+				release()
+			}
+			leases, _ := cl.CoordinationV1().Leases("plex").List(ctx, metav1.ListOptions{})
+			if len(leases.Items) != len(before.Items) {
+				t.Errorf("%d leases left behind, want %d", len(leases.Items), len(before.Items))
+			}
+		})
+	}
+}
+
+func TestAcquireTranscodeSlotConcurrently(t *testing.T) {
+	// every shim reserves before counting, the last one to count sees the
+	// others and backs off
+	ctx := context.Background()
+	cl := fake.NewSimpleClientset()
+	first, err := acquireTranscodeSlot(ctx, cl, "plex", "", 1, concurrencyPolicyLocal, nil)
+	if err != nil {
+		t.Fatalf("acquireTranscodeSlot() error = %s", err)
+	}
+	if _, err := acquireTranscodeSlot(ctx, cl, "plex", "", 1, concurrencyPolicyReject, nil); err != errAtCapacity {
+		t.Errorf("acquireTranscodeSlot() error = %v while the slot is reserved, want %v", err, errAtCapacity)
+	}
+	first()
+	if _, err := acquireTranscodeSlot(ctx, cl, "plex", "", 1, concurrencyPolicyLocal, nil); err != nil {
+		t.Errorf("acquireTranscodeSlot() error = %s once released", err)
+	}
+}
+
+func TestCollectSlotReservations(t *testing.T) {
+	ctx := context.Background()
+	global := map[string]string{slotLabel: slotGlobal}
+	cl := fake.NewSimpleClientset(
+		testSlot("kube-plex-slot-fresh", global, 0),
+		testSlot("kube-plex-slot-expired", global, 2*slotTTL),
+	)
+	if err := collectSlotReservations(ctx, cl, "plex"); err != nil {
+		t.Fatalf("collectSlotReservations() error = %s", err)
+	}
+	leases, err := cl.CoordinationV1().Leases("plex").List(ctx, metav1.ListOptions{})
+	if err != nil {
+		t.Fatalf("error listing leases: %s", err)
+	}
+	if len(leases.Items) != 1 || leases.Items[0].Name != "kube-plex-slot-fresh" {
+		t.Errorf("leases = %v, want only kube-plex-slot-fresh", leases.Items)
+	}
+}
+
+func TestValidateConcurrencyPolicy(t *testing.T) {
+	defer func(policy string) { concurrencyPolicy = policy }(concurrencyPolicy)
+	for policy, valid := range map[string]bool{"queue": true, "local": true, "reject": true, "qeue": false, "": false} {
+		concurrencyPolicy = policy
+		if err := validateConcurrencyPolicy(); (err == nil) != valid {
+			t.Errorf("validateConcurrencyPolicy() of %q = %v, want valid %t", policy, err, valid)
+		}
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/yaml"
+)
+
+// sources of configuration values, from the lowest to the highest
+// precedence
+const (
+	sourceDefault   = "default"
+	sourceFile      = "file"
+	sourceConfigMap = "configmap"
+	sourceEnv       = "env"
+	sourceSession   = "session"
+)
+
+// key of the configuration in KUBE_PLEX_CONFIGMAP
+const configMapKey = "config.yaml"
+
+// configFile is the format of KUBE_PLEX_CONFIG and of KUBE_PLEX_CONFIGMAP
+type configFile struct {
+	// values of the configuration variables
+	Settings map[string]string `json:"settings"`
+	// values overriding the others for sessions of a class, streaming or
+	// background
+	Sessions map[string]map[string]string `json:"sessions"`
+}
+
+// configLayer holds the values set by one source
+type configLayer struct {
+	source string
+	values map[string]string
+}
+
+// setting is the effective value of a configuration variable and the
+// source that set it
+type setting struct {
+	value  string
+	source string
+}
+
+var (
+	// sources of the configuration, from the highest to the lowest
+	// precedence, loaded by loadConfig
+	configLayers []configLayer
+
+	// effective value of every configuration variable looked up
+	settings = map[string]setting{}
+)
+
+// configDefaults are the values of the configuration variables that aren't
+// set by any source
+var configDefaults = map[string]string{
+	"LIMIT_CPU":                constDefaultLimitCPU,
+	"PRIORITY_BOOST_THRESHOLD": constDefaultPriorityBoostThreshold,
+	"CONCURRENCY_POLICY":       constDefaultConcurrencyPolicy,
+	"RESTART_POLICY":           constDefaultRestartPolicy,
+	"JOB_BACKOFF_LIMIT":        constDefaultJobBackoffLimit,
+	"CODECS_PATH":              constDefaultCodecsPath,
+	"STOP_GRACE_PERIOD":        constDefaultStopGracePeriod,
+	"POD_STUCK_TIMEOUT":        constDefaultPodStuckTimeout,
+	"POD_START_TIMEOUT":        constDefaultPodStartTimeout,
+	"WAIT_POLL_INTERVAL":       constDefaultWaitPollInterval,
+	"RECREATE_LIMIT":           constDefaultRecreateLimit,
+	"POD_CREATE_TIMEOUT":       constDefaultPodCreateTimeout,
+	"PMS_CONTAINER_NAME":       constDefaultPMSContainerName,
+	"LOCAL_TRANSCODER":         constDefaultLocalTranscoder,
+	"MANIFEST_HISTORY":         constDefaultManifestHistory,
+	"USAGE_SAMPLE_INTERVAL":    constDefaultUsageSampleInterval,
+	"DISTRIBUTED_MIN_DURATION": constDefaultDistributedMinDuration,
+	"S3_REGION":                constDefaultS3Region,
+	"KUBE_API_TIMEOUT":         constDefaultKubeAPITimeout,
+	"HOOK_TIMEOUT":             constDefaultHookTimeout,
+	"EXECUTION_BACKEND":        constDefaultExecutionBackend,
+	"SSH_TRANSCODER":           constDefaultSSHTranscoder,
+	"AUDIT_SQLITE":             constDefaultAuditSQLite,
+	"CLEANUP_DELAY":            constDefaultCleanupDelay,
+	"SPREAD_TOPOLOGY_KEY":      constDefaultSpreadTopologyKey,
+	"GPU_RESOURCE_COUNT":       constDefaultGPUResourceCount,
+}
+
+// getenv returns the value of a configuration variable. Per-session
+// overrides take precedence over environment variables, which take
+// precedence over KUBE_PLEX_CONFIGMAP, then KUBE_PLEX_CONFIG and the
+// defaults.
+func getenv(key string) string {
+	for _, layer := range configLayers {
+		if v := layer.values[key]; v != "" {
+			settings[key] = setting{value: v, source: layer.source}
+			return v
+		}
+	}
+	settings[key] = setting{}
+	return ""
+}
+
+// setDefault records a default computed at runtime
+func setDefault(key string, value *string, def string) {
+	if *value == "" {
+		*value = def
+		settings[key] = setting{value: def, source: sourceDefault}
+	}
+}
+
+// loadConfigLayers reads every configuration source. The session layer is
+// picked by the class of the transcoder invocation the process was started
+// for. Sessions still start with the other sources when KUBE_PLEX_CONFIGMAP
+// can't be read, e.g. while the API server is unreachable.
+func loadConfigLayers() ([]configLayer, error) {
+	env := map[string]string{}
+	for _, kv := range os.Environ() {
+		if k, v, ok := strings.Cut(kv, "="); ok {
+			env[k] = v
+		}
+	}
+
+	var file, cm configFile
+	if path := os.Getenv("KUBE_PLEX_CONFIG"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("error reading KUBE_PLEX_CONFIG: %w", err)
+		}
+		if err := yaml.UnmarshalStrict(data, &file); err != nil {
+			return nil, fmt.Errorf("error parsing KUBE_PLEX_CONFIG: %w", err)
+		}
+	}
+
+	lookup := func(key string) string {
+		if v := env[key]; v != "" {
+			return v
+		}
+		return file.Settings[key]
+	}
+	if name := lookup("KUBE_PLEX_CONFIGMAP"); name != "" {
+		data, err := readConfigMapData(name, lookup("KUBE_NAMESPACE"))
+		if err != nil {
+			log.Printf("warning: unable to read KUBE_PLEX_CONFIGMAP %q, ignoring it: %s", name, err)
+		} else if err := yaml.UnmarshalStrict([]byte(data), &cm); err != nil {
+			return nil, fmt.Errorf("error parsing %s of KUBE_PLEX_CONFIGMAP: %w", configMapKey, err)
+		}
+	}
+
+	var session map[string]string
+	if class := invocationClass(); class != "" {
+		session = mergeSettings(file.Sessions[class], cm.Sessions[class])
+	}
+	return []configLayer{
+		{source: sourceSession, values: session},
+		{source: sourceEnv, values: env},
+		{source: sourceConfigMap, values: cm.Settings},
+		{source: sourceFile, values: file.Settings},
+		{source: sourceDefault, values: configDefaults},
+	}, nil
+}
+
+// readConfigMapData reads the configuration stored in a ConfigMap, empty
+// when it doesn't exist
+func readConfigMapData(name, namespace string) (string, error) {
+	// the client settings are part of the configuration being read
+	cfg, ns, err := buildClusterConfig("", "")
+	if err != nil {
+		return "", err
+	}
+	cl, err := kubernetes.NewForConfig(cfg)
+	if err != nil {
+		return "", fmt.Errorf("error building kubernetes clientset: %w", err)
+	}
+	if namespace == "" {
+		namespace = ns
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	cm, err := cl.CoreV1().ConfigMaps(namespace).Get(ctx, name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return cm.Data[configMapKey], nil
+}
+
+// invocationClass returns the class of the session when the process was
+// started as the Plex Transcoder, or with --dry-run
+func invocationClass() string {
+	args := os.Args
+	if isCommandInvocation(args) {
+		if len(args) <= 2 || args[1] != "--dry-run" {
+			return ""
+		}
+		args = args[2:]
+	}
+	if len(args) == 0 {
+		return ""
+	}
+	return jobClass(args)
+}
+
+// mergeSettings merges b over a
+func mergeSettings(a, b map[string]string) map[string]string {
+	out := map[string]string{}
+	for k, v := range a {
+		out[k] = v
+	}
+	for k, v := range b {
+		out[k] = v
+	}
+	return out
+}
+
+// runConfig implements the config subcommand
+func runConfig(args []string) error {
+	if len(args) != 1 || args[0] != "dump" {
+		return fmt.Errorf("usage: kube-plex config dump")
+	}
+
+	setDefaults()
+	return writeSettings(os.Stdout)
+}
+
+// writeSettings writes the effective configuration, masking the values of
+// sensitive variables
+func writeSettings(out io.Writer) error {
+	keys := make([]string, 0, len(settings))
+	for key := range settings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tVALUE\tSOURCE")
+	for _, key := range keys {
+		s := settings[key]
+		source := s.source
+		if source == "" {
+			source = "-"
+		}
+		value := redact(s.value)
+		if isSensitiveEnv(key) && value != "" {
+			value = "REDACTED"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", key, strings.ReplaceAll(value, "\n", `\n`), source)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGetenvPrecedence(t *testing.T) {
+	defer func(layers []configLayer, old map[string]setting, args []string) {
+		configLayers, settings, os.Args = layers, old, args
+	}(configLayers, settings, os.Args)
+	settings = map[string]setting{}
+	os.Args = []string{"Plex Transcoder", "-i", "/data/movie.mkv", "-f", "dash", "/transcode/session/dash"}
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	file := `settings:
+  LIMIT_CPU: "2"
+  STOP_GRACE_PERIOD: 30s
+  POD_STUCK_TIMEOUT: 1m
+  CODECS_PATH: /file/codecs
+sessions:
+  streaming:
+    LIMIT_CPU: "4"
+  background:
+    STOP_GRACE_PERIOD: 1s
+`
+	if err := os.WriteFile(path, []byte(file), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("KUBE_PLEX_CONFIG", path)
+	t.Setenv("KUBE_PLEX_CONFIGMAP", "")
+	t.Setenv("LIMIT_CPU", "3")
+	t.Setenv("STOP_GRACE_PERIOD", "20s")
+	// empty variables are unset
+	t.Setenv("JOB_BACKOFF_LIMIT", "")
+
+	layers, err := loadConfigLayers()
+	if err != nil {
+		t.Fatalf("loadConfigLayers() error = %s", err)
+	}
+	// as read from KUBE_PLEX_CONFIGMAP
+	for i := range layers {
+		if layers[i].source == sourceConfigMap {
+			layers[i].values = map[string]string{"STOP_GRACE_PERIOD": "15s", "CODECS_PATH": "/configmap/codecs"}
+		}
+	}
+	configLayers = layers
+
+	tests := []struct {
+		key        string
+		want       string
+		wantSource string
+	}{
+		{key: "LIMIT_CPU", want: "4", wantSource: sourceSession},
+		{key: "STOP_GRACE_PERIOD", want: "20s", wantSource: sourceEnv},
+		{key: "CODECS_PATH", want: "/configmap/codecs", wantSource: sourceConfigMap},
+		{key: "POD_STUCK_TIMEOUT", want: "1m", wantSource: sourceFile},
+		{key: "JOB_BACKOFF_LIMIT", want: constDefaultJobBackoffLimit, wantSource: sourceDefault},
+		{key: "KUBE_PLEX_UNKNOWN"},
+	}
+	for _, tt := range tests {
+		if got := getenv(tt.key); got != tt.want {
+			t.Errorf("getenv(%s) = %q, want %q", tt.key, got, tt.want)
+		}
+		if source := settings[tt.key].source; source != tt.wantSource {
+			t.Errorf("%s set by %q, want %q", tt.key, source, tt.wantSource)
+		}
+	}
+}
+
+func TestWriteSettingsRedacts(t *testing.T) {
+	defer func(old map[string]setting) { settings = old }(settings)
+	settings = map[string]setting{
+		"ADMIN_TOKEN":          {value: "hunter2", source: sourceEnv},
+		"S3_SECRET_ACCESS_KEY": {value: "wJalrXUtnFEMI", source: sourceEnv},
+		"WEBHOOK_URLS":         {value: "https://hooks.example.com/T000/B000/XXXX", source: sourceEnv},
+		"PMS_INTERNAL_ADDRESS": {value: "http://plex:32400/?X-Plex-Token=abc&token=abc", source: sourceEnv},
+		"KUBE_NAMESPACE":       {value: "plex", source: sourceEnv},
+		"PLEX_CLAIM":           {},
+	}
+
+	var buf bytes.Buffer
+	if err := writeSettings(&buf); err != nil {
+		t.Fatalf("writeSettings() error = %s", err)
+	}
+	out := buf.String()
+	for _, secret := range []string{"hunter2", "wJalrXUtnFEMI", "hooks.example.com", "token=abc"} {
+		if strings.Contains(out, secret) {
+			t.Errorf("config dump contains %q:\n%s", secret, out)
+		}
+	}
+	if !strings.Contains(out, "plex") {
+		t.Errorf("config dump is missing KUBE_NAMESPACE:\n%s", out)
+	}
+	for _, line := range strings.Split(out, "\n") {
+		if strings.HasPrefix(line, "PLEX_CLAIM") && strings.Contains(line, "REDACTED") {
+			t.Errorf("unset PLEX_CLAIM is shown as set: %q", line)
+		}
+	}
+}
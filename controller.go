@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/lrascao/kube-plex/pkg/signals"
+)
+
+type controllerOptions struct {
+	kubeconfig string
+	namespace  string
+	interval   time.Duration
+	poolSize   int
+	prepull    bool
+	policy     string
+	policyAll  bool
+	admin      string
+	dashboard  string
+	history    int
+	health     string
+	pprof      bool
+
+	leaderElect      bool
+	leaderElectionID string
+}
+
+// runController runs the long lived kube-plex controller, reconciling the
+// cluster side state shared by every session until it's asked to stop
+func runController(args []string) error {
+	var opts controllerOptions
+
+	fs := flag.NewFlagSet("controller", flag.ContinueOnError)
+	fs.StringVar(&opts.kubeconfig, "kubeconfig", "", "path to the kubeconfig file")
+	fs.StringVar(&opts.namespace, "namespace", namespace, "namespace the transcode pods run in (defaults to the kubeconfig namespace)")
+	fs.DurationVar(&opts.interval, "interval", 10*time.Second, "how often to reconcile")
+	fs.IntVar(&opts.poolSize, "pool-size", 0, "number of idle pre-warmed transcoder pods to keep")
+	fs.BoolVar(&opts.prepull, "prepull", false, "keep a DaemonSet pulling the transcoder image on every eligible node")
+	fs.StringVar(&opts.policy, "policy-configmap", admissionPolicyConfigMap, "ConfigMap holding the admission policy transcode pods are checked against")
+	fs.BoolVar(&opts.policyAll, "policy-all-namespaces", false, "check the transcode pods of every namespace against the admission policy, not only those of -namespace")
+	fs.StringVar(&opts.admin, "admin-address", "", "address the admin API listens on, e.g. :8080, disabled when empty")
+	fs.StringVar(&opts.dashboard, "dashboard-address", "", "address the web dashboard listens on, e.g. :8081, disabled when empty")
+	fs.IntVar(&opts.history, "dashboard-history", 50, "number of ended sessions the dashboard shows")
+	fs.StringVar(&opts.health, "health-address", "", "address /healthz, /readyz and /metrics are served on, e.g. :8082, disabled when empty")
+	fs.BoolVar(&opts.pprof, "pprof", false, "serve profiles under /debug/pprof/ on the health address")
+	fs.BoolVar(&opts.leaderElect, "leader-elect", false, "only reconcile while holding the leader election lease, for running several replicas")
+	fs.StringVar(&opts.leaderElectionID, "leader-election-id", "kube-plex-controller", "name of the leader election Lease")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if opts.pprof && opts.health == "" {
+		return fmt.Errorf("-pprof requires -health-address")
+	}
+	if opts.admin != "" && adminToken == "" {
+		return fmt.Errorf("ADMIN_TOKEN must be set to serve the admin API")
+	}
+	var adminTLS *tls.Config
+	if opts.admin != "" {
+		var err error
+		if adminTLS, err = adminTLSConfig(); err != nil {
+			return err
+		}
+	}
+
+	cfg, ns, err := buildCommandConfig(opts.kubeconfig)
+	if err != nil {
+		return err
+	}
+	cl, err := kubernetes.NewForConfig(cfg)
+	if err != nil {
+		return fmt.Errorf("error building kubernetes clientset: %w", err)
+	}
+	if opts.namespace == "" {
+		opts.namespace = ns
+	}
+	setDefaults()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stopCh := signals.SetupSignalHandler()
+
+	if opts.admin != "" {
+		go serveAdmin(ctx, opts.admin, adminTLS, &adminServer{
+			cfg:         cfg,
+			cl:          cl,
+			ns:          opts.namespace,
+			token:       adminToken,
+			maintenance: maintenanceConfigMap,
+		})
+	}
+
+	health := newHealthServer(opts.interval, opts.pprof)
+	if opts.health != "" {
+		go serveHealth(ctx, opts.health, health)
+	}
+	if opts.dashboard != "" {
+		go serveDashboard(ctx, opts.dashboard, newDashboard(cl, opts.namespace, opts.history))
+	}
+
+	// stop reconciling, releasing the lease, when asked to exit
+	go func() {
+		<-stopCh
+		log.Printf("exit requested.")
+		cancel()
+	}()
+
+	reconcile := func(ctx context.Context) {
+		for {
+			if opts.poolSize > 0 {
+				err := reconcilePool(ctx, cl, opts.namespace, opts.poolSize)
+				if err != nil {
+					log.Printf("error reconciling pool: %s", err)
+				}
+				health.observe("pool", err)
+			}
+			if opts.prepull {
+				err := reconcilePrepuller(ctx, cl, opts.namespace, transcodeImage())
+				if err != nil {
+					log.Printf("error reconciling pre-puller: %s", err)
+				}
+				health.observe("prepull", err)
+			}
+
+			err := collectGarbage(ctx, cl, opts.namespace)
+			if err != nil {
+				log.Printf("error collecting garbage: %s", err)
+			}
+			health.observe("gc", err)
+			if labelCompat != "false" {
+				err := migrateLegacyPods(ctx, cl, opts.namespace)
+				if err != nil {
+					log.Printf("error migrating pod labels: %s", err)
+				}
+				health.observe("label-compat", err)
+			}
+			if opts.policy != "" {
+				ns := opts.namespace
+				if opts.policyAll {
+					ns = metav1.NamespaceAll
+				}
+				err := enforceAdmissionPolicy(ctx, cl, ns, opts.namespace, opts.policy)
+				if err != nil {
+					log.Printf("error enforcing admission policy: %s", err)
+				}
+				health.observe("admission", err)
+			}
+			if opts.health != "" {
+				// listing the sessions tells whether the API server is reachable
+				pods, err := sessionPods(ctx, cl, opts.namespace)
+				if err != nil {
+					log.Printf("error counting sessions: %s", err)
+				}
+				health.reconciledAll(len(pods), err)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(opts.interval):
+			}
+		}
+	}
+
+	log.Printf("controller started in namespace %s", opts.namespace)
+	if !opts.leaderElect {
+		reconcile(ctx)
+		return nil
+	}
+	return runLeaderElected(ctx, cl, opts.namespace, opts.leaderElectionID, health, reconcile)
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/duration"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+)
+
+// dashboardSession is a session as shown on the dashboard
+type dashboardSession struct {
+	Pod     string
+	Session string
+	User    string
+	Title   string
+	Node    string
+	Phase   corev1.PodPhase
+	Created time.Time
+	// time from the creation of the pod to the start of the transcoder,
+	// zero until it started
+	Startup time.Duration
+	// set once the pod is gone, Result is completed, failed or stopped
+	Ended  time.Time
+	Result string
+}
+
+// dashboard is a read-only web page of the active sessions, where they run
+// and how long they took to start, and of those that ended since the
+// controller started
+type dashboard struct {
+	cl kubernetes.Interface
+	ns string
+	// number of ended sessions shown
+	max int
+
+	mu      sync.Mutex
+	active  map[types.UID]dashboardSession
+	history []dashboardSession
+}
+
+func newDashboard(cl kubernetes.Interface, ns string, max int) *dashboard {
+	return &dashboard{cl: cl, ns: ns, max: max, active: map[types.UID]dashboardSession{}}
+}
+
+// serveDashboard tracks the sessions and serves the dashboard on address
+// until the context is done
+func serveDashboard(ctx context.Context, address string, d *dashboard) {
+	go d.track(ctx)
+
+	srv := &http.Server{Addr: address, Handler: d}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	log.Printf("dashboard listening on %s", address)
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Printf("error serving dashboard: %s", err)
+	}
+}
+
+// track follows the transcode pods, moving sessions to the history as their
+// pod is deleted
+func (d *dashboard) track(ctx context.Context) {
+	for ctx.Err() == nil {
+		if err := d.watch(ctx); err != nil {
+			log.Printf("warning: dashboard unable to watch transcode pods: %s", err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(10 * time.Second):
+			}
+		}
+	}
+}
+
+func (d *dashboard) watch(ctx context.Context) error {
+	opts := metav1.ListOptions{LabelSelector: managedPodSelector()}
+	pods, err := d.cl.CoreV1().Pods(d.ns).List(ctx, opts)
+	if err != nil {
+		return err
+	}
+	d.mu.Lock()
+	current := map[types.UID]bool{}
+	for i := range pods.Items {
+		current[pods.Items[i].UID] = true
+		d.update(&pods.Items[i])
+	}
+	// pods deleted while not watching
+	for uid, s := range d.active {
+		if !current[uid] {
+			d.end(uid, s)
+		}
+	}
+	d.mu.Unlock()
+
+	opts.ResourceVersion = pods.ResourceVersion
+	w, err := d.cl.CoreV1().Pods(d.ns).Watch(ctx, opts)
+	if err != nil {
+		return err
+	}
+	defer w.Stop()
+	for ev := range w.ResultChan() {
+		pod, ok := ev.Object.(*corev1.Pod)
+		if !ok {
+			// the watch expired, it's listed again
+			return nil
+		}
+		d.mu.Lock()
+		switch ev.Type {
+		case watch.Added, watch.Modified:
+			d.update(pod)
+		case watch.Deleted:
+			d.update(pod)
+			if s, ok := d.active[pod.UID]; ok {
+				d.end(pod.UID, s)
+			}
+		}
+		d.mu.Unlock()
+	}
+	return nil
+}
+
+// update records the state of the session running in the pod, idle pool
+// pods aren't sessions
+func (d *dashboard) update(pod *corev1.Pod) {
+	if pod.Labels[poolLabel] == poolIdle {
+		return
+	}
+	d.active[pod.UID] = dashboardSession{
+		Pod:     pod.Name,
+		Session: pod.Labels[sessionLabel],
+		User:    pod.Annotations[userAnnotation],
+		Title:   pod.Annotations[titleAnnotation],
+		Node:    pod.Spec.NodeName,
+		Phase:   pod.Status.Phase,
+		Created: pod.CreationTimestamp.Time,
+		Startup: podStartup(pod),
+	}
+}
+
+// end moves the session to the history, pods deleted while running were
+// stopped
+func (d *dashboard) end(uid types.UID, s dashboardSession) {
+	delete(d.active, uid)
+	s.Ended = time.Now()
+	switch s.Phase {
+	case corev1.PodSucceeded:
+		s.Result = "completed"
+	case corev1.PodFailed:
+		s.Result = "failed"
+	default:
+		s.Result = "stopped"
+	}
+	d.history = append([]dashboardSession{s}, d.history...)
+	if len(d.history) > d.max {
+		d.history = d.history[:d.max]
+	}
+}
+
+// podStartup returns how long the transcoder of the pod took to start after
+// the pod was created
+func podStartup(pod *corev1.Pod) time.Duration {
+	if pod.CreationTimestamp.IsZero() {
+		return 0
+	}
+	for _, status := range pod.Status.ContainerStatuses {
+		if status.Name != pod.Spec.Containers[0].Name {
+			continue
+		}
+		switch {
+		case status.State.Running != nil:
+			return status.State.Running.StartedAt.Sub(pod.CreationTimestamp.Time)
+		case status.State.Terminated != nil:
+			return status.State.Terminated.StartedAt.Sub(pod.CreationTimestamp.Time)
+		}
+	}
+	return 0
+}
+
+func (d *dashboard) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	d.mu.Lock()
+	active := make([]dashboardSession, 0, len(d.active))
+	for _, s := range d.active {
+		active = append(active, s)
+	}
+	history := append([]dashboardSession(nil), d.history...)
+	d.mu.Unlock()
+	sort.Slice(active, func(i, j int) bool { return active[i].Created.After(active[j].Created) })
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := dashboardTemplate.Execute(w, map[string]interface{}{
+		"Namespace": d.ns,
+		"Active":    active,
+		"History":   history,
+	})
+	if err != nil {
+		log.Printf("warning: unable to render dashboard: %s", err)
+	}
+}
+
+var dashboardTemplate = template.Must(template.New("dashboard").Funcs(template.FuncMap{
+	"age": func(t time.Time) string {
+		return duration.HumanDuration(time.Since(t))
+	},
+	"seconds": func(d time.Duration) string {
+		if d <= 0 {
+			return "-"
+		}
+		return d.Round(time.Second).String()
+	},
+	"orDash": orDash,
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="10">
+<title>kube-plex</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { text-align: left; padding: 0.3em 1em; border-bottom: 1px solid #ddd; }
+.failed { color: #b00; }
+</style>
+</head>
+<body>
+<h1>kube-plex transcodes in {{.Namespace}}</h1>
+<h2>Active sessions</h2>
+<table>
+<tr><th>Pod</th><th>Session</th><th>User</th><th>Title</th><th>Node</th><th>Phase</th><th>Startup</th><th>Age</th></tr>
+{{- range .Active}}
+<tr><td>{{.Pod}}</td><td>{{orDash .Session}}</td><td>{{orDash .User}}</td><td>{{orDash .Title}}</td><td>{{orDash .Node}}</td><td>{{.Phase}}</td><td>{{seconds .Startup}}</td><td>{{age .Created}}</td></tr>
+{{- else}}
+<tr><td colspan="8">No active sessions</td></tr>
+{{- end}}
+</table>
+<h2>History</h2>
+<table>
+<tr><th>Pod</th><th>Session</th><th>User</th><th>Title</th><th>Node</th><th>Result</th><th>Startup</th><th>Ended</th></tr>
+{{- range .History}}
+<tr class="{{.Result}}"><td>{{.Pod}}</td><td>{{orDash .Session}}</td><td>{{orDash .User}}</td><td>{{orDash .Title}}</td><td>{{orDash .Node}}</td><td>{{.Result}}</td><td>{{seconds .Startup}}</td><td>{{age .Ended}} ago</td></tr>
+{{- else}}
+<tr><td colspan="8">No sessions ended since the controller started</td></tr>
+{{- end}}
+</table>
+</body>
+</html>
+`))
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/kubernetes"
+)
+
+// nodeEventsWindow is how far back node events are collected
+const nodeEventsWindow = 15 * time.Minute
+
+// collectNodeDiagnostics describes the state of the node a failed pod ran
+// on: conditions that aren't healthy and recent events. Many transcode
+// failures that look random are caused by memory or disk pressure.
+func collectNodeDiagnostics(ctx context.Context, cl kubernetes.Interface, pod *corev1.Pod) (string, error) {
+	pod, err := cl.CoreV1().Pods(pod.Namespace).Get(ctx, pod.Name, metav1.GetOptions{})
+	if err != nil {
+		return "", err
+	}
+	if pod.Spec.NodeName == "" {
+		return "pod was never scheduled to a node", nil
+	}
+
+	node, err := cl.CoreV1().Nodes().Get(ctx, pod.Spec.NodeName, metav1.GetOptions{})
+	if err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "node %s:\n", node.Name)
+	healthy := true
+	for _, cond := range node.Status.Conditions {
+		unhealthy := cond.Status == corev1.ConditionTrue
+		if cond.Type == corev1.NodeReady {
+			unhealthy = cond.Status != corev1.ConditionTrue
+		}
+		if unhealthy {
+			healthy = false
+			fmt.Fprintf(&b, "  condition %s=%s since %s: %s %s\n", cond.Type, cond.Status, cond.LastTransitionTime.Format(time.RFC3339), cond.Reason, cond.Message)
+		}
+	}
+	if healthy {
+		fmt.Fprintf(&b, "  all conditions healthy\n")
+	}
+	if node.Spec.Unschedulable {
+		fmt.Fprintf(&b, "  node is cordoned\n")
+	}
+
+	events, err := cl.CoreV1().Events(metav1.NamespaceAll).List(ctx, metav1.ListOptions{
+		FieldSelector: fields.Set{
+			"involvedObject.kind": "Node",
+			"involvedObject.name": node.Name,
+		}.String(),
+	})
+	if err != nil {
+		fmt.Fprintf(&b, "  unable to list node events: %s\n", err)
+		return b.String(), nil
+	}
+	recent := events.Items[:0]
+	for _, ev := range events.Items {
+		if time.Since(eventTime(ev)) < nodeEventsWindow {
+			recent = append(recent, ev)
+		}
+	}
+	sort.Slice(recent, func(i, j int) bool {
+		return eventTime(recent[i]).Before(eventTime(recent[j]))
+	})
+	for _, ev := range recent {
+		fmt.Fprintf(&b, "  event %s %s %s: %s\n", eventTime(ev).Format(time.RFC3339), ev.Type, ev.Reason, ev.Message)
+	}
+	return b.String(), nil
+}
+
+func eventTime(ev corev1.Event) time.Time {
+	if !ev.LastTimestamp.IsZero() {
+		return ev.LastTimestamp.Time
+	}
+	return ev.EventTime.Time
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/lrascao/kube-plex/pkg/ffmpeg"
+)
+
+// inputDurationRe matches the duration ffmpeg prints for its input,
+// Duration: 01:52:07.36
+var inputDurationRe = regexp.MustCompile(`Duration: (\d+):(\d{2}):(\d{2}(?:\.\d+)?)`)
+
+// splitFlags are the arguments whose timestamps or outputs don't survive
+// splitting the input
+var splitFlags = []string{"-ss", "-t", "-to", "-copyts", "-segment_list", "-manifest_name"}
+
+// sessionPart is the time range of the input one pod of a distributed
+// session transcodes
+type sessionPart struct {
+	args   []string
+	output string
+}
+
+// splitSession splits a background session in parts transcoding a time
+// range of the input each, to run them in parallel and stitch the outputs.
+// It returns nil when the session can't or shouldn't be split: streaming,
+// remuxing, several or remote inputs, or inputs too short to be worth it.
+func splitSession(args []string, inv ffmpeg.Invocation, parts int, minPart time.Duration) []sessionPart {
+	if parts < 2 || !inv.Background() || inv.LiveTV || inv.VideoCodec == "" || inv.VideoCodec == "copy" {
+		return nil
+	}
+	if len(inv.Inputs) != 1 || len(inv.LocalInputs()) != 1 {
+		return nil
+	}
+	for _, flag := range splitFlags {
+		if argIndex(args, flag) >= 0 {
+			return nil
+		}
+	}
+	output := args[len(args)-1]
+	if strings.HasPrefix(output, "-") || strings.Contains(output, "%") || filepath.Ext(output) == "" {
+		return nil
+	}
+
+	duration, err := probeDuration(inv.Inputs[0])
+	if err != nil {
+		log.Printf("warning: unable to read the duration of %s, not splitting it: %s", inv.Inputs[0], err)
+		return nil
+	}
+	if n := int(duration / minPart); n < parts {
+		parts = n
+	}
+	if parts < 2 {
+		return nil
+	}
+
+	length := duration / time.Duration(parts)
+	ext := filepath.Ext(output)
+	var out []sessionPart
+	for i := 0; i < parts; i++ {
+		partArgs := append([]string(nil), args[:len(args)-1]...)
+		if i > 0 {
+			// only the first part reports progress to PMS
+			if j := argIndex(partArgs, "-progressurl"); j >= 0 {
+				partArgs = append(partArgs[:j], partArgs[j+2:]...)
+			}
+		}
+		partArgs = setArg(partArgs, "-ss", formatTimestamp(length*time.Duration(i)), argIndex(partArgs, "-i"))
+		if i < parts-1 {
+			partArgs = append(partArgs, "-t", formatTimestamp(length))
+		}
+		partOutput := fmt.Sprintf("%s.part%02d%s", strings.TrimSuffix(output, ext), i, ext)
+		out = append(out, sessionPart{args: append(partArgs, partOutput), output: partOutput})
+	}
+	return out
+}
+
+// probeDuration reads the duration of the input with the local transcoder
+func probeDuration(input string) (time.Duration, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command(localTranscoder, "-hide_banner", "-i", input)
+	cmd.Stderr = &stderr
+	// without an output ffmpeg exits with an error after printing the input
+	cmd.Run()
+	m := inputDurationRe.FindStringSubmatch(stderr.String())
+	if m == nil {
+		return 0, fmt.Errorf("no duration found")
+	}
+	h, _ := strconv.Atoi(m[1])
+	mins, _ := strconv.Atoi(m[2])
+	sec, _ := strconv.ParseFloat(m[3], 64)
+	return time.Duration(h)*time.Hour + time.Duration(mins)*time.Minute + time.Duration(sec*float64(time.Second)), nil
+}
+
+func formatTimestamp(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', 3, 64)
+}
+
+// runDistributed runs every part of the session in a pod created from the
+// template and stitches their outputs into the output of the session,
+// calling started with each pod created. A failing part fails the session,
+// deleting the pods of the others.
+func runDistributed(ctx context.Context, cl kubernetes.Interface, template *corev1.Pod, parts []sessionPart, output string, opts waitOptions, createTimeout time.Duration, stopCh <-chan struct{}, started func(part int, pod *corev1.Pod)) error {
+	pods := make([]*corev1.Pod, len(parts))
+	defer func() {
+		for _, pod := range pods {
+			if pod == nil {
+				continue
+			}
+			if err := cl.CoreV1().Pods(pod.Namespace).Delete(context.Background(), pod.Name, metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+				log.Printf("warning: unable to delete pod %q: %s", pod.Name, err)
+			}
+		}
+		for _, part := range parts {
+			os.Remove(part.output)
+		}
+	}()
+
+	for i, part := range parts {
+		pod := template.DeepCopy()
+		pod.Spec.Containers[0].Command = part.args
+		client := cl.CoreV1().Pods(template.Namespace)
+		created, err := createNamed(ctx, createTimeout, pod, func(ctx context.Context, pod *corev1.Pod) (*corev1.Pod, error) {
+			return client.Create(ctx, pod, metav1.CreateOptions{})
+		}, func(ctx context.Context, name string) (*corev1.Pod, error) {
+			return client.Get(ctx, name, metav1.GetOptions{})
+		})
+		if err != nil {
+			// an attempt timing out may still have created it, it's
+			// deleted with the others
+			pods[i] = pod
+			return fmt.Errorf("error creating pod of part %d: %w", i, err)
+		}
+		pods[i] = created
+		log.Printf("started pod %s transcoding part %d of %d", pods[i].Name, i+1, len(parts))
+		started(i, created)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-stopCh:
+			log.Printf("exit requested.")
+			cancel()
+		}
+	}()
+
+	g, gctx := errgroup.WithContext(ctx)
+	for _, pod := range pods {
+		pod := pod
+		g.Go(func() error {
+			if err := waitForPodCompletion(gctx, cl, pod, opts).err(); err != nil {
+				return fmt.Errorf("pod %s: %w", pod.Name, err)
+			}
+			log.Printf("pod %s completed", pod.Name)
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return err
+	}
+	return stitchParts(parts, output)
+}
+
+// stitchParts concatenates the outputs of the parts into the output with
+// the local transcoder, without transcoding them again
+func stitchParts(parts []sessionPart, output string) error {
+	list, err := os.CreateTemp(filepath.Dir(output), ".kube-plex-parts-*.txt")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(list.Name())
+	for _, part := range parts {
+		path, err := filepath.Abs(part.output)
+		if err != nil {
+			list.Close()
+			return err
+		}
+		fmt.Fprintf(list, "file '%s'\n", strings.ReplaceAll(path, "'", `'\''`))
+	}
+	if err := list.Close(); err != nil {
+		return err
+	}
+
+	cmd := exec.Command(localTranscoder, "-hide_banner", "-y", "-f", "concat", "-safe", "0", "-i", list.Name(), "-map", "0", "-c", "copy", output)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("error stitching parts: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// podDNS is how transcode pods resolve names, so PMS_INTERNAL_ADDRESS can
+// use a hostname the cluster DNS doesn't know
+type podDNS struct {
+	hostAliases []corev1.HostAlias
+	policy      corev1.DNSPolicy
+	config      *corev1.PodDNSConfig
+}
+
+// parsePodDNS parses HOST_ALIASES, DNS_POLICY and DNS_CONFIG
+func parsePodDNS() (podDNS, error) {
+	var dns podDNS
+	if err := yaml.UnmarshalStrict([]byte(hostAliases), &dns.hostAliases); err != nil {
+		return dns, fmt.Errorf("error parsing HOST_ALIASES: %w", err)
+	}
+	switch policy := corev1.DNSPolicy(dnsPolicy); policy {
+	case "", corev1.DNSClusterFirst, corev1.DNSClusterFirstWithHostNet, corev1.DNSDefault, corev1.DNSNone:
+		dns.policy = policy
+	default:
+		return dns, fmt.Errorf("error parsing DNS_POLICY: unknown policy %q", dnsPolicy)
+	}
+	if dnsConfig != "" {
+		dns.config = &corev1.PodDNSConfig{}
+		if err := yaml.UnmarshalStrict([]byte(dnsConfig), dns.config); err != nil {
+			return dns, fmt.Errorf("error parsing DNS_CONFIG: %w", err)
+		}
+	}
+	if dns.policy == corev1.DNSNone && (dns.config == nil || len(dns.config.Nameservers) == 0) {
+		return dns, fmt.Errorf("DNS_POLICY None requires nameservers in DNS_CONFIG")
+	}
+	return dns, nil
+}
+
+// setPodDNS sets the host aliases and DNS settings of the pod, invalid
+// settings are reported by the shim before any pod is generated
+func setPodDNS(pod *corev1.Pod) {
+	dns, err := parsePodDNS()
+	if err != nil {
+		return
+	}
+	pod.Spec.HostAliases = dns.hostAliases
+	pod.Spec.DNSPolicy = dns.policy
+	pod.Spec.DNSConfig = dns.config
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+type doctorOptions struct {
+	kubeconfig         string
+	namespace          string
+	serviceAccount     string
+	dataPVC            string
+	configPVC          string
+	transcodePVC       string
+	pmsImage           string
+	pmsInternalAddress string
+	skipImagePull      bool
+	timeout            time.Duration
+}
+
+// doctorCheck is a single preflight check, it returns an error describing
+// what is wrong and how to fix it
+type doctorCheck struct {
+	name string
+	fn   func(ctx context.Context) error
+}
+
+// runDoctor validates that the environment kube-plex runs in is able to
+// launch transcode pods. Options default to the same environment variables
+// the transcoder shim reads, so running it inside the PMS container checks
+// the live configuration.
+func runDoctor(args []string) error {
+	var opts doctorOptions
+
+	fs := flag.NewFlagSet("doctor", flag.ContinueOnError)
+	fs.StringVar(&opts.kubeconfig, "kubeconfig", "", "path to the kubeconfig file")
+	fs.StringVar(&opts.namespace, "namespace", namespace, "namespace the transcode pods run in (defaults to the kubeconfig namespace)")
+	fs.StringVar(&opts.serviceAccount, "service-account", "", "service account to check permissions for (defaults to the current user)")
+	fs.StringVar(&opts.dataPVC, "data-pvc", dataPVC, "data claim name")
+	fs.StringVar(&opts.configPVC, "config-pvc", configPVC, "config claim name")
+	fs.StringVar(&opts.transcodePVC, "transcode-pvc", transcodePVC, "transcode claim name")
+	fs.StringVar(&opts.pmsImage, "pms-image", transcodeImage(), "image used for transcode pods")
+	fs.StringVar(&opts.pmsInternalAddress, "pms-internal-address", pmsInternalAddress, "address transcode pods use to reach PMS")
+	fs.BoolVar(&opts.skipImagePull, "skip-image-pull", false, "do not start a pod to verify the image can be pulled")
+	fs.DurationVar(&opts.timeout, "timeout", 2*time.Minute, "how long to wait for the image pull check")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	cl, ns, err := buildCommandClient(opts.kubeconfig)
+	if err != nil {
+		return err
+	}
+	if opts.namespace == "" {
+		opts.namespace = ns
+	}
+
+	var checks []doctorCheck
+	// volumes declared as NFS or hostPath sources have no claim
+	if dataVolume == "" {
+		checks = append(checks, doctorCheck{"data claim exists", func(ctx context.Context) error {
+			return checkClaim(ctx, cl, opts.namespace, "DATA_PVC", opts.dataPVC, false)
+		}})
+	}
+	if configVolume == "" {
+		checks = append(checks, doctorCheck{"config claim exists", func(ctx context.Context) error {
+			return checkClaim(ctx, cl, opts.namespace, "CONFIG_PVC", opts.configPVC, false)
+		}})
+	}
+	if transcodeVolume == "" {
+		checks = append(checks, doctorCheck{"transcode claim exists and is ReadWriteMany", func(ctx context.Context) error {
+			return checkClaim(ctx, cl, opts.namespace, "TRANSCODE_PVC", opts.transcodePVC, true)
+		}})
+	}
+	checks = append(checks, []doctorCheck{
+		{"permissions are sufficient", func(ctx context.Context) error {
+			return checkPermissions(ctx, cl, opts.namespace, opts.serviceAccount)
+		}},
+		{"PMS internal address is reachable", func(ctx context.Context) error {
+			return checkAddress(ctx, opts.pmsInternalAddress)
+		}},
+		{"transcoder image matches the PMS version", func(ctx context.Context) error {
+			return validateTranscoderImage()
+		}},
+	}...)
+	if !opts.skipImagePull {
+		checks = append(checks, doctorCheck{"transcoder image can be pulled", func(ctx context.Context) error {
+			return checkImage(ctx, cl, opts.namespace, opts.pmsImage, opts.timeout)
+		}})
+	}
+
+	ctx := context.Background()
+	failed := 0
+	for _, check := range checks {
+		if err := check.fn(ctx); err != nil {
+			failed++
+			fmt.Printf("[FAIL] %s: %s\n", check.name, err)
+			continue
+		}
+		fmt.Printf("[ OK ] %s\n", check.name)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d checks failed", failed, len(checks))
+	}
+	return nil
+}
+
+func checkClaim(ctx context.Context, cl kubernetes.Interface, ns, envName, name string, rwx bool) error {
+	if name == "" {
+		return fmt.Errorf("%s is not set", envName)
+	}
+	pvc, err := cl.CoreV1().PersistentVolumeClaims(ns).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("unable to get claim %q in namespace %q, check %s: %w", name, ns, envName, err)
+	}
+	if pvc.Status.Phase != corev1.ClaimBound {
+		return fmt.Errorf("claim %q is %s, it must be bound to a volume", name, pvc.Status.Phase)
+	}
+	if !rwx {
+		return nil
+	}
+	for _, mode := range pvc.Spec.AccessModes {
+		if mode == corev1.ReadWriteMany {
+			return nil
+		}
+	}
+	return fmt.Errorf("claim %q access modes are %v, transcode pods on other nodes need ReadWriteMany", name, pvc.Spec.AccessModes)
+}
+
+func checkPermissions(ctx context.Context, cl kubernetes.Interface, ns, serviceAccount string) error {
+	required := []authorizationv1.ResourceAttributes{
+		{Namespace: ns, Resource: "pods", Verb: "create"},
+		{Namespace: ns, Resource: "pods", Verb: "get"},
+		{Namespace: ns, Resource: "pods", Verb: "list"},
+		{Namespace: ns, Resource: "pods", Verb: "delete"},
+		{Namespace: ns, Resource: "pods", Subresource: "log", Verb: "get"},
+		{Namespace: ns, Resource: "pods", Subresource: "exec", Verb: "create"},
+		// JOB_MODE sessions and the cleanup of session directories
+		{Namespace: ns, Group: "batch", Resource: "jobs", Verb: "create"},
+		{Namespace: ns, Group: "batch", Resource: "jobs", Verb: "get"},
+		{Namespace: ns, Group: "batch", Resource: "jobs", Verb: "delete"},
+		// sensitive environment variables of sessions
+		{Namespace: ns, Resource: "secrets", Verb: "create"},
+		{Namespace: ns, Resource: "secrets", Verb: "patch"},
+		{Namespace: ns, Resource: "secrets", Verb: "delete"},
+		{Namespace: ns, Resource: "events", Verb: "create"},
+		{Namespace: ns, Resource: "configmaps", Verb: "get"},
+		// transcode slot reservations of MAX_CONCURRENT_TRANSCODES
+		{Namespace: ns, Group: "coordination.k8s.io", Resource: "leases", Verb: "create"},
+		{Namespace: ns, Group: "coordination.k8s.io", Resource: "leases", Verb: "list"},
+		{Namespace: ns, Group: "coordination.k8s.io", Resource: "leases", Verb: "delete"},
+	}
+
+	var missing []string
+	for i := range required {
+		attrs := &required[i]
+
+		var allowed bool
+		if serviceAccount == "" {
+			review, err := cl.AuthorizationV1().SelfSubjectAccessReviews().Create(ctx, &authorizationv1.SelfSubjectAccessReview{
+				Spec: authorizationv1.SelfSubjectAccessReviewSpec{ResourceAttributes: attrs},
+			}, metav1.CreateOptions{})
+			if err != nil {
+				return err
+			}
+			allowed = review.Status.Allowed
+		} else {
+			review, err := cl.AuthorizationV1().SubjectAccessReviews().Create(ctx, &authorizationv1.SubjectAccessReview{
+				Spec: authorizationv1.SubjectAccessReviewSpec{
+					ResourceAttributes: attrs,
+					User:               fmt.Sprintf("system:serviceaccount:%s:%s", ns, serviceAccount),
+				},
+			}, metav1.CreateOptions{})
+			if err != nil {
+				return err
+			}
+			allowed = review.Status.Allowed
+		}
+
+		if !allowed {
+			resource := attrs.Resource
+			if attrs.Group != "" {
+				resource += "." + attrs.Group
+			}
+			if attrs.Subresource != "" {
+				resource += "/" + attrs.Subresource
+			}
+			missing = append(missing, attrs.Verb+" "+resource)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing permissions in namespace %q: %s, run `kube-plex install` to generate the required Role", ns, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+func checkAddress(ctx context.Context, address string) error {
+	if address == "" {
+		return fmt.Errorf("PMS_INTERNAL_ADDRESS is not set")
+	}
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(address, "/")+"/identity", nil)
+	if err != nil {
+		return fmt.Errorf("invalid PMS_INTERNAL_ADDRESS %q: %w", address, err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("unable to reach %q, transcode pods will not be able to report progress: %w", address, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%q returned %s, check it points at the PMS service", address, resp.Status)
+	}
+	return nil
+}
+
+// doctorPod returns the pod checkImage starts, generated like transcode
+// pods, with their volumes, pull secrets, placement and security, running
+// true with the image instead of a transcoder
+func doctorPod(image string) (*corev1.Pod, error) {
+	uid, err := parseID(plexUID)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing PLEX_UID: %w", err)
+	}
+	gid, err := parseID(plexGID)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing PLEX_GID: %w", err)
+	}
+	pod, err := generatePod(transcodeDir(), uid, gid, nil, []string{"true"})
+	if err != nil {
+		return nil, err
+	}
+	pod.GenerateName = "kube-plex-doctor-"
+	// not a session, neither counted nor collected as one
+	delete(pod.Labels, managedByLabel)
+	delete(pod.Labels, schemaLabel)
+	pod.Labels["app"] = "kube-plex-doctor"
+	pod.Spec.RestartPolicy = corev1.RestartPolicyNever
+	pod.Spec.Containers[0].Image = image
+	return pod, nil
+}
+
+// checkImage starts a short lived pod like transcode pods running the image,
+// to verify nodes are able to pull it and start the pod
+func checkImage(ctx context.Context, cl kubernetes.Interface, ns, image string, timeout time.Duration) error {
+	if image == "" {
+		return fmt.Errorf("neither TRANSCODER_IMAGE nor PMS_IMAGE are set")
+	}
+	probe, err := doctorPod(image)
+	if err != nil {
+		return fmt.Errorf("unable to generate test pod: %w", err)
+	}
+	pod, err := cl.CoreV1().Pods(ns).Create(ctx, probe, metav1.CreateOptions{})
+	if err != nil {
+		return fmt.Errorf("unable to create test pod: %w", err)
+	}
+	defer cl.CoreV1().Pods(ns).Delete(ctx, pod.Name, metav1.DeleteOptions{})
+
+	deadline := time.After(timeout)
+	for {
+		select {
+		case <-deadline:
+			if current, err := cl.CoreV1().Pods(ns).Get(ctx, pod.Name, metav1.GetOptions{}); err == nil {
+				if pendingErr := pendingPodError(current); pendingErr != nil {
+					return fmt.Errorf("test pod did not start within %s: %w", timeout, pendingErr)
+				}
+			}
+			return fmt.Errorf("test pod did not start within %s", timeout)
+		case <-time.After(2 * time.Second):
+			pod, err := cl.CoreV1().Pods(ns).Get(ctx, pod.Name, metav1.GetOptions{})
+			if err != nil {
+				return err
+			}
+			if pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+				// the image was pulled, whether the command ran is irrelevant
+				return nil
+			}
+			for _, status := range pod.Status.ContainerStatuses {
+				if status.Name != pod.Spec.Containers[0].Name {
+					continue
+				}
+				if status.State.Running != nil || status.State.Terminated != nil {
+					return nil
+				}
+				if w := status.State.Waiting; w != nil && (w.Reason == "ErrImagePull" || w.Reason == "ImagePullBackOff" || w.Reason == "InvalidImageName") {
+					return fmt.Errorf("unable to pull %q: %s, check the image name and imagePullSecrets", image, w.Message)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	ktesting "k8s.io/client-go/testing"
+)
+
+func TestDoctorPod(t *testing.T) {
+	defer func(secrets, selector, taint, profile string) {
+		imagePullSecretNames, nodePoolSelector, nodePoolTaint, securityProfile = secrets, selector, taint, profile
+	}(imagePullSecretNames, nodePoolSelector, nodePoolTaint, securityProfile)
+	imagePullSecretNames, nodePoolSelector, nodePoolTaint, securityProfile = "registry", "pool=transcode", "dedicated=transcode:NoSchedule", securityProfileRestricted
+
+	pod, err := doctorPod("registry.example/transcoder:1")
+	if err != nil {
+		t.Fatalf("doctorPod() error = %s", err)
+	}
+	if _, ok := pod.Labels[managedByLabel]; ok {
+		t.Errorf("test pod is labeled as a transcode pod: %v", pod.Labels)
+	}
+	if pod.Spec.RestartPolicy != corev1.RestartPolicyNever {
+		t.Errorf("restart policy = %s, want Never", pod.Spec.RestartPolicy)
+	}
+	if image := pod.Spec.Containers[0].Image; image != "registry.example/transcoder:1" {
+		t.Errorf("image = %q", image)
+	}
+	if len(pod.Spec.ImagePullSecrets) != 1 || pod.Spec.ImagePullSecrets[0].Name != "registry" {
+		t.Errorf("imagePullSecrets = %v", pod.Spec.ImagePullSecrets)
+	}
+	if pod.Spec.NodeSelector["pool"] != "transcode" || len(pod.Spec.Tolerations) == 0 {
+		t.Errorf("test pod isn't placed on the node pool: %v, %v", pod.Spec.NodeSelector, pod.Spec.Tolerations)
+	}
+	if c := pod.Spec.Containers[0].SecurityContext; c == nil || c.ReadOnlyRootFilesystem == nil || !*c.ReadOnlyRootFilesystem {
+		t.Errorf("test container isn't hardened: %v", c)
+	}
+}
+
+func TestCheckPermissions(t *testing.T) {
+	tests := []struct {
+		name    string
+		denied  string
+		wantErr string
+	}{
+		{name: "allowed"},
+		{name: "jobs", denied: "jobs", wantErr: "create jobs.batch"},
+		{name: "leases", denied: "leases", wantErr: "create leases.coordination.k8s.io"},
+		{name: "secrets", denied: "secrets", wantErr: "create secrets"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cl := fake.NewSimpleClientset()
+			cl.PrependReactor("create", "selfsubjectaccessreviews", func(action ktesting.Action) (bool, runtime.Object, error) {
+				review := action.(ktesting.CreateAction).GetObject().(*authorizationv1.SelfSubjectAccessReview)
+				review.Status.Allowed = review.Spec.ResourceAttributes.Resource != tt.denied
+				return true, review, nil
+			})
+			err := checkPermissions(context.Background(), cl, "plex", "")
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("checkPermissions() error = %s", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("checkPermissions() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/lrascao/kube-plex/pkg/ffmpeg"
+)
+
+// eaeModeSidecar runs EasyAudioEncoder next to the transcoder in the pod
+const eaeModeSidecar = "sidecar"
+
+// addEAESidecar runs EasyAudioEncoder as a sidecar of the transcoder.
+// PMS starts EasyAudioEncoder on its own host and the transcoder expects it
+// to be watching the EAE root, which doesn't happen in a remote pod. The
+// sidecar shares every volume of the transcoder so it watches the same
+// directory, and is declared as a restartable init container so the pod
+// completes when the transcoder exits.
+func addEAESidecar(pod *corev1.Pod, args []string) {
+	inv := ffmpeg.Parse(args)
+	if eaeMode != eaeModeSidecar || !inv.UsesEAE {
+		return
+	}
+	root := inv.EAERoot
+	if root == "" {
+		root = "/tmp"
+	}
+
+	transcoder := pod.Spec.Containers[0]
+	always := corev1.ContainerRestartPolicyAlways
+	pod.Spec.InitContainers = append(pod.Spec.InitContainers, corev1.Container{
+		Name:          "eae",
+		Image:         transcoder.Image,
+		Command:       []string{"/bin/sh", "-c", `mkdir -p "$0" && cd "$0" && exec ` + eaeCommand, root},
+		Env:           transcoder.Env,
+		VolumeMounts:  transcoder.VolumeMounts,
+		RestartPolicy: &always,
+	})
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// droppedEnv are the PMS environment variables the transcoder never needs,
+// which are not passed to transcode pods
+var droppedEnv = map[string]bool{
+	"PLEX_CLAIM":           true,
+	"ADMIN_TOKEN":          true,
+	"WEBHOOK_URLS":         true,
+	"S3_ACCESS_KEY_ID":     true,
+	"S3_SECRET_ACCESS_KEY": true,
+	clusterIndexEnv:        true,
+}
+
+var (
+	// serviceLinkEnvRe matches the names of the variables Kubernetes
+	// injects for the services of the namespace and the API server
+	serviceLinkEnvRe = regexp.MustCompile(`^(KUBERNETES_[A-Z0-9_]+|[A-Z0-9_]+_SERVICE_(HOST|PORT(_[A-Z0-9_]+)?)|[A-Z0-9_]+_PORT_[0-9]+_(TCP|UDP|SCTP)(_(PROTO|PORT|ADDR))?)$`)
+	// serviceLinkPortRe matches the value of the <SERVICE>_PORT variables
+	serviceLinkPortRe = regexp.MustCompile(`^(tcp|udp|sctp)://`)
+)
+
+// isServiceLinkEnv reports whether the variable was injected by Kubernetes
+// for a service rather than set for PMS
+func isServiceLinkEnv(name, value string) bool {
+	if serviceLinkEnvRe.MatchString(name) {
+		return true
+	}
+	return strings.HasSuffix(name, "_PORT") && serviceLinkPortRe.MatchString(value)
+}
+
+// filterEnv drops the variables the transcoder doesn't need from the
+// environment passed to transcode pods, sorted so the same environment
+// always generates the same pod
+func filterEnv(env []string) []string {
+	excluded := map[string]bool{}
+	for _, name := range strings.Split(envExclude, ",") {
+		excluded[strings.TrimSpace(name)] = true
+	}
+	var out []string
+	for _, kv := range env {
+		name, value, _ := strings.Cut(kv, "=")
+		if droppedEnv[name] || excluded[name] {
+			continue
+		}
+		if serviceLinks != "true" && isServiceLinkEnv(name, value) {
+			continue
+		}
+		out = append(out, kv)
+	}
+	sort.Strings(out)
+	return out
+}
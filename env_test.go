@@ -0,0 +1,26 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFilterEnv(t *testing.T) {
+	defer func(exclude, links string) { envExclude, serviceLinks = exclude, links }(envExclude, serviceLinks)
+	envExclude, serviceLinks = "DEBUG", "false"
+
+	env := []string{
+		"TZ=Europe/Lisbon",
+		"ADMIN_TOKEN=hunter2",
+		"PLEX_CLAIM=claim-abc",
+		"DEBUG=1",
+		"PLEX_SERVICE_HOST=10.0.0.1",
+		"PLEX_PORT=tcp://10.0.0.1:32400",
+		"HOME=/config",
+		"LANG=en_US.UTF-8",
+	}
+	want := "HOME=/config,LANG=en_US.UTF-8,TZ=Europe/Lisbon"
+	if got := strings.Join(filterEnv(env), ","); got != want {
+		t.Errorf("filterEnv() = %s, want %s", got, want)
+	}
+}
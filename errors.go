@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// errors a session fails with when the cluster couldn't run the transcoder,
+// as opposed to the transcoder itself failing
+var (
+	ErrUnschedulable = errors.New("transcode pod can't be scheduled")
+	ErrImagePull     = errors.New("unable to pull the transcoder image")
+	ErrStorage       = errors.New("unable to mount the transcode pod volumes")
+	ErrDisrupted     = errors.New("transcode pod was disrupted by the cluster")
+	ErrStartTimeout  = errors.New("transcode pod didn't start in time")
+)
+
+// ErrTranscoder is returned when the transcoder ran and exited with an error
+type ErrTranscoder struct {
+	ExitCode int
+	Reason   string
+	Message  string
+}
+
+func (e *ErrTranscoder) Error() string {
+	msg := fmt.Sprintf("transcoder exited with code %d", e.ExitCode)
+	if e.Reason != "" {
+		msg += ": " + e.Reason
+	}
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	return msg
+}
+
+// errImageInvalid is wrapped with ErrImagePull when the image can never be
+// pulled, so waiting for it is pointless
+var errImageInvalid = errors.New("invalid image")
+
+// exitCodeFor returns the code the shim exits with so PMS sees the session
+// fail the same way a local transcoder would
+func exitCodeFor(err error) int {
+	if err == nil {
+		return 0
+	}
+	var transcoderErr *ErrTranscoder
+	if errors.As(err, &transcoderErr) && transcoderErr.ExitCode > 0 {
+		return transcoderErr.ExitCode
+	}
+	return 1
+}
+
+// isInfrastructureError reports whether the session failed before or
+// regardless of the transcoder, so running it again elsewhere may succeed
+func isInfrastructureError(err error) bool {
+	return errors.Is(err, ErrUnschedulable) || errors.Is(err, ErrImagePull) ||
+		errors.Is(err, ErrStorage) || errors.Is(err, ErrDisrupted) || errors.Is(err, ErrStartTimeout)
+}
+
+// isStartError reports whether the transcode pod never started, so the
+// session may still be transcoded locally
+func isStartError(err error) bool {
+	return errors.Is(err, ErrUnschedulable) || errors.Is(err, ErrImagePull) ||
+		errors.Is(err, ErrStorage) || errors.Is(err, ErrStartTimeout)
+}
+
+// volumeErrorRe matches the container creation errors caused by the volumes
+// of the pod, e.g. a subPath that can't be mounted
+var volumeErrorRe = regexp.MustCompile(`(?i)volume|mount|subpath`)
+
+// pendingPodError returns the typed error explaining why a pod that hasn't
+// started its transcoder is stuck, nil when there's no known reason
+func pendingPodError(pod *corev1.Pod) error {
+	for _, cond := range pod.Status.Conditions {
+		if cond.Type == corev1.PodScheduled && cond.Status == corev1.ConditionFalse && cond.Reason == corev1.PodReasonUnschedulable {
+			return fmt.Errorf("%w: %s", ErrUnschedulable, cond.Message)
+		}
+	}
+	statuses := append(append([]corev1.ContainerStatus(nil), pod.Status.InitContainerStatuses...), pod.Status.ContainerStatuses...)
+	for _, status := range statuses {
+		w := status.State.Waiting
+		if w == nil {
+			continue
+		}
+		switch w.Reason {
+		case "InvalidImageName", "ErrImageNeverPull":
+			return fmt.Errorf("%w %q: %w: %s", ErrImagePull, status.Image, errImageInvalid, w.Message)
+		case "ErrImagePull", "ImagePullBackOff":
+			return fmt.Errorf("%w %q: %s", ErrImagePull, status.Image, w.Message)
+		case "CreateContainerConfigError", "CreateContainerError":
+			if volumeErrorRe.MatchString(w.Message) {
+				return fmt.Errorf("%w: %s", ErrStorage, w.Message)
+			}
+			return fmt.Errorf("container %s can't be created: %s", status.Name, w.Message)
+		}
+	}
+	return nil
+}
+
+// stuckPodError returns why the transcoder of the pod hasn't started yet,
+// nil while it's running or starting normally
+func stuckPodError(pod *corev1.Pod) error {
+	if err := pendingPodError(pod); err != nil {
+		return err
+	}
+	for _, status := range pod.Status.ContainerStatuses {
+		// the image may still be pulling, mount failures only show in
+		// the pod events
+		if w := status.State.Waiting; w != nil && w.Reason == "ContainerCreating" {
+			return fmt.Errorf("container %s is still being created, check the pod events for mount failures", status.Name)
+		}
+	}
+	return nil
+}
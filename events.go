@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// reasons of the Events recorded against transcode pods
+const (
+	eventReasonCreated   = "TranscodeCreated"
+	eventReasonRecreated = "TranscodeRecreated"
+	eventReasonAdopted   = "TranscodeAdopted"
+	eventReasonClaimed   = "TranscodeClaimed"
+	eventReasonCompleted = "TranscodeCompleted"
+	eventReasonFailed    = "TranscodeFailed"
+	eventReasonStopped   = "TranscodeStopped"
+	eventReasonRetained  = "TranscodeRetained"
+)
+
+// recordEvent records an Event against the transcode pod, so the session
+// shows in kubectl describe and event exporters. Events are recorded
+// synchronously as the shim exits right after the session ends.
+func recordEvent(ctx context.Context, cl kubernetes.Interface, pod *corev1.Pod, eventType, reason, message string) {
+	if transcodeEvents != "true" {
+		return
+	}
+	now := metav1.Now()
+	event := &corev1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: pod.Name + ".",
+			Namespace:    pod.Namespace,
+			Labels: map[string]string{
+				managedByLabel: managedByValue,
+			},
+		},
+		InvolvedObject: corev1.ObjectReference{
+			APIVersion: "v1",
+			Kind:       "Pod",
+			Namespace:  pod.Namespace,
+			Name:       pod.Name,
+			UID:        pod.UID,
+		},
+		Reason:         reason,
+		Message:        message,
+		Type:           eventType,
+		Source:         corev1.EventSource{Component: managedByValue},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if _, err := cl.CoreV1().Events(pod.Namespace).Create(ctx, event, metav1.CreateOptions{}); err != nil {
+		log.Printf("warning: unable to record %s event of pod %q: %s", reason, pod.Name, err)
+	}
+}
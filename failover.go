@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	// name of the cluster PMS runs in, in TRANSCODE_CLUSTERS
+	inClusterName = "in-cluster"
+	// environment variable holding the index of the cluster of
+	// TRANSCODE_CLUSTERS the session is tried in
+	clusterIndexEnv = "KUBE_PLEX_CLUSTER_INDEX"
+)
+
+// clusterIndex is the index of the cluster of TRANSCODE_CLUSTERS the session
+// is tried in
+var clusterIndex int
+
+// transcodeClusters returns the clusters of TRANSCODE_CLUSTERS
+func transcodeClusters() []string {
+	var clusters []string
+	for _, c := range strings.Split(transcodeClusterList, ",") {
+		if c = strings.TrimSpace(c); c != "" {
+			clusters = append(clusters, c)
+		}
+	}
+	return clusters
+}
+
+// selectCluster picks the cluster of TRANSCODE_CLUSTERS the session is tried
+// in, the first one unless previous ones failed it, pointing
+// TRANSCODE_CONTEXT at it
+func selectCluster() error {
+	clusters := transcodeClusters()
+	if len(clusters) == 0 {
+		return nil
+	}
+	if v := os.Getenv(clusterIndexEnv); v != "" {
+		var err error
+		if clusterIndex, err = strconv.Atoi(v); err != nil || clusterIndex < 0 || clusterIndex >= len(clusters) {
+			return fmt.Errorf("invalid %s %q", clusterIndexEnv, v)
+		}
+	}
+	if clusters[clusterIndex] == inClusterName {
+		transcodeKubeconfig, transcodeContext = "", ""
+	} else {
+		transcodeContext = clusters[clusterIndex]
+	}
+	return nil
+}
+
+// failover runs the session again in the next cluster of
+// TRANSCODE_CLUSTERS. The shim replaces itself, so PMS keeps following the
+// same process. It returns when there's no cluster left to try.
+func failover(args []string, cause error) {
+	clusters := transcodeClusters()
+	next := clusterIndex + 1
+	if next >= len(clusters) {
+		return
+	}
+	self, err := os.Executable()
+	if err != nil {
+		log.Printf("warning: unable to fail over to cluster %s: %s", clusters[next], err)
+		return
+	}
+	log.Printf("%s, failing over to cluster %s", cause, clusters[next])
+
+	env := []string{clusterIndexEnv + "=" + strconv.Itoa(next)}
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, clusterIndexEnv+"=") {
+			env = append(env, kv)
+		}
+	}
+	err = syscall.Exec(self, args, env)
+	log.Printf("warning: unable to fail over to cluster %s: %s", clusters[next], err)
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	utilrand "k8s.io/apimachinery/pkg/util/rand"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	ktesting "k8s.io/client-go/testing"
+	"sigs.k8s.io/yaml"
+)
+
+// kubePlexModeFake runs sessions against an in-memory cluster
+const kubePlexModeFake = "fake"
+
+const (
+	// image of the PMS pod of the fake cluster
+	fakePMSImage = "plexinc/pms-docker:latest"
+	// node the pods of the fake cluster run on
+	fakeNodeName = "fake-node"
+)
+
+// newFakeCluster returns a client of an in-memory cluster holding the PMS
+// pod, where every transcode pod, or Job pod, runs on a fake node and
+// succeeds right away. The pods are logged, so the argument rewriting and pod
+// generation can be checked without a cluster.
+func newFakeCluster(ctx context.Context, ns string) kubernetes.Interface {
+	pms := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: pmsPodName, Namespace: ns},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: pmsContainerName, Image: fakePMSImage}},
+		},
+	}
+	cl := fake.NewSimpleClientset(pms)
+	// the fake clientset neither generates names, UIDs nor creation
+	// timestamps
+	cl.PrependReactor("create", "*", func(action ktesting.Action) (bool, runtime.Object, error) {
+		obj, ok := action.(ktesting.CreateAction).GetObject().(metav1.Object)
+		if !ok {
+			return false, nil, nil
+		}
+		if obj.GetName() == "" && obj.GetGenerateName() != "" {
+			obj.SetName(obj.GetGenerateName() + utilrand.String(5))
+		}
+		if obj.GetUID() == "" {
+			obj.SetUID(types.UID(utilrand.String(16)))
+		}
+		if ts := obj.GetCreationTimestamp(); ts.IsZero() {
+			obj.SetCreationTimestamp(metav1.Now())
+		}
+		return false, nil, nil
+	})
+
+	// watched before returning, pods created right away would be missed
+	// by watches started in the goroutines
+	pods, err := cl.CoreV1().Pods(ns).Watch(ctx, metav1.ListOptions{LabelSelector: managedByLabel + "=" + managedByValue})
+	if err != nil {
+		log.Printf("warning: unable to watch fake pods: %s", err)
+	} else {
+		go runFakeKubelet(ctx, cl, pods)
+	}
+	jobs, err := cl.BatchV1().Jobs(ns).Watch(ctx, metav1.ListOptions{})
+	if err != nil {
+		log.Printf("warning: unable to watch fake jobs: %s", err)
+	} else {
+		go runFakeJobController(ctx, cl, jobs)
+	}
+	return cl
+}
+
+// runFakeKubelet runs the pods created in the fake cluster
+func runFakeKubelet(ctx context.Context, cl kubernetes.Interface, w watch.Interface) {
+	defer w.Stop()
+	for ev := range w.ResultChan() {
+		pod, ok := ev.Object.(*corev1.Pod)
+		if !ok || ev.Type != watch.Added {
+			continue
+		}
+		if manifest, err := yaml.Marshal(sanitizePod(pod)); err == nil {
+			log.Printf("fake pod %s:\n%s", pod.Name, manifest)
+		}
+		if err := completeFakePod(ctx, cl, pod); err != nil {
+			log.Printf("warning: unable to run fake pod %q: %s", pod.Name, err)
+		}
+	}
+}
+
+// completeFakePod reports the pod running on the fake node, then its
+// containers exiting successfully
+func completeFakePod(ctx context.Context, cl kubernetes.Interface, pod *corev1.Pod) error {
+	now := metav1.Now()
+	pod = pod.DeepCopy()
+	pod.Spec.NodeName = fakeNodeName
+	pod.Status.Phase = corev1.PodRunning
+	pod.Status.StartTime = &now
+	pod.Status.ContainerStatuses = nil
+	for _, c := range pod.Spec.Containers {
+		pod.Status.ContainerStatuses = append(pod.Status.ContainerStatuses, corev1.ContainerStatus{
+			Name:  c.Name,
+			Image: c.Image,
+			Ready: true,
+			State: corev1.ContainerState{Running: &corev1.ContainerStateRunning{StartedAt: now}},
+		})
+	}
+	pod, err := cl.CoreV1().Pods(pod.Namespace).UpdateStatus(ctx, pod, metav1.UpdateOptions{})
+	if err != nil {
+		return err
+	}
+
+	pod.Status.Phase = corev1.PodSucceeded
+	finished := metav1.Now()
+	for i := range pod.Status.ContainerStatuses {
+		status := &pod.Status.ContainerStatuses[i]
+		status.Ready = false
+		status.State = corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{
+			ExitCode:   0,
+			Reason:     "Completed",
+			StartedAt:  now,
+			FinishedAt: finished,
+		}}
+	}
+	_, err = cl.CoreV1().Pods(pod.Namespace).UpdateStatus(ctx, pod, metav1.UpdateOptions{})
+	return err
+}
+
+// runFakeJobController creates the pods of the Jobs created in the fake
+// cluster and completes the Jobs with them
+func runFakeJobController(ctx context.Context, cl kubernetes.Interface, w watch.Interface) {
+	defer w.Stop()
+	for ev := range w.ResultChan() {
+		job, ok := ev.Object.(*batchv1.Job)
+		if !ok || ev.Type != watch.Added {
+			continue
+		}
+		go func() {
+			if err := runFakeJob(ctx, cl, job); err != nil {
+				log.Printf("warning: unable to run fake job %q: %s", job.Name, err)
+			}
+		}()
+	}
+}
+
+func runFakeJob(ctx context.Context, cl kubernetes.Interface, job *batchv1.Job) error {
+	pod := &corev1.Pod{
+		ObjectMeta: *job.Spec.Template.ObjectMeta.DeepCopy(),
+		Spec:       *job.Spec.Template.Spec.DeepCopy(),
+	}
+	pod.GenerateName = job.Name + "-"
+	pod.Namespace = job.Namespace
+	if pod.Labels == nil {
+		pod.Labels = map[string]string{}
+	}
+	pod.Labels["job-name"] = job.Name
+	pod.OwnerReferences = []metav1.OwnerReference{{APIVersion: "batch/v1", Kind: "Job", Name: job.Name, UID: job.UID}}
+	pod, err := cl.CoreV1().Pods(job.Namespace).Create(ctx, pod, metav1.CreateOptions{})
+	if err != nil {
+		return err
+	}
+
+	for {
+		pod, err = cl.CoreV1().Pods(pod.Namespace).Get(ctx, pod.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if pod.Status.Phase == corev1.PodSucceeded {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("context cancelled")
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	job.Status.Succeeded = 1
+	job.Status.Conditions = append(job.Status.Conditions, batchv1.JobCondition{
+		Type:   batchv1.JobComplete,
+		Status: corev1.ConditionTrue,
+	})
+	_, err = cl.BatchV1().Jobs(job.Namespace).UpdateStatus(ctx, job, metav1.UpdateOptions{})
+	return err
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// faults holds the failures injected into a session to exercise the error
+// handling paths without a misbehaving cluster. They are configured with
+// FAULT_INJECTION as a comma separated list of name=value pairs, e.g.
+// create-failure=0.5,schedule-delay=30s,delete-pod-after=2m
+type faults struct {
+	// probability of the pod creation failing
+	createFailure float64
+	// delay before the pod is created, simulating slow scheduling
+	scheduleDelay time.Duration
+	// delete the pod this long after it's created, simulating a lost pod
+	deletePodAfter time.Duration
+}
+
+func parseFaults(in string) (faults, error) {
+	var f faults
+	if in == "" {
+		return f, nil
+	}
+	for _, kv := range strings.Split(in, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(kv), "=")
+		if !ok {
+			return f, fmt.Errorf("invalid fault %q, expected name=value", kv)
+		}
+
+		var err error
+		switch name {
+		case "create-failure":
+			f.createFailure, err = strconv.ParseFloat(value, 64)
+		case "schedule-delay":
+			f.scheduleDelay, err = time.ParseDuration(value)
+		case "delete-pod-after":
+			f.deletePodAfter, err = time.ParseDuration(value)
+		default:
+			err = fmt.Errorf("unknown fault")
+		}
+		if err != nil {
+			return f, fmt.Errorf("invalid fault %q: %w", kv, err)
+		}
+	}
+	return f, nil
+}
+
+// beforeCreate is called right before the pod is created
+func (f faults) beforeCreate(ctx context.Context) error {
+	if f.scheduleDelay > 0 {
+		log.Printf("fault injection: delaying pod creation by %s", f.scheduleDelay)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(f.scheduleDelay):
+		}
+	}
+	return nil
+}
+
+// createError is called on every pod creation attempt, injected failures
+// look like an unavailable API server so they're retried
+func (f faults) createError() error {
+	if f.createFailure > 0 && rand.Float64() < f.createFailure {
+		return apierrors.NewServiceUnavailable("fault injection: pod creation failed")
+	}
+	return nil
+}
+
+// afterCreate is called once the pod has been created
+func (f faults) afterCreate(ctx context.Context, cl kubernetes.Interface, pod *corev1.Pod) {
+	if f.deletePodAfter <= 0 {
+		return
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(f.deletePodAfter):
+		}
+		log.Printf("fault injection: deleting pod %s", pod.Name)
+		if err := cl.CoreV1().Pods(pod.Namespace).Delete(ctx, pod.Name, metav1.DeleteOptions{}); err != nil {
+			log.Printf("fault injection: unable to delete pod %q: %s", pod.Name, err)
+		}
+	}()
+}
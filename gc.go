@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+// retainedUntilAnnotation marks failed pods and Jobs kept for inspection,
+// the controller deletes them once the time it holds has passed
+const retainedUntilAnnotation = "kube-plex/retained-until"
+
+// retainFailed keeps the failed pod, and the Job owning it, for retention
+// instead of deleting them, so their status and logs can be inspected
+func retainFailed(ctx context.Context, cl kubernetes.Interface, pod *corev1.Pod, job *batchv1.Job, retention time.Duration) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{
+				retainedUntilAnnotation: time.Now().Add(retention).UTC().Format(time.RFC3339),
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if job != nil {
+		if _, err := cl.BatchV1().Jobs(job.Namespace).Patch(ctx, job.Name, types.MergePatchType, patch, metav1.PatchOptions{}); err != nil {
+			return err
+		}
+	}
+	_, err = cl.CoreV1().Pods(pod.Namespace).Patch(ctx, pod.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+	return err
+}
+
+// expired reports whether the retention of a retained object has passed
+func expired(annotations map[string]string, now time.Time) bool {
+	value, ok := annotations[retainedUntilAnnotation]
+	if !ok {
+		return false
+	}
+	until, err := time.Parse(time.RFC3339, value)
+	return err != nil || now.After(until)
+}
+
+// collectGarbage deletes the retained pods and Jobs whose retention passed,
+// and the expired transcode slot reservations, and starts the cleanup Jobs
+// that are due
+func collectGarbage(ctx context.Context, cl kubernetes.Interface, ns string) error {
+	now := time.Now()
+	propagation := metav1.DeletePropagationBackground
+
+	jobs, err := cl.BatchV1().Jobs(ns).List(ctx, metav1.ListOptions{LabelSelector: managedPodSelector()})
+	if err != nil {
+		return err
+	}
+	for _, job := range jobs.Items {
+		if !expired(job.Annotations, now) {
+			continue
+		}
+		log.Printf("deleting retained job %s", job.Name)
+		err := cl.BatchV1().Jobs(ns).Delete(ctx, job.Name, metav1.DeleteOptions{PropagationPolicy: &propagation})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+	}
+
+	pods, err := listManagedPods(ctx, cl, ns)
+	if err != nil {
+		return err
+	}
+	for _, pod := range pods {
+		if !expired(pod.Annotations, now) || pod.DeletionTimestamp != nil {
+			continue
+		}
+		log.Printf("deleting retained pod %s", pod.Name)
+		err := cl.CoreV1().Pods(ns).Delete(ctx, pod.Name, metav1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+	}
+	if err := startDueCleanups(ctx, cl, ns); err != nil {
+		return err
+	}
+	return collectSlotReservations(ctx, cl, ns)
+}
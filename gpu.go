@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+
+	"github.com/lrascao/kube-plex/pkg/ffmpeg"
+)
+
+// devices hardware transcodes request and the runtime class NVIDIA ones run
+// with when HWACCEL_AUTO is enabled
+var (
+	hwaccelResources = map[string]string{
+		capabilityNVENC: "nvidia.com/gpu",
+		capabilityQSV:   "gpu.intel.com/i915",
+	}
+	nvidiaRuntimeClass = "nvidia"
+)
+
+// hardwareCapability returns the GPU capability the session decodes or
+// encodes video with, nvenc or qsv, or an empty string for software ones
+func hardwareCapability(inv ffmpeg.Invocation) string {
+	for _, c := range sessionCapabilities(inv) {
+		if c == capabilityNVENC || c == capabilityQSV {
+			return c
+		}
+	}
+	return ""
+}
+
+// gpuResourceFor returns the extended resource the session requests,
+// GPU_RESOURCE for hardware transcodes or else the device of their GPU
+// vendor when HWACCEL_AUTO is enabled
+func gpuResourceFor(inv ffmpeg.Invocation) string {
+	c := hardwareCapability(inv)
+	switch {
+	case c == "":
+		return ""
+	case gpuResource != "":
+		return gpuResource
+	case hwaccelAuto == "true":
+		return hwaccelResources[c]
+	}
+	return ""
+}
+
+// parseGPUResource parses GPU_RESOURCE_COUNT, the quantity of their GPU
+// resource hardware transcodes request
+func parseGPUResource() (resource.Quantity, error) {
+	q, err := resource.ParseQuantity(gpuResourceCount)
+	if err != nil {
+		return q, err
+	}
+	if q.Sign() <= 0 {
+		return q, fmt.Errorf("%q must be positive", gpuResourceCount)
+	}
+	return q, nil
+}
+
+// requestGPU makes hardware transcodes request GPU_RESOURCE, which may be a
+// whole GPU or a share of one: a time-sliced or MPS replica such as
+// nvidia.com/gpu.shared, or a MIG slice such as nvidia.com/mig-1g.5gb, so
+// several hardware transcodes can run on one card. NVIDIA containers are
+// given the video driver capability NVENC and NVDEC need.
+func requestGPU(pod *corev1.Pod, inv ffmpeg.Invocation) {
+	gpu := gpuResourceFor(inv)
+	if gpu == "" {
+		return
+	}
+	// validated in main
+	q, _ := parseGPUResource()
+	container := &pod.Spec.Containers[0]
+	if container.Resources.Requests == nil {
+		container.Resources.Requests = corev1.ResourceList{}
+	}
+	if container.Resources.Limits == nil {
+		container.Resources.Limits = corev1.ResourceList{}
+	}
+	// extended resources must have equal requests and limits
+	name := corev1.ResourceName(gpu)
+	container.Resources.Requests[name] = q.DeepCopy()
+	container.Resources.Limits[name] = q.DeepCopy()
+
+	if !strings.HasPrefix(gpu, "nvidia.com/") {
+		return
+	}
+	for _, e := range container.Env {
+		if e.Name == "NVIDIA_DRIVER_CAPABILITIES" {
+			return
+		}
+	}
+	container.Env = append(container.Env, corev1.EnvVar{Name: "NVIDIA_DRIVER_CAPABILITIES", Value: "compute,video,utility"})
+}
+
+// accelerateHardwareTranscode runs hardware transcodes where their GPU is,
+// requiring the node label of the capability, and NVIDIA ones with the
+// nvidia runtime class unless RUNTIME_CLASS is set, so they work without
+// per-cluster routing rules
+func accelerateHardwareTranscode(pod *corev1.Pod, inv ffmpeg.Invocation) {
+	c := hardwareCapability(inv)
+	if hwaccelAuto != "true" || c == "" {
+		return
+	}
+	// validated in main
+	labels, _ := parseCapabilityLabels(nodeCapabilityLabels)
+	if k, v, ok := strings.Cut(labels[c], "="); ok {
+		if pod.Spec.NodeSelector == nil {
+			pod.Spec.NodeSelector = map[string]string{}
+		}
+		pod.Spec.NodeSelector[k] = v
+	}
+	if c == capabilityNVENC && pod.Spec.RuntimeClassName == nil {
+		pod.Spec.RuntimeClassName = &nvidiaRuntimeClass
+	}
+}
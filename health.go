@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+)
+
+// healthServer serves the probes and metrics of the controller:
+//
+//	GET /healthz         ok unless reconciling got stuck
+//	GET /readyz          ok while the API server is reachable
+//	GET /metrics         metrics in the Prometheus text format
+//	GET /debug/pprof/    profiles, when enabled
+//
+// Replicas standing by for the leader election are healthy and ready.
+type healthServer struct {
+	// reconciling is stuck when it didn't finish for stale
+	stale time.Duration
+	pprof bool
+
+	mu    sync.Mutex
+	start time.Time
+	// when reconciling started, and last finished
+	leading    time.Time
+	reconciled time.Time
+	standby    bool
+	// whether the sessions could be listed last time
+	ready bool
+	// reconciliations and their errors by loop
+	runs, errs map[string]int
+	sessions   int
+}
+
+func newHealthServer(interval time.Duration, pprof bool) *healthServer {
+	return &healthServer{
+		// leave room for slow API servers
+		stale:   3*interval + time.Minute,
+		pprof:   pprof,
+		start:   time.Now(),
+		leading: time.Now(),
+		runs:    map[string]int{},
+		errs:    map[string]int{},
+	}
+}
+
+// serveHealth serves the probes and metrics on address until the context is
+// done
+func serveHealth(ctx context.Context, address string, h *healthServer) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", h.healthz)
+	mux.HandleFunc("/readyz", h.readyz)
+	mux.HandleFunc("/metrics", h.metrics)
+	if h.pprof {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+
+	srv := &http.Server{Addr: address, Handler: mux}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	log.Printf("health endpoints listening on %s", address)
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Printf("error serving health endpoints: %s", err)
+	}
+}
+
+// observe records a reconciliation of the loop
+func (h *healthServer) observe(loop string, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.runs[loop]++
+	if err != nil {
+		h.errs[loop]++
+	}
+}
+
+// standBy records whether the controller is waiting to become the leader
+func (h *healthServer) standBy(standby bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.standby && !standby {
+		h.leading = time.Now()
+		h.reconciled = time.Time{}
+	}
+	h.standby = standby
+}
+
+// reconciledAll records every loop ran, with the sessions found or the
+// error listing them
+func (h *healthServer) reconciledAll(sessions int, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.reconciled = time.Now()
+	h.ready = err == nil
+	if err == nil {
+		h.sessions = sessions
+	}
+}
+
+func (h *healthServer) healthz(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	standby := h.standby
+	last := h.reconciled
+	if last.IsZero() {
+		last = h.leading
+	}
+	h.mu.Unlock()
+	if standby {
+		fmt.Fprintln(w, "standing by")
+		return
+	}
+	if since := time.Since(last); since > h.stale {
+		http.Error(w, fmt.Sprintf("not reconciled for %s", since.Round(time.Second)), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+func (h *healthServer) readyz(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	standby, ready := h.standby, h.ready
+	h.mu.Unlock()
+	if standby {
+		fmt.Fprintln(w, "standing by")
+		return
+	}
+	if !ready {
+		http.Error(w, "unable to list sessions", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+func (h *healthServer) metrics(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintln(w, "# HELP kube_plex_reconcile_total Reconciliations of the controller by loop.")
+	fmt.Fprintln(w, "# TYPE kube_plex_reconcile_total counter")
+	for _, loop := range sortedKeys(h.runs) {
+		fmt.Fprintf(w, "kube_plex_reconcile_total{loop=%q} %d\n", loop, h.runs[loop])
+	}
+	fmt.Fprintln(w, "# HELP kube_plex_reconcile_errors_total Failed reconciliations of the controller by loop.")
+	fmt.Fprintln(w, "# TYPE kube_plex_reconcile_errors_total counter")
+	for _, loop := range sortedKeys(h.runs) {
+		fmt.Fprintf(w, "kube_plex_reconcile_errors_total{loop=%q} %d\n", loop, h.errs[loop])
+	}
+	fmt.Fprintln(w, "# HELP kube_plex_last_reconcile_timestamp_seconds When every loop last ran.")
+	fmt.Fprintln(w, "# TYPE kube_plex_last_reconcile_timestamp_seconds gauge")
+	var last float64
+	if !h.reconciled.IsZero() {
+		last = float64(h.reconciled.UnixNano()) / 1e9
+	}
+	fmt.Fprintf(w, "kube_plex_last_reconcile_timestamp_seconds %.3f\n", last)
+	fmt.Fprintln(w, "# HELP kube_plex_sessions Transcode sessions running in the namespace.")
+	fmt.Fprintln(w, "# TYPE kube_plex_sessions gauge")
+	fmt.Fprintf(w, "kube_plex_sessions %d\n", h.sessions)
+	fmt.Fprintln(w, "# HELP kube_plex_leader Whether the controller reconciles, 0 while standing by for the leader election.")
+	fmt.Fprintln(w, "# TYPE kube_plex_leader gauge")
+	leader := 1
+	if h.standby {
+		leader = 0
+	}
+	fmt.Fprintf(w, "kube_plex_leader %d\n", leader)
+	fmt.Fprintln(w, "# HELP process_start_time_seconds Start time of the process since unix epoch in seconds.")
+	fmt.Fprintln(w, "# TYPE process_start_time_seconds gauge")
+	fmt.Fprintf(w, "process_start_time_seconds %.3f\n", float64(h.start.UnixNano())/1e9)
+	fmt.Fprintln(w, "# HELP go_goroutines Number of goroutines that currently exist.")
+	fmt.Fprintln(w, "# TYPE go_goroutines gauge")
+	fmt.Fprintf(w, "go_goroutines %d\n", runtime.NumGoroutine())
+	fmt.Fprintln(w, "# HELP go_memstats_heap_alloc_bytes Number of heap bytes allocated and still in use.")
+	fmt.Fprintln(w, "# TYPE go_memstats_heap_alloc_bytes gauge")
+	fmt.Fprintf(w, "go_memstats_heap_alloc_bytes %d\n", mem.HeapAlloc)
+}
+
+func sortedKeys(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
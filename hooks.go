@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// hookMutate is the event the hook may rewrite the pod at, before it's
+// created. The other events are those of the webhooks.
+const hookMutate = "mutate"
+
+// runHook runs HOOK_COMMAND with the event as argument and the pod as JSON
+// on stdin, returning its output. The session and its error, if any, are
+// passed in KUBE_PLEX_SESSION and KUBE_PLEX_ERROR.
+func runHook(ctx context.Context, event string, pod *corev1.Pod, session string, sessionErr error) ([]byte, error) {
+	data, err := json.Marshal(pod)
+	if err != nil {
+		return nil, err
+	}
+	// validated in main
+	timeout, _ := time.ParseDuration(hookTimeout)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, hookCommand, event)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Env = append(os.Environ(), "KUBE_PLEX_HOOK_EVENT="+event, "KUBE_PLEX_SESSION="+session)
+	if sessionErr != nil {
+		cmd.Env = append(cmd.Env, "KUBE_PLEX_ERROR="+sessionErr.Error())
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("%s hook: %w: %s", event, err, msg)
+		}
+		return nil, fmt.Errorf("%s hook: %w", event, err)
+	}
+	return out, nil
+}
+
+// mutatePod passes the pod to the hook before it's created, replacing it with
+// the pod, in JSON or YAML, the hook prints. Hooks printing nothing leave it
+// unchanged.
+func mutatePod(ctx context.Context, pod *corev1.Pod, session string) (*corev1.Pod, error) {
+	out, err := runHook(ctx, hookMutate, pod, session, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(bytes.TrimSpace(out)) == 0 {
+		return pod, nil
+	}
+	var mutated corev1.Pod
+	if err := yaml.UnmarshalStrict(out, &mutated); err != nil {
+		return nil, fmt.Errorf("%s hook printed an invalid pod: %w", hookMutate, err)
+	}
+	if len(mutated.Spec.Containers) == 0 {
+		return nil, fmt.Errorf("%s hook printed a pod without containers", hookMutate)
+	}
+	return &mutated, nil
+}
+
+// notifyHook runs the hook at a lifecycle event of the session, with the
+// sensitive values of the pod redacted
+func notifyHook(ctx context.Context, event string, pod *corev1.Pod, session string, sessionErr error) {
+	if _, err := runHook(ctx, event, sanitizePod(pod), session, sessionErr); err != nil {
+		log.Printf("warning: %s", err)
+	}
+}
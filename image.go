@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// transcodeImage returns the image transcode pods run, a dedicated
+// transcoder image when configured and the PMS image otherwise
+func transcodeImage() string {
+	if transcoderImage != "" {
+		return transcoderImage
+	}
+	return pmsImage
+}
+
+// imagePullSecrets returns the references to the Secrets in
+// IMAGE_PULL_SECRETS
+func imagePullSecrets() []corev1.LocalObjectReference {
+	var refs []corev1.LocalObjectReference
+	for _, name := range strings.Split(imagePullSecretNames, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			refs = append(refs, corev1.LocalObjectReference{Name: name})
+		}
+	}
+	return refs
+}
+
+// validateImagePullPolicy checks IMAGE_PULL_POLICY is a policy Kubernetes
+// knows
+func validateImagePullPolicy() error {
+	switch corev1.PullPolicy(imagePullPolicy) {
+	case "", corev1.PullAlways, corev1.PullIfNotPresent, corev1.PullNever:
+		return nil
+	}
+	return fmt.Errorf("unknown image pull policy %q, expected %s, %s or %s", imagePullPolicy, corev1.PullAlways, corev1.PullIfNotPresent, corev1.PullNever)
+}
+
+// setImagePullPolicy sets IMAGE_PULL_POLICY on every container of the pod
+func setImagePullPolicy(pod *corev1.Pod) {
+	if imagePullPolicy == "" {
+		return
+	}
+	for i := range pod.Spec.InitContainers {
+		pod.Spec.InitContainers[i].ImagePullPolicy = corev1.PullPolicy(imagePullPolicy)
+	}
+	for i := range pod.Spec.Containers {
+		pod.Spec.Containers[i].ImagePullPolicy = corev1.PullPolicy(imagePullPolicy)
+	}
+}
+
+// imageTag returns the tag of an image reference, ignoring digests and the
+// port of the registry
+func imageTag(image string) string {
+	image, _, _ = strings.Cut(image, "@")
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		return image[i+1:]
+	}
+	return "latest"
+}
+
+// validateTranscoderImage checks the dedicated transcoder image was built
+// for the same PMS version, the transcoder and PMS talk a private protocol
+// and mismatched versions fail in obscure ways. Images are expected to be
+// tagged with the PMS version, floating tags can't be checked.
+func validateTranscoderImage() error {
+	if transcoderImage == "" || pmsImage == "" {
+		return nil
+	}
+	pmsTag, transcoderTag := imageTag(pmsImage), imageTag(transcoderImage)
+	if pmsTag == "latest" || transcoderTag == "latest" {
+		return nil
+	}
+	// PMS versions look like 1.40.1.8227-c0dd5a73e, transcoder images may
+	// carry a suffix of their own
+	if !strings.HasPrefix(transcoderTag, pmsTag) {
+		return fmt.Errorf("transcoder image %q does not match PMS version %q", transcoderImage, pmsTag)
+	}
+	return nil
+}
+
+// detectPMSImage reads the image of the PMS container from the PMS pod, so
+// transcode pods follow PMS upgrades without PMS_IMAGE being kept in sync
+func detectPMSImage(ctx context.Context, cl kubernetes.Interface, ns string) (string, error) {
+	pod, err := cl.CoreV1().Pods(ns).Get(ctx, pmsPodName, metav1.GetOptions{})
+	if err != nil {
+		return "", fmt.Errorf("unable to get PMS pod %q, set PMS_POD_NAME: %w", pmsPodName, err)
+	}
+	for _, c := range pod.Spec.Containers {
+		if c.Name == pmsContainerName {
+			return c.Image, nil
+		}
+	}
+	return "", fmt.Errorf("PMS pod %q has no container %q, set PMS_CONTAINER_NAME", pmsPodName, pmsContainerName)
+}
+
+// checkPMSVersion compares the version PMS reports with the tag of the image
+// transcode pods run. PMS images may update PMS on start, leaving transcode
+// pods on an older transcoder.
+func checkPMSVersion(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(pmsInternalAddress, "/")+"/identity", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("unable to query PMS version: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var identity struct {
+		Version string `xml:"version,attr"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&identity); err != nil {
+		return fmt.Errorf("unable to parse PMS identity: %w", err)
+	}
+
+	tag := imageTag(transcodeImage())
+	if tag == "latest" || identity.Version == "" {
+		return nil
+	}
+	if !strings.HasPrefix(tag, identity.Version) {
+		return fmt.Errorf("PMS is running version %s but transcode pods run %s", identity.Version, transcodeImage())
+	}
+	return nil
+}
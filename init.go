@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// addInitContainers runs the init containers of INIT_CONTAINERS in the pod
+// before the transcoder, after the one preparing the session directory
+func addInitContainers(pod *corev1.Pod, cwd string, uid, gid *int64) {
+	if prepareTranscodeDir == "true" {
+		addPrepareContainer(pod, cwd, uid, gid)
+	}
+	// validated in main
+	containers, _ := parseContainers(initContainers)
+	pod.Spec.InitContainers = append(pod.Spec.InitContainers, containers...)
+}
+
+// addPrepareContainer creates the session directory on the transcode volume
+// before the transcoder starts, owned by the user and group the transcoder
+// runs as or else writable by anyone, so it can write its segments whatever
+// the ownership of the volume
+func addPrepareContainer(pod *corev1.Pod, cwd string, uid, gid *int64) {
+	transcoder := pod.Spec.Containers[0]
+	var mounts []corev1.VolumeMount
+	for _, m := range transcoder.VolumeMounts {
+		if m.Name == "transcode" {
+			mounts = append(mounts, m)
+		}
+	}
+
+	script := `mkdir -p "$0" && chmod 0777 "$0"`
+	var owner string
+	switch {
+	case uid != nil && gid != nil:
+		owner = fmt.Sprintf("%d:%d", *uid, *gid)
+	case uid != nil:
+		owner = fmt.Sprint(*uid)
+	case gid != nil:
+		owner = fmt.Sprintf(":%d", *gid)
+	}
+	if owner != "" {
+		script = `mkdir -p "$0" && chown "$1" "$0" && chmod 0775 "$0"`
+	}
+	root := int64(0)
+	pod.Spec.InitContainers = append([]corev1.Container{{
+		Name:         "prepare",
+		Image:        transcoder.Image,
+		Command:      []string{"/bin/sh", "-c", script, cwd, owner},
+		VolumeMounts: mounts,
+		SecurityContext: &corev1.SecurityContext{
+			RunAsUser:  &root,
+			RunAsGroup: &root,
+		},
+	}}, pod.Spec.InitContainers...)
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/yaml"
+)
+
+type installOptions struct {
+	kubeconfig string
+	namespace  string
+	name       string
+	apply      bool
+
+	// restrict the egress of transcode pods to the PMS pods, selected by
+	// pmsSelector, DNS and the comma separated egressCIDRs
+	networkPolicy bool
+	pmsSelector   string
+	egressCIDRs   string
+
+	// kube-plex configuration stored in the generated ConfigMap
+	config map[string]*string
+}
+
+// runInstall generates the ServiceAccount, RBAC and configuration needed by
+// kube-plex in a namespace, printing them as YAML or applying them directly
+func runInstall(args []string) error {
+	opts := installOptions{config: map[string]*string{}}
+
+	fs := flag.NewFlagSet("install", flag.ContinueOnError)
+	fs.StringVar(&opts.kubeconfig, "kubeconfig", "", "path to the kubeconfig file, only used with -apply")
+	fs.StringVar(&opts.namespace, "namespace", "", "namespace the transcode pods run in (defaults to the kubeconfig namespace)")
+	fs.StringVar(&opts.name, "name", "kube-plex", "name of the generated resources")
+	fs.BoolVar(&opts.apply, "apply", false, "create or update the resources in the cluster instead of printing them")
+	fs.BoolVar(&opts.networkPolicy, "network-policy", false, "generate a NetworkPolicy only letting transcode pods reach PMS and DNS")
+	fs.StringVar(&opts.pmsSelector, "pms-selector", "app=plex", "label selector of the PMS pods transcode pods may reach, with -network-policy")
+	fs.StringVar(&opts.egressCIDRs, "egress-cidr", "", "comma separated CIDRs transcode pods may also reach with -network-policy, e.g. those of the S3 endpoint, webhooks or remote media")
+	for flagName, key := range map[string]string{
+		"data-pvc":             "DATA_PVC",
+		"config-pvc":           "CONFIG_PVC",
+		"transcode-pvc":        "TRANSCODE_PVC",
+		"pms-image":            "PMS_IMAGE",
+		"pms-internal-address": "PMS_INTERNAL_ADDRESS",
+	} {
+		opts.config[key] = fs.String(flagName, "", fmt.Sprintf("value of %s in the generated ConfigMap", key))
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if opts.networkPolicy && segmentRelay == "s3" && opts.egressCIDRs == "" {
+		return fmt.Errorf("-network-policy blocks the s3 segment relay, allow the S3 endpoint with -egress-cidr")
+	}
+
+	var cl kubernetes.Interface
+	if opts.apply || opts.namespace == "" {
+		var ns string
+		var err error
+		cl, ns, err = buildCommandClient(opts.kubeconfig)
+		if err != nil {
+			return err
+		}
+		if opts.namespace == "" {
+			opts.namespace = ns
+		}
+	}
+
+	objects, err := generateInstallManifests(opts)
+	if err != nil {
+		return err
+	}
+	if !opts.apply {
+		return printManifests(objects)
+	}
+	return applyManifests(context.Background(), cl, objects)
+}
+
+func generateInstallManifests(opts installOptions) ([]runtime.Object, error) {
+	meta := metav1.ObjectMeta{
+		Name:      opts.name,
+		Namespace: opts.namespace,
+		Labels: map[string]string{
+			"app": opts.name,
+		},
+	}
+
+	data := map[string]string{
+		"KUBE_NAMESPACE": opts.namespace,
+	}
+	for key, value := range opts.config {
+		if *value != "" {
+			data[key] = *value
+		}
+	}
+
+	objects := []runtime.Object{
+		&corev1.ServiceAccount{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "ServiceAccount"},
+			ObjectMeta: meta,
+		},
+		&rbacv1.Role{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "rbac.authorization.k8s.io/v1", Kind: "Role"},
+			ObjectMeta: meta,
+			Rules: []rbacv1.PolicyRule{
+				{
+					APIGroups: []string{""},
+					Resources: []string{"pods", "pods/log", "pods/exec"},
+					Verbs:     []string{"create", "delete", "get", "list", "patch", "update", "watch"},
+				},
+				{
+					APIGroups: []string{"policy"},
+					Resources: []string{"poddisruptionbudgets"},
+					Verbs:     []string{"create", "delete", "get"},
+				},
+				{
+					APIGroups: []string{"batch"},
+					Resources: []string{"jobs"},
+					Verbs:     []string{"create", "delete", "get", "list", "patch", "watch"},
+				},
+				{
+					APIGroups: []string{"apps"},
+					Resources: []string{"daemonsets"},
+					Verbs:     []string{"create", "get", "update"},
+				},
+				{
+					APIGroups: []string{""},
+					Resources: []string{"configmaps"},
+					Verbs:     []string{"create", "get", "update"},
+				},
+				{
+					APIGroups: []string{""},
+					Resources: []string{"secrets"},
+					Verbs:     []string{"create", "delete", "get", "patch"},
+				},
+				{
+					APIGroups: []string{""},
+					Resources: []string{"events"},
+					Verbs:     []string{"create"},
+				},
+				{
+					APIGroups: []string{"coordination.k8s.io"},
+					Resources: []string{"leases"},
+					Verbs:     []string{"create", "delete", "get", "list", "update"},
+				},
+				{
+					APIGroups: []string{"metrics.k8s.io"},
+					Resources: []string{"pods"},
+					Verbs:     []string{"get"},
+				},
+			},
+		},
+		&rbacv1.RoleBinding{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "rbac.authorization.k8s.io/v1", Kind: "RoleBinding"},
+			ObjectMeta: meta,
+			RoleRef: rbacv1.RoleRef{
+				APIGroup: "rbac.authorization.k8s.io",
+				Kind:     "Role",
+				Name:     opts.name,
+			},
+			Subjects: []rbacv1.Subject{
+				{
+					Kind:      "ServiceAccount",
+					Name:      opts.name,
+					Namespace: opts.namespace,
+				},
+			},
+		},
+		&corev1.ConfigMap{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "ConfigMap"},
+			ObjectMeta: meta,
+			Data:       data,
+		},
+	}
+	if opts.networkPolicy {
+		policy, err := generateNetworkPolicy(meta, opts.pmsSelector, opts.egressCIDRs)
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, policy)
+	}
+	return objects, nil
+}
+
+// generateNetworkPolicy only lets transcode pods, which process untrusted
+// media, reach the PMS pods, the cluster DNS and the comma separated
+// egressCIDRs
+func generateNetworkPolicy(meta metav1.ObjectMeta, pmsSelector, egressCIDRs string) (*networkingv1.NetworkPolicy, error) {
+	pms, err := metav1.ParseToLabelSelector(pmsSelector)
+	if err != nil {
+		return nil, fmt.Errorf("invalid PMS selector %q: %w", pmsSelector, err)
+	}
+	var external []networkingv1.NetworkPolicyPeer
+	for _, cidr := range strings.Split(egressCIDRs, ",") {
+		if cidr = strings.TrimSpace(cidr); cidr == "" {
+			continue
+		}
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return nil, fmt.Errorf("invalid egress CIDR %q: %w", cidr, err)
+		}
+		external = append(external, networkingv1.NetworkPolicyPeer{
+			IPBlock: &networkingv1.IPBlock{CIDR: cidr},
+		})
+	}
+	meta = *meta.DeepCopy()
+	meta.Name += "-transcode"
+	udp, tcp := corev1.ProtocolUDP, corev1.ProtocolTCP
+	dns := intstr.FromInt32(53)
+	policy := &networkingv1.NetworkPolicy{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "networking.k8s.io/v1", Kind: "NetworkPolicy"},
+		ObjectMeta: meta,
+		Spec: networkingv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{
+				MatchLabels: map[string]string{managedByLabel: managedByValue},
+			},
+			PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeEgress},
+			Egress: []networkingv1.NetworkPolicyEgressRule{
+				{
+					// progress reports, segments and the segment relay
+					To: []networkingv1.NetworkPolicyPeer{{PodSelector: pms}},
+				},
+				{
+					To: []networkingv1.NetworkPolicyPeer{{
+						NamespaceSelector: &metav1.LabelSelector{},
+						PodSelector: &metav1.LabelSelector{
+							MatchLabels: map[string]string{"k8s-app": "kube-dns"},
+						},
+					}},
+					Ports: []networkingv1.NetworkPolicyPort{
+						{Protocol: &udp, Port: &dns},
+						{Protocol: &tcp, Port: &dns},
+					},
+				},
+			},
+		},
+	}
+	if len(external) > 0 {
+		// the S3 segment relay, webhooks and remote media
+		policy.Spec.Egress = append(policy.Spec.Egress, networkingv1.NetworkPolicyEgressRule{To: external})
+	}
+	return policy, nil
+}
+
+func printManifests(objects []runtime.Object) error {
+	for _, obj := range objects {
+		out, err := yaml.Marshal(obj)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stdout, "---\n%s", out)
+	}
+	return nil
+}
+
+// applyManifests creates every object, updating the ones that already exist
+func applyManifests(ctx context.Context, cl kubernetes.Interface, objects []runtime.Object) error {
+	for _, obj := range objects {
+		var err error
+		switch o := obj.(type) {
+		case *corev1.ServiceAccount:
+			_, err = cl.CoreV1().ServiceAccounts(o.Namespace).Create(ctx, o, metav1.CreateOptions{})
+			if apierrors.IsAlreadyExists(err) {
+				_, err = cl.CoreV1().ServiceAccounts(o.Namespace).Update(ctx, o, metav1.UpdateOptions{})
+			}
+		case *rbacv1.Role:
+			_, err = cl.RbacV1().Roles(o.Namespace).Create(ctx, o, metav1.CreateOptions{})
+			if apierrors.IsAlreadyExists(err) {
+				_, err = cl.RbacV1().Roles(o.Namespace).Update(ctx, o, metav1.UpdateOptions{})
+			}
+		case *rbacv1.RoleBinding:
+			_, err = cl.RbacV1().RoleBindings(o.Namespace).Create(ctx, o, metav1.CreateOptions{})
+			if apierrors.IsAlreadyExists(err) {
+				_, err = cl.RbacV1().RoleBindings(o.Namespace).Update(ctx, o, metav1.UpdateOptions{})
+			}
+		case *corev1.ConfigMap:
+			_, err = cl.CoreV1().ConfigMaps(o.Namespace).Create(ctx, o, metav1.CreateOptions{})
+			if apierrors.IsAlreadyExists(err) {
+				_, err = cl.CoreV1().ConfigMaps(o.Namespace).Update(ctx, o, metav1.UpdateOptions{})
+			}
+		case *networkingv1.NetworkPolicy:
+			_, err = cl.NetworkingV1().NetworkPolicies(o.Namespace).Create(ctx, o, metav1.CreateOptions{})
+			if apierrors.IsAlreadyExists(err) {
+				_, err = cl.NetworkingV1().NetworkPolicies(o.Namespace).Update(ctx, o, metav1.UpdateOptions{})
+			}
+		default:
+			err = fmt.Errorf("unsupported object %T", obj)
+		}
+		if err != nil {
+			return fmt.Errorf("error applying %s: %w", obj.GetObjectKind().GroupVersionKind().Kind, err)
+		}
+		fmt.Fprintf(os.Stdout, "applied %s %s\n", obj.GetObjectKind().GroupVersionKind().Kind, obj.(metav1.Object).GetName())
+	}
+	return nil
+}
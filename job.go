@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/lrascao/kube-plex/pkg/ffmpeg"
+)
+
+const (
+	// job classes, sessions serving a stream to a client and background
+	// optimize or sync conversions
+	jobClassStreaming  = "streaming"
+	jobClassBackground = "background"
+)
+
+// jobClass returns the class of the transcoder invocation
+func jobClass(args []string) string {
+	if ffmpeg.Parse(args).Background() {
+		return jobClassBackground
+	}
+	return jobClassStreaming
+}
+
+// restartPolicyFor returns the restart policy of transcode pods of the given
+// class, RESTART_POLICY_<CLASS> takes precedence over RESTART_POLICY
+func restartPolicyFor(class string) corev1.RestartPolicy {
+	policy := restartPolicy
+	switch class {
+	case jobClassStreaming:
+		if restartPolicyStreaming != "" {
+			policy = restartPolicyStreaming
+		}
+	case jobClassBackground:
+		if restartPolicyBackground != "" {
+			policy = restartPolicyBackground
+		}
+	}
+	return corev1.RestartPolicy(policy)
+}
+
+// validateRestartPolicy checks a RESTART_POLICY setting, transcode pods
+// complete so they can't restart Always
+func validateRestartPolicy(policy string) error {
+	switch corev1.RestartPolicy(policy) {
+	case "", corev1.RestartPolicyNever, corev1.RestartPolicyOnFailure:
+		return nil
+	}
+	return fmt.Errorf("unknown restart policy %q, expected %s or %s", policy, corev1.RestartPolicyNever, corev1.RestartPolicyOnFailure)
+}
+
+// priorityClassFor returns the priority class of transcode pods of the
+// invocation. Live TV sessions use PRIORITY_CLASS_LIVE, then
+// PRIORITY_CLASS_<CLASS> takes precedence over PRIORITY_CLASS.
+func priorityClassFor(inv ffmpeg.Invocation) string {
+	if inv.LiveTV && priorityClassLive != "" {
+		return priorityClassLive
+	}
+	switch {
+	case inv.Background() && priorityClassBackground != "":
+		return priorityClassBackground
+	case !inv.Background() && priorityClassStreaming != "":
+		return priorityClassStreaming
+	}
+	return priorityClass
+}
+
+// useJob reports whether sessions of the given class run as Jobs,
+// JOB_MODE_<CLASS> takes precedence over JOB_MODE
+func useJob(class string) bool {
+	mode := jobMode
+	switch class {
+	case jobClassStreaming:
+		if jobModeStreaming != "" {
+			mode = jobModeStreaming
+		}
+	case jobClassBackground:
+		if jobModeBackground != "" {
+			mode = jobModeBackground
+		}
+	}
+	return mode == "true"
+}
+
+// generateJob wraps the transcode pod in a Job that retries up to
+// backoffLimit times. With the Never restart policy a pod failure policy
+// ignores pods disrupted by the cluster (preemption, eviction, node drain),
+// so they're recreated without counting towards the limit, while transcoder
+// errors fail the Job right away.
+func generateJob(pod *corev1.Pod, backoffLimit int32) *batchv1.Job {
+	job := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: pod.GenerateName,
+			Namespace:    pod.Namespace,
+			Labels:       pod.Labels,
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit:          &backoffLimit,
+			ActiveDeadlineSeconds: pod.Spec.ActiveDeadlineSeconds,
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels:      pod.Labels,
+					Annotations: pod.Annotations,
+				},
+				Spec: pod.Spec,
+			},
+		},
+	}
+
+	if pod.Spec.RestartPolicy == corev1.RestartPolicyNever {
+		job.Spec.PodFailurePolicy = &batchv1.PodFailurePolicy{
+			Rules: []batchv1.PodFailurePolicyRule{
+				{
+					Action: batchv1.PodFailurePolicyActionIgnore,
+					OnPodConditions: []batchv1.PodFailurePolicyOnPodConditionsPattern{
+						{Type: corev1.DisruptionTarget, Status: corev1.ConditionTrue},
+					},
+				},
+				{
+					Action: batchv1.PodFailurePolicyActionFailJob,
+					OnExitCodes: &batchv1.PodFailurePolicyOnExitCodesRequirement{
+						ContainerName: &pod.Spec.Containers[0].Name,
+						Operator:      batchv1.PodFailurePolicyOnExitCodesOpNotIn,
+						Values:        []int32{0},
+					},
+				},
+			},
+		}
+	}
+	return job
+}
+
+// waitForJobPod returns the pod created by the Job once it exists
+func waitForJobPod(ctx context.Context, cl kubernetes.Interface, job *batchv1.Job) (*corev1.Pod, error) {
+	for {
+		pods, err := cl.CoreV1().Pods(job.Namespace).List(ctx, metav1.ListOptions{
+			LabelSelector: "job-name=" + job.Name,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if len(pods.Items) > 0 {
+			return &pods.Items[0], nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("context cancelled")
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func waitForJobCompletion(ctx context.Context, cl kubernetes.Interface, job *batchv1.Job, pollInterval time.Duration) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("context cancelled")
+		case <-time.After(pollInterval):
+			job, err := cl.BatchV1().Jobs(job.Namespace).Get(ctx, job.Name, metav1.GetOptions{})
+			if err != nil {
+				return err
+			}
+			for _, cond := range job.Status.Conditions {
+				if cond.Status != corev1.ConditionTrue {
+					continue
+				}
+				switch cond.Type {
+				case batchv1.JobComplete:
+					return nil
+				case batchv1.JobFailed:
+					return jobFailure(ctx, cl, job, cond)
+				}
+			}
+		}
+	}
+}
+
+// jobFailure returns the error of the failed pod of the Job, falling back to
+// the condition that failed it
+func jobFailure(ctx context.Context, cl kubernetes.Interface, job *batchv1.Job, cond batchv1.JobCondition) error {
+	pods, err := cl.CoreV1().Pods(job.Namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: "job-name=" + job.Name,
+	})
+	if err == nil {
+		for i := range pods.Items {
+			if result, done := podStatusResult(&pods.Items[i]); done && result.outcome != podSucceeded {
+				return result.err()
+			}
+		}
+	}
+	return fmt.Errorf("job %q failed: %s: %s", job.Name, cond.Reason, cond.Message)
+}
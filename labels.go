@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// schemaLabel records the version of the labels kube-plex set on a pod,
+	// so later versions can tell how to migrate them
+	schemaLabel   = "kube-plex/schema"
+	schemaVersion = "2"
+
+	// legacyPodPrefix is the only thing identifying pods created before
+	// kube-plex labelled them
+	legacyPodPrefix = "pms-elastic-transcoder-"
+)
+
+// managedPodSelector selects the transcode pods with current labels
+func managedPodSelector() string {
+	return managedByLabel + "=" + managedByValue
+}
+
+// legacyPodOptions narrows the pods of previous kube-plex versions down to
+// the unlabelled pods that never restart, the rest is told by their name
+func legacyPodOptions() metav1.ListOptions {
+	return metav1.ListOptions{
+		LabelSelector: "!" + managedByLabel,
+		FieldSelector: "spec.restartPolicy=" + string(corev1.RestartPolicyNever),
+	}
+}
+
+// isLegacyPod reports whether the pod was created by a kube-plex version
+// that didn't label its pods
+func isLegacyPod(pod *corev1.Pod) bool {
+	return pod.Labels[managedByLabel] == "" && strings.HasPrefix(pod.Name, legacyPodPrefix)
+}
+
+// listManagedPods returns the transcode pods in the namespace. While label
+// compatibility is on, pods of previous kube-plex versions are included so
+// upgrades don't orphan the sessions they're running.
+func listManagedPods(ctx context.Context, cl kubernetes.Interface, ns string) ([]corev1.Pod, error) {
+	pods, err := cl.CoreV1().Pods(ns).List(ctx, metav1.ListOptions{LabelSelector: managedPodSelector()})
+	if err != nil {
+		return nil, err
+	}
+	out := pods.Items
+	if labelCompat == "false" {
+		return out, nil
+	}
+	legacy, err := cl.CoreV1().Pods(ns).List(ctx, legacyPodOptions())
+	if err != nil {
+		return nil, err
+	}
+	for _, pod := range legacy.Items {
+		if isLegacyPod(&pod) {
+			out = append(out, pod)
+		}
+	}
+	return out, nil
+}
+
+// migrateLegacyPods adds the current labels to the pods of previous
+// kube-plex versions, after which they're found by label selectors
+func migrateLegacyPods(ctx context.Context, cl kubernetes.Interface, ns string) error {
+	pods, err := listManagedPods(ctx, cl, ns)
+	if err != nil {
+		return err
+	}
+	for i := range pods {
+		pod := &pods[i]
+		if !isLegacyPod(pod) && pod.Labels[schemaLabel] == schemaVersion {
+			continue
+		}
+		patch, err := json.Marshal(map[string]interface{}{
+			"metadata": map[string]interface{}{
+				"labels": map[string]string{
+					managedByLabel: managedByValue,
+					schemaLabel:    schemaVersion,
+				},
+			},
+		})
+		if err != nil {
+			return err
+		}
+		if _, err := cl.CoreV1().Pods(ns).Patch(ctx, pod.Name, types.StrategicMergePatchType, patch, metav1.PatchOptions{}); err != nil {
+			return err
+		}
+		log.Printf("migrated labels of pod %s to schema %s", pod.Name, schemaVersion)
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	ktesting "k8s.io/client-go/testing"
+)
+
+func TestListManagedPods(t *testing.T) {
+	defer func(old string) { labelCompat = old }(labelCompat)
+
+	legacy := testPod(legacyPodPrefix+"abcde", nil, corev1.PodRunning)
+	legacy.Spec.RestartPolicy = corev1.RestartPolicyNever
+	unrelated := testPod("plex-0", map[string]string{"app": "plex"}, corev1.PodRunning)
+	unrelated.Spec.RestartPolicy = corev1.RestartPolicyAlways
+
+	tests := []struct {
+		name   string
+		compat string
+		want   []string
+	}{
+		{name: "compatibility on", compat: "true", want: []string{"a", legacy.Name}},
+		{name: "compatibility off", compat: "false", want: []string{"a"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			labelCompat = tt.compat
+			cl := fake.NewSimpleClientset(testPod("a", transcodeLabels(nil), corev1.PodRunning), legacy, unrelated)
+			pods, err := listManagedPods(context.Background(), cl, "plex")
+			if err != nil {
+				t.Fatalf("listManagedPods() error = %s", err)
+			}
+			var names []string
+			for _, pod := range pods {
+				names = append(names, pod.Name)
+			}
+			sort.Strings(names)
+			if strings.Join(names, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("listManagedPods() = %v, want %v", names, tt.want)
+			}
+			for _, action := range cl.Actions() {
+				if list, ok := action.(ktesting.ListAction); ok && list.GetListRestrictions().Labels.Empty() {
+					t.Errorf("listed every pod in the namespace")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+// leader election timings, those of the Kubernetes controllers
+const (
+	leaseDuration = 15 * time.Second
+	renewDeadline = 10 * time.Second
+	retryPeriod   = 2 * time.Second
+)
+
+// runLeaderElected runs reconcile while the controller holds the Lease, so
+// only one of several replicas manages pods while the others stand by.
+// Losing the Lease is an error, the controller is restarted to stand by
+// rather than risk reconciling alongside the new leader.
+func runLeaderElected(ctx context.Context, cl kubernetes.Interface, ns, name string, health *healthServer, reconcile func(ctx context.Context)) error {
+	host, err := os.Hostname()
+	if err != nil {
+		return fmt.Errorf("error getting hostname: %w", err)
+	}
+	identity := host + "_" + string(uuid.NewUUID())
+
+	health.standBy(true)
+	leaderelection.RunOrDie(ctx, leaderelection.LeaderElectionConfig{
+		Lock: &resourcelock.LeaseLock{
+			LeaseMeta:  metav1.ObjectMeta{Name: name, Namespace: ns},
+			Client:     cl.CoordinationV1(),
+			LockConfig: resourcelock.ResourceLockConfig{Identity: identity},
+		},
+		LeaseDuration:   leaseDuration,
+		RenewDeadline:   renewDeadline,
+		RetryPeriod:     retryPeriod,
+		ReleaseOnCancel: true,
+		Name:            name,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				log.Printf("became the leader, reconciling")
+				health.standBy(false)
+				reconcile(ctx)
+			},
+			OnStoppedLeading: func() {
+				health.standBy(true)
+			},
+			OnNewLeader: func(leader string) {
+				if leader != identity {
+					log.Printf("%s is the leader, standing by", leader)
+				}
+			},
+		},
+	})
+	if ctx.Err() == nil {
+		return fmt.Errorf("lost the %s Lease", name)
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"log"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// reportLeaks cancels the session context and logs the goroutines started by
+// kube-plex that are still running once they were given a moment to return.
+// Goroutines owned by client-go and the runtime are ignored.
+func reportLeaks(cancel context.CancelFunc) {
+	cancel()
+
+	var leaked []string
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+		leaked = leakedGoroutines()
+		if len(leaked) == 0 {
+			return
+		}
+	}
+	log.Printf("leak check: %d goroutines still running\n%s", len(leaked), strings.Join(leaked, "\n\n"))
+}
+
+func leakedGoroutines() []string {
+	buf := make([]byte, 1<<20)
+	buf = buf[:runtime.Stack(buf, true)]
+
+	var leaked []string
+	for _, g := range strings.Split(string(buf), "\n\n") {
+		// the main goroutine is the one checking
+		if strings.Contains(g, "main.main()") {
+			continue
+		}
+		if strings.Contains(g, "main.") {
+			leaked = append(leaked, g)
+		}
+	}
+	return leaked
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/lrascao/kube-plex/pkg/ffmpeg"
+)
+
+// parseLiveTVNodeSelector parses the comma separated key=value labels of
+// LIVE_TV_NODE_SELECTOR
+func parseLiveTVNodeSelector() (map[string]string, error) {
+	if liveTVNodeSelector == "" {
+		return nil, nil
+	}
+	selector := map[string]string{}
+	for _, entry := range strings.Split(liveTVNodeSelector, ",") {
+		k, v, ok := strings.Cut(entry, "=")
+		if k = strings.TrimSpace(k); !ok || k == "" {
+			return nil, fmt.Errorf("invalid node label %q, expected key=value", entry)
+		}
+		selector[k] = strings.TrimSpace(v)
+	}
+	return selector, nil
+}
+
+// validateLiveTVQueueSize checks LIVE_TV_THREAD_QUEUE_SIZE is a positive
+// number of packets
+func validateLiveTVQueueSize() error {
+	if liveTVThreadQueueSize == "" {
+		return nil
+	}
+	if n, err := strconv.Atoi(liveTVThreadQueueSize); err != nil || n <= 0 {
+		return fmt.Errorf("%q is not a positive number of packets", liveTVThreadQueueSize)
+	}
+	return nil
+}
+
+// liveTVArgs gives the tuner inputs of live TV and DVR sessions the larger
+// input packet queue of LIVE_TV_THREAD_QUEUE_SIZE, so bursts of the tuner
+// aren't dropped while the transcoder catches up
+func liveTVArgs(args []string) []string {
+	if liveTVThreadQueueSize == "" || !ffmpeg.Parse(args).LiveTV {
+		return args
+	}
+	out := make([]string, 0, len(args)+2)
+	for i, v := range args {
+		isLiveInput := v == "-i" && i+1 < len(args) && strings.Contains(args[i+1], "/livetv/")
+		// input options apply to the next -i
+		hasQueueSize := i >= 2 && args[i-2] == "-thread_queue_size"
+		if isLiveInput && !hasQueueSize {
+			out = append(out, "-thread_queue_size", liveTVThreadQueueSize)
+		}
+		out = append(out, v)
+	}
+	return out
+}
+
+// applyLiveTVProfile places live TV and DVR sessions, which run for as long
+// as the channel is watched or the recording lasts, on the nodes of
+// LIVE_TV_NODE_SELECTOR and lifts MAX_TRANSCODE_DURATION off them. Their
+// priority class is PRIORITY_CLASS_LIVE.
+func applyLiveTVProfile(pod *corev1.Pod, inv ffmpeg.Invocation) {
+	if !inv.LiveTV {
+		return
+	}
+	pod.Spec.ActiveDeadlineSeconds = nil
+	// validated in main
+	selector, _ := parseLiveTVNodeSelector()
+	if len(selector) > 0 && pod.Spec.NodeSelector == nil {
+		pod.Spec.NodeSelector = map[string]string{}
+	}
+	for k, v := range selector {
+		pod.Spec.NodeSelector[k] = v
+	}
+}
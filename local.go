@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// runLocal runs the original Plex Transcoder on the PMS host with the
+// unmodified arguments, returning its exit code. The transcoder is asked to
+// exit when PMS stops the session, and killed when it didn't after
+// STOP_GRACE_PERIOD.
+func runLocal(args []string, stopCh <-chan struct{}) (int, error) {
+	cmd := exec.Command(localTranscoder, args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Start(); err != nil {
+		return 1, err
+	}
+	exited := make(chan struct{})
+	go func() {
+		select {
+		case <-stopCh:
+			log.Printf("exit requested.")
+			stopLocal(cmd.Process, exited)
+		case <-exited:
+		}
+	}()
+	err := cmd.Wait()
+	close(exited)
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode(), nil
+	}
+	if err != nil {
+		return 1, err
+	}
+	return 0, nil
+}
+
+// stopLocal sends SIGTERM to the local transcoder, and SIGKILL when it
+// didn't exit after STOP_GRACE_PERIOD
+func stopLocal(p *os.Process, exited <-chan struct{}) {
+	if err := p.Signal(syscall.SIGTERM); err != nil {
+		if !errors.Is(err, os.ErrProcessDone) {
+			log.Printf("warning: unable to stop local transcoder: %s", err)
+		}
+		return
+	}
+	// validated in main
+	grace, _ := time.ParseDuration(stopGracePeriod)
+	select {
+	case <-exited:
+	case <-time.After(grace):
+		log.Printf("local transcoder didn't exit after %s, killing it", grace)
+		if err := p.Kill(); err != nil && !errors.Is(err, os.ErrProcessDone) {
+			log.Printf("warning: unable to kill local transcoder: %s", err)
+		}
+	}
+}
+
+// transcodeLocally runs the session on the PMS host and exits with the exit
+// code of the transcoder
+func transcodeLocally(args []string, stopCh <-chan struct{}) {
+	code, err := runLocal(args, stopCh)
+	if err != nil {
+		log.Fatalf("Error running local transcoder: %s", err)
+	}
+	os.Exit(code)
+}
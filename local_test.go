@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRunLocalStopped(t *testing.T) {
+	defer func(transcoder, grace string) { localTranscoder, stopGracePeriod = transcoder, grace }(localTranscoder, stopGracePeriod)
+	localTranscoder, stopGracePeriod = "/bin/sh", "200ms"
+
+	tests := []struct {
+		name   string
+		script string
+	}{
+		{"exits on SIGTERM", "exec sleep 30"},
+		{"ignores SIGTERM", "trap '' TERM; exec sleep 30"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stopCh := make(chan struct{})
+			time.AfterFunc(100*time.Millisecond, func() { close(stopCh) })
+			start := time.Now()
+			code, err := runLocal([]string{"Plex Transcoder", "-c", tt.script}, stopCh)
+			if err != nil {
+				t.Fatalf("runLocal() error = %s", err)
+			}
+			if code == 0 {
+				t.Errorf("runLocal() = 0, want the exit code of a stopped transcoder")
+			}
+			if d := time.Since(start); d > 5*time.Second {
+				t.Errorf("runLocal() returned after %s, the transcoder wasn't stopped", d)
+			}
+		})
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// openTranscoderLog opens the file remote transcoder output is appended to
+func openTranscoderLog(pod *corev1.Pod) (*os.File, error) {
+	f, err := os.OpenFile(transcoderLog, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(f, "%s kube-plex: transcoder output of pod %s/%s\n", time.Now().Format(time.RFC3339), pod.Namespace, pod.Name)
+	return f, nil
+}
+
+// forwardLogs returns a function appending the output of the transcoder
+// running in the pod to f, so it's part of the logs PMS collects. Once the
+// output was partially copied, later calls resume from where it broke.
+func forwardLogs(cl kubernetes.Interface, pod *corev1.Pod, f io.Writer) func(ctx context.Context) error {
+	var since *metav1.Time
+	return func(ctx context.Context) error {
+		req := cl.CoreV1().Pods(pod.Namespace).GetLogs(pod.Name, &corev1.PodLogOptions{
+			Container: pod.Spec.Containers[0].Name,
+			Follow:    true,
+			SinceTime: since,
+		})
+		logsReader, err := req.Stream(ctx)
+		if err != nil {
+			return err
+		}
+		defer logsReader.Close()
+
+		_, err = io.Copy(f, logsReader)
+		if err != nil {
+			since = &metav1.Time{Time: time.Now()}
+		}
+		return err
+	}
+}
@@ -2,9 +2,10 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"io"
 	"log"
+	"net"
 	"os"
 	"strconv"
 	"strings"
@@ -14,43 +15,698 @@ import (
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 
+	"sigs.k8s.io/yaml"
+
+	"github.com/lrascao/kube-plex/pkg/ffmpeg"
+	"github.com/lrascao/kube-plex/pkg/launcher"
+	"github.com/lrascao/kube-plex/pkg/podtemplate"
 	"github.com/lrascao/kube-plex/pkg/signals"
 )
 
 const (
-	constDefaultLimitCPU = "100m"
+	// labels identifying the pods created by kube-plex
+	managedByLabel = "app.kubernetes.io/managed-by"
+	managedByValue = "kube-plex"
+)
+
+const (
+	constDefaultLimitCPU               = "100m"
+	constDefaultPriorityBoostThreshold = "90"
+	constDefaultManifestHistory        = "20"
+	constDefaultUsageSampleInterval    = "15s"
+	constDefaultDistributedMinDuration = "5m"
+	constDefaultS3Region               = "us-east-1"
+	constDefaultKubeAPITimeout         = "30s"
+	constDefaultHookTimeout            = "30s"
+	constDefaultCleanupDelay           = "1h"
+	constDefaultSpreadTopologyKey      = corev1.LabelHostname
+	constDefaultGPUResourceCount       = "1"
+	constDefaultConcurrencyPolicy      = concurrencyPolicyQueue
+	constDefaultLocalTranscoder        = "/tmp/Plex Transcoder"
+	constDefaultExecutionBackend       = backendKubernetes
+	constDefaultSSHTranscoder          = "/usr/lib/plexmediaserver/Plex Transcoder"
+	constDefaultAuditSQLite            = "/usr/lib/plexmediaserver/Plex SQLite"
+	constDefaultPMSContainerName       = "plex"
+	constDefaultRestartPolicy          = string(corev1.RestartPolicyNever)
+	constDefaultJobBackoffLimit        = "3"
+	constDefaultStopGracePeriod        = "10s"
+	constDefaultPodStuckTimeout        = "5m"
+	constDefaultPodStartTimeout        = "10m"
+	constDefaultWaitPollInterval       = "5s"
+	constDefaultPodCreateTimeout       = "1m"
+	constDefaultRecreateLimit          = "3"
+	constDefaultCodecsPath             = "/config/Library/Application Support/Plex Media Server/Codecs"
+	constDefaultTranscodeDir           = "/transcode"
 )
 
 var (
 	// data pvc name
-	dataPVC = os.Getenv("DATA_PVC")
+	dataPVC string
 
 	// config pvc name
-	configPVC = os.Getenv("CONFIG_PVC")
+	configPVC string
 
 	// transcode pvc name
-	transcodePVC = os.Getenv("TRANSCODE_PVC")
+	transcodePVC string
+
+	// nfs:<server>:<path> or hostPath:<path> sources of the data, config
+	// and transcode volumes, used instead of their claims when set
+	dataVolume      string
+	configVolume    string
+	transcodeVolume string
+	// comma separated subPath, subPathExpr, readOnly and mountPropagation
+	// options of the mounts of the data, config and transcode volumes
+	dataMountOptions      string
+	configMountOptions    string
+	transcodeMountOptions string
+	// mount only the session directory of the transcode volume in
+	// transcode pods
+	isolateSessions string
+	// remove the session directory from the transcode volume once the
+	// session ended, after the delay PMS may still serve its segments for
+	// when the transcoder completed
+	cleanupTranscodeDir string
+	cleanupDelay        string
+
+	// free space the transcode volume must have for sessions to start, a
+	// quantity or a percentage of its size, and what to do with sessions
+	// when it doesn't: fail, queue or local
+	minTranscodeFreeSpace string
+	transcodeFullPolicy   string
+
+	// run transcode pods on the nodes the volumes bound to their claims
+	// can be attached to
+	volumeTopology string
+	// prefer scheduling transcode pods on the nodes running the fewest
+	// sessions
+	leastLoadedPlacement string
+	// prefer or require concurrent transcode pods to run in different
+	// topology domains of SPREAD_TOPOLOGY_KEY, nodes by default
+	spreadTranscodes  string
+	spreadTopologyKey string
+
+	// YAML list of sidecar containers mounting media with FUSE, e.g.
+	// rclone, and the path of the volume their mounts are shared through
+	mediaSidecars  string
+	mediaMountPath string
+
+	// YAML list of init containers run in transcode pods before the
+	// transcoder
+	initContainers string
+	// YAML list of sidecar containers run in transcode pods alongside the
+	// transcoder, sharing its volumes
+	sidecarContainers string
+
+	// labels and annotations of transcode pods, as comma separated
+	// key=value pairs or a JSON object
+	podLabels      string
+	podAnnotations string
+	// create the session directory owned by the transcoder user in an init
+	// container running as root
+	prepareTranscodeDir string
+	// path the transcode pvc is mounted at, the transcoder temp directory
+	// set in Plex when unset
+	transcodeDirectory string
+
+	// user and group transcode pods run as, the image default when unset
+	plexUID string
+	plexGID string
 
 	// pms namespace
-	namespace = os.Getenv("KUBE_NAMESPACE")
+	namespace string
 
 	// image for the plexmediaserver container containing the transcoder. This
 	// should be set to the same as the 'master' pms server
-	pmsImage           = os.Getenv("PMS_IMAGE")
-	pmsInternalAddress = os.Getenv("PMS_INTERNAL_ADDRESS")
+	pmsImage           string
+	pmsInternalAddress string
+	// PMS service and pod IP PMS_INTERNAL_ADDRESS is derived from when unset
+	pmsServiceName string
+	podIP          string
+
+	// YAML list of host aliases, DNS policy and YAML DNS config of transcode
+	// pods, so they can resolve PMS_INTERNAL_ADDRESS
+	hostAliases string
+	dnsPolicy   string
+	dnsConfig   string
+
+	// comma separated names of the Secrets used to pull the transcoder
+	// image, and the pull policy of transcode pods
+	imagePullSecretNames string
+	imagePullPolicy      string
+
+	// priority class of transcode pods, and of live TV, streaming and
+	// background sessions
+	priorityClass           string
+	priorityClassLive       string
+	priorityClassStreaming  string
+	priorityClassBackground string
+	// comma separated key=value node labels live TV and DVR sessions are
+	// placed on, and the input packet queue of their tuner streams
+	liveTVNodeSelector    string
+	liveTVThreadQueueSize string
+	// HH:MM-HH:MM window of local time background conversions run in, and
+	// what happens to those started outside of it: defer them until it
+	// opens or run them on spot nodes
+	backgroundWindow string
+	backgroundPolicy string
+
+	// security profile of transcode pods, restricted passes the restricted
+	// Pod Security admission
+	securityProfile string
+
+	// runtime class transcode pods run with, e.g. gvisor or kata to sandbox
+	// the transcoder
+	runtimeClass string
+
+	// service account of transcode pods, whether its token is mounted and
+	// the scheduler placing them
+	transcodeServiceAccount string
+	automountToken          string
+	schedulerName           string
+
+	// optional slim image containing only the transcoder, PMS_IMAGE is used
+	// when unset
+	transcoderImage string
+	// refuse to run remotely when the transcoder image doesn't match the PMS
+	// version instead of just warning
+	transcoderImageStrict string
+
+	// name of the PMS pod and container, used to detect the PMS image when
+	// PMS_IMAGE is unset
+	pmsPodName       string
+	pmsContainerName string
+	// compare the version reported by PMS with the image tag
+	pmsVersionCheck string
 
 	// CPU limit
-	limitCPU = os.Getenv("LIMIT_CPU")
+	limitCPU string
+
+	// size transcode pods from the media parameters of the session with the
+	// YAML list of profiles in RESOURCE_PROFILES, or the default ones
+	resourceSizing   string
+	resourceProfiles string
+
+	// follow the transcoder settings of the Plex UI, read from
+	// Preferences.xml
+	preferencesSync     string
+	plexPreferencesPath string
+
+	// YAML list of rules placing sessions on node pools by their media
+	// parameters
+	routingRules string
+
+	// progress percentage past which background transcodes are protected
+	// from eviction, 0 disables it
+	priorityBoostThreshold string
+
+	// name of the ConfigMap the manifests of created pods are recorded in,
+	// recording is disabled when unset
+	manifestConfigMap string
+	// number of manifests kept in the ConfigMap
+	manifestHistory string
+
+	// label transcode pods with the user and client of the session, looked
+	// up in PMS
+	sessionMetadataLookup string
+
+	// record Events against transcode pods as sessions start and end
+	transcodeEvents string
+
+	// comma separated URLs notified as sessions start and end
+	webhookURLs string
+	// comma separated events notified to the webhooks, all when unset
+	webhookEvents string
+	// executable run with the pod before it's created, to mutate it, and
+	// when the session starts and ends
+	hookCommand string
+	// how long the hook may run
+	hookTimeout string
+
+	// whether progress callbacks to PMS identify the remote node
+	annotateProgress string
+
+	// comma separated names of environment variables not passed to
+	// transcode pods
+	envExclude string
+	// keep the variables Kubernetes injects for services in the
+	// environment of transcode pods
+	serviceLinks string
+
+	// kubeconfig and context of the cluster transcode pods run in, when it's
+	// not the cluster PMS runs in, and their namespace there
+	transcodeKubeconfig string
+	transcodeContext    string
+	transcodeNamespace  string
+	// comma separated contexts of TRANSCODE_KUBECONFIG sessions are tried
+	// in, in order, in-cluster being the cluster PMS runs in
+	transcodeClusterList string
+
+	// relay segments from transcode pods to PMS over HTTP instead of sharing
+	// the transcode PVC, the kube-plex image the relay sidecar runs and the
+	// address transcode pods reach the PMS pod at, POD_IP when unset
+	segmentRelay  string
+	kubePlexImage string
+	relayAddress  string
+
+	// S3 compatible bucket the relay stores segments in when SEGMENT_RELAY
+	// is s3, the shim fetching them from it, and the credentials of both
+	s3Endpoint        string
+	s3Region          string
+	s3Bucket          string
+	s3Prefix          string
+	s3AccessKeyID     string
+	s3SecretAccessKey string
+
+	// rate limit and timeout of the requests to the API server, client-go
+	// defaults to 5 requests per second with bursts of 10
+	kubeAPIQPS     string
+	kubeAPIBurst   string
+	kubeAPITimeout string
+
+	// print the generated pod instead of creating it
+	dryRun string
+	// fake runs sessions against an in-memory cluster instead of the real
+	// one
+	kubePlexMode string
+
+	// where sessions run: kubernetes in transcode pods, local on the PMS
+	// host or ssh on one of SSH_HOSTS
+	executionBackend string
+	// comma separated hosts sessions run on with the ssh backend, e.g.
+	// plex@worker1,plex@worker2
+	sshHosts string
+	// additional ssh options, e.g. -i /config/.ssh/id_ed25519
+	sshOptions string
+	// path of the Plex Transcoder on the SSH hosts
+	sshTranscoder string
+	// keep the pods of failed sessions instead of deleting them, for
+	// debugging
+	keepFailedPods string
+	// directory the logs and manifest of failed pods are copied to for
+	// post-mortem, disabled when unset
+	failureArtifactsDir string
+
+	// maximum number of transcode pods running at once, unlimited when unset
+	maxConcurrentTranscodes string
+	// what to do with sessions over the limit, either queue or local
+	concurrencyPolicy string
+	// maximum number of transcode pods of each Plex user running at once,
+	// unlimited when unset
+	maxTranscodesPerUser string
+	// comma separated user=limit pairs overriding MAX_TRANSCODES_PER_USER
+	userQuotaOverrides string
+	// number of pods background sessions are split across, by time ranges
+	// of their input, and the shortest range worth a pod
+	distributedSegments    string
+	distributedMinDuration string
+	// path the original Plex Transcoder was moved to, used for transcoding
+	// locally
+	localTranscoder string
+
+	// transcode cheap jobs locally instead of paying for a pod
+	localTrivial string
+
+	// ConfigMap holding the maintenance mode switch, while enabled every new
+	// session is transcoded locally
+	maintenanceConfigMap string
+
+	// bearer token of the admin API of the controller
+	adminToken string
+
+	// certificate and key the admin API is served with over TLS, and the CA
+	// client certificates must be signed by, PEM files usually mounted from
+	// a Secret
+	adminTLSCert     string
+	adminTLSKey      string
+	adminTLSClientCA string
+
+	// failures to inject into the session, for testing only
+	faultInjection string
+
+	// whether sessions are exec'd into idle pods kept by the controller
+	transcoderPool string
+
+	// log goroutines still running when the session ends, for soak testing
+	leakCheck string
+
+	// restart policy of transcode pods, optionally per job class
+	restartPolicy           string
+	restartPolicyStreaming  string
+	restartPolicyBackground string
+
+	// run transcodes as Jobs instead of bare pods, optionally per job class
+	jobMode           string
+	jobModeStreaming  string
+	jobModeBackground string
+	// number of retries of a Job
+	jobBackoffLimit string
+
+	// writable Codecs directory of transcode pods, either backed by a shared
+	// claim or copied from the config volume
+	codecsMode string
+	codecsPVC  string
+	codecsPath string
+
+	// amount of each input file read before the transcoder starts, to warm
+	// the network storage cache, disabled when unset
+	cacheWarmupSize string
+
+	// how sessions using EasyAudioEncoder get one, sidecar runs it in the
+	// transcode pod, otherwise the one started by PMS is expected to watch
+	// the shared transcode volume
+	eaeMode string
+	// command starting EasyAudioEncoder in the sidecar
+	eaeCommand string
+
+	// file the output of remote transcoders is appended to, forwarding is
+	// disabled when unset
+	transcoderLog string
+
+	// forward the signals PMS throttles the transcoder with to the pod
+	throttleForwarding string
+
+	// how long the remote transcoder is given to exit when the session is
+	// stopped before its pod is deleted
+	stopGracePeriod string
+	// how long the kubelet gives transcode pods to exit once deleted, and
+	// the shell command run in the transcoder container before
+	terminationGracePeriod string
+	// grace period transcode pods are deleted with when their session ended,
+	// the one of the pod when unset
+	deleteGracePeriod string
+	// how long deleted transcode pods may be terminating before they're
+	// deleted without a grace period, never when unset
+	forceDelete string
+	// longest a transcode pod may run before it's killed, unlimited when
+	// unset
+	maxTranscodeDuration string
+	preStopCommand       string
+
+	// labels of the dedicated node pool transcode pods run on, and the taint
+	// keeping other pods off it
+	nodePoolSelector string
+	nodePoolTaint    string
+	// whether node autoscalers may evict running transcode pods to scale
+	// their node down
+	safeToEvict string
+	// run transcode pods on spot nodes, either prefer or require, the node
+	// label selecting them and their taint
+	spotNodes        string
+	spotNodeSelector string
+	spotToleration   string
+	// prefer or require running transcode pods on nodes with the
+	// capabilities their session needs, and the comma separated
+	// capability:key=value node labels overriding the Node Feature Discovery
+	// ones
+	capabilityPlacement  string
+	nodeCapabilityLabels string
+	// extended resource hardware transcodes request and how much of it, a
+	// whole GPU or a time-sliced, MPS or MIG share of one
+	gpuResource      string
+	gpuResourceCount string
+	// detect hardware transcodes from their arguments and give them the
+	// device, runtime class and nodes of their GPU vendor
+	hwaccelAuto string
+	// resume disrupted streaming sessions from the segments they already
+	// wrote instead of restarting them
+	resumeDisrupted string
+	// reattach to the running pod of a session when the shim is restarted
+	// or invoked again with the same arguments instead of creating another
+	adoptSessions string
+
+	// how long a pod may be stuck unschedulable, pulling its image or
+	// creating its containers before the session fails
+	podStuckTimeout string
+	// how long the transcoder may take to start for any reason
+	podStartTimeout string
+	// how long a pod may be unschedulable while a node pool scales up,
+	// POD_STUCK_TIMEOUT applies when unset
+	scaleUpTimeout string
+	// how often the status of the transcode pod or job is read
+	waitPollInterval string
+	// number of times disrupted transcode pods are recreated
+	recreateLimit string
+	// how long transient errors creating the transcode pod are retried for
+	podCreateTimeout string
+	// transcode locally when the transcode pod couldn't be created or start
+	localFallback string
+
+	// ConfigMap holding the cluster wide admission policy
+	admissionPolicyConfigMap string
+
+	// recognize the pods of previous kube-plex versions, turn off once
+	// they're gone
+	labelCompat string
+
+	// how often the resource usage and CPU throttling of the transcoder are
+	// logged, disabled when unset
+	sessionStatsInterval string
+	// log the resources every session requested and used
+	sessionUsageAccounting string
+	// CSV file the usage of every session is appended to
+	usageCSV string
+	// how often the usage of sessions is sampled
+	usageSampleInterval string
+	// file, sqlite:<database> or HTTP endpoint a record of every session is
+	// appended to
+	auditLog string
+	// sqlite3 shell writing to the SQLite database of AUDIT_LOG
+	auditSQLite string
+
+	// how long pods whose transcoder failed are kept before the controller
+	// deletes them, they're deleted right away when unset
+	failedPodRetention string
+
+	// collect the state of the node when a session fails
+	nodeDiagnostics string
 )
 
+// loadConfig reads the configuration sources and looks up every
+// configuration variable. It runs first thing in main rather than while the
+// package is initialised, reading KUBE_PLEX_CONFIGMAP talks to the API
+// server.
+func loadConfig() error {
+	var err error
+	if configLayers, err = loadConfigLayers(); err != nil {
+		return err
+	}
+	dataPVC = getenv("DATA_PVC")
+	configPVC = getenv("CONFIG_PVC")
+	transcodePVC = getenv("TRANSCODE_PVC")
+	dataVolume = getenv("DATA_VOLUME")
+	configVolume = getenv("CONFIG_VOLUME")
+	transcodeVolume = getenv("TRANSCODE_VOLUME")
+	dataMountOptions = getenv("DATA_MOUNT_OPTIONS")
+	configMountOptions = getenv("CONFIG_MOUNT_OPTIONS")
+	transcodeMountOptions = getenv("TRANSCODE_MOUNT_OPTIONS")
+	isolateSessions = getenv("ISOLATE_SESSIONS")
+	cleanupTranscodeDir = getenv("CLEANUP_TRANSCODE_DIR")
+	cleanupDelay = getenv("CLEANUP_DELAY")
+	minTranscodeFreeSpace = getenv("MIN_TRANSCODE_FREE_SPACE")
+	transcodeFullPolicy = getenv("TRANSCODE_FULL_POLICY")
+	volumeTopology = getenv("VOLUME_TOPOLOGY")
+	leastLoadedPlacement = getenv("LEAST_LOADED_PLACEMENT")
+	spreadTranscodes = getenv("SPREAD_TRANSCODES")
+	spreadTopologyKey = getenv("SPREAD_TOPOLOGY_KEY")
+	mediaSidecars = getenv("MEDIA_SIDECARS")
+	mediaMountPath = getenv("MEDIA_MOUNT_PATH")
+	initContainers = getenv("INIT_CONTAINERS")
+	sidecarContainers = getenv("SIDECARS")
+	podLabels = getenv("POD_LABELS")
+	podAnnotations = getenv("POD_ANNOTATIONS")
+	prepareTranscodeDir = getenv("PREPARE_TRANSCODE_DIR")
+	transcodeDirectory = getenv("TRANSCODE_DIR")
+	plexUID = getenv("PLEX_UID")
+	plexGID = getenv("PLEX_GID")
+	namespace = getenv("KUBE_NAMESPACE")
+	pmsImage = getenv("PMS_IMAGE")
+	pmsInternalAddress = getenv("PMS_INTERNAL_ADDRESS")
+	pmsServiceName = getenv("PMS_SERVICE_NAME")
+	podIP = getenv("POD_IP")
+	hostAliases = getenv("HOST_ALIASES")
+	dnsPolicy = getenv("DNS_POLICY")
+	dnsConfig = getenv("DNS_CONFIG")
+	imagePullSecretNames = getenv("IMAGE_PULL_SECRETS")
+	imagePullPolicy = getenv("IMAGE_PULL_POLICY")
+	priorityClass = getenv("PRIORITY_CLASS")
+	priorityClassLive = getenv("PRIORITY_CLASS_LIVE")
+	priorityClassStreaming = getenv("PRIORITY_CLASS_STREAMING")
+	priorityClassBackground = getenv("PRIORITY_CLASS_BACKGROUND")
+	liveTVNodeSelector = getenv("LIVE_TV_NODE_SELECTOR")
+	liveTVThreadQueueSize = getenv("LIVE_TV_THREAD_QUEUE_SIZE")
+	backgroundWindow = getenv("BACKGROUND_WINDOW")
+	backgroundPolicy = getenv("BACKGROUND_POLICY")
+	securityProfile = getenv("SECURITY_PROFILE")
+	runtimeClass = getenv("RUNTIME_CLASS")
+	transcodeServiceAccount = getenv("TRANSCODE_SERVICE_ACCOUNT")
+	automountToken = getenv("AUTOMOUNT_SERVICE_ACCOUNT_TOKEN")
+	schedulerName = getenv("SCHEDULER_NAME")
+	transcoderImage = getenv("TRANSCODER_IMAGE")
+	transcoderImageStrict = getenv("TRANSCODER_IMAGE_STRICT")
+	pmsPodName = getenv("PMS_POD_NAME")
+	pmsContainerName = getenv("PMS_CONTAINER_NAME")
+	pmsVersionCheck = getenv("PMS_VERSION_CHECK")
+	limitCPU = getenv("LIMIT_CPU")
+	resourceSizing = getenv("RESOURCE_SIZING")
+	resourceProfiles = getenv("RESOURCE_PROFILES")
+	preferencesSync = getenv("PREFERENCES_SYNC")
+	plexPreferencesPath = getenv("PLEX_PREFERENCES")
+	routingRules = getenv("ROUTING_RULES")
+	priorityBoostThreshold = getenv("PRIORITY_BOOST_THRESHOLD")
+	manifestConfigMap = getenv("MANIFEST_CONFIGMAP")
+	manifestHistory = getenv("MANIFEST_HISTORY")
+	sessionMetadataLookup = getenv("SESSION_METADATA")
+	transcodeEvents = getenv("TRANSCODE_EVENTS")
+	webhookURLs = getenv("WEBHOOK_URLS")
+	webhookEvents = getenv("WEBHOOK_EVENTS")
+	hookCommand = getenv("HOOK_COMMAND")
+	hookTimeout = getenv("HOOK_TIMEOUT")
+	annotateProgress = getenv("ANNOTATE_PROGRESS")
+	envExclude = getenv("ENV_EXCLUDE")
+	serviceLinks = getenv("SERVICE_LINKS")
+	transcodeKubeconfig = getenv("TRANSCODE_KUBECONFIG")
+	transcodeContext = getenv("TRANSCODE_CONTEXT")
+	transcodeNamespace = getenv("TRANSCODE_NAMESPACE")
+	transcodeClusterList = getenv("TRANSCODE_CLUSTERS")
+	segmentRelay = getenv("SEGMENT_RELAY")
+	kubePlexImage = getenv("KUBE_PLEX_IMAGE")
+	relayAddress = getenv("RELAY_ADDRESS")
+	s3Endpoint = getenv("S3_ENDPOINT")
+	s3Region = getenv("S3_REGION")
+	s3Bucket = getenv("S3_BUCKET")
+	s3Prefix = getenv("S3_PREFIX")
+	s3AccessKeyID = getenv("S3_ACCESS_KEY_ID")
+	s3SecretAccessKey = getenv("S3_SECRET_ACCESS_KEY")
+	kubeAPIQPS = getenv("KUBE_API_QPS")
+	kubeAPIBurst = getenv("KUBE_API_BURST")
+	kubeAPITimeout = getenv("KUBE_API_TIMEOUT")
+	dryRun = getenv("KUBE_PLEX_DRY_RUN")
+	kubePlexMode = getenv("KUBE_PLEX_MODE")
+	executionBackend = getenv("EXECUTION_BACKEND")
+	sshHosts = getenv("SSH_HOSTS")
+	sshOptions = getenv("SSH_OPTIONS")
+	sshTranscoder = getenv("SSH_TRANSCODER")
+	keepFailedPods = getenv("KEEP_FAILED_PODS")
+	failureArtifactsDir = getenv("FAILURE_ARTIFACTS_DIR")
+	maxConcurrentTranscodes = getenv("MAX_CONCURRENT_TRANSCODES")
+	concurrencyPolicy = getenv("CONCURRENCY_POLICY")
+	maxTranscodesPerUser = getenv("MAX_TRANSCODES_PER_USER")
+	userQuotaOverrides = getenv("USER_QUOTAS")
+	distributedSegments = getenv("DISTRIBUTED_SEGMENTS")
+	distributedMinDuration = getenv("DISTRIBUTED_MIN_DURATION")
+	localTranscoder = getenv("LOCAL_TRANSCODER")
+	localTrivial = getenv("LOCAL_TRIVIAL")
+	maintenanceConfigMap = getenv("MAINTENANCE_CONFIGMAP")
+	adminToken = getenv("ADMIN_TOKEN")
+	adminTLSCert = getenv("ADMIN_TLS_CERT")
+	adminTLSKey = getenv("ADMIN_TLS_KEY")
+	adminTLSClientCA = getenv("ADMIN_TLS_CLIENT_CA")
+	faultInjection = getenv("FAULT_INJECTION")
+	transcoderPool = getenv("TRANSCODER_POOL")
+	leakCheck = getenv("LEAK_CHECK")
+	restartPolicy = getenv("RESTART_POLICY")
+	restartPolicyStreaming = getenv("RESTART_POLICY_STREAMING")
+	restartPolicyBackground = getenv("RESTART_POLICY_BACKGROUND")
+	jobMode = getenv("JOB_MODE")
+	jobModeStreaming = getenv("JOB_MODE_STREAMING")
+	jobModeBackground = getenv("JOB_MODE_BACKGROUND")
+	jobBackoffLimit = getenv("JOB_BACKOFF_LIMIT")
+	codecsMode = getenv("CODECS_MODE")
+	codecsPVC = getenv("CODECS_PVC")
+	codecsPath = getenv("CODECS_PATH")
+	cacheWarmupSize = getenv("CACHE_WARMUP_SIZE")
+	eaeMode = getenv("EAE_MODE")
+	eaeCommand = getenv("EAE_COMMAND")
+	transcoderLog = getenv("TRANSCODER_LOG")
+	throttleForwarding = getenv("THROTTLE_FORWARDING")
+	stopGracePeriod = getenv("STOP_GRACE_PERIOD")
+	terminationGracePeriod = getenv("TERMINATION_GRACE_PERIOD")
+	deleteGracePeriod = getenv("DELETE_GRACE_PERIOD")
+	forceDelete = getenv("FORCE_DELETE")
+	maxTranscodeDuration = getenv("MAX_TRANSCODE_DURATION")
+	preStopCommand = getenv("PRESTOP_COMMAND")
+	nodePoolSelector = getenv("NODE_POOL_SELECTOR")
+	nodePoolTaint = getenv("NODE_POOL_TAINT")
+	safeToEvict = getenv("SAFE_TO_EVICT")
+	spotNodes = getenv("SPOT_NODES")
+	spotNodeSelector = getenv("SPOT_NODE_SELECTOR")
+	spotToleration = getenv("SPOT_TOLERATION")
+	capabilityPlacement = getenv("CAPABILITY_PLACEMENT")
+	nodeCapabilityLabels = getenv("NODE_CAPABILITY_LABELS")
+	gpuResource = getenv("GPU_RESOURCE")
+	gpuResourceCount = getenv("GPU_RESOURCE_COUNT")
+	hwaccelAuto = getenv("HWACCEL_AUTO")
+	resumeDisrupted = getenv("RESUME_DISRUPTED")
+	adoptSessions = getenv("ADOPT_SESSIONS")
+	podStuckTimeout = getenv("POD_STUCK_TIMEOUT")
+	podStartTimeout = getenv("POD_START_TIMEOUT")
+	scaleUpTimeout = getenv("SCALE_UP_TIMEOUT")
+	waitPollInterval = getenv("WAIT_POLL_INTERVAL")
+	recreateLimit = getenv("RECREATE_LIMIT")
+	podCreateTimeout = getenv("POD_CREATE_TIMEOUT")
+	localFallback = getenv("LOCAL_FALLBACK")
+	admissionPolicyConfigMap = getenv("ADMISSION_POLICY_CONFIGMAP")
+	labelCompat = getenv("LABEL_COMPAT")
+	sessionStatsInterval = getenv("SESSION_STATS_INTERVAL")
+	sessionUsageAccounting = getenv("SESSION_USAGE")
+	usageCSV = getenv("USAGE_CSV")
+	usageSampleInterval = getenv("USAGE_SAMPLE_INTERVAL")
+	auditLog = getenv("AUDIT_LOG")
+	auditSQLite = getenv("AUDIT_SQLITE")
+	failedPodRetention = getenv("FAILED_POD_RETENTION")
+	nodeDiagnostics = getenv("NODE_DIAGNOSTICS")
+	return nil
+}
+
 func main() {
+	if err := loadConfig(); err != nil {
+		log.Fatalf("Error loading configuration: %s", err)
+	}
+
+	args := os.Args
+	if isCommandInvocation(args) {
+		// kube-plex --dry-run <transcoder> [args...] renders the pod the
+		// transcoder invocation would run in, kube-plex --keep-failed-pods
+		// <transcoder> [args...] runs it keeping the pod if it fails
+		flags := args[1:]
+	parse:
+		for len(flags) > 1 {
+			switch flags[0] {
+			case "--dry-run":
+				dryRun = "true"
+			case "--keep-failed-pods":
+				keepFailedPods = "true"
+			default:
+				break parse
+			}
+			flags = flags[1:]
+		}
+		if len(flags) == len(args)-1 {
+			if err := runCommand(args[1:]); err != nil {
+				log.Fatalf("%s", err)
+			}
+			return
+		}
+		args = flags
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
 	env := os.Environ()
-	args := os.Args
+	// keep the original arguments in case the session runs locally
+	origArgs := append([]string(nil), args...)
+
+	if err := selectCluster(); err != nil {
+		log.Fatalf("Error selecting transcode cluster: %s", err)
+	}
+	derivePMSAddress()
+	if err := validatePMSAddress(pmsInternalAddress); err != nil && dryRun != "true" {
+		log.Fatalf("Error parsing PMS_INTERNAL_ADDRESS: %s", err)
+	}
 
 	rewriteEnv(env)
 	rewriteArgs(args)
@@ -66,208 +722,993 @@ func main() {
 		log.Fatalf("Error getting working directory: %s", err)
 	}
 
-	cfg, err := clientcmd.BuildConfigFromFlags("", "")
+	threshold, err := strconv.ParseFloat(priorityBoostThreshold, 64)
 	if err != nil {
-		log.Fatalf("Error building kubeconfig: %s", err)
+		log.Fatalf("Error parsing PRIORITY_BOOST_THRESHOLD: %s", err)
+	}
+	history, err := strconv.Atoi(manifestHistory)
+	if err != nil {
+		log.Fatalf("Error parsing MANIFEST_HISTORY: %s", err)
+	}
+	if limitCPU != "" {
+		if _, err := resource.ParseQuantity(limitCPU); err != nil {
+			log.Fatalf("Error parsing LIMIT_CPU: %s", err)
+		}
+	}
+	if cacheWarmupSize != "" {
+		size, err := resource.ParseQuantity(cacheWarmupSize)
+		if err != nil {
+			log.Fatalf("Error parsing CACHE_WARMUP_SIZE: %s", err)
+		}
+		if size.Sign() < 0 {
+			log.Fatalf("Error parsing CACHE_WARMUP_SIZE: %q must not be negative", cacheWarmupSize)
+		}
 	}
 
-	kubeClient, err := kubernetes.NewForConfig(cfg)
+	injected, err := parseFaults(faultInjection)
+	if err != nil {
+		log.Fatalf("Error parsing FAULT_INJECTION: %s", err)
+	}
+	backoffLimit, err := strconv.ParseInt(jobBackoffLimit, 10, 32)
+	if err != nil {
+		log.Fatalf("Error parsing JOB_BACKOFF_LIMIT: %s", err)
+	}
+	grace, err := time.ParseDuration(stopGracePeriod)
 	if err != nil {
-		log.Fatalf("Error building kubernetes clientset: %s", err)
+		log.Fatalf("Error parsing STOP_GRACE_PERIOD: %s", err)
 	}
+	if terminationGracePeriod != "" {
+		if _, err := time.ParseDuration(terminationGracePeriod); err != nil {
+			log.Fatalf("Error parsing TERMINATION_GRACE_PERIOD: %s", err)
+		}
+	}
+	if deleteGracePeriod != "" {
+		if d, err := time.ParseDuration(deleteGracePeriod); err != nil || d < 0 {
+			log.Fatalf("Error parsing DELETE_GRACE_PERIOD: %q must be a duration", deleteGracePeriod)
+		}
+	}
+	if forceDelete != "" {
+		if d, err := time.ParseDuration(forceDelete); err != nil || d <= 0 {
+			log.Fatalf("Error parsing FORCE_DELETE: %q must be a positive duration", forceDelete)
+		}
+	}
+	var maxDuration time.Duration
+	if maxTranscodeDuration != "" {
+		if maxDuration, err = time.ParseDuration(maxTranscodeDuration); err != nil {
+			log.Fatalf("Error parsing MAX_TRANSCODE_DURATION: %s", err)
+		}
+	}
+	// the Job controller limits the restarts of Jobs, the shim those of
+	// bare pods
+	waitOpts := waitOptions{maxRestarts: int32(backoffLimit)}
+	waitOpts.stuckTimeout, err = time.ParseDuration(podStuckTimeout)
+	if err != nil {
+		log.Fatalf("Error parsing POD_STUCK_TIMEOUT: %s", err)
+	}
+	waitOpts.startTimeout, err = time.ParseDuration(podStartTimeout)
+	if err != nil {
+		log.Fatalf("Error parsing POD_START_TIMEOUT: %s", err)
+	}
+	if scaleUpTimeout != "" {
+		waitOpts.scaleUpTimeout, err = time.ParseDuration(scaleUpTimeout)
+		if err != nil {
+			log.Fatalf("Error parsing SCALE_UP_TIMEOUT: %s", err)
+		}
+	}
+	waitOpts.pollInterval, err = time.ParseDuration(waitPollInterval)
+	if err != nil || waitOpts.pollInterval <= 0 {
+		log.Fatalf("Error parsing WAIT_POLL_INTERVAL: %q must be a positive duration", waitPollInterval)
+	}
+	createTimeout, err := time.ParseDuration(podCreateTimeout)
+	if err != nil {
+		log.Fatalf("Error parsing POD_CREATE_TIMEOUT: %s", err)
+	}
+	recreates, err := strconv.Atoi(recreateLimit)
+	if err != nil {
+		log.Fatalf("Error parsing RECREATE_LIMIT: %s", err)
+	}
+	profiles, err := parseResourceProfiles(resourceProfiles)
+	if err != nil {
+		log.Fatalf("Error parsing RESOURCE_PROFILES: %s", err)
+	}
+	if err := validateImagePullPolicy(); err != nil {
+		log.Fatalf("Error parsing IMAGE_PULL_POLICY: %s", err)
+	}
+	if err := validateSecurityProfile(); err != nil {
+		log.Fatalf("Error parsing SECURITY_PROFILE: %s", err)
+	}
+	if _, err := parsePodDNS(); err != nil {
+		log.Fatalf("%s", err)
+	}
+	for key, policy := range map[string]string{"RESTART_POLICY": restartPolicy, "RESTART_POLICY_STREAMING": restartPolicyStreaming, "RESTART_POLICY_BACKGROUND": restartPolicyBackground} {
+		if err := validateRestartPolicy(policy); err != nil {
+			log.Fatalf("Error parsing %s: %s", key, err)
+		}
+	}
+	for key, spec := range map[string]string{"DATA_VOLUME": dataVolume, "CONFIG_VOLUME": configVolume, "TRANSCODE_VOLUME": transcodeVolume} {
+		if _, err := parseVolumeSource(spec); err != nil {
+			log.Fatalf("Error parsing %s: %s", key, err)
+		}
+	}
+	for key, spec := range map[string]string{"DATA_MOUNT_OPTIONS": dataMountOptions, "CONFIG_MOUNT_OPTIONS": configMountOptions, "TRANSCODE_MOUNT_OPTIONS": transcodeMountOptions} {
+		if _, err := parseMountOptions(spec); err != nil {
+			log.Fatalf("Error parsing %s: %s", key, err)
+		}
+	}
+	if _, err := parseContainers(initContainers); err != nil {
+		log.Fatalf("Error parsing INIT_CONTAINERS: %s", err)
+	}
+	if _, err := parseContainers(sidecarContainers); err != nil {
+		log.Fatalf("Error parsing SIDECARS: %s", err)
+	}
+	if _, err := parsePodLabels(); err != nil {
+		log.Fatalf("Error parsing POD_LABELS: %s", err)
+	}
+	if _, err := parsePodAnnotations(); err != nil {
+		log.Fatalf("Error parsing POD_ANNOTATIONS: %s", err)
+	}
+	if prepareTranscodeDir == "true" && securityProfile == securityProfileRestricted {
+		log.Printf("warning: PREPARE_TRANSCODE_DIR runs as root, which the restricted security profile forbids")
+	}
+	if _, err := parseMediaSidecars(mediaSidecars); err != nil {
+		log.Fatalf("Error parsing MEDIA_SIDECARS: %s", err)
+	}
+	if mediaSidecars != "" && securityProfile == securityProfileRestricted {
+		log.Printf("warning: FUSE sidecars of MEDIA_SIDECARS usually need privileges the restricted security profile drops")
+	}
+	if _, err := parseNodePoolSelector(); err != nil {
+		log.Fatalf("Error parsing NODE_POOL_SELECTOR: %s", err)
+	}
+	if _, err := parseNodePoolTaint(); err != nil {
+		log.Fatalf("Error parsing NODE_POOL_TAINT: %s", err)
+	}
+	if err := validateSafeToEvict(); err != nil {
+		log.Fatalf("Error parsing SAFE_TO_EVICT: %s", err)
+	}
+	if err := validateSpotNodes(); err != nil {
+		log.Fatalf("Error parsing SPOT_NODES: %s", err)
+	}
+	if _, err := parseLiveTVNodeSelector(); err != nil {
+		log.Fatalf("Error parsing LIVE_TV_NODE_SELECTOR: %s", err)
+	}
+	if err := validateLiveTVQueueSize(); err != nil {
+		log.Fatalf("Error parsing LIVE_TV_THREAD_QUEUE_SIZE: %s", err)
+	}
+	if err := validateBackgroundWindow(); err != nil {
+		log.Fatalf("Error parsing BACKGROUND_WINDOW: %s", err)
+	}
+	if err := validateSpreadTranscodes(); err != nil {
+		log.Fatalf("Error parsing SPREAD_TRANSCODES: %s", err)
+	}
+	if _, err := parseGPUResource(); err != nil {
+		log.Fatalf("Error parsing GPU_RESOURCE_COUNT: %s", err)
+	}
+	if err := validateCapabilityPlacement(); err != nil {
+		log.Fatalf("Error parsing CAPABILITY_PLACEMENT: %s", err)
+	}
+	if d, err := time.ParseDuration(hookTimeout); err != nil || d <= 0 {
+		log.Fatalf("Error parsing HOOK_TIMEOUT: %q must be a positive duration", hookTimeout)
+	}
+	if err := validateWebhookEvents(); err != nil {
+		log.Fatalf("Error parsing WEBHOOK_EVENTS: %s", err)
+	}
+	if err := validateAuditLog(); err != nil {
+		log.Fatalf("Error parsing AUDIT_LOG: %s", err)
+	}
+	rules, err := parseRoutingRules(routingRules)
+	if err != nil {
+		log.Fatalf("Error parsing ROUTING_RULES: %s", err)
+	}
+	prefs := &plexPreferences{}
+	if preferencesSync == "true" {
+		if prefs, err = readPreferences(preferencesPath()); err != nil {
+			log.Printf("warning: unable to read Plex preferences: %s", err)
+			prefs = &plexPreferences{}
+		}
+		if !prefs.hardwareTranscoding() {
+			rules = softwareRoutingRules(rules)
+		}
+	}
+	var statsInterval time.Duration
+	if sessionStatsInterval != "" {
+		statsInterval, err = time.ParseDuration(sessionStatsInterval)
+		if err != nil {
+			log.Fatalf("Error parsing SESSION_STATS_INTERVAL: %s", err)
+		}
+	}
+	usageInterval, err := time.ParseDuration(usageSampleInterval)
+	if err != nil {
+		log.Fatalf("Error parsing USAGE_SAMPLE_INTERVAL: %s", err)
+	}
+	freeSpaceMin, err := parseFreeSpaceThreshold(minTranscodeFreeSpace)
+	if err != nil {
+		log.Fatalf("Error parsing MIN_TRANSCODE_FREE_SPACE: %s", err)
+	}
+	if err := validateFullPolicy(transcodeFullPolicy); err != nil {
+		log.Fatalf("Error parsing TRANSCODE_FULL_POLICY: %s", err)
+	}
+	cleanupAfter, err := time.ParseDuration(cleanupDelay)
+	if err != nil || cleanupAfter < 0 {
+		log.Fatalf("Error parsing CLEANUP_DELAY: %q must be a duration", cleanupDelay)
+	}
+	var retention time.Duration
+	if failedPodRetention != "" {
+		retention, err = time.ParseDuration(failedPodRetention)
+		if err != nil {
+			log.Fatalf("Error parsing FAILED_POD_RETENTION: %s", err)
+		}
+	}
+	maxTranscodes := 0
+	if maxConcurrentTranscodes != "" {
+		maxTranscodes, err = strconv.Atoi(maxConcurrentTranscodes)
+		if err != nil {
+			log.Fatalf("Error parsing MAX_CONCURRENT_TRANSCODES: %s", err)
+		}
+	}
+	distributedParts := 0
+	if distributedSegments != "" {
+		distributedParts, err = strconv.Atoi(distributedSegments)
+		if err != nil {
+			log.Fatalf("Error parsing DISTRIBUTED_SEGMENTS: %s", err)
+		}
+	}
+	minPart, err := time.ParseDuration(distributedMinDuration)
+	if err != nil || minPart <= 0 {
+		log.Fatalf("Error parsing DISTRIBUTED_MIN_DURATION: %q must be a positive duration", distributedMinDuration)
+	}
+	quotas, err := parseUserQuotas(maxTranscodesPerUser, userQuotaOverrides)
+	if err != nil {
+		log.Fatalf("Error parsing user quotas: %s", err)
+	}
+	if err := validateConcurrencyPolicy(); err != nil {
+		log.Fatalf("Error parsing CONCURRENCY_POLICY: %s", err)
+	}
+
+	// PMS stops sessions with SIGTERM, which the transcoder is asked to
+	// exit on wherever it runs
+	stopCh := signals.SetupSignalHandler()
+
+	switch executionBackend {
+	case backendKubernetes:
+	case backendLocal, backendSSH:
+		if executionBackend == backendSSH {
+			if _, err := parseSSHHosts(); err != nil {
+				log.Fatalf("Error parsing SSH_HOSTS: %s", err)
+			}
+		}
+		if dryRun == "true" {
+			log.Fatalf("Error rendering pod: sessions run with the %s backend", executionBackend)
+		}
+		backend, err := newBackend(executionBackend, nil)
+		if err != nil {
+			log.Fatalf("Error creating %s backend: %s", executionBackend, err)
+		}
+		// the local transcoder reaches PMS over the loopback
+		backendArgs := args
+		if executionBackend == backendLocal {
+			backendArgs = origArgs
+		}
+		code, err := runBackend(ctx, backend, backendArgs, env, cwd, stopCh)
+		if err != nil {
+			log.Fatalf("Error running %s backend: %s", executionBackend, err)
+		}
+		os.Exit(code)
+	default:
+		log.Fatalf("Error parsing EXECUTION_BACKEND: %q must be %s, %s or %s", executionBackend, backendKubernetes, backendLocal, backendSSH)
+	}
+
+	var cfg *rest.Config
+	var kubeClient kubernetes.Interface
+	if kubePlexMode != "" && kubePlexMode != kubePlexModeFake {
+		log.Fatalf("Error parsing KUBE_PLEX_MODE: %q must be %s", kubePlexMode, kubePlexModeFake)
+	}
+	if kubePlexMode == kubePlexModeFake && dryRun != "true" {
+		log.Printf("fake mode, running the session against an in-memory cluster")
+		cfg = &rest.Config{}
+		kubeClient = newFakeCluster(ctx, namespace)
+		if pmsImage == "" {
+			if pmsImage, err = detectPMSImage(ctx, kubeClient, namespace); err != nil {
+				log.Fatalf("Error detecting PMS image, set PMS_IMAGE: %s", err)
+			}
+		}
+	} else if dryRun != "true" {
+		// in cluster configuration is used unless KUBECONFIG points elsewhere
+		cfg, err = clientcmd.BuildConfigFromFlags("", os.Getenv("KUBECONFIG"))
+		if err != nil {
+			log.Fatalf("Error building kubeconfig: %s", err)
+		}
+		if err := configureClient(cfg); err != nil {
+			log.Fatalf("Error parsing %s", err)
+		}
 
-	uid := os.Getenv("PLEX_UID")
-	gid := os.Getenv("PLEX_GID")
+		kubeClient, err = kubernetes.NewForConfig(cfg)
+		if err != nil {
+			log.Fatalf("Error building kubernetes clientset: %s", err)
+		}
+		// PMS runs in this cluster, transcode pods may run in another
+		pmsClient, pmsNamespace := kubeClient, namespace
+		if remoteCluster() {
+			if cfg, kubeClient, namespace, err = buildTranscodeClient(); err != nil {
+				log.Fatalf("Error building transcode cluster client: %s", err)
+			}
+		}
 
-	pod := generatePod(cwd, uid, gid, env, args)
+		if pmsImage == "" {
+			pmsImage, err = detectPMSImage(ctx, pmsClient, pmsNamespace)
+			if err != nil {
+				log.Fatalf("Error detecting PMS image, set PMS_IMAGE: %s", err)
+			}
+			log.Printf("detected PMS image %s", pmsImage)
+		}
+		if err := checkAddress(ctx, pmsInternalAddress); err != nil {
+			log.Printf("warning: %s", err)
+		}
+		if pmsVersionCheck == "true" {
+			if err := checkPMSVersion(ctx); err != nil {
+				log.Printf("warning: %s", err)
+			}
+		}
+	}
+	if err := validateTranscoderImage(); err != nil {
+		if transcoderImageStrict == "true" {
+			log.Printf("%s, transcoding locally", err)
+			transcodeLocally(origArgs, stopCh)
+		}
+		log.Printf("warning: %s", err)
+	}
 
-	pod, err = kubeClient.CoreV1().Pods(namespace).Create(ctx, pod, metav1.CreateOptions{})
+	uid, err := parseID(plexUID)
 	if err != nil {
-		log.Fatalf("Error creating pod: %s", err)
+		log.Fatalf("Error parsing PLEX_UID: %s", err)
+	}
+	gid, err := parseID(plexGID)
+	if err != nil {
+		log.Fatalf("Error parsing PLEX_GID: %s", err)
 	}
-	log.Printf("started pod %s\n", pod.Name)
 
-	stopCh := signals.SetupSignalHandler()
-	waitFn := func() <-chan error {
-		stopCh := make(chan error)
-		go func() {
-			stopCh <- waitForPodCompletion(ctx, kubeClient, pod)
-		}()
-		return stopCh
-	}
-
-	select {
-	case <-time.After(10 * time.Minute):
-		log.Printf("timeout waiting for pod to complete")
-	case err := <-waitFn():
+	args = liveTVArgs(args)
+	inv := ffmpeg.Parse(args)
+	pod, err := generatePod(cwd, uid, gid, env, args)
+	if err != nil {
+		log.Fatalf("Error generating pod: %s", err)
+	}
+	pod.Namespace = namespace
+	if resourceSizing == "true" {
+		applyResourceProfile(pod, profiles, inv)
+	}
+	scaleCPU(pod, prefs.cpuFactor())
+	applyLiveTVProfile(pod, inv)
+	placeByCapabilities(pod, inv)
+	requestGPU(pod, inv)
+	accelerateHardwareTranscode(pod, inv)
+	applyRoutingRule(pod, rules, inv)
+	var meta *sessionMetadata
+	// quotas need the user of the session
+	if (sessionMetadataLookup == "true" || quotas.enabled()) && dryRun != "true" {
+		if meta, err = lookupSession(ctx, inv.SessionID, os.Getenv("X_PLEX_TOKEN")); err != nil {
+			log.Printf("warning: %s", err)
+		}
+	}
+	addSessionMetadata(pod, inv, meta)
+	if volumeTopology == "true" && dryRun != "true" {
+		if err := constrainToVolumeTopology(ctx, kubeClient, namespace, pod); err != nil {
+			log.Printf("warning: unable to read the topology of the volumes: %s", err)
+		}
+	}
+	if leastLoadedPlacement == "true" && dryRun != "true" {
+		load, err := sessionsPerNode(ctx, kubeClient, namespace)
 		if err != nil {
-			log.Printf("error waiting for pod to complete: %s", err)
+			log.Printf("warning: unable to count the sessions per node: %s", err)
+		}
+		preferLeastLoadedNodes(pod, load)
+	}
 
+	var receiver *relayReceiver
+	if segmentRelay == "true" || segmentRelay == "s3" {
+		setDefault("RELAY_ADDRESS", &relayAddress, podIP)
+		if kubePlexImage == "" || relayAddress == "" {
+			log.Fatalf("Error configuring the segment relay: KUBE_PLEX_IMAGE and RELAY_ADDRESS or POD_IP must be set")
+		}
+		var objectPrefix string
+		if segmentRelay == "s3" {
+			if s3Endpoint == "" || s3Bucket == "" {
+				log.Fatalf("Error configuring the segment relay: S3_ENDPOINT and S3_BUCKET must be set")
+			}
+			objectPrefix = sessionObjectPrefix(cwd)
+		}
+		token, err := relayToken()
+		if err != nil {
+			log.Fatalf("Error generating relay token: %s", err)
+		}
+		pushURL := "http://" + net.JoinHostPort(relayAddress, "0")
+		if dryRun != "true" {
+			if receiver, err = startRelayReceiver(cwd, relayAddress, token, objectPrefix); err != nil {
+				log.Fatalf("Error starting the segment relay receiver: %s", err)
+			}
+			defer receiver.close()
+			pushURL = receiver.url
+		}
+		addSegmentRelay(pod, cwd, pushURL, token, objectPrefix)
+	}
+
+	if dryRun == "true" {
+		manifest, err := yaml.Marshal(sanitizePod(pod))
+		if err != nil {
+			log.Fatalf("Error rendering pod: %s", err)
+		}
+		fmt.Printf("%s", manifest)
+		return
+	}
+
+	if localTrivial == "true" {
+		if kind := trivialSession(origArgs); kind != "" {
+			log.Printf("%s session, transcoding locally", kind)
+			transcodeLocally(origArgs, stopCh)
+		}
+	}
+
+	if maintenanceConfigMap != "" {
+		maintenance, err := inMaintenance(ctx, kubeClient, namespace, maintenanceConfigMap)
+		if err != nil {
+			log.Printf("warning: unable to read maintenance mode: %s", err)
+		}
+		if maintenance {
+			log.Printf("maintenance mode enabled, transcoding locally")
+			transcodeLocally(origArgs, stopCh)
+		}
+	}
+
+	if admissionPolicyConfigMap != "" {
+		err := applyAdmissionPolicy(ctx, kubeClient, pod)
+		if err == errAdmissionDenied {
+			log.Printf("%s, transcoding locally", err)
+			transcodeLocally(origArgs, stopCh)
+		}
+		if err != nil {
+			log.Printf("warning: unable to apply admission policy: %s", err)
+		}
+	}
+
+	// pods of relayed sessions push to the receiver of the shim that
+	// created them, so they can't be adopted
+	var adopted *corev1.Pod
+	var state *sessionState
+	if adoptSessions == "true" && receiver == nil {
+		if adopted, state = adoptSession(ctx, kubeClient, namespace, cwd, args); adopted != nil {
+			log.Printf("adopting pod %s", adopted.Name)
+		}
+	}
+
+	if adopted == nil && inv.Background() && backgroundWindow != "" {
+		if err := scheduleBackground(pod, stopCh); err != nil {
+			log.Fatalf("Error scheduling background conversion: %s", err)
+		}
+	}
+	if adopted == nil && minTranscodeFreeSpace != "" {
+		err := waitForFreeSpace(cwd, freeSpaceMin, transcodeFullPolicy, stopCh)
+		if errors.Is(err, errTranscodeVolumeFull) && transcodeFullPolicy == fullPolicyLocal {
+			log.Printf("%s, transcoding locally", err)
+			transcodeLocally(origArgs, stopCh)
+		}
+		if err != nil {
+			log.Fatalf("Error checking the free space of the transcode volume: %s", err)
+		}
+	}
+
+	// the slots are reserved until the pod of the session is created and
+	// counted instead, reservations left behind by failures expire
+	releaseSlots := func() {}
+	if adopted == nil && maxTranscodes > 0 {
+		release, err := acquireTranscodeSlot(ctx, kubeClient, namespace, "", maxTranscodes, concurrencyPolicy, stopCh)
+		if err == errAtCapacity && concurrencyPolicy == concurrencyPolicyLocal {
+			log.Printf("%s, transcoding locally", err)
+			transcodeLocally(origArgs, stopCh)
+		}
+		if err != nil {
+			log.Fatalf("Error waiting for a free transcode slot: %s", err)
+		}
+		releaseSlots = release
+	}
+	if adopted == nil && meta != nil && meta.user != "" && quotas.limit(meta.user) > 0 {
+		release, err := acquireTranscodeSlot(ctx, kubeClient, namespace, meta.user, quotas.limit(meta.user), concurrencyPolicy, stopCh)
+		if err != nil {
+			releaseSlots()
+		}
+		if err == errUserAtCapacity && concurrencyPolicy == concurrencyPolicyLocal {
+			log.Printf("%s, transcoding locally", err)
+			transcodeLocally(origArgs, stopCh)
+		}
+		if err != nil {
+			log.Fatalf("Error waiting for a free transcode slot of %s: %s", meta.user, err)
+		}
+		releaseGlobal := releaseSlots
+		releaseSlots = func() {
+			releaseGlobal()
+			release()
+		}
+	}
+
+	// pool pods share the transcode PVC and have no sidecars
+	if adopted == nil && transcoderPool == "true" && receiver == nil && mediaSidecars == "" && sidecarContainers == "" {
+		labels, annotations := sessionMeta(pod)
+		pooled, err := claimPoolPod(ctx, kubeClient, namespace, labels, annotations)
+		if err != nil {
+			log.Printf("warning: unable to claim a pool pod: %s", err)
+		}
+		if pooled != nil {
+			log.Printf("claimed pool pod %s", pooled.Name)
+			releaseSlots()
+			recordEvent(ctx, kubeClient, pooled, corev1.EventTypeNormal, eventReasonClaimed, fmt.Sprintf("Transcoding %s", strings.Join(inv.Inputs, ", ")))
+			startTime := time.Now()
+			var usage *sessionUsage
+			if sessionUsageAccounting == "true" || usageCSV != "" || auditLog != "" {
+				usage = newSessionUsage(pooled)
+			}
+			notifyWebhooks(ctx, newWebhookPayload(webhookStarted, pooled, inv))
+			if hookCommand != "" {
+				notifyHook(ctx, webhookStarted, pooled, inv.SessionID, nil)
+			}
+
+			execCtx, execCancel := context.WithCancel(ctx)
+			stopped := false
+			stopDone := make(chan struct{})
+			go func() {
+				defer close(stopDone)
+				select {
+				case <-stopCh:
+					log.Printf("exit requested.")
+					stopped = true
+					// the exec returns once the transcoder exits
+					if err := signalTranscoder(execCtx, cfg, kubeClient, pooled, args[0], "TERM"); err == nil {
+						select {
+						case <-time.After(grace):
+						case <-execCtx.Done():
+						}
+					}
+					execCancel()
+				case <-execCtx.Done():
+				}
+			}()
+			if throttleForwarding == "true" {
+				go forwardSignals(execCtx, cfg, kubeClient, pooled, args[0])
+			}
+			if usage != nil {
+				go usage.sample(execCtx, kubeClient, pooled, usageInterval)
+			}
+			code, err := runInPoolPod(execCtx, cfg, kubeClient, pooled, cwd, env, args)
+			execCancel()
+			<-stopDone
+			var sessionErr error
+			switch {
+			case stopped:
+			case err != nil:
+				sessionErr = err
+				log.Printf("error running in pool pod: %s", err)
+			case code != 0:
+				sessionErr = &ErrTranscoder{ExitCode: code}
+			}
+			reportSession(ctx, kubeClient, pooled, inv, args, startTime, usage, stopped, sessionErr)
+			log.Printf("cleaning up pod...")
+			if err := deletePod(ctx, kubeClient, pooled, createTimeout); err != nil {
+				log.Printf("error cleaning up pod: %s", err)
+			}
+			os.Exit(code)
+		}
+	}
+
+	// sensitive environment variables are passed through a Secret
+	var secret *corev1.Secret
+	if adopted == nil {
+		if hookCommand != "" {
+			if pod, err = mutatePod(ctx, pod, inv.SessionID); err != nil {
+				log.Fatalf("Error running hook: %s", err)
+			}
+		}
+		if err := injected.beforeCreate(ctx); err != nil {
+			log.Fatalf("Error creating pod: %s", err)
+		}
+		if s := extractSecretEnv(pod); s != nil {
+			secret, err = createSessionSecret(ctx, kubeClient, pod, s, createTimeout)
+			if err != nil {
+				releaseSlots()
+				createFailed(origArgs, "secret", err, stopCh)
+			}
+		}
+	} else if state.Secret != "" {
+		secret, err = kubeClient.CoreV1().Secrets(namespace).Get(ctx, state.Secret, metav1.GetOptions{})
+		if err != nil {
+			log.Printf("warning: unable to get secret %q of adopted pod %q: %s", state.Secret, adopted.Name, err)
+			secret = nil
+		}
+	}
+	session := &podSession{
+		cl:            kubeClient,
+		cfg:           cfg,
+		namespace:     namespace,
+		inv:           inv,
+		transcoder:    args[0],
+		cwd:           cwd,
+		template:      pod,
+		adopted:       adopted,
+		state:         state,
+		secret:        secret,
+		useJob:        adopted == nil && useJob(jobClass(args)),
+		backoffLimit:  int32(backoffLimit),
+		injected:      injected,
+		waitOpts:      waitOpts,
+		createTimeout: createTimeout,
+		grace:         grace,
+		maxDuration:   maxDuration,
+		recreates:     recreates,
+		statsInterval: statsInterval,
+		usageInterval: usageInterval,
+		threshold:     threshold,
+	}
+	if adopted != nil {
+		session.template = adoptedTemplate(adopted)
+	}
+
+	if adopted == nil && distributedParts > 1 {
+		template := session.template
+		command := template.Spec.Containers[0].Command
+		if parts := splitSession(command, inv, distributedParts, minPart); parts != nil {
+			log.Printf("splitting session in %d parts", len(parts))
+			startTime := time.Now()
+			var usage *sessionUsage
+			if sessionUsageAccounting == "true" || usageCSV != "" || auditLog != "" {
+				usage = newSessionUsage(template)
+				usage.scale(len(parts))
+			}
+			sampleCtx, stopSampling := context.WithCancel(ctx)
+			// the session is reported against the pod of its first part
+			first := template
+			partStarted := func(i int, pod *corev1.Pod) {
+				recordEvent(ctx, kubeClient, pod, corev1.EventTypeNormal, eventReasonCreated, fmt.Sprintf("Transcoding part %d of %d of %s", i+1, len(parts), strings.Join(inv.Inputs, ", ")))
+				if i == 0 {
+					first = pod
+					releaseSlots()
+					notifyWebhooks(ctx, newWebhookPayload(webhookStarted, pod, inv))
+					if hookCommand != "" {
+						notifyHook(ctx, webhookStarted, pod, inv.SessionID, nil)
+					}
+				}
+				if usage != nil {
+					go usage.sample(sampleCtx, kubeClient, pod, usageInterval)
+				}
+			}
+			err := runDistributed(ctx, kubeClient, template, parts, command[len(command)-1], waitOpts, createTimeout, stopCh, partStarted)
+			stopSampling()
+			releaseSlots()
+			stopped := false
+			select {
+			case <-stopCh:
+				// the parts were cancelled, PMS stopped the session
+				stopped, err = true, nil
+			default:
+			}
+			if err != nil {
+				log.Printf("error running distributed session: %s", err)
+			}
+			reportSession(ctx, kubeClient, first, inv, args, startTime, usage, stopped, err)
+			session.deleteSecret(ctx)
+			if err != nil {
+				os.Exit(exitCodeFor(err))
+			}
+			return
+		}
+	}
+
+	backend, err := newBackend(executionBackend, session)
+	if err != nil {
+		log.Fatalf("Error creating %s backend: %s", executionBackend, err)
+	}
+	err = backend.Launch(ctx, args, env, cwd)
+	releaseSlots()
+	if err != nil {
+		session.deleteSecret(ctx)
+		var createErr *createError
+		if errors.As(err, &createErr) {
+			createFailed(origArgs, createErr.kind, createErr.err, stopCh)
+		}
+		log.Printf("%s", err)
+		os.Exit(1)
+	}
+	pod = session.pod
+
+	session.started = func(reason string) {
+		pod, job := session.pod, session.job
+		log.Printf("started pod %s\n", pod.Name)
+		recordEvent(ctx, kubeClient, pod, corev1.EventTypeNormal, reason, fmt.Sprintf("Transcoding %s", strings.Join(inv.Inputs, ", ")))
+		injected.afterCreate(ctx, kubeClient, pod)
+		// the secret goes away with the pod, even if the shim doesn't
+		if secret != nil {
+			owner := metav1.OwnerReference{APIVersion: "v1", Kind: "Pod", Name: pod.Name, UID: pod.UID}
+			if job != nil {
+				owner = metav1.OwnerReference{APIVersion: "batch/v1", Kind: "Job", Name: job.Name, UID: job.UID}
+			}
+			if err := ownSecret(ctx, kubeClient, secret, owner); err != nil {
+				log.Printf("warning: unable to hand secret %q over to %s %q: %s", secret.Name, owner.Kind, owner.Name, err)
+			}
+		}
+		if hookCommand != "" {
+			notifyHook(ctx, webhookStarted, pod, inv.SessionID, nil)
+		}
+
+		if manifestConfigMap != "" {
+			if err := recordManifest(ctx, kubeClient, manifestConfigMap, pod, history); err != nil {
+				log.Printf("warning: unable to record manifest of pod %q: %s", pod.Name, err)
+			}
+		}
+		if adoptSessions == "true" && receiver == nil {
+			state := sessionState{Pod: pod.Name, Namespace: namespace, Session: inv.SessionID, Args: argsHash(args)}
+			if job != nil {
+				state.Job = job.Name
+			}
+			if secret != nil {
+				state.Secret = secret.Name
+			}
+			if err := writeSessionState(cwd, state); err != nil {
+				log.Printf("warning: unable to record session state: %s", err)
+			}
+		}
+	}
+	if adopted != nil {
+		session.started(eventReasonAdopted)
+	} else {
+		session.started(eventReasonCreated)
+	}
+	startTime := time.Now()
+	var usage *sessionUsage
+	if sessionUsageAccounting == "true" || usageCSV != "" || auditLog != "" {
+		usage = newSessionUsage(pod)
+	}
+	session.usage = usage
+	notifyWebhooks(ctx, newWebhookPayload(webhookStarted, pod, inv))
+
+	_, sessionErr := followBackend(backend, stopCh)
+	pod = session.pod
+	switch {
+	case session.stopped:
+		// the transcoder exit code is irrelevant when PMS stopped it
+	case session.timeoutErr != nil:
+		log.Printf("%s", sessionErr)
+	case session.waitErr != nil:
+		log.Printf("error waiting for pod to complete: %s", sessionErr)
+
+		// the transcoder never ran when the cluster failed the pod
+		if !isInfrastructureError(sessionErr) {
 			// dump pod logs
-			req := kubeClient.CoreV1().Pods(namespace).GetLogs(pod.Name, &corev1.PodLogOptions{})
-			logsReader, err := req.Stream(ctx)
+			req := kubeClient.CoreV1().Pods(namespace).GetLogs(pod.Name, &corev1.PodLogOptions{
+				Container: pod.Spec.Containers[0].Name,
+			})
+			logs, err := req.DoRaw(ctx)
 			if err != nil {
-				log.Fatalf("Error getting pod logs: %s", err)
+				log.Printf("warning: unable to get pod logs: %s", err)
+			} else {
+				log.Printf("pod logs:\n%s", redact(string(logs)))
 			}
-			defer logsReader.Close()
-			// read all logs and print them
-			logs, err := io.ReadAll(logsReader)
+		}
+
+		if nodeDiagnostics == "true" {
+			diag, err := collectNodeDiagnostics(ctx, kubeClient, pod)
 			if err != nil {
-				log.Fatalf("Error reading pod logs: %s", err)
+				log.Printf("warning: unable to collect node diagnostics: %s", err)
+			} else {
+				log.Printf("node diagnostics:\n%s", diag)
 			}
-			log.Printf("pod logs:\n%s", logs)
 		}
-	case <-stopCh:
-		log.Printf("exit requested.")
 	}
 
-	log.Printf("cleaning up pod...")
-	if err := kubeClient.CoreV1().Pods(namespace).Delete(ctx, pod.Name, metav1.DeleteOptions{}); err != nil {
-		log.Fatalf("error cleaning up pod: %s", err)
+	// the relay pushes the last segments once the transcoder exited
+	if receiver != nil && sessionErr == nil && !receiver.wait(time.Minute) {
+		log.Printf("warning: the segment relay of pod %s didn't push the last segments", pod.Name)
+	}
+
+	reportSession(ctx, kubeClient, pod, inv, args, startTime, usage, session.stopped, sessionErr)
+
+	if failureArtifactsDir != "" && sessionErr != nil {
+		dir, err := captureFailure(ctx, kubeClient, pod, sessionErr)
+		if err != nil {
+			log.Printf("warning: unable to capture failure artifacts of pod %q: %s", pod.Name, err)
+		} else {
+			log.Printf("failure artifacts of pod %s copied to %s", pod.Name, dir)
+		}
+	}
+
+	// pods whose transcoder failed are kept for inspection, the controller
+	// deletes them later
+	var retained bool
+	var transcoderErr *ErrTranscoder
+	if retention > 0 && errors.As(sessionErr, &transcoderErr) {
+		if err := retainFailed(ctx, kubeClient, pod, session.job, retention); err != nil {
+			log.Printf("warning: unable to retain failed pod %q: %s", pod.Name, err)
+		} else {
+			retained = true
+			log.Printf("keeping failed pod %s for %s", pod.Name, retention)
+			recordEvent(ctx, kubeClient, pod, corev1.EventTypeNormal, eventReasonRetained, fmt.Sprintf("Kept for inspection for %s", retention))
+		}
+	}
+
+	if keepFailedPods == "true" && sessionErr != nil && !retained {
+		retained = true
+		log.Printf("keeping failed pod %s", pod.Name)
+	}
+
+	if !retained {
+		session.cleanup(ctx)
+	}
+	if adoptSessions == "true" {
+		removeSessionState(cwd)
+	}
+
+	// sessions failing to start are retried in the same directory, and
+	// the segments of retained pods are kept with them
+	if cleanupTranscodeDir == "true" && !retained && !isStartError(sessionErr) {
+		delay := cleanupAfter
+		if session.stopped || sessionErr != nil {
+			// PMS won't serve the segments of stopped or failed sessions
+			delay = 0
+		}
+		cleanupSession(ctx, kubeClient, pod, cwd, delay)
+	}
+
+	if isStartError(sessionErr) {
+		failover(origArgs, sessionErr)
+	}
+	if localFallback == "true" && isStartError(sessionErr) {
+		log.Printf("transcode pod couldn't start, transcoding locally")
+		transcodeLocally(origArgs, stopCh)
+	}
+
+	if leakCheck == "true" {
+		reportLeaks(cancel)
+	}
+	if sessionErr != nil {
+		os.Exit(exitCodeFor(sessionErr))
 	}
 }
 
+// createFailed fails the session over to the next cluster when the transcode
+// pod or job couldn't be created, or else transcodes locally when
+// LOCAL_FALLBACK is enabled, exiting otherwise
+func createFailed(args []string, kind string, err error, stopCh <-chan struct{}) {
+	failover(args, fmt.Errorf("error creating %s: %w", kind, err))
+	if localFallback == "true" {
+		log.Printf("error creating %s: %s, transcoding locally", kind, err)
+		transcodeLocally(args, stopCh)
+	}
+	log.Fatalf("Error creating %s: %s", kind, err)
+}
+
 // rewriteEnv rewrites environment variables to be passed to the transcoder
 func rewriteEnv(in []string) {
 	// no changes needed
 }
 
 func rewriteArgs(in []string) {
-	for i, v := range in {
-		switch v {
-		case "-progressurl", "-manifest_name", "-segment_list":
-			in[i+1] = strings.Replace(in[i+1], "http://127.0.0.1:32400", pmsInternalAddress, 1)
-		case "-loglevel", "-loglevel_plex":
-			in[i+1] = "debug"
-		}
+	opts := []launcher.Option{
+		launcher.WithPMSAddress(pmsInternalAddress),
+		launcher.WithLogLevel("debug"),
 	}
+	if annotateProgress == "true" {
+		opts = append(opts, launcher.WithProgressURL(annotateProgressURL))
+	}
+	launcher.RewriteArgs(in, opts...)
 }
 
-func generatePod(cwd string, uid, gid string, env []string, args []string) *corev1.Pod {
-	strToi64 := func(s string) *int64 {
-		n, err := strconv.ParseInt(s, 10, 64)
-		if err != nil {
-			panic(err)
-		}
-		return &n
-	}
-
-	envVars := toCoreV1EnvVar(env)
-	return &corev1.Pod{
-		ObjectMeta: metav1.ObjectMeta{
-			GenerateName: "pms-elastic-transcoder-",
-		},
-		Spec: corev1.PodSpec{
-			NodeSelector: map[string]string{
-				"kubernetes.io/arch": "amd64",
-			},
-			RestartPolicy: corev1.RestartPolicyNever,
-			SecurityContext: &corev1.PodSecurityContext{
-				RunAsUser:  strToi64(uid),
-				RunAsGroup: strToi64(gid),
-			},
-			Containers: []corev1.Container{
-				{
-					Name:       "plex",
-					Command:    args,
-					Image:      pmsImage,
-					Env:        envVars,
-					WorkingDir: cwd,
-					Resources: corev1.ResourceRequirements{
-						Limits: corev1.ResourceList{
-							corev1.ResourceCPU: resource.MustParse(limitCPU),
-						},
-					},
-					VolumeMounts: []corev1.VolumeMount{
-						{
-							Name:      "data",
-							MountPath: "/data",
-						},
-						{
-							Name:      "config",
-							MountPath: "/config",
-							ReadOnly:  true,
-						},
-						{
-							Name:      "transcode",
-							MountPath: "/transcode",
-						},
-						{
-							Name:      "transcode",
-							MountPath: "/tmp",
-						},
-					},
-				},
-			},
-			Volumes: []corev1.Volume{
-				{
-					Name: "data",
-					VolumeSource: corev1.VolumeSource{
-						PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
-							ClaimName: dataPVC,
-						},
-					},
-				},
-				{
-					Name: "config",
-					VolumeSource: corev1.VolumeSource{
-						PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
-							ClaimName: configPVC,
-						},
-					},
-				},
-				{
-					Name: "transcode",
-					VolumeSource: corev1.VolumeSource{
-						PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
-							ClaimName: transcodePVC,
-						},
-					},
-				},
-			},
-		},
+// reportSession reports the end of the session that ran in the pod, however
+// it ran: as an Event of the pod, to the webhooks and the hook, in the usage
+// accounting and in the audit log
+func reportSession(ctx context.Context, cl kubernetes.Interface, pod *corev1.Pod, inv ffmpeg.Invocation, args []string, start time.Time, usage *sessionUsage, stopped bool, sessionErr error) {
+	switch {
+	case stopped:
+		recordEvent(ctx, cl, pod, corev1.EventTypeNormal, eventReasonStopped, "Session stopped by PMS")
+	case sessionErr != nil:
+		recordEvent(ctx, cl, pod, corev1.EventTypeWarning, eventReasonFailed, sessionErr.Error())
+	default:
+		recordEvent(ctx, cl, pod, corev1.EventTypeNormal, eventReasonCompleted, "Transcoder exited successfully")
 	}
-}
 
-func toCoreV1EnvVar(in []string) []corev1.EnvVar {
-	out := make([]corev1.EnvVar, len(in))
-	for i, v := range in {
-		splitvar := strings.SplitN(v, "=", 2)
-		out[i] = corev1.EnvVar{
-			Name:  splitvar[0],
-			Value: splitvar[1],
+	ended := newWebhookPayload(webhookFinished, pod, inv)
+	ended.Duration = time.Since(start).Seconds()
+	ended.Stopped = stopped
+	if sessionErr != nil {
+		ended.Event = webhookFailed
+		ended.Error = sessionErr.Error()
+	}
+	notifyWebhooks(ctx, ended)
+	if hookCommand != "" {
+		notifyHook(ctx, ended.Event, pod, inv.SessionID, sessionErr)
+	}
+	if usage != nil {
+		usage.report(pod, inv, sessionErr)
+	}
+	if auditLog != "" {
+		if err := writeAudit(ctx, newAuditRecord(pod, inv, args, start, usage, stopped, sessionErr)); err != nil {
+			log.Printf("warning: unable to record session of pod %q in the audit log: %s", pod.Name, err)
 		}
 	}
-	return out
 }
 
-func waitForPodCompletion(ctx context.Context, cl kubernetes.Interface, pod *corev1.Pod) error {
-	for {
-		select {
-		case <-ctx.Done():
-			return fmt.Errorf("context cancelled")
-		case <-time.After(5 * time.Second):
-			pod, err := cl.CoreV1().Pods(pod.Namespace).Get(ctx, pod.Name, metav1.GetOptions{})
-			if err != nil {
-				return err
-			}
+func generatePod(cwd string, uid, gid *int64, env []string, args []string) (*corev1.Pod, error) {
+	labels := map[string]string{
+		managedByLabel: managedByValue,
+		schemaLabel:    schemaVersion,
+	}
+	pod, err := podtemplate.New(
+		podtemplate.WithLabels(labels),
+		podtemplate.WithImage(transcodeImage()),
+		podtemplate.WithCommand(args),
+		podtemplate.WithEnv(filterEnv(env)),
+		podtemplate.WithEnvVars(nodeNameEnvVar()),
+		podtemplate.WithWorkingDir(cwd),
+		podtemplate.WithCPULimit(limitCPU),
+		podtemplate.WithTranscodeDir(transcodeDir()),
+		podtemplate.WithVolume(podtemplate.DataVolume, volumeSource(dataVolume, dataPVC)),
+		podtemplate.WithVolume(podtemplate.ConfigVolume, volumeSource(configVolume, configPVC)),
+		podtemplate.WithVolume(podtemplate.TranscodeVolume, volumeSource(transcodeVolume, transcodePVC)),
+		podtemplate.WithUser(uid, gid),
+		podtemplate.WithNodeSelector(transcodeNodeSelector()),
+		podtemplate.WithRestartPolicy(restartPolicyFor(jobClass(args))),
+		podtemplate.WithServiceLinks(serviceLinks == "true"),
+		podtemplate.WithImagePullSecrets(imagePullSecrets()),
+		podtemplate.WithServiceAccount(transcodeServiceAccount),
+		podtemplate.WithScheduler(schedulerName),
+		podtemplate.WithPriorityClass(priorityClassFor(ffmpeg.Parse(args))),
+	)
+	if err != nil {
+		return nil, err
+	}
+	addPodMetadata(pod)
+	addCodecsVolume(pod)
+	addCacheWarmup(pod, args)
+	addEAESidecar(pod, args)
+	addMediaSidecars(pod)
+	addInitContainers(pod, cwd, uid, gid)
+	applyMountOptions(pod)
+	if isolateSessions == "true" {
+		isolateSession(pod, cwd)
+	}
+	addSidecars(pod)
+	enableSignalForwarding(pod)
+	setImagePullPolicy(pod)
+	setTermination(pod)
+	setPodDNS(pod)
+	placeOnNodePool(pod)
+	placeOnSpotNodes(pod)
+	spreadSessions(pod)
+	hardenPod(pod)
+	if runtimeClass != "" {
+		pod.Spec.RuntimeClassName = &runtimeClass
+	}
+	if automountToken != "" {
+		automount := automountToken == "true"
+		pod.Spec.AutomountServiceAccountToken = &automount
+	}
+	return pod, nil
+}
 
-			switch pod.Status.Phase {
-			case corev1.PodPending:
-			case corev1.PodRunning:
-			case corev1.PodUnknown:
-				log.Printf("warning: pod %q is in an unknown state", pod.Name)
-			case corev1.PodFailed:
-				return fmt.Errorf("pod %q failed", pod.Name)
-			case corev1.PodSucceeded:
-				return nil
-			}
-		}
+// parseID parses a numeric user or group id, returning nil when unset
+func parseID(s string) (*int64, error) {
+	if s == "" {
+		return nil, nil
 	}
+	id, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || id < 0 {
+		return nil, fmt.Errorf("%q is not a numeric id", s)
+	}
+	return &id, nil
 }
 
-func setDefaults() {
-	if limitCPU == "" {
-		limitCPU = constDefaultLimitCPU
+// transcodeNodeSelector returns the node selector of transcode pods
+func transcodeNodeSelector() map[string]string {
+	return map[string]string{
+		"kubernetes.io/arch": "amd64",
 	}
 }
+
+func setDefaults() {
+	setDefault("EAE_COMMAND", &eaeCommand, `"$(ls -d "`+codecsPath+`"/EasyAudioEncoder-*/EasyAudioEncoder/EasyAudioEncoder | tail -n 1)"`)
+	hostname, _ := os.Hostname()
+	setDefault("PMS_POD_NAME", &pmsPodName, hostname)
+}
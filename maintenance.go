@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+)
+
+// maintenanceKey is the ConfigMap key holding the maintenance mode switch
+const maintenanceKey = "maintenance"
+
+// inMaintenance reports whether maintenance mode is enabled in the named
+// ConfigMap, a missing ConfigMap means maintenance mode is off
+func inMaintenance(ctx context.Context, cl kubernetes.Interface, ns, name string) (bool, error) {
+	cm, err := cl.CoreV1().ConfigMaps(ns).Get(ctx, name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return cm.Data[maintenanceKey] == "true", nil
+}
+
+// runMaintenance turns maintenance mode on or off. While on, new sessions
+// are transcoded locally and sessions already running remotely are left to
+// finish.
+func runMaintenance(args []string) error {
+	var kubeconfig, ns, name string
+
+	fs := flag.NewFlagSet("maintenance", flag.ContinueOnError)
+	fs.StringVar(&kubeconfig, "kubeconfig", "", "path to the kubeconfig file")
+	fs.StringVar(&ns, "namespace", namespace, "namespace of the ConfigMap (defaults to the kubeconfig namespace)")
+	fs.StringVar(&name, "configmap", maintenanceConfigMap, "name of the ConfigMap holding the switch")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 || (fs.Arg(0) != "on" && fs.Arg(0) != "off") {
+		return fmt.Errorf("usage: kube-plex maintenance [flags] on|off")
+	}
+	if name == "" {
+		return fmt.Errorf("-configmap or MAINTENANCE_CONFIGMAP must be set")
+	}
+	cl, defaultNs, err := buildCommandClient(kubeconfig)
+	if err != nil {
+		return err
+	}
+	if ns == "" {
+		ns = defaultNs
+	}
+
+	if err := setMaintenance(context.Background(), cl, ns, name, fs.Arg(0) == "on"); err != nil {
+		return err
+	}
+	fmt.Printf("maintenance mode %s\n", fs.Arg(0))
+	return nil
+}
+
+// setMaintenance turns maintenance mode on or off in the named ConfigMap
+func setMaintenance(ctx context.Context, cl kubernetes.Interface, ns, name string, on bool) error {
+	value := fmt.Sprint(on)
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		cm, err := cl.CoreV1().ConfigMaps(ns).Get(ctx, name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			_, err = cl.CoreV1().ConfigMaps(ns).Create(ctx, &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: ns},
+				Data:       map[string]string{maintenanceKey: value},
+			}, metav1.CreateOptions{})
+			return err
+		}
+		if err != nil {
+			return err
+		}
+		if cm.Data == nil {
+			cm.Data = map[string]string{}
+		}
+		cm.Data[maintenanceKey] = value
+		_, err = cl.CoreV1().ConfigMaps(ns).Update(ctx, cm, metav1.UpdateOptions{})
+		return err
+	})
+}
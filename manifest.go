@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/yaml"
+)
+
+// sensitiveEnvRe matches the names of environment variables whose values
+// must never be persisted or logged
+var sensitiveEnvRe = regexp.MustCompile(`(?i)token|claim|secret|password|passwd|key|webhook_url`)
+
+func isSensitiveEnv(name string) bool {
+	return sensitiveEnvRe.MatchString(name)
+}
+
+// tokenParamRe matches the tokens in the query of URLs
+var tokenParamRe = regexp.MustCompile(`(?i)([?&][a-z-]*token=)[^&\s"]+`)
+
+// redact hides the tokens of the URLs in s
+func redact(s string) string {
+	return tokenParamRe.ReplaceAllString(s, "${1}REDACTED")
+}
+
+// maxRedactLine is how much of a line redactWriter holds back waiting for
+// its end, longer lines are redacted in pieces
+const maxRedactLine = 64 << 10
+
+// redactWriter redacts the tokens of the lines written to w. Partial lines
+// are held back until they end, or Close is called, so tokens split across
+// writes are still redacted.
+type redactWriter struct {
+	w    io.Writer
+	line []byte
+}
+
+func (r *redactWriter) Write(p []byte) (int, error) {
+	r.line = append(r.line, p...)
+	end := bytes.LastIndexByte(r.line, '\n') + 1
+	if end == 0 && len(r.line) < maxRedactLine {
+		return len(p), nil
+	}
+	if end == 0 {
+		end = len(r.line)
+	}
+	if _, err := io.WriteString(r.w, redact(string(r.line[:end]))); err != nil {
+		return 0, err
+	}
+	r.line = append(r.line[:0], r.line[end:]...)
+	return len(p), nil
+}
+
+// Close writes the last partial line
+func (r *redactWriter) Close() error {
+	if len(r.line) == 0 {
+		return nil
+	}
+	_, err := io.WriteString(r.w, redact(string(r.line)))
+	r.line = nil
+	return err
+}
+
+// sanitizePod returns a copy of the pod with the values of sensitive
+// environment variables and the tokens in its command redacted
+func sanitizePod(pod *corev1.Pod) *corev1.Pod {
+	out := pod.DeepCopy()
+	sanitize := func(containers []corev1.Container) {
+		for i := range containers {
+			for j, env := range containers[i].Env {
+				if isSensitiveEnv(env.Name) && env.Value != "" {
+					containers[i].Env[j].Value = "REDACTED"
+				}
+			}
+			for j, arg := range containers[i].Command {
+				containers[i].Command[j] = redact(arg)
+			}
+		}
+	}
+	sanitize(out.Spec.InitContainers)
+	sanitize(out.Spec.Containers)
+	return out
+}
+
+// recordManifest stores the sanitized manifest of a submitted pod in a
+// rolling ConfigMap, keeping at most max entries, so it can be reviewed after
+// the pod is gone
+func recordManifest(ctx context.Context, cl kubernetes.Interface, name string, pod *corev1.Pod, max int) error {
+	manifest, err := yaml.Marshal(sanitizePod(pod))
+	if err != nil {
+		return err
+	}
+	// keys sort chronologically so the oldest entries are dropped first
+	key := fmt.Sprintf("%s-%s.yaml", time.Now().UTC().Format("20060102T150405"), pod.Name)
+
+	retriable := func(err error) bool {
+		return apierrors.IsConflict(err) || apierrors.IsAlreadyExists(err)
+	}
+	return retry.OnError(retry.DefaultRetry, retriable, func() error {
+		cm, err := cl.CoreV1().ConfigMaps(pod.Namespace).Get(ctx, name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			cm = &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      name,
+					Namespace: pod.Namespace,
+				},
+				Data: map[string]string{
+					key: string(manifest),
+				},
+			}
+			_, err = cl.CoreV1().ConfigMaps(pod.Namespace).Create(ctx, cm, metav1.CreateOptions{})
+			return err
+		}
+		if err != nil {
+			return err
+		}
+
+		if cm.Data == nil {
+			cm.Data = map[string]string{}
+		}
+		cm.Data[key] = string(manifest)
+
+		keys := make([]string, 0, len(cm.Data))
+		for k := range cm.Data {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for len(keys) > max {
+			delete(cm.Data, keys[0])
+			keys = keys[1:]
+		}
+
+		_, err = cl.CoreV1().ConfigMaps(pod.Namespace).Update(ctx, cm, metav1.UpdateOptions{})
+		return err
+	})
+}
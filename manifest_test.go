@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRedactWriter(t *testing.T) {
+	tests := []struct {
+		name   string
+		writes []string
+		want   string
+	}{
+		{
+			name:   "whole lines",
+			writes: []string{"GET /video?X-Plex-Token=abc&x=1\n", "done\n"},
+			want:   "GET /video?X-Plex-Token=REDACTED&x=1\ndone\n",
+		},
+		{
+			name:   "token split across writes",
+			writes: []string{"GET /video?X-Plex-To", "ken=ab", "c&x=1\n"},
+			want:   "GET /video?X-Plex-Token=REDACTED&x=1\n",
+		},
+		{
+			name:   "partial last line",
+			writes: []string{"ok\n", "http://plex:32400/?token=abc"},
+			want:   "ok\nhttp://plex:32400/?token=REDACTED",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			w := &redactWriter{w: &buf}
+			for _, s := range tt.writes {
+				if n, err := w.Write([]byte(s)); err != nil || n != len(s) {
+					t.Fatalf("Write() = %d, %v", n, err)
+				}
+			}
+			if err := w.Close(); err != nil {
+				t.Fatalf("Close() error = %s", err)
+			}
+			if got := buf.String(); got != tt.want {
+				t.Errorf("redacted %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRedactWriterLongLine(t *testing.T) {
+	var buf bytes.Buffer
+	w := &redactWriter{w: &buf}
+	w.Write([]byte(strings.Repeat("x", maxRedactLine)))
+	if buf.Len() != maxRedactLine {
+		t.Errorf("%d bytes written of a line longer than the limit, want %d", buf.Len(), maxRedactLine)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// name of the volume FUSE sidecars share their mounts through
+const mediaVolumeName = "media"
+
+// parseContainers parses a YAML list of containers
+func parseContainers(in string) ([]corev1.Container, error) {
+	var containers []corev1.Container
+	if err := yaml.UnmarshalStrict([]byte(in), &containers); err != nil {
+		return nil, err
+	}
+	for i, c := range containers {
+		if c.Name == "" || c.Image == "" {
+			return nil, fmt.Errorf("container %d must have a name and an image", i)
+		}
+	}
+	return containers, nil
+}
+
+// parseMediaSidecars parses the YAML list of containers of MEDIA_SIDECARS
+func parseMediaSidecars(in string) ([]corev1.Container, error) {
+	sidecars, err := parseContainers(in)
+	if err != nil {
+		return nil, err
+	}
+	if len(sidecars) > 0 && mediaMountPath == "" {
+		return nil, fmt.Errorf("MEDIA_MOUNT_PATH must be set")
+	}
+	return sidecars, nil
+}
+
+// addMediaSidecars runs the sidecars of MEDIA_SIDECARS in the pod, e.g.
+// rclone mounting cloud hosted media on demand. They start before the
+// transcoder and share an emptyDir mounted at MEDIA_MOUNT_PATH with it, the
+// mounts they make in it propagating to the transcoder.
+func addMediaSidecars(pod *corev1.Pod) {
+	// validated in main
+	sidecars, _ := parseMediaSidecars(mediaSidecars)
+	if len(sidecars) == 0 {
+		return
+	}
+	pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{
+		Name:         mediaVolumeName,
+		VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}},
+	})
+	bidirectional := corev1.MountPropagationBidirectional
+	always := corev1.ContainerRestartPolicyAlways
+	for _, c := range sidecars {
+		c.VolumeMounts = append(c.VolumeMounts, corev1.VolumeMount{
+			Name:             mediaVolumeName,
+			MountPath:        mediaMountPath,
+			MountPropagation: &bidirectional,
+		})
+		c.RestartPolicy = &always
+		pod.Spec.InitContainers = append(pod.Spec.InitContainers, c)
+	}
+	hostToContainer := corev1.MountPropagationHostToContainer
+	transcoder := &pod.Spec.Containers[0]
+	transcoder.VolumeMounts = append(transcoder.VolumeMounts, corev1.VolumeMount{
+		Name:             mediaVolumeName,
+		MountPath:        mediaMountPath,
+		ReadOnly:         true,
+		MountPropagation: &hostToContainer,
+	})
+}
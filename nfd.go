@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/lrascao/kube-plex/pkg/ffmpeg"
+)
+
+// capabilities of nodes transcodes need
+const (
+	capabilityAVX2   = "avx2"
+	capabilityAVX512 = "avx512"
+	capabilityQSV    = "qsv"
+	capabilityNVENC  = "nvenc"
+)
+
+// how transcode pods are placed on the nodes with the capabilities they need
+const (
+	capabilityPlacementPrefer  = "prefer"
+	capabilityPlacementRequire = "require"
+)
+
+// defaultCapabilityLabels are the labels Node Feature Discovery, and the
+// NVIDIA GPU feature discovery, set on the nodes with each capability
+var defaultCapabilityLabels = map[string]string{
+	capabilityAVX2:   "feature.node.kubernetes.io/cpu-cpuid.AVX2=true",
+	capabilityAVX512: "feature.node.kubernetes.io/cpu-cpuid.AVX512F=true",
+	capabilityQSV:    "feature.node.kubernetes.io/pci-0300_8086.present=true",
+	capabilityNVENC:  "nvidia.com/gpu.present=true",
+}
+
+// parseCapabilityLabels parses the comma separated capability:key=value
+// node labels of NODE_CAPABILITY_LABELS over the default ones
+func parseCapabilityLabels(in string) (map[string]string, error) {
+	labels := map[string]string{}
+	for c, l := range defaultCapabilityLabels {
+		labels[c] = l
+	}
+	if in == "" {
+		return labels, nil
+	}
+	for _, entry := range strings.Split(in, ",") {
+		c, l, ok := strings.Cut(strings.TrimSpace(entry), ":")
+		k, _, isLabel := strings.Cut(l, "=")
+		if !ok || c == "" || !isLabel || k == "" {
+			return nil, fmt.Errorf("invalid capability label %q, expected capability:key=value", entry)
+		}
+		labels[c] = l
+	}
+	return labels, nil
+}
+
+// validateCapabilityPlacement checks CAPABILITY_PLACEMENT and the labels of
+// NODE_CAPABILITY_LABELS
+func validateCapabilityPlacement() error {
+	switch capabilityPlacement {
+	case "", capabilityPlacementPrefer, capabilityPlacementRequire:
+	default:
+		return fmt.Errorf("unknown capability placement %q, expected %s or %s", capabilityPlacement, capabilityPlacementPrefer, capabilityPlacementRequire)
+	}
+	_, err := parseCapabilityLabels(nodeCapabilityLabels)
+	return err
+}
+
+// sessionCapabilities returns the capabilities of the nodes the session can
+// be sustained on: the hardware encoder or decoder it uses, or else the
+// vector instructions software transcodes depend on, AVX-512 for 4K
+func sessionCapabilities(inv ffmpeg.Invocation) []string {
+	codec := inv.VideoCodec
+	switch {
+	case inv.HWAccel == "cuda" || inv.HWAccel == "nvdec" || strings.HasSuffix(codec, "_nvenc"):
+		return []string{capabilityNVENC}
+	case inv.HWAccel == "qsv" || inv.HWAccel == "vaapi" || strings.HasSuffix(codec, "_qsv") || strings.HasSuffix(codec, "_vaapi"):
+		return []string{capabilityQSV}
+	case codec == "" || codec == "copy":
+		return nil
+	case inv.Height >= 2160:
+		return []string{capabilityAVX2, capabilityAVX512}
+	}
+	return []string{capabilityAVX2}
+}
+
+// placeByCapabilities prefers, or requires, scheduling the pod on nodes
+// labelled with the capabilities the session needs
+func placeByCapabilities(pod *corev1.Pod, inv ffmpeg.Invocation) {
+	if capabilityPlacement == "" {
+		return
+	}
+	// validated in main
+	labels, _ := parseCapabilityLabels(nodeCapabilityLabels)
+	for _, c := range sessionCapabilities(inv) {
+		k, v, _ := strings.Cut(labels[c], "=")
+		if k == "" {
+			continue
+		}
+		if capabilityPlacement == capabilityPlacementRequire {
+			if pod.Spec.NodeSelector == nil {
+				pod.Spec.NodeSelector = map[string]string{}
+			}
+			pod.Spec.NodeSelector[k] = v
+			continue
+		}
+		if pod.Spec.Affinity == nil {
+			pod.Spec.Affinity = &corev1.Affinity{}
+		}
+		if pod.Spec.Affinity.NodeAffinity == nil {
+			pod.Spec.Affinity.NodeAffinity = &corev1.NodeAffinity{}
+		}
+		na := pod.Spec.Affinity.NodeAffinity
+		na.PreferredDuringSchedulingIgnoredDuringExecution = append(na.PreferredDuringSchedulingIgnoredDuringExecution, corev1.PreferredSchedulingTerm{
+			Weight: 50,
+			Preference: corev1.NodeSelectorTerm{
+				MatchExpressions: []corev1.NodeSelectorRequirement{
+					{Key: k, Operator: corev1.NodeSelectorOpIn, Values: []string{v}},
+				},
+			},
+		})
+	}
+}
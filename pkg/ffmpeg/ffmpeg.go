@@ -0,0 +1,151 @@
+// Package ffmpeg inspects the arguments PMS invokes the Plex Transcoder
+// with, the Plex fork of ffmpeg.
+package ffmpeg
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Invocation describes a Plex Transcoder invocation
+type Invocation struct {
+	// SessionID is the transcode session PMS tracks the invocation as
+	SessionID string
+	// Inputs are the files or URLs read
+	Inputs []string
+	// SourceVideoCodec is the decoder PMS sets for the input video
+	SourceVideoCodec string
+	// VideoCodec is the encoder of the output video, copy for remuxes.
+	// Plex maps the video stream first, so output stream 0 is taken to be
+	// the video.
+	VideoCodec string
+	// OutputCodecs are the encoders of every output stream
+	OutputCodecs []string
+	// Height is the output height, 0 when the transcoder doesn't scale
+	Height int
+	// Bitrate is the target bitrate of the output video in kbps
+	Bitrate int
+	// ToneMapping is set for HDR to SDR conversions
+	ToneMapping bool
+	// HWAccel is the hardware decoder requested, empty for software
+	HWAccel string
+	// EAERoot is the directory shared with EasyAudioEncoder
+	EAERoot string
+	// UsesEAE is set when an EasyAudioEncoder encoder is used
+	UsesEAE bool
+	// Streaming is set when the output is a manifest served to a client,
+	// as opposed to a file written by optimize and sync jobs
+	Streaming bool
+	// LiveTV is set when the input is a live TV tuner stream
+	LiveTV bool
+	// DVR is set when a live TV stream is recorded
+	DVR bool
+}
+
+// Background reports whether the invocation is an optimize or sync job
+func (inv Invocation) Background() bool {
+	return !inv.Streaming
+}
+
+// LocalInputs returns the inputs that are local files
+func (inv Invocation) LocalInputs() []string {
+	var files []string
+	for _, in := range inv.Inputs {
+		if strings.HasPrefix(in, "/") {
+			files = append(files, in)
+		}
+	}
+	return files
+}
+
+var (
+	// scale=w=1920:h=1080 and scale=1920:1080 in ffmpeg filters, and their
+	// hardware counterparts such as scale_vaapi and scale_cuda
+	scaleHeightRe = regexp.MustCompile(`scale(?:_[a-z]+)?=(?:w=)?-?\d+:(?:h=)?(\d+)`)
+	// -s 1920x1080
+	sizeRe = regexp.MustCompile(`^\d+x(\d+)$`)
+	// .../transcode/session/<id>/...
+	sessionRe = regexp.MustCompile(`/transcode/session/([^/?]+)`)
+)
+
+// Parse inspects the arguments of a Plex Transcoder invocation, args[0]
+// being the transcoder itself
+func Parse(args []string) Invocation {
+	inv := Invocation{}
+	input := false
+	for i, v := range args {
+		var next string
+		if i+1 < len(args) {
+			next = args[i+1]
+		}
+		switch {
+		case v == "-i":
+			input = true
+			inv.Inputs = append(inv.Inputs, next)
+			if strings.Contains(next, "/livetv/") {
+				inv.LiveTV = true
+			}
+		case v == "-hwaccel":
+			inv.HWAccel = next
+		case v == "-eae_root":
+			inv.EAERoot = next
+			inv.UsesEAE = true
+		case strings.HasSuffix(v, "_eae"):
+			inv.UsesEAE = true
+		case v == "-codec:0" || v == "-c:v" || v == "-codec:v" || v == "-vcodec":
+			if input {
+				inv.VideoCodec = next
+			} else {
+				inv.SourceVideoCodec = next
+			}
+		case v == "-maxrate:0" || v == "-b:v" || v == "-b:0":
+			inv.Bitrate = parseBitrate(next)
+		case v == "-s":
+			if m := sizeRe.FindStringSubmatch(next); m != nil {
+				inv.Height, _ = strconv.Atoi(m[1])
+			}
+		case v == "-filter_complex" || v == "-vf" || v == "-filter:0":
+			if m := scaleHeightRe.FindStringSubmatch(next); m != nil {
+				inv.Height, _ = strconv.Atoi(m[1])
+			}
+			if strings.Contains(next, "tonemap") {
+				inv.ToneMapping = true
+			}
+		case v == "-manifest_name" || v == "-segment_list":
+			inv.Streaming = true
+			if m := sessionRe.FindStringSubmatch(next); m != nil && inv.SessionID == "" {
+				inv.SessionID = m[1]
+			}
+		case v == "-f" && (next == "dash" || next == "hls" || next == "segment"):
+			inv.Streaming = true
+		case v == "-progressurl":
+			if m := sessionRe.FindStringSubmatch(next); m != nil {
+				inv.SessionID = m[1]
+			}
+		}
+
+		if input && (strings.HasPrefix(v, "-codec:") || strings.HasPrefix(v, "-c:") || v == "-acodec" || v == "-scodec" || v == "-vcodec") && next != "" {
+			inv.OutputCodecs = append(inv.OutputCodecs, next)
+		}
+	}
+	// recordings write the tuner stream to a file instead of serving it
+	inv.DVR = inv.LiveTV && !inv.Streaming
+	return inv
+}
+
+// parseBitrate parses ffmpeg bitrates such as 8000k or 20M into kbps
+func parseBitrate(s string) int {
+	multiplier := 0.001
+	switch {
+	case strings.HasSuffix(s, "k"):
+		multiplier, s = 1, strings.TrimSuffix(s, "k")
+	case strings.HasSuffix(s, "M"):
+		multiplier, s = 1000, strings.TrimSuffix(s, "M")
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0
+	}
+	return int(n * multiplier)
+}
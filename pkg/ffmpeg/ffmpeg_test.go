@@ -0,0 +1,238 @@
+package ffmpeg
+
+import (
+	"reflect"
+	"testing"
+)
+
+const transcoder = "/usr/lib/plexmediaserver/Plex Transcoder"
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want Invocation
+	}{
+		{
+			name: "dash streaming",
+			args: []string{transcoder,
+				"-codec:0", "hevc", "-codec:1", "eac3",
+				"-i", "/data/movies/Movie (2020)/Movie.mkv",
+				"-filter_complex", "[0:0]scale=w=1280:h=720[0]",
+				"-map", "[0]", "-codec:0", "libx264", "-maxrate:0", "4000k",
+				"-map", "0:1", "-codec:1", "aac",
+				"-f", "dash", "-manifest_name", "http://127.0.0.1:32400/video/:/transcode/session/abc123/def/manifest",
+				"-progressurl", "http://127.0.0.1:32400/video/:/transcode/session/abc123/def/progress",
+				"dash",
+			},
+			want: Invocation{
+				SessionID:        "abc123",
+				Inputs:           []string{"/data/movies/Movie (2020)/Movie.mkv"},
+				SourceVideoCodec: "hevc",
+				VideoCodec:       "libx264",
+				OutputCodecs:     []string{"libx264", "aac"},
+				Height:           720,
+				Bitrate:          4000,
+				Streaming:        true,
+			},
+		},
+		{
+			name: "hls streaming",
+			args: []string{transcoder,
+				"-i", "/data/tv/Show/S01E01.mp4",
+				"-map", "0:0", "-codec:0", "copy",
+				"-map", "0:1", "-codec:1", "copy",
+				"-f", "segment", "-segment_format", "mpegts",
+				"-segment_list", "http://127.0.0.1:32400/video/:/transcode/session/xyz/seglist",
+				"media-%05d.ts",
+			},
+			want: Invocation{
+				SessionID:    "xyz",
+				Inputs:       []string{"/data/tv/Show/S01E01.mp4"},
+				VideoCodec:   "copy",
+				OutputCodecs: []string{"copy", "copy"},
+				Streaming:    true,
+			},
+		},
+		{
+			name: "optimize",
+			args: []string{transcoder,
+				"-i", "/data/movies/Movie.mkv",
+				"-s", "1920x1080", "-codec:0", "libx264", "-b:v", "20M",
+				"-codec:1", "aac",
+				"-f", "mp4", "/transcode/Sync+/Movie.mp4",
+			},
+			want: Invocation{
+				Inputs:       []string{"/data/movies/Movie.mkv"},
+				VideoCodec:   "libx264",
+				OutputCodecs: []string{"libx264", "aac"},
+				Height:       1080,
+				Bitrate:      20000,
+			},
+		},
+		{
+			name: "live tv",
+			args: []string{transcoder,
+				"-i", "http://127.0.0.1:32400/livetv/sessions/1/index.m3u8",
+				"-codec:0", "copy",
+				"-f", "hls", "-progressurl", "http://127.0.0.1:32400/video/:/transcode/session/tv1/progress",
+				"index.m3u8",
+			},
+			want: Invocation{
+				SessionID:    "tv1",
+				Inputs:       []string{"http://127.0.0.1:32400/livetv/sessions/1/index.m3u8"},
+				VideoCodec:   "copy",
+				OutputCodecs: []string{"copy"},
+				Streaming:    true,
+				LiveTV:       true,
+			},
+		},
+		{
+			name: "dvr",
+			args: []string{transcoder,
+				"-i", "http://127.0.0.1:32400/livetv/sessions/2/index.m3u8",
+				"-codec:0", "copy", "-codec:1", "copy",
+				"-f", "mpegts", "/data/dvr/.grab/recording.ts",
+			},
+			want: Invocation{
+				Inputs:       []string{"http://127.0.0.1:32400/livetv/sessions/2/index.m3u8"},
+				VideoCodec:   "copy",
+				OutputCodecs: []string{"copy", "copy"},
+				LiveTV:       true,
+				DVR:          true,
+			},
+		},
+		{
+			name: "hardware accelerated tone mapping",
+			args: []string{transcoder,
+				"-hwaccel", "vaapi", "-hwaccel_device", "/dev/dri/renderD128",
+				"-codec:0", "hevc",
+				"-i", "/data/movies/HDR.mkv",
+				"-filter_complex", "[0:0]hwupload,tonemap_vaapi=format=nv12,scale_vaapi=w=1920:h=1080[0]",
+				"-codec:0", "h264_vaapi", "-b:0", "8000000",
+				"-f", "dash", "-manifest_name", "/transcode/session/hdr/manifest",
+				"dash",
+			},
+			want: Invocation{
+				SessionID:        "hdr",
+				Inputs:           []string{"/data/movies/HDR.mkv"},
+				SourceVideoCodec: "hevc",
+				VideoCodec:       "h264_vaapi",
+				OutputCodecs:     []string{"h264_vaapi"},
+				Height:           1080,
+				Bitrate:          8000,
+				ToneMapping:      true,
+				HWAccel:          "vaapi",
+				Streaming:        true,
+			},
+		},
+		{
+			name: "easy audio encoder",
+			args: []string{transcoder,
+				"-codec:1", "truehd_eae",
+				"-eae_prefix:1", "abc_",
+				"-i", "/data/movies/Atmos.mkv",
+				"-codec:0", "copy", "-codec:1", "aac",
+				"-eae_root", "/transcode/eae",
+				"-f", "dash", "-manifest_name", "/transcode/session/eae/manifest",
+				"dash",
+			},
+			want: Invocation{
+				SessionID:    "eae",
+				Inputs:       []string{"/data/movies/Atmos.mkv"},
+				VideoCodec:   "copy",
+				OutputCodecs: []string{"copy", "aac"},
+				EAERoot:      "/transcode/eae",
+				UsesEAE:      true,
+				Streaming:    true,
+			},
+		},
+		{
+			name: "several inputs",
+			args: []string{transcoder,
+				"-i", "/data/movies/Movie.mkv",
+				"-i", "/data/movies/Movie.en.srt",
+				"-codec:0", "copy", "-scodec", "ass",
+				"-f", "mp4", "/transcode/out.mp4",
+			},
+			want: Invocation{
+				Inputs:       []string{"/data/movies/Movie.mkv", "/data/movies/Movie.en.srt"},
+				VideoCodec:   "copy",
+				OutputCodecs: []string{"copy", "ass"},
+			},
+		},
+		{
+			name: "no arguments",
+			args: []string{transcoder},
+			want: Invocation{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Parse(tt.args); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Parse() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInvocationBackground(t *testing.T) {
+	tests := []struct {
+		name string
+		inv  Invocation
+		want bool
+	}{
+		{"streaming", Invocation{Streaming: true}, false},
+		{"optimize", Invocation{}, true},
+		{"dvr", Invocation{LiveTV: true, DVR: true}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.inv.Background(); got != tt.want {
+				t.Errorf("Background() = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInvocationLocalInputs(t *testing.T) {
+	tests := []struct {
+		name   string
+		inputs []string
+		want   []string
+	}{
+		{"files", []string{"/data/a.mkv", "/data/a.srt"}, []string{"/data/a.mkv", "/data/a.srt"}},
+		{"urls", []string{"http://127.0.0.1:32400/livetv/sessions/1/index.m3u8"}, nil},
+		{"mixed", []string{"http://example.com/a.mkv", "/data/a.srt"}, []string{"/data/a.srt"}},
+		{"none", nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inv := Invocation{Inputs: tt.inputs}
+			if got := inv.LocalInputs(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("LocalInputs() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseBitrate(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int
+	}{
+		{"8000k", 8000},
+		{"20M", 20000},
+		{"1.5M", 1500},
+		{"4000000", 4000},
+		{"", 0},
+		{"fast", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			if got := parseBitrate(tt.in); got != tt.want {
+				t.Errorf("parseBitrate(%q) = %d, want %d", tt.in, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,67 @@
+// Package launcher prepares the arguments PMS invokes the Plex Transcoder
+// with to run away from PMS, in a transcode pod: the URLs the transcoder
+// reports to point at PMS over the network instead of the loopback.
+package launcher
+
+import "strings"
+
+// loopbackAddress is the address PMS tells the transcoder to reach it at
+const loopbackAddress = "http://127.0.0.1:32400"
+
+// options of RewriteArgs
+type options struct {
+	pmsAddress  string
+	progressURL func(string) string
+	logLevel    string
+}
+
+// Option configures RewriteArgs
+type Option func(*options)
+
+// WithPMSAddress sets the address the transcoder reaches PMS at, e.g.
+// http://plex:32400
+func WithPMSAddress(addr string) Option {
+	return func(o *options) { o.pmsAddress = addr }
+}
+
+// WithProgressURL rewrites the URL the transcoder reports its progress to,
+// once pointed at PMS
+func WithProgressURL(rewrite func(string) string) Option {
+	return func(o *options) { o.progressURL = rewrite }
+}
+
+// WithLogLevel sets the log level of the transcoder, left as PMS set it
+// when empty
+func WithLogLevel(level string) Option {
+	return func(o *options) { o.logLevel = level }
+}
+
+// RewriteArgs rewrites the transcoder arguments in place
+func RewriteArgs(args []string, opts ...Option) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	for i := 0; i < len(args)-1; i++ {
+		switch args[i] {
+		case "-progressurl":
+			args[i+1] = o.rewriteAddress(args[i+1])
+			if o.progressURL != nil {
+				args[i+1] = o.progressURL(args[i+1])
+			}
+		case "-manifest_name", "-segment_list":
+			args[i+1] = o.rewriteAddress(args[i+1])
+		case "-loglevel", "-loglevel_plex":
+			if o.logLevel != "" {
+				args[i+1] = o.logLevel
+			}
+		}
+	}
+}
+
+func (o options) rewriteAddress(url string) string {
+	if o.pmsAddress == "" {
+		return url
+	}
+	return strings.Replace(url, loopbackAddress, o.pmsAddress, 1)
+}
@@ -0,0 +1,89 @@
+package launcher
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRewriteArgs(t *testing.T) {
+	args := []string{"/usr/lib/plexmediaserver/Plex Transcoder",
+		"-loglevel", "quiet", "-loglevel_plex", "error",
+		"-i", "/data/a.mkv",
+		"-progressurl", "http://127.0.0.1:32400/video/:/transcode/session/abc/progress",
+		"-manifest_name", "http://127.0.0.1:32400/video/:/transcode/session/abc/manifest",
+		"-segment_list", "http://127.0.0.1:32400/video/:/transcode/session/abc/seglist",
+		"dash",
+	}
+	tests := []struct {
+		name string
+		opts []Option
+		want []string
+	}{
+		{
+			name: "no options",
+			want: args,
+		},
+		{
+			name: "pms address",
+			opts: []Option{WithPMSAddress("http://plex:32400")},
+			want: []string{"/usr/lib/plexmediaserver/Plex Transcoder",
+				"-loglevel", "quiet", "-loglevel_plex", "error",
+				"-i", "/data/a.mkv",
+				"-progressurl", "http://plex:32400/video/:/transcode/session/abc/progress",
+				"-manifest_name", "http://plex:32400/video/:/transcode/session/abc/manifest",
+				"-segment_list", "http://plex:32400/video/:/transcode/session/abc/seglist",
+				"dash",
+			},
+		},
+		{
+			name: "progress url",
+			opts: []Option{
+				WithPMSAddress("http://plex:32400"),
+				WithProgressURL(func(url string) string { return url + "?pod=p" }),
+			},
+			want: []string{"/usr/lib/plexmediaserver/Plex Transcoder",
+				"-loglevel", "quiet", "-loglevel_plex", "error",
+				"-i", "/data/a.mkv",
+				"-progressurl", "http://plex:32400/video/:/transcode/session/abc/progress?pod=p",
+				"-manifest_name", "http://plex:32400/video/:/transcode/session/abc/manifest",
+				"-segment_list", "http://plex:32400/video/:/transcode/session/abc/seglist",
+				"dash",
+			},
+		},
+		{
+			name: "log level",
+			opts: []Option{WithLogLevel("debug")},
+			want: []string{"/usr/lib/plexmediaserver/Plex Transcoder",
+				"-loglevel", "debug", "-loglevel_plex", "debug",
+				"-i", "/data/a.mkv",
+				"-progressurl", "http://127.0.0.1:32400/video/:/transcode/session/abc/progress",
+				"-manifest_name", "http://127.0.0.1:32400/video/:/transcode/session/abc/manifest",
+				"-segment_list", "http://127.0.0.1:32400/video/:/transcode/session/abc/seglist",
+				"dash",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := append([]string(nil), args...)
+			RewriteArgs(got, tt.opts...)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("RewriteArgs() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRewriteArgsLeavesInputs(t *testing.T) {
+	// only the URLs the transcoder reports to are rewritten, inputs served
+	// by PMS are left alone
+	args := []string{"-i", "http://127.0.0.1:32400/livetv/sessions/1/index.m3u8", "-progressurl"}
+	RewriteArgs(args, WithPMSAddress("http://plex:32400"))
+	if !strings.HasPrefix(args[1], "http://127.0.0.1:32400") {
+		t.Errorf("input rewritten to %q", args[1])
+	}
+	if args[2] != "-progressurl" {
+		t.Errorf("trailing flag rewritten to %q", args[2])
+	}
+}
@@ -0,0 +1,270 @@
+// Package podtemplate builds the pod a Plex Transcoder invocation runs in:
+// the transcoder container sharing the data, config and transcode volumes
+// of PMS. Callers refine the pod returned by New with their own placement,
+// sidecars and policies.
+package podtemplate
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// names of the volumes shared with PMS
+const (
+	DataVolume      = "data"
+	ConfigVolume    = "config"
+	TranscodeVolume = "transcode"
+)
+
+// DefaultGenerateName prefixes the names of transcode pods
+const DefaultGenerateName = "pms-elastic-transcoder-"
+
+// DefaultContainerName is the name of the transcoder container
+const DefaultContainerName = "plex"
+
+// options of the generated pod
+type options struct {
+	generateName       string
+	labels             map[string]string
+	image              string
+	command            []string
+	env                []corev1.EnvVar
+	workingDir         string
+	cpuLimit           string
+	transcodeDir       string
+	volumes            map[string]corev1.VolumeSource
+	uid, gid           *int64
+	nodeSelector       map[string]string
+	restartPolicy      corev1.RestartPolicy
+	serviceLinks       bool
+	imagePullSecrets   []corev1.LocalObjectReference
+	serviceAccountName string
+	schedulerName      string
+	priorityClassName  string
+}
+
+// Option configures the pod built by New
+type Option func(*options)
+
+// WithGenerateName sets the prefix of the pod name
+func WithGenerateName(prefix string) Option {
+	return func(o *options) { o.generateName = prefix }
+}
+
+// WithLabels adds labels to the pod
+func WithLabels(labels map[string]string) Option {
+	return func(o *options) {
+		for k, v := range labels {
+			o.labels[k] = v
+		}
+	}
+}
+
+// WithImage sets the image of the transcoder container, which must ship the
+// Plex Transcoder of the PMS version invoking it
+func WithImage(image string) Option {
+	return func(o *options) { o.image = image }
+}
+
+// WithCommand sets the transcoder command line
+func WithCommand(command []string) Option {
+	return func(o *options) { o.command = command }
+}
+
+// WithEnv sets the environment of the transcoder, as KEY=value pairs
+func WithEnv(env []string) Option {
+	return func(o *options) { o.env = append(o.env, EnvVars(env)...) }
+}
+
+// WithEnvVars adds environment variables to the transcoder
+func WithEnvVars(env ...corev1.EnvVar) Option {
+	return func(o *options) { o.env = append(o.env, env...) }
+}
+
+// WithWorkingDir sets the directory the transcoder runs in, the session
+// directory on the transcode volume
+func WithWorkingDir(dir string) Option {
+	return func(o *options) { o.workingDir = dir }
+}
+
+// WithCPULimit sets the CPU limit of the transcoder, a resource quantity
+func WithCPULimit(limit string) Option {
+	return func(o *options) { o.cpuLimit = limit }
+}
+
+// WithTranscodeDir sets where the transcode volume is mounted, the transcoder
+// temp directory of PMS
+func WithTranscodeDir(dir string) Option {
+	return func(o *options) { o.transcodeDir = dir }
+}
+
+// WithVolume sets the source of one of the shared volumes
+func WithVolume(name string, source corev1.VolumeSource) Option {
+	return func(o *options) { o.volumes[name] = source }
+}
+
+// WithClaims sets the claims of the data, config and transcode volumes
+func WithClaims(data, config, transcode string) Option {
+	return func(o *options) {
+		o.volumes[DataVolume] = ClaimSource(data)
+		o.volumes[ConfigVolume] = ClaimSource(config)
+		o.volumes[TranscodeVolume] = ClaimSource(transcode)
+	}
+}
+
+// WithUser runs the pod as the user and group, either may be nil
+func WithUser(uid, gid *int64) Option {
+	return func(o *options) { o.uid, o.gid = uid, gid }
+}
+
+// WithNodeSelector sets the node selector of the pod
+func WithNodeSelector(selector map[string]string) Option {
+	return func(o *options) { o.nodeSelector = selector }
+}
+
+// WithRestartPolicy sets the restart policy of the pod
+func WithRestartPolicy(policy corev1.RestartPolicy) Option {
+	return func(o *options) { o.restartPolicy = policy }
+}
+
+// WithServiceLinks injects the variables of the services of the namespace
+func WithServiceLinks(enabled bool) Option {
+	return func(o *options) { o.serviceLinks = enabled }
+}
+
+// WithImagePullSecrets sets the secrets the image is pulled with
+func WithImagePullSecrets(secrets []corev1.LocalObjectReference) Option {
+	return func(o *options) { o.imagePullSecrets = secrets }
+}
+
+// WithServiceAccount sets the service account of the pod
+func WithServiceAccount(name string) Option {
+	return func(o *options) { o.serviceAccountName = name }
+}
+
+// WithScheduler sets the scheduler of the pod
+func WithScheduler(name string) Option {
+	return func(o *options) { o.schedulerName = name }
+}
+
+// WithPriorityClass sets the priority class of the pod
+func WithPriorityClass(name string) Option {
+	return func(o *options) { o.priorityClassName = name }
+}
+
+// New returns the pod running the transcoder, or an error when an option is
+// invalid
+func New(opts ...Option) (*corev1.Pod, error) {
+	o := options{
+		generateName:  DefaultGenerateName,
+		labels:        map[string]string{},
+		transcodeDir:  "/transcode",
+		volumes:       map[string]corev1.VolumeSource{},
+		nodeSelector:  map[string]string{"kubernetes.io/arch": "amd64"},
+		restartPolicy: corev1.RestartPolicyNever,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	container := corev1.Container{
+		Name:       DefaultContainerName,
+		Command:    o.command,
+		Image:      o.image,
+		Env:        o.env,
+		WorkingDir: o.workingDir,
+		VolumeMounts: []corev1.VolumeMount{
+			{
+				Name:      DataVolume,
+				MountPath: "/data",
+			},
+			{
+				Name:      ConfigVolume,
+				MountPath: "/config",
+				ReadOnly:  true,
+			},
+		},
+	}
+	if o.cpuLimit != "" {
+		limit, err := resource.ParseQuantity(o.cpuLimit)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CPU limit %q: %w", o.cpuLimit, err)
+		}
+		container.Resources.Limits = corev1.ResourceList{
+			corev1.ResourceCPU: limit,
+		}
+	}
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: o.generateName,
+			Labels:       o.labels,
+		},
+		Spec: corev1.PodSpec{
+			NodeSelector:       o.nodeSelector,
+			RestartPolicy:      o.restartPolicy,
+			EnableServiceLinks: &o.serviceLinks,
+			ImagePullSecrets:   o.imagePullSecrets,
+			ServiceAccountName: o.serviceAccountName,
+			SchedulerName:      o.schedulerName,
+			PriorityClassName:  o.priorityClassName,
+			Containers:         []corev1.Container{container},
+		},
+	}
+	for _, name := range []string{DataVolume, ConfigVolume, TranscodeVolume} {
+		pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{
+			Name:         name,
+			VolumeSource: o.volumes[name],
+		})
+	}
+	if o.uid != nil || o.gid != nil {
+		pod.Spec.SecurityContext = &corev1.PodSecurityContext{
+			RunAsUser:  o.uid,
+			RunAsGroup: o.gid,
+		}
+	}
+	AddTranscodeMounts(pod, o.transcodeDir)
+	return pod, nil
+}
+
+// ClaimSource returns the source of a volume backed by the claim
+func ClaimSource(claim string) corev1.VolumeSource {
+	return corev1.VolumeSource{
+		PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: claim},
+	}
+}
+
+// AddTranscodeMounts mounts the transcode volume at the transcoder temp
+// directory and at /tmp in the transcoder container
+func AddTranscodeMounts(pod *corev1.Pod, dir string) {
+	c := &pod.Spec.Containers[0]
+	c.VolumeMounts = append(c.VolumeMounts, corev1.VolumeMount{
+		Name:      TranscodeVolume,
+		MountPath: dir,
+	})
+	if filepath.Clean(dir) != "/tmp" {
+		c.VolumeMounts = append(c.VolumeMounts, corev1.VolumeMount{
+			Name:      TranscodeVolume,
+			MountPath: "/tmp",
+		})
+	}
+}
+
+// EnvVars converts KEY=value pairs, as returned by os.Environ, to container
+// environment variables
+func EnvVars(in []string) []corev1.EnvVar {
+	out := make([]corev1.EnvVar, len(in))
+	for i, v := range in {
+		name, value, _ := strings.Cut(v, "=")
+		out[i] = corev1.EnvVar{
+			Name:  name,
+			Value: value,
+		}
+	}
+	return out
+}
@@ -0,0 +1,202 @@
+package podtemplate
+
+import (
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+func TestNewDefaults(t *testing.T) {
+	pod, err := New()
+	if err != nil {
+		t.Fatalf("New() error = %s", err)
+	}
+	if pod.GenerateName != DefaultGenerateName {
+		t.Errorf("GenerateName = %q, want %q", pod.GenerateName, DefaultGenerateName)
+	}
+	if pod.Spec.RestartPolicy != corev1.RestartPolicyNever {
+		t.Errorf("RestartPolicy = %q, want %q", pod.Spec.RestartPolicy, corev1.RestartPolicyNever)
+	}
+	if want := map[string]string{"kubernetes.io/arch": "amd64"}; !reflect.DeepEqual(pod.Spec.NodeSelector, want) {
+		t.Errorf("NodeSelector = %v, want %v", pod.Spec.NodeSelector, want)
+	}
+	if *pod.Spec.EnableServiceLinks {
+		t.Errorf("EnableServiceLinks = true, want false")
+	}
+	if pod.Spec.SecurityContext != nil {
+		t.Errorf("SecurityContext = %+v, want nil", pod.Spec.SecurityContext)
+	}
+	if len(pod.Spec.Containers) != 1 || pod.Spec.Containers[0].Name != DefaultContainerName {
+		t.Fatalf("Containers = %+v, want a single %q container", pod.Spec.Containers, DefaultContainerName)
+	}
+	if limits := pod.Spec.Containers[0].Resources.Limits; limits != nil {
+		t.Errorf("Limits = %v, want none", limits)
+	}
+}
+
+func TestNewOptions(t *testing.T) {
+	uid, gid := int64(1000), int64(1001)
+	secrets := []corev1.LocalObjectReference{{Name: "registry"}}
+	pod, err := New(
+		WithGenerateName("transcode-"),
+		WithLabels(map[string]string{"a": "1"}),
+		WithLabels(map[string]string{"b": "2"}),
+		WithImage("plexinc/pms-docker:1.40"),
+		WithCommand([]string{"/usr/lib/plexmediaserver/Plex Transcoder", "-i", "/data/a.mkv"}),
+		WithEnv([]string{"PLEX_MEDIA_SERVER_HOME=/usr/lib/plexmediaserver", "EMPTY=", "NOVALUE"}),
+		WithEnvVars(corev1.EnvVar{Name: "NODE_NAME", Value: "n"}),
+		WithWorkingDir("/transcode/session/abc"),
+		WithCPULimit("1500m"),
+		WithClaims("data-claim", "config-claim", "transcode-claim"),
+		WithUser(&uid, &gid),
+		WithNodeSelector(map[string]string{"gpu": "true"}),
+		WithRestartPolicy(corev1.RestartPolicyOnFailure),
+		WithServiceLinks(true),
+		WithImagePullSecrets(secrets),
+		WithServiceAccount("transcoder"),
+		WithScheduler("bin-packing"),
+		WithPriorityClass("transcode-high"),
+	)
+	if err != nil {
+		t.Fatalf("New() error = %s", err)
+	}
+
+	if pod.GenerateName != "transcode-" {
+		t.Errorf("GenerateName = %q, want %q", pod.GenerateName, "transcode-")
+	}
+	if want := map[string]string{"a": "1", "b": "2"}; !reflect.DeepEqual(pod.Labels, want) {
+		t.Errorf("Labels = %v, want %v", pod.Labels, want)
+	}
+	spec := pod.Spec
+	if spec.RestartPolicy != corev1.RestartPolicyOnFailure {
+		t.Errorf("RestartPolicy = %q, want %q", spec.RestartPolicy, corev1.RestartPolicyOnFailure)
+	}
+	if want := map[string]string{"gpu": "true"}; !reflect.DeepEqual(spec.NodeSelector, want) {
+		t.Errorf("NodeSelector = %v, want %v", spec.NodeSelector, want)
+	}
+	if !*spec.EnableServiceLinks {
+		t.Errorf("EnableServiceLinks = false, want true")
+	}
+	if !reflect.DeepEqual(spec.ImagePullSecrets, secrets) {
+		t.Errorf("ImagePullSecrets = %v, want %v", spec.ImagePullSecrets, secrets)
+	}
+	if spec.ServiceAccountName != "transcoder" || spec.SchedulerName != "bin-packing" || spec.PriorityClassName != "transcode-high" {
+		t.Errorf("ServiceAccountName, SchedulerName, PriorityClassName = %q, %q, %q", spec.ServiceAccountName, spec.SchedulerName, spec.PriorityClassName)
+	}
+	if sc := spec.SecurityContext; sc == nil || *sc.RunAsUser != uid || *sc.RunAsGroup != gid {
+		t.Errorf("SecurityContext = %+v, want user %d and group %d", sc, uid, gid)
+	}
+
+	claims := map[string]string{}
+	for _, v := range spec.Volumes {
+		claims[v.Name] = v.PersistentVolumeClaim.ClaimName
+	}
+	wantClaims := map[string]string{DataVolume: "data-claim", ConfigVolume: "config-claim", TranscodeVolume: "transcode-claim"}
+	if !reflect.DeepEqual(claims, wantClaims) {
+		t.Errorf("claims = %v, want %v", claims, wantClaims)
+	}
+
+	c := spec.Containers[0]
+	if c.Image != "plexinc/pms-docker:1.40" {
+		t.Errorf("Image = %q", c.Image)
+	}
+	if c.WorkingDir != "/transcode/session/abc" {
+		t.Errorf("WorkingDir = %q", c.WorkingDir)
+	}
+	if len(c.Command) != 3 || c.Command[2] != "/data/a.mkv" {
+		t.Errorf("Command = %q", c.Command)
+	}
+	wantEnv := []corev1.EnvVar{
+		{Name: "PLEX_MEDIA_SERVER_HOME", Value: "/usr/lib/plexmediaserver"},
+		{Name: "EMPTY"},
+		{Name: "NOVALUE"},
+		{Name: "NODE_NAME", Value: "n"},
+	}
+	if !reflect.DeepEqual(c.Env, wantEnv) {
+		t.Errorf("Env = %v, want %v", c.Env, wantEnv)
+	}
+	if got, want := c.Resources.Limits[corev1.ResourceCPU], resource.MustParse("1500m"); !got.Equal(want) {
+		t.Errorf("CPU limit = %s, want %s", got.String(), want.String())
+	}
+}
+
+func TestNewInvalidCPULimit(t *testing.T) {
+	for _, limit := range []string{"two", "1.5.0", "1 core"} {
+		t.Run(limit, func(t *testing.T) {
+			if _, err := New(WithCPULimit(limit)); err == nil {
+				t.Errorf("New() succeeded, want an error")
+			}
+		})
+	}
+}
+
+func TestTranscodeMounts(t *testing.T) {
+	tests := []struct {
+		name string
+		dir  string
+		want []corev1.VolumeMount
+	}{
+		{
+			name: "default",
+			dir:  "",
+			want: []corev1.VolumeMount{
+				{Name: DataVolume, MountPath: "/data"},
+				{Name: ConfigVolume, MountPath: "/config", ReadOnly: true},
+				{Name: TranscodeVolume, MountPath: "/transcode"},
+				{Name: TranscodeVolume, MountPath: "/tmp"},
+			},
+		},
+		{
+			name: "custom directory",
+			dir:  "/var/transcode",
+			want: []corev1.VolumeMount{
+				{Name: DataVolume, MountPath: "/data"},
+				{Name: ConfigVolume, MountPath: "/config", ReadOnly: true},
+				{Name: TranscodeVolume, MountPath: "/var/transcode"},
+				{Name: TranscodeVolume, MountPath: "/tmp"},
+			},
+		},
+		{
+			name: "tmp",
+			dir:  "/tmp/",
+			want: []corev1.VolumeMount{
+				{Name: DataVolume, MountPath: "/data"},
+				{Name: ConfigVolume, MountPath: "/config", ReadOnly: true},
+				{Name: TranscodeVolume, MountPath: "/tmp/"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var opts []Option
+			if tt.dir != "" {
+				opts = append(opts, WithTranscodeDir(tt.dir))
+			}
+			pod, err := New(opts...)
+			if err != nil {
+				t.Fatalf("New() error = %s", err)
+			}
+			if got := pod.Spec.Containers[0].VolumeMounts; !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("VolumeMounts = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWithVolume(t *testing.T) {
+	source := corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}
+	pod, err := New(
+		WithClaims("data", "config", "transcode"),
+		WithVolume(TranscodeVolume, source),
+	)
+	if err != nil {
+		t.Fatalf("New() error = %s", err)
+	}
+	for _, v := range pod.Spec.Volumes {
+		if v.Name == TranscodeVolume && !reflect.DeepEqual(v.VolumeSource, source) {
+			t.Errorf("transcode volume = %+v, want %+v", v.VolumeSource, source)
+		}
+	}
+}
@@ -0,0 +1,218 @@
+// Package s3 is a minimal client of S3 compatible object storage, storing
+// and fetching objects with path style requests signed with AWS Signature
+// Version 4.
+package s3
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// unsignedPayload skips hashing the body of uploads, which are streamed
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+// Client stores objects in a bucket
+type Client struct {
+	// Endpoint is the URL of the service, e.g. https://s3.eu-west-1.amazonaws.com
+	// or http://minio.storage:9000
+	Endpoint string
+	Region   string
+	Bucket   string
+
+	AccessKeyID     string
+	SecretAccessKey string
+
+	HTTPClient *http.Client
+}
+
+// Put stores the object, of size bytes read from body
+func (c *Client) Put(ctx context.Context, key string, body io.Reader, size int64) error {
+	req, err := c.request(ctx, http.MethodPut, key, body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Get returns the content of the object, which the caller must close
+func (c *Client) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	req, err := c.request(ctx, http.MethodGet, key, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// Delete removes the object
+func (c *Client) Delete(ctx context.Context, key string) error {
+	req, err := c.request(ctx, http.MethodDelete, key, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (c *Client) request(ctx context.Context, method, key string, body io.Reader) (*http.Request, error) {
+	u, err := url.Parse(strings.TrimSuffix(c.Endpoint, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid endpoint: %w", err)
+	}
+	u.Path += "/" + c.Bucket + "/" + strings.TrimPrefix(key, "/")
+	// sent escaped as signed
+	u.RawPath = canonicalURI(u.Path)
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	c.sign(req, time.Now().UTC())
+	return req, nil
+}
+
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	cl := c.HTTPClient
+	if cl == nil {
+		cl = http.DefaultClient
+	}
+	resp, err := cl.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("%s %s: %s: %s", req.Method, req.URL.Path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return resp, nil
+}
+
+// sign adds the AWS Signature Version 4 authorization header to the request
+func (c *Client) sign(req *http.Request, now time.Time) {
+	req.Header.Set("X-Amz-Date", now.Format(amzDateFormat))
+	req.Header.Set("X-Amz-Content-Sha256", unsignedPayload)
+	signedHeaders := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	req.Header.Set("Authorization", authorization(req, c.AccessKeyID, c.SecretAccessKey, c.Region, "s3", signedHeaders, unsignedPayload))
+}
+
+// amzDateFormat is the format of X-Amz-Date
+const amzDateFormat = "20060102T150405Z"
+
+// authorization returns the Authorization header signing the request, dated
+// by its X-Amz-Date header, for the service of the region
+func authorization(req *http.Request, accessKeyID, secretAccessKey, region, service string, signedHeaders []string, payloadHash string) string {
+	amzDate := req.Header.Get("X-Amz-Date")
+	date, _, _ := strings.Cut(amzDate, "T")
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	toSign := stringToSign(amzDate, scope, canonicalRequest(req, signedHeaders, payloadHash))
+
+	key := hmacSHA256([]byte("AWS4"+secretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+
+	return fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKeyID, scope, strings.Join(signedHeaders, ";"), signature)
+}
+
+// canonicalRequest returns the canonical form of the request hashed by the
+// signature, signedHeaders are lower case and sorted
+func canonicalRequest(req *http.Request, signedHeaders []string, payloadHash string) string {
+	var headers strings.Builder
+	for _, name := range signedHeaders {
+		value := req.Header.Get(name)
+		if name == "host" {
+			value = req.Host
+			if value == "" {
+				value = req.URL.Host
+			}
+		}
+		fmt.Fprintf(&headers, "%s:%s\n", name, strings.TrimSpace(value))
+	}
+	return strings.Join([]string{
+		req.Method,
+		canonicalURI(req.URL.Path),
+		canonicalQuery(req.URL.Query()),
+		headers.String(),
+		strings.Join(signedHeaders, ";"),
+		payloadHash,
+	}, "\n")
+}
+
+// stringToSign returns the string the signing key signs
+func stringToSign(amzDate, scope, canonicalRequest string) string {
+	return strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, hashHex([]byte(canonicalRequest))}, "\n")
+}
+
+// canonicalURI escapes every byte of the path but the unreserved characters
+// and slashes. Requests are sent with the same escaping, the server checks
+// the signature against the path it received.
+func canonicalURI(path string) string {
+	if path == "" {
+		return "/"
+	}
+	return uriEscape(path, false)
+}
+
+// canonicalQuery returns the query sorted by name then value, escaped
+func canonicalQuery(query url.Values) string {
+	var params []string
+	for name, values := range query {
+		for _, value := range values {
+			params = append(params, uriEscape(name, true)+"="+uriEscape(value, true))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
+
+// uriEscape percent-encodes s as AWS Signature Version 4 does, keeping
+// unreserved characters, and slashes unless escapeSlash
+func uriEscape(s string, escapeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && !escapeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func hashHex(data []byte) string {
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:])
+}
@@ -0,0 +1,137 @@
+package s3
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// credentials and date of the AWS Signature Version 4 test suite
+const (
+	testAccessKeyID     = "AKIDEXAMPLE"
+	testSecretAccessKey = "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"
+	testAmzDate         = "20150830T123600Z"
+	testScope           = "20150830/us-east-1/service/aws4_request"
+	// hash of the empty payload
+	emptyPayload = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+func TestAuthorizationTestSuite(t *testing.T) {
+	tests := []struct {
+		name             string
+		method           string
+		url              string
+		canonicalRequest string
+		stringToSign     string
+		signature        string
+	}{
+		{
+			name:   "get-vanilla",
+			method: http.MethodGet,
+			url:    "https://example.amazonaws.com/",
+			canonicalRequest: "GET\n/\n\n" +
+				"host:example.amazonaws.com\nx-amz-date:20150830T123600Z\n\n" +
+				"host;x-amz-date\n" + emptyPayload,
+			stringToSign: "AWS4-HMAC-SHA256\n20150830T123600Z\n" + testScope + "\n" +
+				"bb579772317eb040ac9ed261061d46c1f17a8133879d6129b6e1c25292927e63",
+			signature: "5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31",
+		},
+		{
+			name:   "get-vanilla-query-order-key-case",
+			method: http.MethodGet,
+			url:    "https://example.amazonaws.com/?Param2=value2&Param1=value1",
+			canonicalRequest: "GET\n/\nParam1=value1&Param2=value2\n" +
+				"host:example.amazonaws.com\nx-amz-date:20150830T123600Z\n\n" +
+				"host;x-amz-date\n" + emptyPayload,
+			signature: "b97d918cfa904a5beff61c982a1b6f458b799221646efd99d3219ec94cdf2500",
+		},
+		{
+			name:   "post-vanilla",
+			method: http.MethodPost,
+			url:    "https://example.amazonaws.com/",
+			canonicalRequest: "POST\n/\n\n" +
+				"host:example.amazonaws.com\nx-amz-date:20150830T123600Z\n\n" +
+				"host;x-amz-date\n" + emptyPayload,
+			signature: "5da7c1a2acd57cee7505fc6676e4e544621c30862966e37dddb68e92efbe5d6b",
+		},
+	}
+	signedHeaders := []string{"host", "x-amz-date"}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, tt.url, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("X-Amz-Date", testAmzDate)
+
+			canonical := canonicalRequest(req, signedHeaders, emptyPayload)
+			if canonical != tt.canonicalRequest {
+				t.Errorf("canonicalRequest() =\n%s\nwant\n%s", canonical, tt.canonicalRequest)
+			}
+			if tt.stringToSign != "" {
+				if got := stringToSign(testAmzDate, testScope, canonical); got != tt.stringToSign {
+					t.Errorf("stringToSign() =\n%s\nwant\n%s", got, tt.stringToSign)
+				}
+			}
+			want := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/" + testScope + ", SignedHeaders=host;x-amz-date, Signature=" + tt.signature
+			if got := authorization(req, testAccessKeyID, testSecretAccessKey, "us-east-1", "service", signedHeaders, emptyPayload); got != want {
+				t.Errorf("authorization() =\n%s\nwant\n%s", got, want)
+			}
+		})
+	}
+}
+
+func TestCanonicalEscaping(t *testing.T) {
+	tests := []struct {
+		name string
+		path string
+		want string
+	}{
+		{name: "space", path: "/bucket/a b.ts", want: "/bucket/a%20b.ts"},
+		{name: "unicode", path: "/bucket/ሴ/é.ts", want: "/bucket/%E1%88%B4/%C3%A9.ts"},
+		{name: "reserved", path: "/bucket/a+b=(c)!.ts", want: "/bucket/a%2Bb%3D%28c%29%21.ts"},
+		{name: "unreserved", path: "/bucket/A-z_0.9~", want: "/bucket/A-z_0.9~"},
+		{name: "empty", path: "", want: "/"},
+	}
+	for _, tt := range tests {
+		if got := canonicalURI(tt.path); got != tt.want {
+			t.Errorf("canonicalURI(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+
+	req, err := http.NewRequest(http.MethodGet, "http://minio/?prefix=a b/ሴ&list-type=2&a=2&a=1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "a=1&a=2&list-type=2&prefix=a%20b%2F%E1%88%B4"
+	if got := canonicalQuery(req.URL.Query()); got != want {
+		t.Errorf("canonicalQuery() = %q, want %q", got, want)
+	}
+}
+
+func TestClientSendsSignedPath(t *testing.T) {
+	var path, authorization string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path, authorization = r.URL.EscapedPath(), r.Header.Get("Authorization")
+		io.WriteString(w, "segment")
+	}))
+	defer srv.Close()
+
+	c := &Client{Endpoint: srv.URL, Region: "us-east-1", Bucket: "bucket", AccessKeyID: "id", SecretAccessKey: "secret"}
+	body, err := c.Get(context.Background(), "sessions/a b/ሴ+1.ts")
+	if err != nil {
+		t.Fatalf("Get() error = %s", err)
+	}
+	body.Close()
+
+	// the server signs the path as it received it
+	if want := "/bucket/sessions/a%20b/%E1%88%B4%2B1.ts"; path != want {
+		t.Errorf("sent path %q, want %q", path, want)
+	}
+	if !strings.HasPrefix(authorization, "AWS4-HMAC-SHA256 Credential=id/") || !strings.Contains(authorization, "/us-east-1/s3/aws4_request") {
+		t.Errorf("Authorization = %q", authorization)
+	}
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+
+	"golang.org/x/sync/errgroup"
+
+	"github.com/lrascao/kube-plex/pkg/ffmpeg"
+)
+
+// podSession is a session running in a transcode pod, shared by main, which
+// sets it up and reports on it, and the kubernetes backend running it
+type podSession struct {
+	cl        kubernetes.Interface
+	cfg       *rest.Config
+	namespace string
+	inv       ffmpeg.Invocation
+	// transcoder is the command signals are sent to
+	transcoder string
+	cwd        string
+
+	// pods recreated after a disruption are created from the same spec
+	template *corev1.Pod
+	// adopted is the pod of a previous shim the session resumes following
+	adopted *corev1.Pod
+	state   *sessionState
+	// sensitive environment variables are passed through a Secret
+	secret       *corev1.Secret
+	useJob       bool
+	backoffLimit int32
+	injected     faults
+
+	waitOpts      waitOptions
+	createTimeout time.Duration
+	grace         time.Duration
+	maxDuration   time.Duration
+	recreates     int
+
+	// followed while the pod runs
+	statsInterval time.Duration
+	usage         *sessionUsage
+	usageInterval time.Duration
+	threshold     float64
+
+	// started is called once the pod of the session was created, adopted
+	// or recreated
+	started func(reason string)
+
+	pod *corev1.Pod
+	job *batchv1.Job
+	// how the session ended
+	waitErr, timeoutErr error
+	stopped             bool
+}
+
+// createError is returned by Launch when the pod or Job of the session
+// couldn't be created
+type createError struct {
+	kind string
+	err  error
+}
+
+func (e *createError) Error() string {
+	return fmt.Sprintf("error creating %s: %s", e.kind, e.err)
+}
+
+func (e *createError) Unwrap() error {
+	return e.err
+}
+
+// err returns the error the session failed with, nil when PMS stopped it
+func (s *podSession) err() error {
+	switch {
+	case s.stopped:
+		// the transcoder exit code is irrelevant when PMS stopped it
+		return nil
+	case s.timeoutErr != nil:
+		return s.timeoutErr
+	}
+	return s.waitErr
+}
+
+// createPod creates the pod of the session from the template
+func (s *podSession) createPod(ctx context.Context) error {
+	pods := s.cl.CoreV1().Pods(s.namespace)
+	attempt := s.template.DeepCopy()
+	created, err := createNamed(ctx, s.createTimeout, attempt, func(ctx context.Context, pod *corev1.Pod) (*corev1.Pod, error) {
+		if err := s.injected.createError(); err != nil {
+			return nil, err
+		}
+		return pods.Create(ctx, pod, metav1.CreateOptions{})
+	}, func(ctx context.Context, name string) (*corev1.Pod, error) {
+		return pods.Get(ctx, name, metav1.GetOptions{})
+	})
+	if err != nil {
+		// an attempt timing out may still have created it
+		if err := pods.Delete(context.Background(), attempt.Name, metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+			log.Printf("warning: unable to delete pod %q: %s", attempt.Name, err)
+		}
+		return err
+	}
+	s.pod = created
+	return nil
+}
+
+// createJob creates the Job of the session from the template and waits for
+// its pod
+func (s *podSession) createJob(ctx context.Context) error {
+	jobs := s.cl.BatchV1().Jobs(s.namespace)
+	attempt := generateJob(s.template, s.backoffLimit)
+	job, err := createNamed(ctx, s.createTimeout, attempt, func(ctx context.Context, job *batchv1.Job) (*batchv1.Job, error) {
+		if err := s.injected.createError(); err != nil {
+			return nil, err
+		}
+		return jobs.Create(ctx, job, metav1.CreateOptions{})
+	}, func(ctx context.Context, name string) (*batchv1.Job, error) {
+		return jobs.Get(ctx, name, metav1.GetOptions{})
+	})
+	if err != nil {
+		// an attempt timing out may still have created it
+		s.job = attempt
+		s.deleteJob(ctx)
+		return &createError{kind: "job", err: err}
+	}
+	s.job = job
+	log.Printf("started job %s\n", job.Name)
+	s.pod, err = waitForJobPod(ctx, s.cl, job)
+	if err != nil {
+		s.deleteJob(ctx)
+		return fmt.Errorf("error waiting for job pod: %w", err)
+	}
+	return nil
+}
+
+// adopt follows the pod, and the Job, of a previous shim
+func (s *podSession) adopt(ctx context.Context) {
+	s.pod = s.adopted
+	if s.state.Job == "" {
+		return
+	}
+	job, err := s.cl.BatchV1().Jobs(s.namespace).Get(ctx, s.state.Job, metav1.GetOptions{})
+	if err != nil {
+		// the job is still deleted by name during cleanup
+		log.Printf("warning: unable to get job %q of adopted pod %q: %s", s.state.Job, s.adopted.Name, err)
+		job = &batchv1.Job{ObjectMeta: metav1.ObjectMeta{Name: s.state.Job, Namespace: s.namespace}}
+	}
+	s.job = job
+}
+
+// deleteJob deletes the Job of the session and its pods
+func (s *podSession) deleteJob(ctx context.Context) {
+	log.Printf("cleaning up job...")
+	propagation := metav1.DeletePropagationBackground
+	err := deleteWithRetry(ctx, s.createTimeout, func(ctx context.Context) error {
+		return s.cl.BatchV1().Jobs(s.namespace).Delete(ctx, s.job.Name, metav1.DeleteOptions{PropagationPolicy: &propagation})
+	})
+	if err != nil {
+		log.Printf("error cleaning up job: %s", err)
+	}
+}
+
+// deleteSecret deletes the Secret of the session, if any
+func (s *podSession) deleteSecret(ctx context.Context) {
+	if s.secret == nil {
+		return
+	}
+	err := deleteWithRetry(ctx, s.createTimeout, func(ctx context.Context) error {
+		return s.cl.CoreV1().Secrets(s.namespace).Delete(ctx, s.secret.Name, metav1.DeleteOptions{})
+	})
+	if err != nil {
+		log.Printf("warning: unable to delete secret %q: %s", s.secret.Name, err)
+	}
+}
+
+// cleanup deletes the Job, pod and Secret of the session
+func (s *podSession) cleanup(ctx context.Context) {
+	if s.job != nil {
+		s.deleteJob(ctx)
+	}
+	log.Printf("cleaning up pod...")
+	if err := deletePod(ctx, s.cl, s.pod, s.createTimeout); err != nil {
+		log.Printf("error cleaning up pod: %s", err)
+	}
+	s.deleteSecret(ctx)
+}
+
+// kubernetesBackend runs the session in a transcode pod, created bare or
+// through a Job, recreating it when the cluster disrupts it
+type kubernetesBackend struct {
+	*podSession
+	ctx context.Context
+	// closed when the transcoder is asked to exit
+	killed chan struct{}
+	kill   sync.Once
+}
+
+// Launch creates the pod of the session, or adopts the one of a previous
+// shim. The pod was generated from the arguments, environment and directory
+// of the session already.
+func (b *kubernetesBackend) Launch(ctx context.Context, args, env []string, dir string) error {
+	b.ctx = ctx
+	if b.adopted != nil {
+		b.adopt(ctx)
+		return nil
+	}
+	if b.useJob {
+		return b.createJob(ctx)
+	}
+	if err := b.createPod(ctx); err != nil {
+		return &createError{kind: "pod", err: err}
+	}
+	return nil
+}
+
+// Wait follows the pod until the session ends, recreating it after
+// disruptions, and returns the exit code and error of the session
+func (b *kubernetesBackend) Wait() (int, error) {
+	b.waitErr, b.timeoutErr, b.stopped = b.runPod(b.pod)
+	// disrupted pods are recreated, Jobs recreate their own
+	for recreated := 0; b.job == nil && !b.stopped && b.timeoutErr == nil && errors.Is(b.waitErr, ErrDisrupted) && recreated < b.recreates; recreated++ {
+		log.Printf("%s, recreating it", b.waitErr)
+		if b.secret != nil {
+			if err := disownSecret(b.ctx, b.cl, b.secret); err != nil {
+				log.Printf("warning: unable to keep secret %q for the new pod: %s", b.secret.Name, err)
+			}
+		}
+		if err := deletePod(b.ctx, b.cl, b.pod, b.createTimeout); err != nil {
+			log.Printf("warning: unable to delete pod %q: %s", b.pod.Name, err)
+		}
+		if resumeDisrupted == "true" && b.inv.Streaming {
+			if resumed, ok := resumeArgs(b.template.Spec.Containers[0].Command, b.cwd); ok {
+				log.Printf("resuming session with %s", redact(strings.Join(resumed[1:], " ")))
+				b.template = b.template.DeepCopy()
+				b.template.Spec.Containers[0].Command = resumed
+			}
+		}
+		if err := b.createPod(b.ctx); err != nil {
+			log.Printf("error recreating pod: %s", err)
+			break
+		}
+		b.started(eventReasonRecreated)
+		b.waitErr, b.timeoutErr, b.stopped = b.runPod(b.pod)
+	}
+	err := b.err()
+	return exitCodeFor(err), err
+}
+
+// Logs returns right away, the output of transcode pods stays in their logs,
+// which are forwarded to TRANSCODER_LOG and dumped when the session fails
+func (b *kubernetesBackend) Logs(w io.Writer) error {
+	return nil
+}
+
+// Kill asks the transcoder to exit, Wait returns once it did or
+// STOP_GRACE_PERIOD passed
+func (b *kubernetesBackend) Kill() error {
+	b.kill.Do(func() { close(b.killed) })
+	return nil
+}
+
+// runPod follows the session running in the pod until it ends, which happens
+// when the pod completes, times out or PMS stops it, cancelling every other
+// task
+func (b *kubernetesBackend) runPod(pod *corev1.Pod) (waitErr, timeoutErr error, stopped bool) {
+	g, gctx := errgroup.WithContext(b.ctx)
+	g.Go(func() error {
+		if b.job != nil {
+			waitErr = waitForJobCompletion(gctx, b.cl, b.job, b.waitOpts.pollInterval)
+		} else {
+			waitErr = waitForPodCompletion(gctx, b.cl, pod, b.waitOpts).err()
+		}
+		return errSessionEnded
+	})
+	g.Go(func() error {
+		// the deadline of the pod fails it first, this catches pods the
+		// kubelet can't enforce it on
+		var deadline <-chan time.Time
+		if b.maxDuration > 0 && !b.inv.LiveTV {
+			deadline = time.After(b.maxDuration + time.Minute)
+		}
+		select {
+		case <-gctx.Done():
+			return nil
+		case <-deadline:
+			timeoutErr = fmt.Errorf("timeout waiting for pod to complete")
+			if current, err := b.cl.CoreV1().Pods(b.namespace).Get(b.ctx, pod.Name, metav1.GetOptions{}); err == nil {
+				if pendingErr := pendingPodError(current); pendingErr != nil {
+					timeoutErr = pendingErr
+				}
+			}
+		case <-b.killed:
+			stopped = true
+			terminateTranscoder(b.ctx, b.cfg, b.cl, pod, b.transcoder, b.grace)
+		}
+		return errSessionEnded
+	})
+
+	if transcoderLog != "" {
+		f, err := openTranscoderLog(pod)
+		if err != nil {
+			log.Printf("warning: unable to open transcoder log: %s", err)
+		} else {
+			defer f.Close()
+			g.Go(supervise(gctx, "log forwarding", forwardLogs(b.cl, pod, f)))
+		}
+	}
+
+	if throttleForwarding == "true" {
+		g.Go(func() error {
+			forwardSignals(gctx, b.cfg, b.cl, pod, b.transcoder)
+			return nil
+		})
+	}
+
+	if b.statsInterval > 0 {
+		g.Go(func() error {
+			reportStats(gctx, b.cl, pod, b.statsInterval)
+			return nil
+		})
+	}
+
+	if b.usage != nil {
+		g.Go(func() error {
+			b.usage.sample(gctx, b.cl, pod, b.usageInterval)
+			return nil
+		})
+	}
+
+	if b.threshold > 0 && b.inv.Background() {
+		var boosted sync.Once
+		g.Go(supervise(gctx, "progress tracking", func(ctx context.Context) error {
+			return followProgress(ctx, b.cl, pod, func(percent float64) {
+				if percent < b.threshold {
+					return
+				}
+				boosted.Do(func() {
+					log.Printf("pod %s is %.0f%% done, protecting it from eviction", pod.Name, percent)
+					if err := boostPod(ctx, b.cl, pod); err != nil {
+						log.Printf("warning: unable to protect pod %q from eviction: %s", pod.Name, err)
+					}
+				})
+			})
+		}))
+	}
+
+	g.Wait()
+	return waitErr, timeoutErr, stopped
+}
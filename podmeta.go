@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// parseKeyValues parses a JSON object of strings or comma separated
+// key=value pairs
+func parseKeyValues(in string) (map[string]string, error) {
+	in = strings.TrimSpace(in)
+	if in == "" {
+		return nil, nil
+	}
+	out := map[string]string{}
+	if strings.HasPrefix(in, "{") {
+		if err := json.Unmarshal([]byte(in), &out); err != nil {
+			return nil, err
+		}
+		return out, nil
+	}
+	for _, entry := range strings.Split(in, ",") {
+		k, v, ok := strings.Cut(entry, "=")
+		if k = strings.TrimSpace(k); !ok || k == "" {
+			return nil, fmt.Errorf("invalid entry %q, expected key=value", entry)
+		}
+		out[k] = strings.TrimSpace(v)
+	}
+	return out, nil
+}
+
+// parsePodLabels parses the labels of POD_LABELS
+func parsePodLabels() (map[string]string, error) {
+	labels, err := parseKeyValues(podLabels)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range labels {
+		if errs := validation.IsQualifiedName(k); len(errs) > 0 {
+			return nil, fmt.Errorf("invalid label %q: %s", k, strings.Join(errs, ", "))
+		}
+		if errs := validation.IsValidLabelValue(v); len(errs) > 0 {
+			return nil, fmt.Errorf("invalid value of label %q: %s", k, strings.Join(errs, ", "))
+		}
+	}
+	return labels, nil
+}
+
+// parsePodAnnotations parses the annotations of POD_ANNOTATIONS
+func parsePodAnnotations() (map[string]string, error) {
+	annotations, err := parseKeyValues(podAnnotations)
+	if err != nil {
+		return nil, err
+	}
+	for k := range annotations {
+		if errs := validation.IsQualifiedName(k); len(errs) > 0 {
+			return nil, fmt.Errorf("invalid annotation %q: %s", k, strings.Join(errs, ", "))
+		}
+	}
+	return annotations, nil
+}
+
+// addPodMetadata adds the labels and annotations of POD_LABELS and
+// POD_ANNOTATIONS to the pod, e.g. for cost allocation or to toggle service
+// mesh injection. Those kube-plex sets take precedence.
+func addPodMetadata(pod *corev1.Pod) {
+	// validated in main
+	labels, _ := parsePodLabels()
+	annotations, _ := parsePodAnnotations()
+	for k, v := range labels {
+		if _, ok := pod.Labels[k]; !ok {
+			pod.Labels[k] = v
+		}
+	}
+	if len(annotations) > 0 && pod.Annotations == nil {
+		pod.Annotations = map[string]string{}
+	}
+	for k, v := range annotations {
+		if _, ok := pod.Annotations[k]; !ok {
+			pod.Annotations[k] = v
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+const (
+	// poolLabel tracks the state of pre-warmed transcoder pods
+	poolLabel   = "kube-plex/pool"
+	poolIdle    = "idle"
+	poolClaimed = "claimed"
+)
+
+// generatePoolPod returns an idle transcoder pod waiting for a session to
+// be exec'd into it
+func generatePoolPod() (*corev1.Pod, error) {
+	uid, err := parseID(plexUID)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing PLEX_UID: %w", err)
+	}
+	gid, err := parseID(plexGID)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing PLEX_GID: %w", err)
+	}
+	pod, err := generatePod("/", uid, gid, nil, []string{"sleep", "infinity"})
+	if err != nil {
+		return nil, err
+	}
+	pod.GenerateName = "pms-elastic-transcoder-pool-"
+	pod.Labels[poolLabel] = poolIdle
+	// the session the pod will run is unknown
+	pod.Spec.PriorityClassName = priorityClass
+	// idle pods don't keep their node from being scaled down, they're
+	// protected once claimed
+	delete(pod.Annotations, safeToEvictAnnotation)
+	delete(pod.Annotations, doNotDisruptAnnotation)
+	return pod, nil
+}
+
+// reconcilePool keeps size idle transcoder pods around
+func reconcilePool(ctx context.Context, cl kubernetes.Interface, ns string, size int) error {
+	pods, err := cl.CoreV1().Pods(ns).List(ctx, metav1.ListOptions{
+		LabelSelector: poolLabel + "=" + poolIdle,
+	})
+	if err != nil {
+		return err
+	}
+	idle := 0
+	for _, pod := range pods.Items {
+		if pod.DeletionTimestamp != nil || pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+			continue
+		}
+		idle++
+	}
+	for ; idle < size; idle++ {
+		pod, err := generatePoolPod()
+		if err != nil {
+			return err
+		}
+		pod, err = cl.CoreV1().Pods(ns).Create(ctx, pod, metav1.CreateOptions{})
+		if err != nil {
+			return fmt.Errorf("error creating pool pod: %w", err)
+		}
+		log.Printf("created pool pod %s", pod.Name)
+	}
+	return nil
+}
+
+// claimPoolPod takes ownership of a ready idle pod, adding the labels and
+// annotations of the session, it returns nil when none is available. Claims
+// go through an update so two sessions can't claim the same pod.
+func claimPoolPod(ctx context.Context, cl kubernetes.Interface, ns string, labels, annotations map[string]string) (*corev1.Pod, error) {
+	pods, err := cl.CoreV1().Pods(ns).List(ctx, metav1.ListOptions{
+		LabelSelector: poolLabel + "=" + poolIdle,
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if pod.DeletionTimestamp != nil || !isPodReady(pod) {
+			continue
+		}
+		pod.Labels[poolLabel] = poolClaimed
+		for k, v := range labels {
+			pod.Labels[k] = v
+		}
+		if len(annotations) > 0 && pod.Annotations == nil {
+			pod.Annotations = map[string]string{}
+		}
+		for k, v := range annotations {
+			pod.Annotations[k] = v
+		}
+		claimed, err := cl.CoreV1().Pods(ns).Update(ctx, pod, metav1.UpdateOptions{})
+		if apierrors.IsConflict(err) {
+			// claimed by another session
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return claimed, nil
+	}
+	return nil, nil
+}
+
+// poolExecScript changes to the session directory, exports the variables
+// read from stdin up to an empty line and runs the transcoder, whose stdin
+// is the rest. The environment isn't passed as arguments, those end up in
+// the audit log of the API server and in the process list of the pod.
+const poolExecScript = `cd "$0" || exit 1; while IFS= read -r kv && [ -n "$kv" ]; do export "$kv"; done; exec "$@"`
+
+// shellNameRe matches the variable names a POSIX shell can export
+var shellNameRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// runInPoolPod execs the session in a claimed pool pod from the working
+// directory and with the environment of the shim, filtered as for
+// transcode pods
+func runInPoolPod(ctx context.Context, cfg *rest.Config, cl kubernetes.Interface, pod *corev1.Pod, cwd string, env, args []string) (int, error) {
+	command := append([]string{"/bin/sh", "-c", poolExecScript, cwd}, expandNodeName(args, pod.Spec.NodeName)...)
+	var block strings.Builder
+	for _, kv := range filterEnv(env) {
+		name, value, _ := strings.Cut(kv, "=")
+		if !shellNameRe.MatchString(name) || strings.Contains(value, "\n") {
+			continue
+		}
+		block.WriteString(kv + "\n")
+	}
+	block.WriteString("\n")
+	stdin := io.MultiReader(strings.NewReader(block.String()), os.Stdin)
+
+	var stdout, stderr io.Writer = os.Stdout, os.Stderr
+	if transcoderLog != "" {
+		f, err := openTranscoderLog(pod)
+		if err != nil {
+			log.Printf("warning: unable to open transcoder log: %s", err)
+		} else {
+			defer f.Close()
+			stdout, stderr = io.MultiWriter(os.Stdout, f), io.MultiWriter(os.Stderr, f)
+		}
+	}
+	return execInPod(ctx, cfg, cl, pod, command, stdin, stdout, stderr)
+}
+
+func isPodReady(pod *corev1.Pod) bool {
+	if pod.Status.Phase != corev1.PodRunning {
+		return false
+	}
+	for _, cond := range pod.Status.Conditions {
+		if cond.Type == corev1.PodReady {
+			return cond.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/xml"
+	"os"
+	"path/filepath"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// transcoder quality settings of the Plex UI
+const (
+	transcoderQualityAuto        = "0"
+	transcoderQualitySpeed       = "1"
+	transcoderQualityQuality     = "2"
+	transcoderQualityMakeCPUHurt = "3"
+)
+
+// plexPreferences are the transcoder settings of Preferences.xml kube-plex
+// follows
+type plexPreferences struct {
+	TranscoderTempDirectory   string `xml:"TranscoderTempDirectory,attr"`
+	TranscoderQuality         string `xml:"TranscoderQuality,attr"`
+	HardwareAcceleratedCodecs string `xml:"HardwareAcceleratedCodecs,attr"`
+}
+
+// preferencesPath returns where PMS keeps Preferences.xml
+func preferencesPath() string {
+	if plexPreferencesPath != "" {
+		return plexPreferencesPath
+	}
+	dir := os.Getenv("PLEX_MEDIA_SERVER_APPLICATION_SUPPORT_DIR")
+	if dir == "" {
+		dir = "/config/Library/Application Support"
+	}
+	return filepath.Join(dir, "Plex Media Server", "Preferences.xml")
+}
+
+// transcodeDir returns where the transcode volume is mounted, TRANSCODE_DIR
+// or else the transcoder temp directory set in Plex so the paths PMS passes
+// the transcoder resolve in the pod
+func transcodeDir() string {
+	if transcodeDirectory != "" {
+		return transcodeDirectory
+	}
+	if prefs, err := readPreferences(preferencesPath()); err == nil && prefs.TranscoderTempDirectory != "" {
+		return prefs.TranscoderTempDirectory
+	}
+	return constDefaultTranscodeDir
+}
+
+// readPreferences reads the transcoder settings managed in the Plex UI
+func readPreferences(path string) (*plexPreferences, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	prefs := &plexPreferences{}
+	if err := xml.Unmarshal(data, prefs); err != nil {
+		return nil, err
+	}
+	return prefs, nil
+}
+
+// hardwareTranscoding reports whether hardware transcoding is enabled,
+// PMS enables it unless it was turned off
+func (p *plexPreferences) hardwareTranscoding() bool {
+	return p.HardwareAcceleratedCodecs != "0"
+}
+
+// cpuFactor returns how much more CPU the transcoder uses with the quality
+// setting, the presets PMS passes get slower as the quality goes up
+func (p *plexPreferences) cpuFactor() float64 {
+	switch p.TranscoderQuality {
+	case transcoderQualityQuality:
+		return 1.5
+	case transcoderQualityMakeCPUHurt:
+		return 2
+	}
+	return 1
+}
+
+// softwareRoutingRules drops the rules requesting devices, used when
+// hardware transcoding is turned off in Plex
+func softwareRoutingRules(rules []routingRule) []routingRule {
+	var out []routingRule
+	for _, r := range rules {
+		if len(r.Resources) == 0 {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+// scaleCPU multiplies the CPU requests and limits of the transcoder
+func scaleCPU(pod *corev1.Pod, factor float64) {
+	if factor == 1 {
+		return
+	}
+	resources := &pod.Spec.Containers[0].Resources
+	for _, list := range []corev1.ResourceList{resources.Requests, resources.Limits} {
+		if q, ok := list[corev1.ResourceCPU]; ok {
+			list[corev1.ResourceCPU] = *resource.NewMilliQuantity(int64(float64(q.MilliValue())*factor), resource.DecimalSI)
+		}
+	}
+}
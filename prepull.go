@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"log"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	prepullerName  = "kube-plex-prepuller"
+	prepullerPause = "registry.k8s.io/pause:3.9"
+)
+
+// generatePrepuller returns a DaemonSet pulling the transcoder image on every
+// node transcode pods can be scheduled on. The image is pulled by an init
+// container that exits right away, a pause container keeps the pod around.
+// Its pods aren't labelled as managed by kube-plex, which would count them
+// as transcode pods.
+func generatePrepuller(image string) *appsv1.DaemonSet {
+	labels := map[string]string{"app": prepullerName}
+	// placed like transcode pods
+	pod := &corev1.Pod{
+		Spec: corev1.PodSpec{
+			NodeSelector:     transcodeNodeSelector(),
+			ImagePullSecrets: imagePullSecrets(),
+			InitContainers: []corev1.Container{
+				{
+					Name:    "prepull",
+					Image:   image,
+					Command: []string{"true"},
+				},
+			},
+			Containers: []corev1.Container{
+				{
+					Name:  "pause",
+					Image: prepullerPause,
+				},
+			},
+		},
+	}
+	placeOnNodePool(pod)
+	hardenHelperPod(pod)
+	return &appsv1.DaemonSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: prepullerName,
+			Labels: map[string]string{
+				"app":          prepullerName,
+				managedByLabel: managedByValue,
+			},
+		},
+		Spec: appsv1.DaemonSetSpec{
+			Selector: &metav1.LabelSelector{
+				MatchLabels: labels,
+			},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: labels,
+				},
+				Spec: pod.Spec,
+			},
+		},
+	}
+}
+
+// prepullerChanged reports whether the pods of the current pre-puller differ
+// from the desired ones in what kube-plex sets
+func prepullerChanged(current, desired *appsv1.DaemonSet) bool {
+	c, d := current.Spec.Template, desired.Spec.Template
+	return c.Spec.InitContainers[0].Image != d.Spec.InitContainers[0].Image ||
+		!equality.Semantic.DeepEqual(c.Labels, d.Labels) ||
+		!equality.Semantic.DeepEqual(podSecurity(c.Spec), podSecurity(d.Spec)) ||
+		!equality.Semantic.DeepEqual(c.Spec.NodeSelector, d.Spec.NodeSelector) ||
+		!equality.Semantic.DeepEqual(c.Spec.Tolerations, d.Spec.Tolerations) ||
+		!equality.Semantic.DeepEqual(c.Spec.ImagePullSecrets, d.Spec.ImagePullSecrets)
+}
+
+// podSecurity returns the security context of the pod, the API server sets an
+// empty one when unset
+func podSecurity(spec corev1.PodSpec) corev1.PodSecurityContext {
+	if spec.SecurityContext == nil {
+		return corev1.PodSecurityContext{}
+	}
+	return *spec.SecurityContext
+}
+
+// reconcilePrepuller creates the pre-puller DaemonSet, updating it when the
+// transcoder image or the placement of transcode pods changes
+func reconcilePrepuller(ctx context.Context, cl kubernetes.Interface, ns, image string) error {
+	desired := generatePrepuller(image)
+
+	current, err := cl.AppsV1().DaemonSets(ns).Get(ctx, prepullerName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		if _, err := cl.AppsV1().DaemonSets(ns).Create(ctx, desired, metav1.CreateOptions{}); err != nil {
+			return err
+		}
+		log.Printf("created pre-puller for %s", image)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if !prepullerChanged(current, desired) {
+		return nil
+	}
+	current.Spec.Template = desired.Spec.Template
+	if _, err := cl.AppsV1().DaemonSets(ns).Update(ctx, current, metav1.UpdateOptions{}); err != nil {
+		return err
+	}
+	log.Printf("updated pre-puller to %s", image)
+	return nil
+}
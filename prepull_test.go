@@ -0,0 +1,38 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestGeneratePrepullerNodePool(t *testing.T) {
+	defer func(selector, taint string) { nodePoolSelector, nodePoolTaint = selector, taint }(nodePoolSelector, nodePoolTaint)
+	nodePoolSelector, nodePoolTaint = "pool=transcode", "dedicated=transcode:NoSchedule"
+
+	spec := generatePrepuller("plexinc/pms-docker").Spec.Template.Spec
+	wantSelector := map[string]string{"kubernetes.io/arch": "amd64", "pool": "transcode"}
+	if !reflect.DeepEqual(spec.NodeSelector, wantSelector) {
+		t.Errorf("NodeSelector = %v, want %v", spec.NodeSelector, wantSelector)
+	}
+	wantTolerations := []corev1.Toleration{{Key: "dedicated", Operator: corev1.TolerationOpEqual, Value: "transcode", Effect: corev1.TaintEffectNoSchedule}}
+	if !reflect.DeepEqual(spec.Tolerations, wantTolerations) {
+		t.Errorf("Tolerations = %v, want %v", spec.Tolerations, wantTolerations)
+	}
+}
+
+func TestGeneratePrepullerRestricted(t *testing.T) {
+	defer func(profile string) { securityProfile = profile }(securityProfile)
+	securityProfile = securityProfileRestricted
+
+	spec := generatePrepuller("plexinc/pms-docker").Spec.Template.Spec
+	if spec.SecurityContext == nil || spec.SecurityContext.RunAsUser == nil || *spec.SecurityContext.RunAsUser == 0 {
+		t.Fatalf("SecurityContext = %v, want a non-root user", spec.SecurityContext)
+	}
+	for _, c := range append(spec.InitContainers, spec.Containers...) {
+		if c.SecurityContext == nil || c.SecurityContext.AllowPrivilegeEscalation == nil || *c.SecurityContext.AllowPrivilegeEscalation {
+			t.Errorf("container %s isn't hardened", c.Name)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"regexp"
+	"strconv"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+var (
+	// ffmpeg prints the input duration once at startup and the current
+	// output position on every stats line
+	durationRe = regexp.MustCompile(`Duration: (\d+):(\d+):(\d+(?:\.\d+)?)`)
+	positionRe = regexp.MustCompile(`(?:time|out_time)=(\d+):(\d+):(\d+(?:\.\d+)?)`)
+)
+
+// followProgress follows the transcoder output of the pod and calls fn with
+// the completion percentage every time the transcoder reports its position.
+// It returns once the output ends.
+func followProgress(ctx context.Context, cl kubernetes.Interface, pod *corev1.Pod, fn func(percent float64)) error {
+	req := cl.CoreV1().Pods(pod.Namespace).GetLogs(pod.Name, &corev1.PodLogOptions{
+		Container: pod.Spec.Containers[0].Name,
+		Follow:    true,
+	})
+	logsReader, err := req.Stream(ctx)
+	if err != nil {
+		return err
+	}
+	defer logsReader.Close()
+
+	var duration time.Duration
+	scanner := bufio.NewScanner(logsReader)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if m := durationRe.FindStringSubmatch(line); m != nil && duration == 0 {
+			duration = parseTimestamp(m[1:])
+			continue
+		}
+		if m := positionRe.FindStringSubmatch(line); m != nil && duration > 0 {
+			fn(100 * float64(parseTimestamp(m[1:])) / float64(duration))
+		}
+	}
+	return scanner.Err()
+}
+
+// parseTimestamp converts the hours, minutes and seconds captured from an
+// ffmpeg HH:MM:SS.ms timestamp into a duration
+func parseTimestamp(parts []string) time.Duration {
+	h, _ := strconv.Atoi(parts[0])
+	m, _ := strconv.Atoi(parts[1])
+	s, _ := strconv.ParseFloat(parts[2], 64)
+	return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute + time.Duration(s*float64(time.Second))
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	ktesting "k8s.io/client-go/testing"
+)
+
+func TestFollowProgressTranscoderContainer(t *testing.T) {
+	pod := testPod("a", transcodeLabels(nil), corev1.PodRunning)
+	// sidecars come after the transcoder
+	pod.Spec.Containers = []corev1.Container{{Name: "plex"}, {Name: "relay"}}
+	cl := fake.NewSimpleClientset(pod)
+
+	if err := followProgress(context.Background(), cl, pod, func(float64) {}); err != nil {
+		t.Fatalf("followProgress() error = %s", err)
+	}
+	var container string
+	for _, action := range cl.Actions() {
+		if action.GetSubresource() != "log" {
+			continue
+		}
+		if opts, ok := action.(ktesting.GenericAction).GetValue().(*corev1.PodLogOptions); ok {
+			container = opts.Container
+		}
+	}
+	if container != "plex" {
+		t.Errorf("followed the logs of container %q, want plex", container)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// userQuotas are the limits on the concurrent transcodes of each Plex user
+type userQuotas struct {
+	// limit of the users without their own, unlimited when 0
+	def int
+	// limits by user name, as reported by PMS
+	users map[string]int
+}
+
+// parseUserQuotas parses MAX_TRANSCODES_PER_USER and the comma separated
+// user=limit pairs of USER_QUOTAS
+func parseUserQuotas(def, quotas string) (userQuotas, error) {
+	q := userQuotas{users: map[string]int{}}
+	if def != "" {
+		n, err := strconv.Atoi(def)
+		if err != nil || n < 0 {
+			return q, fmt.Errorf("invalid limit %q", def)
+		}
+		q.def = n
+	}
+	if quotas == "" {
+		return q, nil
+	}
+	for _, entry := range strings.Split(quotas, ",") {
+		user, limit, ok := strings.Cut(entry, "=")
+		user = strings.TrimSpace(user)
+		if !ok || user == "" {
+			return q, fmt.Errorf("invalid quota %q, expected user=limit", entry)
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(limit))
+		if err != nil || n < 0 {
+			return q, fmt.Errorf("invalid limit of user %q: %q", user, limit)
+		}
+		q.users[user] = n
+	}
+	return q, nil
+}
+
+// enabled reports whether any user is limited
+func (q userQuotas) enabled() bool {
+	return q.def > 0 || len(q.users) > 0
+}
+
+// limit returns the maximum number of concurrent transcodes of the user, 0
+// when unlimited
+func (q userQuotas) limit(user string) int {
+	if n, ok := q.users[user]; ok {
+		return n
+	}
+	return q.def
+}
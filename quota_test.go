@@ -0,0 +1,47 @@
+package main
+
+import "testing"
+
+func TestParseUserQuotas(t *testing.T) {
+	tests := []struct {
+		name        string
+		def, quotas string
+		want        map[string]int
+		wantEnabled bool
+		wantErr     bool
+	}{
+		{name: "unlimited", want: map[string]int{"alice": 0}},
+		{name: "default", def: "2", want: map[string]int{"alice": 2}, wantEnabled: true},
+		{
+			name:        "overrides",
+			def:         "2",
+			quotas:      "alice=1, kids = 0",
+			want:        map[string]int{"alice": 1, "kids": 0, "bob": 2},
+			wantEnabled: true,
+		},
+		{name: "override only", quotas: "alice=1", want: map[string]int{"alice": 1, "bob": 0}, wantEnabled: true},
+		{name: "negative default", def: "-1", wantErr: true},
+		{name: "missing limit", quotas: "alice", wantErr: true},
+		{name: "missing user", quotas: "=1", wantErr: true},
+		{name: "invalid limit", quotas: "alice=many", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, err := parseUserQuotas(tt.def, tt.quotas)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseUserQuotas() error = %v, want error %t", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if q.enabled() != tt.wantEnabled {
+				t.Errorf("enabled() = %t, want %t", q.enabled(), tt.wantEnabled)
+			}
+			for user, want := range tt.want {
+				if got := q.limit(user); got != want {
+					t.Errorf("limit(%s) = %d, want %d", user, got, want)
+				}
+			}
+		})
+	}
+}
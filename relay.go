@@ -0,0 +1,383 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/lrascao/kube-plex/pkg/s3"
+	"github.com/lrascao/kube-plex/pkg/signals"
+)
+
+const (
+	// address the relay sidecar receives the segment callbacks of the
+	// transcoder on
+	relayListenAddress = "127.0.0.1:32499"
+	// path the relay posts to once every segment was pushed
+	relayDonePath = "/.kube-plex-done"
+	// path the relay posts the files it stored in the bucket to
+	relayFetchPath = "/.kube-plex-fetch"
+	// header carrying the session token of the relay
+	relayTokenHeader = "X-Kube-Plex-Relay-Token"
+)
+
+// addSegmentRelay makes the transcode pod write its segments to a local
+// emptyDir instead of the transcode PVC. The segment callbacks of the
+// transcoder go through a relay sidecar, which pushes the new segments to
+// the shim at pushURL before forwarding the callback to PMS, so PMS never
+// hears of a segment it can't read yet. With an object prefix the relay
+// stores the segments in the S3 bucket instead and only tells the shim which
+// to fetch.
+func addSegmentRelay(pod *corev1.Pod, cwd, pushURL, token, objectPrefix string) {
+	for i := range pod.Spec.Volumes {
+		if pod.Spec.Volumes[i].Name == "transcode" {
+			pod.Spec.Volumes[i].VolumeSource = corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}
+		}
+	}
+
+	transcoder := &pod.Spec.Containers[0]
+	for i, v := range transcoder.Command {
+		if (v == "-segment_list" || v == "-manifest_name") && i+1 < len(transcoder.Command) {
+			transcoder.Command[i+1] = strings.Replace(transcoder.Command[i+1], pmsInternalAddress, "http://"+relayListenAddress, 1)
+		}
+	}
+
+	var mounts []corev1.VolumeMount
+	for _, m := range transcoder.VolumeMounts {
+		if m.Name == "transcode" {
+			mounts = append(mounts, m)
+		}
+	}
+	command := []string{
+		"/kube-plex", "relay",
+		"-dir", cwd,
+		"-push", pushURL,
+		"-pms", pmsInternalAddress,
+		"-listen", relayListenAddress,
+	}
+	env := []corev1.EnvVar{{Name: "RELAY_TOKEN", Value: token}}
+	if objectPrefix != "" {
+		command = append(command, "-s3-prefix", objectPrefix)
+		env = append(env,
+			corev1.EnvVar{Name: "S3_ENDPOINT", Value: s3Endpoint},
+			corev1.EnvVar{Name: "S3_REGION", Value: s3Region},
+			corev1.EnvVar{Name: "S3_BUCKET", Value: s3Bucket},
+			corev1.EnvVar{Name: "S3_ACCESS_KEY_ID", Value: s3AccessKeyID},
+			corev1.EnvVar{Name: "S3_SECRET_ACCESS_KEY", Value: s3SecretAccessKey},
+		)
+	}
+	always := corev1.ContainerRestartPolicyAlways
+	pod.Spec.InitContainers = append(pod.Spec.InitContainers, corev1.Container{
+		Name:          "relay",
+		Image:         kubePlexImage,
+		Command:       command,
+		Env:           env,
+		VolumeMounts:  mounts,
+		RestartPolicy: &always,
+	})
+}
+
+// segmentBucket returns the client of the S3 bucket of S3_ENDPOINT and
+// S3_BUCKET
+func segmentBucket() *s3.Client {
+	return &s3.Client{
+		Endpoint:        s3Endpoint,
+		Region:          s3Region,
+		Bucket:          s3Bucket,
+		AccessKeyID:     s3AccessKeyID,
+		SecretAccessKey: s3SecretAccessKey,
+	}
+}
+
+// sessionObjectPrefix returns the prefix of the objects of the segments of
+// the session in the bucket
+func sessionObjectPrefix(cwd string) string {
+	return s3Prefix + filepath.Base(cwd) + "/"
+}
+
+// relayToken returns a random token authenticating the relay of a session
+func relayToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// relayReceiver writes the files pushed by the relay of a session into the
+// session directory on the PMS side
+type relayReceiver struct {
+	dir   string
+	token string
+	url   string
+	srv   *http.Server
+	done  chan struct{}
+	once  sync.Once
+	// bucket the relay stores the files in and their prefix, when not
+	// pushed directly
+	bucket *s3.Client
+	prefix string
+}
+
+// startRelayReceiver listens for the pushes of the relay on an ephemeral
+// port of the address transcode pods reach the PMS pod at. With an object
+// prefix the files are fetched from the S3 bucket.
+func startRelayReceiver(dir, host, token, objectPrefix string) (*relayReceiver, error) {
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		return nil, err
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	r := &relayReceiver{
+		dir:   dir,
+		token: token,
+		url:   fmt.Sprintf("http://%s", net.JoinHostPort(host, fmt.Sprint(port))),
+		done:  make(chan struct{}),
+	}
+	if objectPrefix != "" {
+		r.bucket, r.prefix = segmentBucket(), objectPrefix
+	}
+	r.srv = &http.Server{Handler: r}
+	go func() {
+		if err := r.srv.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("warning: segment relay receiver stopped: %s", err)
+		}
+	}()
+	return r, nil
+}
+
+func (r *relayReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if subtle.ConstantTimeCompare([]byte(req.Header.Get(relayTokenHeader)), []byte(r.token)) != 1 {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if req.URL.Path == relayDonePath {
+		r.once.Do(func() { close(r.done) })
+		return
+	}
+
+	var err error
+	switch {
+	case r.bucket != nil && req.Method == http.MethodPost && strings.HasPrefix(req.URL.Path, relayFetchPath+"/"):
+		err = r.fetch(req.Context(), filepath.Clean("/"+strings.TrimPrefix(req.URL.Path, relayFetchPath)))
+	case r.bucket == nil && req.Method == http.MethodPut:
+		err = r.write(filepath.Clean("/"+req.URL.Path), req.Body)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// fetch downloads the file stored by the relay from the bucket, removing it
+// from the bucket once written
+func (r *relayReceiver) fetch(ctx context.Context, name string) error {
+	key := r.prefix + strings.TrimPrefix(filepath.ToSlash(name), "/")
+	body, err := r.bucket.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	if err := r.write(name, body); err != nil {
+		return err
+	}
+	if err := r.bucket.Delete(ctx, key); err != nil {
+		log.Printf("warning: unable to delete %s from the bucket: %s", key, err)
+	}
+	return nil
+}
+
+// write writes the file into the session directory
+func (r *relayReceiver) write(name string, body io.Reader) error {
+	path := filepath.Join(r.dir, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	// written aside and renamed, so PMS never reads a partial segment
+	f, err := os.CreateTemp(filepath.Dir(path), ".relay-*")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, body)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// wait waits for the relay to push the last segments, up to timeout
+func (r *relayReceiver) wait(timeout time.Duration) bool {
+	select {
+	case <-r.done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func (r *relayReceiver) close() {
+	r.srv.Close()
+}
+
+// relay pushes the files of the session directory to the shim as the
+// transcoder reports them to PMS
+type relay struct {
+	dir   string
+	push  string
+	token string
+	// bucket the files are stored in and their prefix, when not pushed
+	// directly
+	bucket *s3.Client
+	prefix string
+	// size and modification time of the files pushed
+	mu     sync.Mutex
+	pushed map[string]string
+}
+
+// runRelay implements the relay subcommand run as a sidecar of transcode
+// pods
+func runRelay(args []string) error {
+	var dir, push, pms, listen, objectPrefix string
+	fs := flag.NewFlagSet("relay", flag.ContinueOnError)
+	fs.StringVar(&dir, "dir", "", "session directory the transcoder writes to")
+	fs.StringVar(&push, "push", "", "URL the files are pushed to")
+	fs.StringVar(&pms, "pms", "", "address of PMS the callbacks are forwarded to")
+	fs.StringVar(&listen, "listen", relayListenAddress, "address the callbacks of the transcoder are received on")
+	fs.StringVar(&objectPrefix, "s3-prefix", "", "prefix of the objects the files are stored as in the S3 bucket, pushed directly when unset")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if dir == "" || push == "" || pms == "" {
+		return fmt.Errorf("usage: kube-plex relay -dir <dir> -push <url> -pms <url>")
+	}
+	target, err := url.Parse(pms)
+	if err != nil {
+		return fmt.Errorf("error parsing PMS address: %w", err)
+	}
+
+	r := &relay{dir: dir, push: strings.TrimSuffix(push, "/"), token: os.Getenv("RELAY_TOKEN"), pushed: map[string]string{}}
+	if objectPrefix != "" {
+		if s3Endpoint == "" || s3Bucket == "" {
+			return fmt.Errorf("S3_ENDPOINT and S3_BUCKET must be set to store segments in S3")
+		}
+		r.bucket, r.prefix = segmentBucket(), objectPrefix
+	}
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	srv := &http.Server{
+		Addr: listen,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if err := r.sync(req.Context()); err != nil {
+				log.Printf("error pushing segments: %s", err)
+				http.Error(w, err.Error(), http.StatusBadGateway)
+				return
+			}
+			req.Host = target.Host
+			proxy.ServeHTTP(w, req)
+		}),
+	}
+	go func() {
+		<-signals.SetupSignalHandler()
+		// the transcoder exited, push what it wrote last
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		if err := r.sync(ctx); err != nil {
+			log.Printf("error pushing segments: %s", err)
+		} else if err := r.send(ctx, http.MethodPost, relayDonePath, nil); err != nil {
+			log.Printf("error notifying the end of the session: %s", err)
+		}
+		srv.Close()
+	}()
+	log.Printf("relaying %s to %s", dir, push)
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// sync pushes the files of the session directory that changed since they
+// were last pushed
+func (r *relay) sync(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return filepath.WalkDir(r.dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		version := fmt.Sprintf("%d-%d", info.Size(), info.ModTime().UnixNano())
+		if r.pushed[path] == version {
+			return nil
+		}
+		rel, err := filepath.Rel(r.dir, path)
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		name := filepath.ToSlash(rel)
+		if r.bucket != nil {
+			// the transcoder may still be appending to it, store what was
+			// there when walked
+			if err := r.bucket.Put(ctx, r.prefix+name, io.LimitReader(f, info.Size()), info.Size()); err != nil {
+				return fmt.Errorf("%s: %w", rel, err)
+			}
+			if err := r.send(ctx, http.MethodPost, relayFetchPath+"/"+name, nil); err != nil {
+				return fmt.Errorf("%s: %w", rel, err)
+			}
+		} else if err := r.send(ctx, http.MethodPut, "/"+name, f); err != nil {
+			return fmt.Errorf("%s: %w", rel, err)
+		}
+		r.pushed[path] = version
+		return nil
+	})
+}
+
+func (r *relay) send(ctx context.Context, method, path string, body io.Reader) error {
+	req, err := http.NewRequestWithContext(ctx, method, r.push+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(relayTokenHeader, r.token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
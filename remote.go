@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// remoteCluster reports whether transcode pods run in another cluster than
+// PMS, e.g. a lab or cloud burst cluster
+func remoteCluster() bool {
+	return transcodeKubeconfig != "" || transcodeContext != ""
+}
+
+// buildTranscodeClient builds the client of the cluster transcode pods run
+// in and returns the namespace they're created in, TRANSCODE_NAMESPACE or
+// else the namespace of the context
+func buildTranscodeClient() (*rest.Config, kubernetes.Interface, string, error) {
+	cfg, ns, err := buildClusterConfig(transcodeKubeconfig, transcodeContext)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	if err := configureClient(cfg); err != nil {
+		return nil, nil, "", fmt.Errorf("error parsing %w", err)
+	}
+	cl, err := kubernetes.NewForConfig(cfg)
+	if err != nil {
+		return nil, nil, "", fmt.Errorf("error building kubernetes clientset: %w", err)
+	}
+	if transcodeNamespace != "" {
+		ns = transcodeNamespace
+	}
+	return cfg, cl, ns, nil
+}
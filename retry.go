@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilnet "k8s.io/apimachinery/pkg/util/net"
+	utilrand "k8s.io/apimachinery/pkg/util/rand"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// isTransientAPIError reports whether a failed API call may succeed when
+// retried: throttling, timeouts, unavailable servers and admission webhooks
+// failing to respond
+func isTransientAPIError(err error) bool {
+	if apierrors.IsTooManyRequests(err) || apierrors.IsServerTimeout(err) || apierrors.IsTimeout(err) ||
+		apierrors.IsServiceUnavailable(err) || apierrors.IsInternalError(err) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return utilnet.IsConnectionRefused(err) || utilnet.IsConnectionReset(err) || utilnet.IsProbableEOF(err)
+}
+
+// createWithRetry calls create until it succeeds, retrying transient API
+// errors with a jittered exponential backoff for at most deadline
+func createWithRetry(ctx context.Context, deadline time.Duration, create func(ctx context.Context) error) error {
+	ctx, cancel := context.WithTimeout(ctx, deadline)
+	defer cancel()
+
+	backoff := wait.Backoff{
+		Duration: 500 * time.Millisecond,
+		Factor:   2,
+		Jitter:   0.5,
+		Steps:    1 << 30,
+		Cap:      10 * time.Second,
+	}
+	for {
+		err := create(ctx)
+		if err == nil || !isTransientAPIError(err) {
+			return err
+		}
+		delay := backoff.Step()
+		log.Printf("warning: %s, retrying in %s", err, delay.Round(time.Millisecond))
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("giving up after %s: %w", deadline, err)
+		case <-time.After(delay):
+		}
+	}
+}
+
+// createNamed creates obj with createWithRetry under a name picked from its
+// GenerateName before the first attempt. An attempt timing out after the
+// server created the object is then retried under the same name, and the
+// object it created is fetched, rather than a second transcoder being
+// started under another name. obj is modified, callers pass a copy.
+func createNamed[T metav1.Object](ctx context.Context, deadline time.Duration, obj T,
+	create func(ctx context.Context, obj T) (T, error), get func(ctx context.Context, name string) (T, error)) (T, error) {
+	if obj.GetName() == "" && obj.GetGenerateName() != "" {
+		obj.SetName(obj.GetGenerateName() + utilrand.String(5))
+	}
+	var created T
+	retried := false
+	err := createWithRetry(ctx, deadline, func(ctx context.Context) error {
+		var err error
+		created, err = create(ctx, obj)
+		if apierrors.IsAlreadyExists(err) && retried {
+			created, err = get(ctx, obj.GetName())
+		}
+		retried = true
+		return err
+	})
+	return created, err
+}
+
+// deleteWithRetry calls del until it succeeds or the object is gone,
+// retrying transient API errors like createWithRetry, so sessions don't
+// leave their pods behind when the API server blips during cleanup
+func deleteWithRetry(ctx context.Context, deadline time.Duration, del func(ctx context.Context) error) error {
+	err := createWithRetry(ctx, deadline, del)
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+
+	"github.com/lrascao/kube-plex/pkg/ffmpeg"
+)
+
+// routeAnnotation records the routing rule a transcode pod was placed with
+const routeAnnotation = "kube-plex/route"
+
+// routingRule places sessions matching it on a node pool, e.g. tone mapping
+// sessions on GPU nodes requesting the device
+type routingRule struct {
+	Name string `json:"name"`
+	mediaMatch
+
+	// replaces the default node selector
+	NodeSelector map[string]string   `json:"nodeSelector,omitempty"`
+	Tolerations  []corev1.Toleration `json:"tolerations,omitempty"`
+	// extra resources requested by the transcoder, e.g. nvidia.com/gpu
+	Resources corev1.ResourceList `json:"resources,omitempty"`
+	// image used instead of the transcode image, e.g. one with GPU drivers
+	Image string `json:"image,omitempty"`
+	// runtime class used instead of RUNTIME_CLASS, e.g. nvidia
+	RuntimeClass string `json:"runtimeClass,omitempty"`
+}
+
+// parseRoutingRules parses the YAML list of rules in ROUTING_RULES
+func parseRoutingRules(in string) ([]routingRule, error) {
+	var rules []routingRule
+	if err := yaml.UnmarshalStrict([]byte(in), &rules); err != nil {
+		return nil, err
+	}
+	for i, r := range rules {
+		if r.Name == "" {
+			return nil, fmt.Errorf("rule %d has no name", i)
+		}
+	}
+	return rules, nil
+}
+
+// applyRoutingRule places the pod according to the first rule matching the
+// media parameters of the session, pods matching none keep the default
+// placement
+func applyRoutingRule(pod *corev1.Pod, rules []routingRule, inv ffmpeg.Invocation) {
+	for _, r := range rules {
+		if !r.matches(inv) {
+			continue
+		}
+		if r.NodeSelector != nil {
+			pod.Spec.NodeSelector = r.NodeSelector
+		}
+		pod.Spec.Tolerations = append(pod.Spec.Tolerations, r.Tolerations...)
+		if r.RuntimeClass != "" {
+			pod.Spec.RuntimeClassName = &r.RuntimeClass
+		}
+
+		container := &pod.Spec.Containers[0]
+		if r.Image != "" {
+			container.Image = r.Image
+		}
+		if len(r.Resources) > 0 {
+			if container.Resources.Requests == nil {
+				container.Resources.Requests = corev1.ResourceList{}
+			}
+			if container.Resources.Limits == nil {
+				container.Resources.Limits = corev1.ResourceList{}
+			}
+			// extended resources must have equal requests and limits
+			for name, q := range r.Resources {
+				container.Resources.Requests[name] = q.DeepCopy()
+				container.Resources.Limits[name] = q.DeepCopy()
+			}
+		}
+
+		if pod.Annotations == nil {
+			pod.Annotations = map[string]string{}
+		}
+		pod.Annotations[routeAnnotation] = r.Name
+		return
+	}
+}
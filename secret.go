@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+// extractSecretEnv moves the sensitive environment variables of the pod
+// containers into a Secret, so they're not readable by anyone with access
+// to pods. It returns nil when there are none.
+func extractSecretEnv(pod *corev1.Pod) *corev1.Secret {
+	data := map[string]string{}
+	extract := func(containers []corev1.Container) {
+		for i := range containers {
+			var env []corev1.EnvVar
+			moved := false
+			for _, e := range containers[i].Env {
+				if isSensitiveEnv(e.Name) && e.Value != "" && e.ValueFrom == nil {
+					data[e.Name] = e.Value
+					moved = true
+					continue
+				}
+				env = append(env, e)
+			}
+			containers[i].Env = env
+			if moved {
+				// the Secret name is only known once it's created
+				containers[i].EnvFrom = append(containers[i].EnvFrom, corev1.EnvFromSource{
+					SecretRef: &corev1.SecretEnvSource{},
+				})
+			}
+		}
+	}
+	extract(pod.Spec.InitContainers)
+	extract(pod.Spec.Containers)
+	if len(data) == 0 {
+		return nil
+	}
+
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: pod.GenerateName,
+			Namespace:    pod.Namespace,
+			Labels: map[string]string{
+				managedByLabel: managedByValue,
+				schemaLabel:    schemaVersion,
+			},
+		},
+		StringData: data,
+	}
+}
+
+// createSessionSecret creates the Secret holding the sensitive environment
+// of the session and points the pod containers at it
+func createSessionSecret(ctx context.Context, cl kubernetes.Interface, pod *corev1.Pod, secret *corev1.Secret, timeout time.Duration) (*corev1.Secret, error) {
+	secrets := cl.CoreV1().Secrets(secret.Namespace)
+	created, err := createNamed(ctx, timeout, secret, func(ctx context.Context, secret *corev1.Secret) (*corev1.Secret, error) {
+		return secrets.Create(ctx, secret, metav1.CreateOptions{})
+	}, func(ctx context.Context, name string) (*corev1.Secret, error) {
+		return secrets.Get(ctx, name, metav1.GetOptions{})
+	})
+	if err != nil {
+		// an attempt timing out may still have created it
+		if err := secrets.Delete(context.Background(), secret.Name, metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+			log.Printf("warning: unable to delete secret %q: %s", secret.Name, err)
+		}
+		return nil, err
+	}
+
+	setName := func(containers []corev1.Container) {
+		for i := range containers {
+			for _, from := range containers[i].EnvFrom {
+				if from.SecretRef != nil && from.SecretRef.Name == "" {
+					from.SecretRef.Name = created.Name
+				}
+			}
+		}
+	}
+	setName(pod.Spec.InitContainers)
+	setName(pod.Spec.Containers)
+	return created, nil
+}
+
+// ownSecret makes the Secret of the session owned by the object running it
+// alone, so it's deleted along with it even when the shim doesn't get to
+func ownSecret(ctx context.Context, cl kubernetes.Interface, secret *corev1.Secret, owner metav1.OwnerReference) error {
+	return setSecretOwners(ctx, cl, secret, []metav1.OwnerReference{owner})
+}
+
+// disownSecret keeps the Secret of the session from being deleted with the
+// pod running it, while that pod is replaced
+func disownSecret(ctx context.Context, cl kubernetes.Interface, secret *corev1.Secret) error {
+	return setSecretOwners(ctx, cl, secret, nil)
+}
+
+func setSecretOwners(ctx context.Context, cl kubernetes.Interface, secret *corev1.Secret, owners []metav1.OwnerReference) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{"ownerReferences": owners},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = cl.CoreV1().Secrets(secret.Namespace).Patch(ctx, secret.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+	return err
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// security profiles of transcode pods
+const (
+	// the restricted Pod Security Standard
+	securityProfileRestricted = "restricted"
+)
+
+// scratchDirs are writable in transcode pods with a read-only root
+// filesystem, besides the mounted volumes
+var scratchDirs = []string{"/var/tmp"}
+
+// validateSecurityProfile checks SECURITY_PROFILE is a known profile
+func validateSecurityProfile() error {
+	switch securityProfile {
+	case "", securityProfileRestricted:
+		return nil
+	}
+	return fmt.Errorf("unknown security profile %q, expected %s", securityProfile, securityProfileRestricted)
+}
+
+// hardenPod makes the pod pass the restricted Pod Security admission: it
+// runs as non-root with the runtime default seccomp profile, every container
+// drops all capabilities, can't escalate privileges and has a read-only root
+// filesystem with emptyDirs for scratch space
+func hardenPod(pod *corev1.Pod) {
+	if securityProfile != securityProfileRestricted {
+		return
+	}
+	nonRoot, escalation, readOnly := true, false, true
+	seccomp := &corev1.SeccompProfile{Type: corev1.SeccompProfileTypeRuntimeDefault}
+
+	if pod.Spec.SecurityContext == nil {
+		pod.Spec.SecurityContext = &corev1.PodSecurityContext{}
+	}
+	pod.Spec.SecurityContext.RunAsNonRoot = &nonRoot
+	pod.Spec.SecurityContext.SeccompProfile = seccomp
+
+	var mounts []corev1.VolumeMount
+	for i, dir := range scratchDirs {
+		name := fmt.Sprintf("scratch-%d", i)
+		pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{
+			Name:         name,
+			VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}},
+		})
+		mounts = append(mounts, corev1.VolumeMount{Name: name, MountPath: dir})
+	}
+
+	harden := func(containers []corev1.Container) {
+		for i := range containers {
+			c := &containers[i]
+			if c.SecurityContext == nil {
+				c.SecurityContext = &corev1.SecurityContext{}
+			}
+			c.SecurityContext.AllowPrivilegeEscalation = &escalation
+			c.SecurityContext.ReadOnlyRootFilesystem = &readOnly
+			c.SecurityContext.Capabilities = &corev1.Capabilities{
+				Drop: []corev1.Capability{"ALL"},
+			}
+			c.VolumeMounts = append(c.VolumeMounts, mounts...)
+		}
+	}
+	harden(pod.Spec.InitContainers)
+	harden(pod.Spec.Containers)
+}
+
+// nobody is the user helper pods run as when they run no transcoder, so
+// the restricted profile admits them whatever the user of their image
+const nobody = 65534
+
+// hardenHelperPod hardens a pod only pulling images or probing the cluster,
+// running it as nobody unless it sets its own user
+func hardenHelperPod(pod *corev1.Pod) {
+	if securityProfile != securityProfileRestricted {
+		return
+	}
+	if pod.Spec.SecurityContext == nil {
+		pod.Spec.SecurityContext = &corev1.PodSecurityContext{}
+	}
+	if pod.Spec.SecurityContext.RunAsUser == nil {
+		id := int64(nobody)
+		pod.Spec.SecurityContext.RunAsUser = &id
+		pod.Spec.SecurityContext.RunAsGroup = &id
+	}
+	hardenPod(pod)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/lrascao/kube-plex/pkg/ffmpeg"
+)
+
+const (
+	// labels and annotations correlating transcode pods with the sessions
+	// of the Plex dashboard. Label values are sanitized, the annotations
+	// hold the values as reported by PMS.
+	sessionLabel     = "kube-plex/session"
+	userLabel        = "kube-plex/user"
+	clientLabel      = "kube-plex/client"
+	userAnnotation   = "kube-plex/user"
+	clientAnnotation = "kube-plex/client"
+	titleAnnotation  = "kube-plex/title"
+)
+
+// sessionMetadata describes who is watching what in a session
+type sessionMetadata struct {
+	user   string
+	client string
+	title  string
+}
+
+// plexSession is an entry of the /status/sessions of PMS
+type plexSession struct {
+	Title            string `xml:"title,attr"`
+	GrandparentTitle string `xml:"grandparentTitle,attr"`
+	User             struct {
+		Title string `xml:"title,attr"`
+	} `xml:"User"`
+	Player struct {
+		Title   string `xml:"title,attr"`
+		Product string `xml:"product,attr"`
+	} `xml:"Player"`
+	TranscodeSession struct {
+		Key string `xml:"key,attr"`
+	} `xml:"TranscodeSession"`
+}
+
+// lookupSession queries PMS for the user, client and title of the transcode
+// session with the token PMS passes the transcoder
+func lookupSession(ctx context.Context, sessionID, token string) (*sessionMetadata, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(pmsInternalAddress, "/")+"/status/sessions", nil)
+	if err != nil {
+		return nil, err
+	}
+	// the token is passed in a header so it never shows in errors
+	req.Header.Set("X-Plex-Token", token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query PMS sessions: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unable to query PMS sessions: %s", resp.Status)
+	}
+
+	var sessions struct {
+		Items []plexSession `xml:",any"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&sessions); err != nil {
+		return nil, fmt.Errorf("unable to parse PMS sessions: %w", err)
+	}
+	for _, s := range sessions.Items {
+		if filepath.Base(s.TranscodeSession.Key) != sessionID {
+			continue
+		}
+		title := s.Title
+		if s.GrandparentTitle != "" {
+			title = s.GrandparentTitle + " - " + s.Title
+		}
+		client := s.Player.Title
+		if client == "" {
+			client = s.Player.Product
+		}
+		return &sessionMetadata{user: s.User.Title, client: client, title: title}, nil
+	}
+	return nil, fmt.Errorf("session %s not found in PMS", sessionID)
+}
+
+// addSessionMetadata labels the pod with the session it transcodes and, when
+// known, the user and client watching it. The title falls back to the name
+// of the input file.
+func addSessionMetadata(pod *corev1.Pod, inv ffmpeg.Invocation, meta *sessionMetadata) {
+	if pod.Annotations == nil {
+		pod.Annotations = map[string]string{}
+	}
+	if v := labelValue(inv.SessionID); v != "" {
+		pod.Labels[sessionLabel] = v
+	}
+	if meta == nil {
+		if inputs := inv.LocalInputs(); len(inputs) > 0 {
+			pod.Annotations[titleAnnotation] = filepath.Base(inputs[0])
+		}
+		return
+	}
+	if v := labelValue(meta.user); v != "" {
+		pod.Labels[userLabel] = v
+		pod.Annotations[userAnnotation] = meta.user
+	}
+	if v := labelValue(meta.client); v != "" {
+		pod.Labels[clientLabel] = v
+		pod.Annotations[clientAnnotation] = meta.client
+	}
+	if meta.title != "" {
+		pod.Annotations[titleAnnotation] = meta.title
+	}
+}
+
+// sessionMeta returns the session labels and annotations of the pod, set on
+// the pool pod claimed for the session along with the node autoscaler
+// annotations
+func sessionMeta(pod *corev1.Pod) (labels, annotations map[string]string) {
+	labels, annotations = map[string]string{}, map[string]string{}
+	for _, k := range []string{sessionLabel, userLabel, clientLabel} {
+		if v, ok := pod.Labels[k]; ok {
+			labels[k] = v
+		}
+	}
+	for _, k := range []string{userAnnotation, clientAnnotation, titleAnnotation, safeToEvictAnnotation, doNotDisruptAnnotation} {
+		if v, ok := pod.Annotations[k]; ok {
+			annotations[k] = v
+		}
+	}
+	return labels, annotations
+}
+
+var invalidLabelChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// labelValue turns s into a valid label value, which is at most 63
+// characters long and starts and ends with an alphanumeric character
+func labelValue(s string) string {
+	v := invalidLabelChars.ReplaceAllString(s, "_")
+	if len(v) > 63 {
+		v = v[:63]
+	}
+	return strings.Trim(v, "._-")
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/duration"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// runSessions lists the sessions running in transcode pods, or kills one
+func runSessions(args []string) error {
+	var kubeconfig, ns string
+
+	fs := flag.NewFlagSet("sessions", flag.ContinueOnError)
+	fs.StringVar(&kubeconfig, "kubeconfig", "", "path to the kubeconfig file")
+	fs.StringVar(&ns, "namespace", namespace, "namespace of the transcode pods (defaults to the kubeconfig namespace)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	cfg, defaultNs, err := buildCommandConfig(kubeconfig)
+	if err != nil {
+		return err
+	}
+	if ns == "" {
+		ns = defaultNs
+	}
+	cl, err := kubernetes.NewForConfig(cfg)
+	if err != nil {
+		return fmt.Errorf("error building kubernetes clientset: %w", err)
+	}
+
+	ctx := context.Background()
+	switch {
+	case fs.NArg() == 0 || (fs.NArg() == 1 && fs.Arg(0) == "list"):
+		return listSessions(ctx, cl, ns)
+	case fs.NArg() == 2 && fs.Arg(0) == "kill":
+		return killSession(ctx, cfg, cl, ns, fs.Arg(1))
+	}
+	return fmt.Errorf("usage: kube-plex sessions [flags] [list | kill <session or pod>]")
+}
+
+// sessionPods returns the transcode pods running sessions, leaving out idle
+// pool pods
+func sessionPods(ctx context.Context, cl kubernetes.Interface, ns string) ([]corev1.Pod, error) {
+	pods, err := listManagedPods(ctx, cl, ns)
+	if err != nil {
+		return nil, err
+	}
+	var out []corev1.Pod
+	for _, pod := range pods {
+		if pod.Labels[poolLabel] != poolIdle && pod.DeletionTimestamp == nil {
+			out = append(out, pod)
+		}
+	}
+	return out, nil
+}
+
+// listSessions prints the sessions with who is watching what, where they
+// run and the resources they use
+func listSessions(ctx context.Context, cl kubernetes.Interface, ns string) error {
+	pods, err := sessionPods(ctx, cl, ns)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "POD\tSESSION\tUSER\tTITLE\tNODE\tSTATUS\tCPU\tMEMORY\tAGE")
+	for i := range pods {
+		pod := &pods[i]
+		cpu, memory := "-", "-"
+		if pod.Status.Phase == corev1.PodRunning {
+			if usage, err := fetchPodMetrics(ctx, cl, pod, pod.Spec.Containers[0].Name); err == nil {
+				cpu, memory = usage.Cpu().String(), usage.Memory().String()
+			}
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			pod.Name,
+			orDash(pod.Labels[sessionLabel]),
+			orDash(pod.Annotations[userAnnotation]),
+			orDash(pod.Annotations[titleAnnotation]),
+			orDash(pod.Spec.NodeName),
+			pod.Status.Phase,
+			cpu, memory,
+			duration.HumanDuration(time.Since(pod.CreationTimestamp.Time)),
+		)
+	}
+	return w.Flush()
+}
+
+// killSession stops the transcoder of the session given its id or pod
+func killSession(ctx context.Context, cfg *rest.Config, cl kubernetes.Interface, ns, id string) error {
+	pod, err := findSession(ctx, cl, ns, id)
+	if err != nil {
+		return err
+	}
+	if err := stopSession(ctx, cfg, cl, pod); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stdout, "killed session in pod %s\n", pod.Name)
+	return nil
+}
+
+// findSession returns the pod running the session given its id or pod
+func findSession(ctx context.Context, cl kubernetes.Interface, ns, id string) (*corev1.Pod, error) {
+	pods, err := sessionPods(ctx, cl, ns)
+	if err != nil {
+		return nil, err
+	}
+	for i := range pods {
+		if pods[i].Name == id || pods[i].Labels[sessionLabel] == id {
+			return &pods[i], nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %q", errSessionNotFound, id)
+}
+
+var errSessionNotFound = errors.New("no such session")
+
+// stopSession stops the transcoder of the session, PMS sees the session
+// fail as if the transcoder had crashed and the shim cleans up its pod
+func stopSession(ctx context.Context, cfg *rest.Config, cl kubernetes.Interface, pod *corev1.Pod) error {
+	err := signalTranscoder(ctx, cfg, cl, pod, pod.Spec.Containers[0].Command[0], "TERM")
+	if err == nil {
+		return nil
+	}
+	// a deleted pod is recreated by the shim unless PMS stops the session,
+	// but the transcoder is gone right away
+	log.Printf("warning: unable to signal the transcoder, deleting pod %s: %s", pod.Name, err)
+	return cl.CoreV1().Pods(pod.Namespace).Delete(ctx, pod.Name, metav1.DeleteOptions{})
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	corev1 "k8s.io/api/core/v1"
+)
+
+// addSidecars runs the containers of SIDECARS alongside the transcoder, e.g.
+// log shippers or exporters. They're native sidecars, so the pod completes
+// when the transcoder exits, and mount the volumes the transcoder mounts at
+// the same paths, except those they mount at these paths themselves.
+func addSidecars(pod *corev1.Pod) {
+	// validated in main
+	sidecars, _ := parseContainers(sidecarContainers)
+	if len(sidecars) == 0 {
+		return
+	}
+	always := corev1.ContainerRestartPolicyAlways
+	transcoder := pod.Spec.Containers[0]
+	for _, c := range sidecars {
+		mounted := map[string]bool{}
+		for _, m := range c.VolumeMounts {
+			mounted[m.MountPath] = true
+		}
+		for _, m := range transcoder.VolumeMounts {
+			if !mounted[m.MountPath] {
+				c.VolumeMounts = append(c.VolumeMounts, m)
+			}
+		}
+		c.RestartPolicy = &always
+		pod.Spec.InitContainers = append(pod.Spec.InitContainers, c)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"sigs.k8s.io/yaml"
+
+	"github.com/lrascao/kube-plex/pkg/ffmpeg"
+)
+
+// mediaMatch selects sessions matching all of its criteria
+type mediaMatch struct {
+	MinHeight    int      `json:"minHeight,omitempty"`
+	SourceCodecs []string `json:"sourceCodecs,omitempty"`
+	Codecs       []string `json:"codecs,omitempty"`
+	MinBitrate   int      `json:"minBitrate,omitempty"`
+	ToneMapping  bool     `json:"toneMapping,omitempty"`
+}
+
+func (mm mediaMatch) matches(inv ffmpeg.Invocation) bool {
+	if inv.Height < mm.MinHeight || inv.Bitrate < mm.MinBitrate {
+		return false
+	}
+	if mm.ToneMapping && !inv.ToneMapping {
+		return false
+	}
+	return matchesCodec(mm.SourceCodecs, inv.SourceVideoCodec) && matchesCodec(mm.Codecs, inv.VideoCodec)
+}
+
+// matchesCodec reports whether codec starts with one of prefixes, an empty
+// list matches everything
+func matchesCodec(prefixes []string, codec string) bool {
+	if len(prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(codec, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// resourceProfile sizes transcode pods matching it
+type resourceProfile struct {
+	Name string `json:"name"`
+	mediaMatch
+
+	Requests corev1.ResourceList `json:"requests,omitempty"`
+	Limits   corev1.ResourceList `json:"limits,omitempty"`
+}
+
+func resources(cpu, memory string) corev1.ResourceList {
+	return corev1.ResourceList{
+		corev1.ResourceCPU:    resource.MustParse(cpu),
+		corev1.ResourceMemory: resource.MustParse(memory),
+	}
+}
+
+// defaultResourceProfiles is used when RESOURCE_PROFILES is unset, the
+// first matching profile wins
+var defaultResourceProfiles = []resourceProfile{
+	{Name: "remux", mediaMatch: mediaMatch{Codecs: []string{"copy"}}, Requests: resources("100m", "128Mi"), Limits: resources("1", "512Mi")},
+	{Name: "tonemap", mediaMatch: mediaMatch{ToneMapping: true}, Requests: resources("4", "1Gi"), Limits: resources("8", "4Gi")},
+	{Name: "4k", mediaMatch: mediaMatch{MinHeight: 2160}, Requests: resources("4", "1Gi"), Limits: resources("8", "4Gi")},
+	{Name: "1080p", mediaMatch: mediaMatch{MinHeight: 1080}, Requests: resources("2", "512Mi"), Limits: resources("4", "2Gi")},
+	{Name: "720p", mediaMatch: mediaMatch{MinHeight: 720}, Requests: resources("1", "256Mi"), Limits: resources("2", "1Gi")},
+	{Name: "sd", Requests: resources("500m", "256Mi"), Limits: resources("1", "1Gi")},
+}
+
+// parseResourceProfiles parses the YAML list of profiles in
+// RESOURCE_PROFILES, returning the default table when it's empty
+func parseResourceProfiles(in string) ([]resourceProfile, error) {
+	if in == "" {
+		return defaultResourceProfiles, nil
+	}
+	var profiles []resourceProfile
+	if err := yaml.UnmarshalStrict([]byte(in), &profiles); err != nil {
+		return nil, err
+	}
+	for i, p := range profiles {
+		if p.Name == "" {
+			return nil, fmt.Errorf("profile %d has no name", i)
+		}
+	}
+	return profiles, nil
+}
+
+// applyResourceProfile sizes the transcoder container with the first profile
+// matching the media parameters of the session, replacing LIMIT_CPU
+func applyResourceProfile(pod *corev1.Pod, profiles []resourceProfile, inv ffmpeg.Invocation) {
+	for _, p := range profiles {
+		if !p.matches(inv) {
+			continue
+		}
+		pod.Spec.Containers[0].Resources = corev1.ResourceRequirements{
+			Requests: p.Requests.DeepCopy(),
+			Limits:   p.Limits.DeepCopy(),
+		}
+		if pod.Annotations == nil {
+			pod.Annotations = map[string]string{}
+		}
+		pod.Annotations[resourceProfileAnnotation] = p.Name
+		return
+	}
+}
+
+// resourceProfileAnnotation records the profile a transcode pod was sized
+// with
+const resourceProfileAnnotation = "kube-plex/resource-profile"
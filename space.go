@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// policies applied when the transcode volume is short of free space
+const (
+	fullPolicyFail  = "fail"
+	fullPolicyQueue = "queue"
+	fullPolicyLocal = "local"
+)
+
+// errTranscodeVolumeFull is returned when a session can't be started
+// because the transcode volume is short of free space
+var errTranscodeVolumeFull = fmt.Errorf("transcode volume is short of free space")
+
+// freeSpaceThreshold is the free space the transcode volume must have for
+// sessions to start, in bytes or as a percentage of its size
+type freeSpaceThreshold struct {
+	bytes   int64
+	percent float64
+}
+
+// parseFreeSpaceThreshold parses MIN_TRANSCODE_FREE_SPACE, a quantity such
+// as 5Gi or a percentage such as 10%
+func parseFreeSpaceThreshold(s string) (freeSpaceThreshold, error) {
+	if s == "" {
+		return freeSpaceThreshold{}, nil
+	}
+	if p, ok := strings.CutSuffix(s, "%"); ok {
+		percent, err := strconv.ParseFloat(p, 64)
+		if err != nil || percent < 0 || percent > 100 {
+			return freeSpaceThreshold{}, fmt.Errorf("%q is not a percentage", s)
+		}
+		return freeSpaceThreshold{percent: percent}, nil
+	}
+	q, err := resource.ParseQuantity(s)
+	if err != nil {
+		return freeSpaceThreshold{}, fmt.Errorf("%q is neither a quantity nor a percentage: %w", s, err)
+	}
+	return freeSpaceThreshold{bytes: q.Value()}, nil
+}
+
+// validateFullPolicy checks TRANSCODE_FULL_POLICY is a known policy
+func validateFullPolicy(policy string) error {
+	switch policy {
+	case "", fullPolicyFail, fullPolicyQueue, fullPolicyLocal:
+		return nil
+	}
+	return fmt.Errorf("unknown policy %q, expected %s, %s or %s", policy, fullPolicyFail, fullPolicyQueue, fullPolicyLocal)
+}
+
+// freeSpace returns the space available to unprivileged users and the size
+// of the filesystem of dir
+func freeSpace(dir string) (free, size int64, err error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, 0, err
+	}
+	return int64(st.Bavail) * st.Bsize, int64(st.Blocks) * st.Bsize, nil
+}
+
+// below reports whether free bytes of a filesystem of size bytes are below
+// the threshold
+func (t freeSpaceThreshold) below(free, size int64) bool {
+	if t.percent > 0 {
+		return size > 0 && float64(free)*100/float64(size) < t.percent
+	}
+	return free < t.bytes
+}
+
+// waitForFreeSpace checks the transcode volume dir is on has the free space
+// of the threshold. With the queue policy it blocks until it does, with the
+// others it returns errTranscodeVolumeFull right away.
+func waitForFreeSpace(dir string, threshold freeSpaceThreshold, policy string, stopCh <-chan struct{}) error {
+	for {
+		free, size, err := freeSpace(dir)
+		if err != nil {
+			return err
+		}
+		if !threshold.below(free, size) {
+			return nil
+		}
+		available := resource.NewQuantity(free, resource.BinarySI)
+		if policy != fullPolicyQueue {
+			return fmt.Errorf("%w: %s available of %s required by MIN_TRANSCODE_FREE_SPACE", errTranscodeVolumeFull, available, minTranscodeFreeSpace)
+		}
+
+		log.Printf("transcode volume has %s available of %s required, waiting for free space", available, minTranscodeFreeSpace)
+		select {
+		case <-stopCh:
+			return fmt.Errorf("exit requested while waiting for free space")
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// how transcode pods are placed on spot nodes
+const (
+	spotNodesPrefer  = "prefer"
+	spotNodesRequire = "require"
+)
+
+var (
+	// segments written by the DASH and HLS muxers of the Plex Transcoder,
+	// chunk-stream0-00042.m4s and media-00042.ts, the video stream is used
+	// for DASH
+	dashSegmentRe = regexp.MustCompile(`^chunk-stream0-(\d+)\.m4s$`)
+	hlsSegmentRe  = regexp.MustCompile(`^media-(\d+)\.ts$`)
+)
+
+// validateSpotNodes checks SPOT_NODES and the spot node labels and taint
+func validateSpotNodes() error {
+	switch spotNodes {
+	case "":
+		return nil
+	case spotNodesPrefer, spotNodesRequire:
+	default:
+		return fmt.Errorf("unknown spot node placement %q, expected %s or %s", spotNodes, spotNodesPrefer, spotNodesRequire)
+	}
+	k, _, ok := strings.Cut(spotNodeSelector, "=")
+	if !ok || k == "" {
+		return fmt.Errorf("SPOT_NODE_SELECTOR must be a key=value node label")
+	}
+	_, err := parseToleration(spotToleration)
+	return err
+}
+
+// placeOnSpotNodes tolerates the taint of spot nodes and prefers, or
+// requires, scheduling the pod on them
+func placeOnSpotNodes(pod *corev1.Pod) {
+	if spotNodes == "" {
+		return
+	}
+	placeOnSpot(pod, spotNodes)
+}
+
+// placeOnSpot tolerates the taint of spot nodes and prefers or requires,
+// according to mode, scheduling the pod on them
+func placeOnSpot(pod *corev1.Pod, mode string) {
+	// validated in main
+	k, v, _ := strings.Cut(spotNodeSelector, "=")
+	if toleration, _ := parseToleration(spotToleration); toleration != nil {
+		pod.Spec.Tolerations = append(pod.Spec.Tolerations, *toleration)
+	}
+
+	if mode == spotNodesRequire {
+		if pod.Spec.NodeSelector == nil {
+			pod.Spec.NodeSelector = map[string]string{}
+		}
+		pod.Spec.NodeSelector[k] = v
+		return
+	}
+	if pod.Spec.Affinity == nil {
+		pod.Spec.Affinity = &corev1.Affinity{}
+	}
+	if pod.Spec.Affinity.NodeAffinity == nil {
+		pod.Spec.Affinity.NodeAffinity = &corev1.NodeAffinity{}
+	}
+	na := pod.Spec.Affinity.NodeAffinity
+	na.PreferredDuringSchedulingIgnoredDuringExecution = append(na.PreferredDuringSchedulingIgnoredDuringExecution, corev1.PreferredSchedulingTerm{
+		Weight: 100,
+		Preference: corev1.NodeSelectorTerm{
+			MatchExpressions: []corev1.NodeSelectorRequirement{
+				{Key: k, Operator: corev1.NodeSelectorOpIn, Values: []string{v}},
+			},
+		},
+	})
+}
+
+// resumeArgs returns the arguments resuming a streaming session whose
+// segments were partly written to dir before its pod was disrupted. The
+// last segment written may be incomplete and is transcoded again, the input
+// is seeked to its start. It returns false when the session can't be
+// resumed, and should be restarted from scratch.
+func resumeArgs(args []string, dir string) ([]string, bool) {
+	startFlag, segmentRe, start := "-segment_start_number", hlsSegmentRe, 0
+	if argValue(args, "-f") == "dash" {
+		startFlag, segmentRe, start = "-skip_to_segment", dashSegmentRe, 1
+	}
+	if v := argValue(args, startFlag); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, false
+		}
+		start = n
+	}
+	duration := segmentDuration(args)
+	if duration <= 0 || argIndex(args, "-i") < 0 {
+		return nil, false
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, false
+	}
+	last := -1
+	for _, e := range entries {
+		if m := segmentRe.FindStringSubmatch(e.Name()); m != nil {
+			if n, err := strconv.Atoi(m[1]); err == nil && n > last {
+				last = n
+			}
+		}
+	}
+	if last <= start {
+		return nil, false
+	}
+
+	seek := 0.0
+	if i := argIndex(args, "-ss"); i >= 0 && i < argIndex(args, "-i") {
+		if seek, err = strconv.ParseFloat(args[i+1], 64); err != nil {
+			return nil, false
+		}
+	}
+	seek += float64(last-start) * duration
+
+	out := setArg(args, startFlag, strconv.Itoa(last), len(args)-1)
+	return setArg(out, "-ss", strconv.FormatFloat(seek, 'f', 3, 64), argIndex(out, "-i")), true
+}
+
+// segmentDuration returns the target segment duration in seconds
+func segmentDuration(args []string) float64 {
+	if v := argValue(args, "-segment_time"); v != "" {
+		d, _ := strconv.ParseFloat(v, 64)
+		return d
+	}
+	if v := argValue(args, "-seg_duration"); v != "" {
+		d, _ := strconv.ParseFloat(v, 64)
+		return d
+	}
+	if v := argValue(args, "-min_seg_duration"); v != "" {
+		// in microseconds
+		d, _ := strconv.ParseFloat(v, 64)
+		return d / 1e6
+	}
+	return 0
+}
+
+// argIndex returns the index of the first flag in args, -1 when absent
+func argIndex(args []string, flag string) int {
+	for i, v := range args {
+		if v == flag && i+1 < len(args) {
+			return i
+		}
+	}
+	return -1
+}
+
+// argValue returns the value of the first flag in args
+func argValue(args []string, flag string) string {
+	if i := argIndex(args, flag); i >= 0 {
+		return args[i+1]
+	}
+	return ""
+}
+
+// setArg returns a copy of args with the value of flag replaced, inserting
+// the flag at index before when it's absent. -ss is only replaced when it
+// seeks the input, before the first -i.
+func setArg(args []string, flag, value string, before int) []string {
+	out := append([]string(nil), args...)
+	i := argIndex(out, flag)
+	if flag == "-ss" && i > argIndex(out, "-i") {
+		// an output seek
+		i = -1
+	}
+	if i >= 0 {
+		out[i+1] = value
+		return out
+	}
+	return append(out[:before], append([]string{flag, value}, args[before:]...)...)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// weight of the scheduling preference against a node per session it runs
+const sessionLoadWeight = 10
+
+// sessionsPerNode returns the number of active transcode pods on each node
+func sessionsPerNode(ctx context.Context, cl kubernetes.Interface, ns string) (map[string]int, error) {
+	pods, err := listManagedPods(ctx, cl, ns)
+	if err != nil {
+		return nil, err
+	}
+	load := map[string]int{}
+	for _, pod := range pods {
+		if pod.DeletionTimestamp != nil || pod.Labels[poolLabel] == poolIdle || pod.Spec.NodeName == "" {
+			continue
+		}
+		if pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+			continue
+		}
+		load[pod.Spec.NodeName]++
+	}
+	return load, nil
+}
+
+// preferLeastLoadedNodes makes the scheduler favour the nodes running the
+// fewest kube-plex sessions. Every node running sessions gets a preferred
+// node affinity term matching the other nodes, weighted by its sessions, so
+// a node scores lower the more sessions it runs.
+func preferLeastLoadedNodes(pod *corev1.Pod, load map[string]int) {
+	nodes := make([]string, 0, len(load))
+	for node := range load {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+	if len(nodes) == 0 {
+		return
+	}
+
+	if pod.Spec.Affinity == nil {
+		pod.Spec.Affinity = &corev1.Affinity{}
+	}
+	if pod.Spec.Affinity.NodeAffinity == nil {
+		pod.Spec.Affinity.NodeAffinity = &corev1.NodeAffinity{}
+	}
+	na := pod.Spec.Affinity.NodeAffinity
+	for _, node := range nodes {
+		weight := int32(load[node] * sessionLoadWeight)
+		if weight > 100 {
+			weight = 100
+		}
+		na.PreferredDuringSchedulingIgnoredDuringExecution = append(na.PreferredDuringSchedulingIgnoredDuringExecution, corev1.PreferredSchedulingTerm{
+			Weight: weight,
+			Preference: corev1.NodeSelectorTerm{
+				MatchFields: []corev1.NodeSelectorRequirement{
+					{Key: "metadata.name", Operator: corev1.NodeSelectorOpNotIn, Values: []string{node}},
+				},
+			},
+		})
+	}
+}
+
+// how concurrent transcode pods are spread across nodes
+const (
+	spreadPrefer  = "prefer"
+	spreadRequire = "require"
+)
+
+// validateSpreadTranscodes checks SPREAD_TRANSCODES
+func validateSpreadTranscodes() error {
+	switch spreadTranscodes {
+	case "", spreadPrefer, spreadRequire:
+		return nil
+	}
+	return fmt.Errorf("unknown spread %q, expected %s or %s", spreadTranscodes, spreadPrefer, spreadRequire)
+}
+
+// spreadSessions keeps the pod away from the nodes, or the topology domains
+// of SPREAD_TOPOLOGY_KEY, running other sessions, so N concurrent
+// transcodes prefer, or require, N different nodes
+func spreadSessions(pod *corev1.Pod) {
+	if spreadTranscodes == "" {
+		return
+	}
+	term := corev1.PodAffinityTerm{
+		LabelSelector: &metav1.LabelSelector{
+			MatchExpressions: []metav1.LabelSelectorRequirement{
+				{Key: sessionLabel, Operator: metav1.LabelSelectorOpExists},
+			},
+		},
+		TopologyKey: spreadTopologyKey,
+	}
+	if pod.Spec.Affinity == nil {
+		pod.Spec.Affinity = &corev1.Affinity{}
+	}
+	if pod.Spec.Affinity.PodAntiAffinity == nil {
+		pod.Spec.Affinity.PodAntiAffinity = &corev1.PodAntiAffinity{}
+	}
+	anti := pod.Spec.Affinity.PodAntiAffinity
+	if spreadTranscodes == spreadRequire {
+		anti.RequiredDuringSchedulingIgnoredDuringExecution = append(anti.RequiredDuringSchedulingIgnoredDuringExecution, term)
+		return
+	}
+	anti.PreferredDuringSchedulingIgnoredDuringExecution = append(anti.PreferredDuringSchedulingIgnoredDuringExecution, corev1.WeightedPodAffinityTerm{
+		Weight:          100,
+		PodAffinityTerm: term,
+	})
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// podMetrics is the subset of metrics.k8s.io/v1beta1 PodMetrics used
+type podMetrics struct {
+	Containers []struct {
+		Name  string              `json:"name"`
+		Usage corev1.ResourceList `json:"usage"`
+	} `json:"containers"`
+}
+
+// cfsStats are the CFS counters of a container, the share of throttled
+// periods tells whether the CPU limit is holding the transcoder back
+type cfsStats struct {
+	periods, throttled float64
+}
+
+// reportStats logs the CPU usage, memory working set and CPU throttling of
+// the transcoder every interval until ctx is cancelled
+func reportStats(ctx context.Context, cl kubernetes.Interface, pod *corev1.Pod, interval time.Duration) {
+	container := pod.Spec.Containers[0].Name
+	var nodeName string
+	var last cfsStats
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+
+		if nodeName == "" {
+			current, err := cl.CoreV1().Pods(pod.Namespace).Get(ctx, pod.Name, metav1.GetOptions{})
+			if err != nil {
+				continue
+			}
+			nodeName = current.Spec.NodeName
+		}
+
+		var fields []string
+		usage, err := fetchPodMetrics(ctx, cl, pod, container)
+		if err == nil {
+			fields = append(fields, fmt.Sprintf("cpu=%s memory=%s", usage.Cpu(), usage.Memory()))
+		} else if !apierrors.IsNotFound(err) && ctx.Err() == nil {
+			log.Printf("warning: unable to read metrics of pod %q: %s", pod.Name, err)
+		}
+		if nodeName != "" {
+			cfs, err := fetchCFSStats(ctx, cl, nodeName, pod, container)
+			if err == nil && cfs.periods > last.periods {
+				throttled := 100 * (cfs.throttled - last.throttled) / (cfs.periods - last.periods)
+				fields = append(fields, fmt.Sprintf("throttled=%.0f%%", throttled))
+				last = cfs
+			} else if err != nil && ctx.Err() == nil {
+				log.Printf("warning: unable to read cAdvisor stats of pod %q: %s", pod.Name, err)
+			}
+		}
+		if len(fields) > 0 {
+			log.Printf("stats of pod %s: %s", pod.Name, strings.Join(fields, " "))
+		}
+	}
+}
+
+// fetchPodMetrics returns the usage of the container reported by the
+// metrics API
+func fetchPodMetrics(ctx context.Context, cl kubernetes.Interface, pod *corev1.Pod, container string) (corev1.ResourceList, error) {
+	body, err := cl.CoreV1().RESTClient().Get().
+		AbsPath("/apis/metrics.k8s.io/v1beta1/namespaces", pod.Namespace, "pods", pod.Name).
+		DoRaw(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var metrics podMetrics
+	if err := json.Unmarshal(body, &metrics); err != nil {
+		return nil, err
+	}
+	for _, c := range metrics.Containers {
+		if c.Name == container {
+			return c.Usage, nil
+		}
+	}
+	return corev1.ResourceList{corev1.ResourceCPU: resource.Quantity{}, corev1.ResourceMemory: resource.Quantity{}}, nil
+}
+
+// fetchCFSStats reads the CFS counters of the container from the cAdvisor
+// metrics of the kubelet running it
+func fetchCFSStats(ctx context.Context, cl kubernetes.Interface, nodeName string, pod *corev1.Pod, container string) (cfsStats, error) {
+	body, err := cl.CoreV1().RESTClient().Get().
+		AbsPath("/api/v1/nodes", nodeName, "proxy/metrics/cadvisor").
+		DoRaw(ctx)
+	if err != nil {
+		return cfsStats{}, err
+	}
+
+	var stats cfsStats
+	labels := fmt.Sprintf(`container=%q`, container)
+	podLabel := fmt.Sprintf(`pod=%q`, pod.Name)
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.Contains(line, labels) || !strings.Contains(line, podLabel) {
+			continue
+		}
+		var target *float64
+		switch {
+		case strings.HasPrefix(line, "container_cpu_cfs_periods_total{"):
+			target = &stats.periods
+		case strings.HasPrefix(line, "container_cpu_cfs_throttled_periods_total{"):
+			target = &stats.throttled
+		default:
+			continue
+		}
+		// name{labels} value [timestamp]
+		fields := strings.Fields(line[strings.LastIndex(line, "}")+1:])
+		if len(fields) > 0 {
+			*target, _ = strconv.ParseFloat(fields[0], 64)
+		}
+	}
+	return stats, scanner.Err()
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// errSessionEnded is returned by the tasks that end a session, cancelling
+// every other task of the group
+var errSessionEnded = errors.New("session ended")
+
+const (
+	// number of times a failed task is restarted before it's given up on
+	taskRestarts = 5
+	// maximum delay between restarts
+	taskMaxBackoff = 30 * time.Second
+)
+
+// supervise returns a task for an errgroup running fn until it returns nil
+// or ctx is cancelled. Failures restart it with a growing delay, up to
+// taskRestarts times, after which it's given up on without failing the
+// group: a broken log stream must not end the session. Logs can't be read
+// before the container starts, such failures aren't counted.
+func supervise(ctx context.Context, name string, fn func(ctx context.Context) error) func() error {
+	return func() error {
+		backoff := time.Second
+		for restarts := 0; ; {
+			err := fn(ctx)
+			if err == nil || ctx.Err() != nil {
+				return nil
+			}
+			if !apierrors.IsBadRequest(err) {
+				if restarts == taskRestarts {
+					log.Printf("warning: giving up on %s after %d restarts: %s", name, restarts, err)
+					return nil
+				}
+				restarts++
+				log.Printf("warning: %s failed, restarting: %s", name, err)
+			}
+
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(backoff):
+			}
+			if backoff *= 2; backoff > taskMaxBackoff {
+				backoff = taskMaxBackoff
+			}
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// terminateTranscoder asks the transcoder in the pod to exit and waits up to
+// grace for it, so the segments it's writing are flushed and PMS sees the
+// session end cleanly before the pod is deleted
+func terminateTranscoder(ctx context.Context, cfg *rest.Config, cl kubernetes.Interface, pod *corev1.Pod, transcoder string, grace time.Duration) {
+	if grace <= 0 {
+		return
+	}
+	log.Printf("terminating transcoder in pod %s", pod.Name)
+	err := signalTranscoder(ctx, cfg, cl, pod, transcoder, "TERM")
+	if errors.Is(err, errTranscoderNotRunning) {
+		return
+	}
+	if err != nil {
+		log.Printf("warning: unable to terminate transcoder in pod %q: %s", pod.Name, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, grace)
+	defer cancel()
+	if result := waitForPodCompletion(ctx, cl, pod, waitOptions{pollInterval: time.Second}); result.outcome == podWaitFailed {
+		log.Printf("warning: transcoder in pod %q didn't exit within %s", pod.Name, grace)
+	}
+}
+
+// setTermination sets how long the transcode pod may run, how long the
+// kubelet gives it to exit before killing it, and the command run in the
+// transcoder container before it's sent SIGTERM, so segments and EAE are
+// flushed
+func setTermination(pod *corev1.Pod) {
+	if terminationGracePeriod != "" {
+		if grace, err := time.ParseDuration(terminationGracePeriod); err == nil {
+			seconds := int64(grace.Seconds())
+			pod.Spec.TerminationGracePeriodSeconds = &seconds
+		}
+	}
+	if maxTranscodeDuration != "" {
+		if limit, err := time.ParseDuration(maxTranscodeDuration); err == nil && limit > 0 {
+			seconds := int64(limit.Seconds())
+			pod.Spec.ActiveDeadlineSeconds = &seconds
+		}
+	}
+	if preStopCommand != "" {
+		pod.Spec.Containers[0].Lifecycle = &corev1.Lifecycle{
+			PreStop: &corev1.LifecycleHandler{
+				Exec: &corev1.ExecAction{Command: []string{"/bin/sh", "-c", preStopCommand}},
+			},
+		}
+	}
+}
+
+// deletePod deletes the transcode pod, giving it DELETE_GRACE_PERIOD to
+// exit. With FORCE_DELETE it waits that long for the pod to be gone and then
+// deletes it again without a grace period, so pods stuck terminating on an
+// unresponsive node don't outlive their session.
+func deletePod(ctx context.Context, cl kubernetes.Interface, pod *corev1.Pod, deadline time.Duration) error {
+	var opts metav1.DeleteOptions
+	if deleteGracePeriod != "" {
+		// validated in main
+		grace, _ := time.ParseDuration(deleteGracePeriod)
+		seconds := int64(grace.Seconds())
+		opts.GracePeriodSeconds = &seconds
+	}
+	err := deleteWithRetry(ctx, deadline, func(ctx context.Context) error {
+		return cl.CoreV1().Pods(pod.Namespace).Delete(ctx, pod.Name, opts)
+	})
+	if err != nil || forceDelete == "" {
+		return err
+	}
+
+	// validated in main
+	timeout, _ := time.ParseDuration(forceDelete)
+	if waitForPodDeletion(ctx, cl, pod, timeout) {
+		return nil
+	}
+	log.Printf("warning: pod %s still terminating after %s, force deleting it", pod.Name, timeout)
+	var zero int64
+	return deleteWithRetry(ctx, deadline, func(ctx context.Context) error {
+		return cl.CoreV1().Pods(pod.Namespace).Delete(ctx, pod.Name, metav1.DeleteOptions{GracePeriodSeconds: &zero})
+	})
+}
+
+// waitForPodDeletion reports whether the pod is gone within timeout
+func waitForPodDeletion(ctx context.Context, cl kubernetes.Interface, pod *corev1.Pod, timeout time.Duration) bool {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	for {
+		current, err := cl.CoreV1().Pods(pod.Namespace).Get(ctx, pod.Name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) || (err == nil && current.UID != pod.UID) {
+			return true
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(time.Second):
+		}
+	}
+}
@@ -0,0 +1,377 @@
+// Package e2e runs kube-plex sessions against a cluster prepared by run.sh
+// and verifies the full start, progress, segments and cleanup flow of every
+// execution mode.
+package e2e
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+const (
+	namespace  = "kube-plex-e2e"
+	image      = "kube-plex-e2e:e2e"
+	transcoder = "/usr/local/bin/fake-transcoder"
+)
+
+// scenario is a single session run in one of the execution modes
+type scenario struct {
+	name string
+	// extra environment of the shim
+	env []string
+	// setup runs before the session and returns a function undoing it
+	setup func(ctx context.Context, cl kubernetes.Interface) (func(), error)
+	// relay is set when the segments are pushed to the shim rather than
+	// written to the transcode volume
+	relay bool
+}
+
+var (
+	binary       = flag.String("binary", "", "path to the kube-plex binary under test, the tests are skipped when unset")
+	relayAddress = flag.String("relay-address", "", "address of this host transcode pods reach, the relay scenario is skipped when unset")
+	soak         = flag.Int("soak", 0, "instead of the scenarios, run this many short sessions and check nothing leaked")
+	parallel     = flag.Int("parallel", 4, "number of sessions running at once in soak mode")
+)
+
+// client returns the client of the cluster prepared by run.sh, skipping the
+// test when not run by it
+func client(t *testing.T) kubernetes.Interface {
+	t.Helper()
+	if *binary == "" {
+		t.Skip("e2e tests run against a kind cluster, see test/e2e/run.sh")
+	}
+	cfg, err := clientcmd.BuildConfigFromFlags("", os.Getenv("KUBECONFIG"))
+	if err != nil {
+		t.Fatalf("Error building kubeconfig: %s", err)
+	}
+	cl, err := kubernetes.NewForConfig(cfg)
+	if err != nil {
+		t.Fatalf("Error building kubernetes clientset: %s", err)
+	}
+	return cl
+}
+
+func TestSessions(t *testing.T) {
+	cl := client(t)
+	if *soak > 0 {
+		t.Skip("soak mode")
+	}
+
+	scenarios := []scenario{
+		{name: "pod"},
+		{name: "job", env: []string{"JOB_MODE=true"}},
+		{name: "pool", env: []string{"TRANSCODER_POOL=true"}, setup: startController},
+		{name: "relay", env: []string{"SEGMENT_RELAY=true", "KUBE_PLEX_IMAGE=" + image, "RELAY_ADDRESS=" + *relayAddress}, relay: true},
+	}
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			if s.relay && *relayAddress == "" {
+				t.Skip("-relay-address isn't set")
+			}
+			if err := run(context.Background(), cl, s); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestSoak(t *testing.T) {
+	cl := client(t)
+	if *soak == 0 {
+		t.Skip("-soak isn't set")
+	}
+	if err := runSoak(context.Background(), cl, *soak, *parallel); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func run(ctx context.Context, cl kubernetes.Interface, s scenario) error {
+	if s.setup != nil {
+		teardown, err := s.setup(ctx, cl)
+		if err != nil {
+			return fmt.Errorf("setup: %w", err)
+		}
+		defer teardown()
+	}
+
+	before, err := progressCount(ctx, cl)
+	if err != nil {
+		return err
+	}
+
+	// relayed segments are pushed to the directory of the shim, written
+	// relative to it by the transcoder. It's under /tmp, which transcode pods
+	// mount the transcode volume at, for the relay to see them.
+	dir, output := "/tmp", fmt.Sprintf("/transcode/e2e-%s/out.m3u8", s.name)
+	if s.relay {
+		if dir, err = os.MkdirTemp("/tmp", "e2e-relay-"); err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		output = "out.m3u8"
+	}
+	if _, err := runShim(dir, s.env, "-progressurl", "http://127.0.0.1:32400/video/:/transcode/session/e2e/progress", output); err != nil {
+		return fmt.Errorf("session: %w", err)
+	}
+
+	after, err := progressCount(ctx, cl)
+	if err != nil {
+		return err
+	}
+	if after <= before {
+		return fmt.Errorf("no progress reported to PMS")
+	}
+	if s.relay {
+		for _, name := range []string{"segment-3.ts", output} {
+			if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+				return fmt.Errorf("segments: %w", err)
+			}
+		}
+	} else if err := checkFile(ctx, cl, output); err != nil {
+		return fmt.Errorf("segments: %w", err)
+	}
+	return checkNoLeftovers(ctx, cl)
+}
+
+// runSoak runs n short sessions, at most parallel at once, and verifies none
+// of them leaked goroutines and that no pods, secrets or configmaps were left
+// behind
+func runSoak(ctx context.Context, cl kubernetes.Interface, n, parallel int) error {
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		failed []string
+	)
+	sem := make(chan struct{}, parallel)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			output := fmt.Sprintf("/transcode/e2e-soak/%d/out.m3u8", i)
+			out, err := runShim("/tmp", []string{"LEAK_CHECK=true"}, output)
+			if err == nil && strings.Contains(out, "leak check:") {
+				err = fmt.Errorf("goroutines leaked")
+			}
+			if err != nil {
+				mu.Lock()
+				failed = append(failed, fmt.Sprintf("session %d: %s", i, err))
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if len(failed) > 0 {
+		return fmt.Errorf("%d of %d sessions failed:\n%s", len(failed), n, strings.Join(failed, "\n"))
+	}
+	return checkNoLeftovers(ctx, cl)
+}
+
+// runShim invokes kube-plex in dir the way PMS invokes Plex Transcoder,
+// returning its output
+func runShim(dir string, env []string, args ...string) (string, error) {
+	abs, err := filepath.Abs(*binary)
+	if err != nil {
+		return "", err
+	}
+	var out bytes.Buffer
+	cmd := exec.Command(abs, args...)
+	cmd.Args[0] = transcoder
+	cmd.Dir = dir
+	cmd.Stdout = io.MultiWriter(os.Stdout, &out)
+	cmd.Stderr = io.MultiWriter(os.Stderr, &out)
+	cmd.Env = append(os.Environ(),
+		"KUBE_NAMESPACE="+namespace,
+		"PMS_IMAGE="+image,
+		// the image is only loaded into the kind nodes
+		"IMAGE_PULL_POLICY=Never",
+		"PMS_INTERNAL_ADDRESS=http://pms-stub:32400",
+		"DATA_PVC=data",
+		"CONFIG_PVC=config",
+		"TRANSCODE_PVC=transcode",
+		"PLEX_UID=0",
+		"PLEX_GID=0",
+	)
+	cmd.Env = append(cmd.Env, env...)
+	err = cmd.Run()
+	return out.String(), err
+}
+
+// startController runs the kube-plex controller keeping a single pool pod
+// and waits for it to become ready
+func startController(ctx context.Context, cl kubernetes.Interface) (func(), error) {
+	cmd := exec.Command(*binary, "controller", "-namespace", namespace, "-pool-size", "1", "-interval", "2s")
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(),
+		"PMS_IMAGE="+image,
+		// the image is only loaded into the kind nodes
+		"IMAGE_PULL_POLICY=Never",
+		"DATA_PVC=data",
+		"CONFIG_PVC=config",
+		"TRANSCODE_PVC=transcode",
+		"PLEX_UID=0",
+		"PLEX_GID=0",
+	)
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	teardown := func() {
+		cmd.Process.Signal(os.Interrupt)
+		cmd.Wait()
+		cl.CoreV1().Pods(namespace).DeleteCollection(ctx, metav1.DeleteOptions{}, metav1.ListOptions{
+			LabelSelector: "kube-plex/pool",
+		})
+	}
+
+	err := waitFor(2*time.Minute, func() (bool, error) {
+		pods, err := cl.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{LabelSelector: "kube-plex/pool=idle"})
+		if err != nil {
+			return false, err
+		}
+		for _, pod := range pods.Items {
+			for _, cond := range pod.Status.Conditions {
+				if cond.Type == corev1.PodReady && cond.Status == corev1.ConditionTrue {
+					return true, nil
+				}
+			}
+		}
+		return false, nil
+	})
+	if err != nil {
+		teardown()
+		return nil, fmt.Errorf("waiting for pool pod: %w", err)
+	}
+	return teardown, nil
+}
+
+func progressCount(ctx context.Context, cl kubernetes.Interface) (int64, error) {
+	body, err := cl.CoreV1().Services(namespace).ProxyGet("http", "pms-stub", "32400", "/stats", nil).DoRaw(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("querying PMS stub: %w", err)
+	}
+	var stats struct {
+		Progress int64 `json:"progress"`
+	}
+	if err := json.Unmarshal(body, &stats); err != nil {
+		return 0, err
+	}
+	return stats.Progress, nil
+}
+
+// checkFile verifies a file exists in the transcode volume by running a pod
+// testing for it
+func checkFile(ctx context.Context, cl kubernetes.Interface, path string) error {
+	pod, err := cl.CoreV1().Pods(namespace).Create(ctx, &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{GenerateName: "e2e-check-"},
+		Spec: corev1.PodSpec{
+			RestartPolicy: corev1.RestartPolicyNever,
+			Containers: []corev1.Container{
+				{
+					Name:            "check",
+					Image:           image,
+					ImagePullPolicy: corev1.PullNever,
+					Command:         []string{"test", "-f", path},
+					VolumeMounts:    []corev1.VolumeMount{{Name: "transcode", MountPath: "/transcode"}},
+				},
+			},
+			Volumes: []corev1.Volume{
+				{
+					Name: "transcode",
+					VolumeSource: corev1.VolumeSource{
+						PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: "transcode"},
+					},
+				},
+			},
+		},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return err
+	}
+	defer cl.CoreV1().Pods(namespace).Delete(ctx, pod.Name, metav1.DeleteOptions{})
+
+	var phase corev1.PodPhase
+	err = waitFor(time.Minute, func() (bool, error) {
+		pod, err := cl.CoreV1().Pods(namespace).Get(ctx, pod.Name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		phase = pod.Status.Phase
+		return phase == corev1.PodSucceeded || phase == corev1.PodFailed, nil
+	})
+	if err != nil {
+		return err
+	}
+	if phase != corev1.PodSucceeded {
+		return fmt.Errorf("%s not found", path)
+	}
+	return nil
+}
+
+// checkNoLeftovers verifies every pod, job, secret and configmap created for the
+// sessions has been removed
+func checkNoLeftovers(ctx context.Context, cl kubernetes.Interface) error {
+	return waitFor(time.Minute, func() (bool, error) {
+		pods, err := cl.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{
+			LabelSelector: "app.kubernetes.io/managed-by=kube-plex,kube-plex/pool!=idle",
+		})
+		if err != nil {
+			return false, err
+		}
+		secrets, err := cl.CoreV1().Secrets(namespace).List(ctx, metav1.ListOptions{
+			LabelSelector: "app.kubernetes.io/managed-by=kube-plex",
+		})
+		if err != nil {
+			return false, err
+		}
+		configMaps, err := cl.CoreV1().ConfigMaps(namespace).List(ctx, metav1.ListOptions{
+			LabelSelector: "app.kubernetes.io/managed-by=kube-plex",
+		})
+		if err != nil {
+			return false, err
+		}
+		jobs, err := cl.BatchV1().Jobs(namespace).List(ctx, metav1.ListOptions{
+			LabelSelector: "app.kubernetes.io/managed-by=kube-plex",
+		})
+		if err != nil {
+			return false, err
+		}
+		return len(pods.Items)+len(secrets.Items)+len(configMaps.Items)+len(jobs.Items) == 0, nil
+	})
+}
+
+func waitFor(timeout time.Duration, fn func() (bool, error)) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		done, err := fn()
+		if err != nil {
+			return err
+		}
+		if done {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out after %s", timeout)
+		}
+		time.Sleep(2 * time.Second)
+	}
+}
@@ -0,0 +1,30 @@
+#!/bin/sh
+# fake-transcoder mimics the parts of Plex Transcoder kube-plex cares about:
+# it reports progress to -progressurl and writes segments next to the output
+# given as the last argument.
+set -e
+
+progressurl=""
+output=""
+while [ $# -gt 0 ]; do
+	case "$1" in
+	-progressurl)
+		progressurl="$2"
+		shift
+		;;
+	esac
+	output="$1"
+	shift
+done
+
+echo "Duration: 00:00:03.00, start: 0.000000, bitrate: 1 kb/s"
+mkdir -p "$(dirname "$output")"
+for i in 1 2 3; do
+	echo "frame=$i time=00:00:0$i.00 speed=1x"
+	echo "segment $i" > "$(dirname "$output")/segment-$i.ts"
+	if [ -n "$progressurl" ]; then
+		wget -q -O /dev/null --post-data "progress=continue" "$progressurl" || true
+	fi
+	sleep 1
+done
+echo "#EXTM3U" > "$output"
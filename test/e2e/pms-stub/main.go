@@ -0,0 +1,30 @@
+// pms-stub is a minimal stand-in for Plex Media Server used by the e2e
+// tests. It answers the identity endpoint and counts the progress callbacks
+// transcoders make to it.
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync/atomic"
+)
+
+func main() {
+	var progress atomic.Int64
+
+	http.HandleFunc("/identity", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/xml")
+		w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?><MediaContainer size="0" machineIdentifier="pms-stub" version="0.0.0"/>`))
+	})
+	http.HandleFunc("/video/:/transcode/session/", func(w http.ResponseWriter, r *http.Request) {
+		progress.Add(1)
+		log.Printf("progress %s %s", r.Method, r.URL)
+	})
+	http.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]int64{"progress": progress.Load()})
+	})
+
+	log.Printf("listening on :32400")
+	log.Fatal(http.ListenAndServe(":32400", nil))
+}
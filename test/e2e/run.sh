@@ -0,0 +1,40 @@
+#!/bin/sh
+# run.sh creates a kind cluster, deploys the PMS stub and runs the e2e
+# tests against it. Set KEEP_CLUSTER=true to leave the cluster around,
+# extra arguments are passed to the tests, e.g. -soak 200.
+set -e
+
+cd "$(dirname "$0")/../.."
+
+CLUSTER=${CLUSTER:-kube-plex-e2e}
+
+if ! kind get clusters | grep -qx "$CLUSTER"; then
+	kind create cluster --name "$CLUSTER"
+fi
+cleanup() {
+	rm -f test/e2e/kube-plex
+	if [ "$KEEP_CLUSTER" != "true" ]; then
+		kind delete cluster --name "$CLUSTER"
+	fi
+}
+trap cleanup EXIT
+
+# the tests and the shims they run only ever talk to the kind cluster
+mkdir -p dist/e2e
+kind get kubeconfig --name "$CLUSTER" > dist/e2e/kubeconfig
+export KUBECONFIG="$PWD/dist/e2e/kubeconfig"
+
+# the image carries the relay too, built for the nodes
+CGO_ENABLED=0 GOOS=linux go build -o test/e2e/kube-plex .
+docker build --tag kube-plex-e2e:e2e test/e2e
+kind load docker-image --name "$CLUSTER" kube-plex-e2e:e2e
+
+kubectl apply -f test/e2e/manifests.yaml
+kubectl -n kube-plex-e2e rollout status deployment/pms-stub --timeout=2m
+
+# transcode pods push relayed segments to this host through the gateway of
+# the kind network
+RELAY_ADDRESS=$(docker network inspect kind --format '{{range .IPAM.Config}}{{.Gateway}} {{end}}' | tr ' ' '\n' | grep -v : | head -n 1)
+
+go build -o dist/e2e/kube-plex .
+go test -count=1 -v -timeout 60m ./test/e2e -args -binary "$PWD/dist/e2e/kube-plex" -relay-address "$RELAY_ADDRESS" "$@"
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// throttleSignals are forwarded to the remote transcoder. SIGSTOP can't be
+// caught, it pauses the shim only, but PMS resumes it with SIGCONT which is
+// forwarded, and SIGTSTP is forwarded as SIGSTOP.
+var throttleSignals = map[os.Signal]string{
+	syscall.SIGTSTP: "STOP",
+	syscall.SIGCONT: "CONT",
+	syscall.SIGUSR1: "USR1",
+	syscall.SIGUSR2: "USR2",
+}
+
+// signalScript signals every process of the container running the
+// transcoder binary, exiting 1 when there's none. The transcoder must not be
+// the init process of its pid namespace, it would ignore SIGSTOP.
+const signalScript = `found=1; for p in /proc/[0-9]*; do if [ "$(readlink "$p/exe" 2>/dev/null)" = "$1" ]; then kill -"$0" "${p#/proc/}" && found=0; fi; done; exit $found`
+
+// errTranscoderNotRunning is returned when signalling finds no transcoder
+// process, it already exited
+var errTranscoderNotRunning = errors.New("transcoder not running")
+
+// enableSignalForwarding makes the transcoder signalable from an exec by
+// sharing the pid namespace of the pod, so it doesn't run as pid 1
+func enableSignalForwarding(pod *corev1.Pod) {
+	if throttleForwarding != "true" {
+		return
+	}
+	share := true
+	pod.Spec.ShareProcessNamespace = &share
+}
+
+// forwardSignals relays the throttling signals received by the shim to the
+// transcoder running in the pod until ctx is cancelled
+func forwardSignals(ctx context.Context, cfg *rest.Config, cl kubernetes.Interface, pod *corev1.Pod, transcoder string) {
+	sigs := make([]os.Signal, 0, len(throttleSignals))
+	for sig := range throttleSignals {
+		sigs = append(sigs, sig)
+	}
+	c := make(chan os.Signal, 4)
+	signal.Notify(c, sigs...)
+	defer signal.Stop(c)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case sig := <-c:
+			name := throttleSignals[sig]
+			if sig == syscall.SIGTSTP {
+				// the transcoder is paused remotely, the shim keeps running
+				// so it can forward the SIGCONT resuming it
+				log.Printf("pausing transcoder in pod %s", pod.Name)
+			}
+			if err := signalTranscoder(ctx, cfg, cl, pod, transcoder, name); err != nil && ctx.Err() == nil {
+				log.Printf("warning: unable to forward SIG%s to pod %q: %s", name, pod.Name, err)
+			}
+		}
+	}
+}
+
+// signalTranscoder sends the named signal to the transcoder running in the
+// pod
+func signalTranscoder(ctx context.Context, cfg *rest.Config, cl kubernetes.Interface, pod *corev1.Pod, transcoder, name string) error {
+	code, err := execInPod(ctx, cfg, cl, pod, []string{"sh", "-c", signalScript, name, transcoder}, nil, nil, os.Stderr)
+	if err != nil {
+		return err
+	}
+	if code == 1 {
+		return errTranscoderNotRunning
+	}
+	if code != 0 {
+		return fmt.Errorf("signalling exited with %d", code)
+	}
+	return nil
+}
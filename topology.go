@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// constrainToVolumeTopology requires the pod to run on the nodes the
+// volumes bound to its claims can be attached to, e.g. the node of a
+// local-path volume or the zone of a zonal disk. Claims not bound yet are
+// skipped.
+func constrainToVolumeTopology(ctx context.Context, cl kubernetes.Interface, ns string, pod *corev1.Pod) error {
+	for _, v := range pod.Spec.Volumes {
+		if v.PersistentVolumeClaim == nil {
+			continue
+		}
+		pvc, err := cl.CoreV1().PersistentVolumeClaims(ns).Get(ctx, v.PersistentVolumeClaim.ClaimName, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if pvc.Spec.VolumeName == "" {
+			continue
+		}
+		pv, err := cl.CoreV1().PersistentVolumes().Get(ctx, pvc.Spec.VolumeName, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if pv.Spec.NodeAffinity != nil && pv.Spec.NodeAffinity.Required != nil {
+			requireNodeSelectorTerms(pod, pv.Spec.NodeAffinity.Required.NodeSelectorTerms)
+		}
+	}
+	return nil
+}
+
+// requireNodeSelectorTerms requires the pod to run on nodes matching one of
+// the terms, as well as its existing required node affinity. Terms are
+// ORed, so every existing term is combined with every new one.
+func requireNodeSelectorTerms(pod *corev1.Pod, terms []corev1.NodeSelectorTerm) {
+	if len(terms) == 0 {
+		return
+	}
+	if pod.Spec.Affinity == nil {
+		pod.Spec.Affinity = &corev1.Affinity{}
+	}
+	if pod.Spec.Affinity.NodeAffinity == nil {
+		pod.Spec.Affinity.NodeAffinity = &corev1.NodeAffinity{}
+	}
+	na := pod.Spec.Affinity.NodeAffinity
+	if na.RequiredDuringSchedulingIgnoredDuringExecution == nil {
+		na.RequiredDuringSchedulingIgnoredDuringExecution = &corev1.NodeSelector{
+			NodeSelectorTerms: append([]corev1.NodeSelectorTerm(nil), terms...),
+		}
+		return
+	}
+	var combined []corev1.NodeSelectorTerm
+	for _, existing := range na.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms {
+		for _, t := range terms {
+			combined = append(combined, corev1.NodeSelectorTerm{
+				MatchExpressions: append(append([]corev1.NodeSelectorRequirement(nil), existing.MatchExpressions...), t.MatchExpressions...),
+				MatchFields:      append(append([]corev1.NodeSelectorRequirement(nil), existing.MatchFields...), t.MatchFields...),
+			})
+		}
+	}
+	na.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms = combined
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/lrascao/kube-plex/pkg/ffmpeg"
+)
+
+// codecs of the streams a cheap session outputs
+var (
+	audioCodecs    = []string{"aac", "ac3", "eac3", "mp3", "libmp3lame", "flac", "opus", "libopus", "vorbis", "libvorbis", "alac", "pcm_"}
+	subtitleCodecs = []string{"srt", "subrip", "ass", "ssa", "webvtt", "mov_text", "text"}
+)
+
+// allOf reports whether every codec starts with one of prefixes
+func allOf(codecs, prefixes []string) bool {
+	if len(codecs) == 0 {
+		return false
+	}
+	for _, codec := range codecs {
+		if !matchesCodec(prefixes, codec) {
+			return false
+		}
+	}
+	return true
+}
+
+// trivialSession returns what kind of cheap job the transcoder invocation
+// is, audio transcodes, subtitle extraction, thumbnails or credits
+// detection, empty when it's a regular transcode
+func trivialSession(args []string) string {
+	codecs := ffmpeg.Parse(args).OutputCodecs
+	for i, v := range args {
+		var next string
+		if i+1 < len(args) {
+			next = args[i+1]
+		}
+		switch {
+		case v == "-f" && (next == "image2" || next == "mjpeg" || next == "singlejpeg"),
+			(v == "-frames:v" || v == "-vframes") && next == "1":
+			return "thumbnail"
+		case v == "-f" && next == "chromaprint",
+			strings.Contains(v, "blackdetect") || strings.Contains(v, "silencedetect"):
+			return "credits detection"
+		case v == "-f" && (next == "srt" || next == "ass" || next == "webvtt"):
+			return "subtitle extraction"
+		}
+	}
+	if allOf(codecs, subtitleCodecs) {
+		return "subtitle extraction"
+	}
+	for _, v := range args {
+		if v == "-vn" {
+			return "audio transcode"
+		}
+	}
+	if allOf(codecs, audioCodecs) {
+		return "audio transcode"
+	}
+	return ""
+}
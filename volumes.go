@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// parseVolumeSource parses the nfs:<server>:<path> or hostPath:<path>
+// source a volume is declared with instead of a claim, returning nil when
+// unset
+func parseVolumeSource(spec string) (*corev1.VolumeSource, error) {
+	if spec == "" {
+		return nil, nil
+	}
+	kind, rest, _ := strings.Cut(spec, ":")
+	switch kind {
+	case "nfs":
+		server, p, ok := strings.Cut(rest, ":")
+		if !ok || server == "" || !path.IsAbs(p) {
+			return nil, fmt.Errorf("invalid NFS volume %q, expected nfs:<server>:<path>", spec)
+		}
+		return &corev1.VolumeSource{NFS: &corev1.NFSVolumeSource{Server: server, Path: p}}, nil
+	case "hostPath":
+		if !path.IsAbs(rest) {
+			return nil, fmt.Errorf("invalid hostPath volume %q, expected hostPath:<path>", spec)
+		}
+		return &corev1.VolumeSource{HostPath: &corev1.HostPathVolumeSource{Path: rest}}, nil
+	}
+	return nil, fmt.Errorf("invalid volume %q, expected nfs:<server>:<path> or hostPath:<path>", spec)
+}
+
+// volumeSource returns the source of a volume, the one declared by spec
+// when set or else the claim
+func volumeSource(spec, claim string) corev1.VolumeSource {
+	// validated in main
+	if source, _ := parseVolumeSource(spec); source != nil {
+		return *source
+	}
+	return corev1.VolumeSource{
+		PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+			ClaimName: claim,
+		},
+	}
+}
+
+// mountOptions are the options of the mounts of a volume
+type mountOptions struct {
+	subPath     string
+	subPathExpr string
+	readOnly    *bool
+	propagation *corev1.MountPropagationMode
+}
+
+// parseMountOptions parses the comma separated subPath, subPathExpr,
+// readOnly and mountPropagation key=value options of the mounts of a volume
+func parseMountOptions(spec string) (*mountOptions, error) {
+	if spec == "" {
+		return nil, nil
+	}
+	opts := &mountOptions{}
+	for _, entry := range strings.Split(spec, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid mount option %q, expected key=value", entry)
+		}
+		switch k {
+		case "subPath":
+			opts.subPath = v
+		case "subPathExpr":
+			opts.subPathExpr = v
+		case "readOnly":
+			if v != "true" && v != "false" {
+				return nil, fmt.Errorf("invalid readOnly %q, expected true or false", v)
+			}
+			readOnly := v == "true"
+			opts.readOnly = &readOnly
+		case "mountPropagation":
+			mode := corev1.MountPropagationMode(v)
+			switch mode {
+			case corev1.MountPropagationNone, corev1.MountPropagationHostToContainer, corev1.MountPropagationBidirectional:
+			default:
+				return nil, fmt.Errorf("invalid mountPropagation %q, expected None, HostToContainer or Bidirectional", v)
+			}
+			opts.propagation = &mode
+		default:
+			return nil, fmt.Errorf("unknown mount option %q", k)
+		}
+	}
+	if opts.subPath != "" && opts.subPathExpr != "" {
+		return nil, fmt.Errorf("subPath and subPathExpr are mutually exclusive")
+	}
+	return opts, nil
+}
+
+// applyMountOptions applies the options of DATA_MOUNT_OPTIONS,
+// CONFIG_MOUNT_OPTIONS and TRANSCODE_MOUNT_OPTIONS to every mount of their
+// volume
+func applyMountOptions(pod *corev1.Pod) {
+	options := map[string]*mountOptions{}
+	for name, spec := range map[string]string{"data": dataMountOptions, "config": configMountOptions, "transcode": transcodeMountOptions} {
+		// validated in main
+		if opts, _ := parseMountOptions(spec); opts != nil {
+			options[name] = opts
+		}
+	}
+	apply := func(containers []corev1.Container) {
+		for i := range containers {
+			for j := range containers[i].VolumeMounts {
+				m := &containers[i].VolumeMounts[j]
+				opts, ok := options[m.Name]
+				if !ok {
+					continue
+				}
+				if opts.subPath != "" {
+					m.SubPath = opts.subPath
+				}
+				if opts.subPathExpr != "" {
+					m.SubPathExpr = opts.subPathExpr
+				}
+				if opts.readOnly != nil {
+					m.ReadOnly = *opts.readOnly
+				}
+				if opts.propagation != nil {
+					m.MountPropagation = opts.propagation
+				}
+			}
+		}
+	}
+	apply(pod.Spec.InitContainers)
+	apply(pod.Spec.Containers)
+}
+
+// isolateSession mounts only the session directory of the transcode volume
+// in the pod, at the same path, so concurrent sessions can't see or
+// overwrite each other's segments. The other mounts of the transcode volume
+// get an emptyDir instead.
+func isolateSession(pod *corev1.Pod, cwd string) {
+	scratch := false
+	isolate := func(containers []corev1.Container) {
+		for i := range containers {
+			c := &containers[i]
+			var session *corev1.VolumeMount
+			for j, m := range c.VolumeMounts {
+				if m.Name != "transcode" {
+					continue
+				}
+				rel, err := filepath.Rel(m.MountPath, cwd)
+				if err != nil || strings.HasPrefix(rel, "..") {
+					continue
+				}
+				if session == nil || len(m.MountPath) > len(session.MountPath) {
+					session = &c.VolumeMounts[j]
+				}
+			}
+			if session == nil {
+				continue
+			}
+			rel, _ := filepath.Rel(session.MountPath, cwd)
+			isolated := *session
+			isolated.MountPath = cwd
+			if isolated.SubPathExpr != "" {
+				isolated.SubPathExpr = path.Join(isolated.SubPathExpr, filepath.ToSlash(rel))
+			} else {
+				isolated.SubPath = path.Join(isolated.SubPath, filepath.ToSlash(rel))
+			}
+
+			var mounts []corev1.VolumeMount
+			for _, m := range c.VolumeMounts {
+				switch {
+				case m.Name != "transcode":
+					mounts = append(mounts, m)
+				case m.MountPath == session.MountPath:
+					mounts = append(mounts, isolated)
+				default:
+					mounts = append(mounts, corev1.VolumeMount{Name: "transcode-scratch", MountPath: m.MountPath})
+					scratch = true
+				}
+			}
+			c.VolumeMounts = mounts
+		}
+	}
+	isolate(pod.Spec.InitContainers)
+	isolate(pod.Spec.Containers)
+	if scratch {
+		pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{
+			Name:         "transcode-scratch",
+			VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}},
+		})
+	}
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// podOutcome is how a transcode pod finished
+type podOutcome int
+
+const (
+	podSucceeded podOutcome = iota
+	// the transcoder exited with an error
+	podFailed
+	// an init container failed, the transcoder never ran
+	podInitFailed
+	// the pod was evicted or disrupted by the cluster
+	podEvicted
+	// the node running the pod stopped reporting
+	podNodeLost
+	// the pod was deleted by someone else
+	podDeleted
+	// the pod was stuck before the transcoder could start
+	podStartFailed
+	// waiting was cancelled or the pod status couldn't be read
+	podWaitFailed
+)
+
+func (o podOutcome) String() string {
+	switch o {
+	case podSucceeded:
+		return "succeeded"
+	case podFailed:
+		return "failed"
+	case podInitFailed:
+		return "init failed"
+	case podEvicted:
+		return "evicted"
+	case podNodeLost:
+		return "node lost"
+	case podDeleted:
+		return "deleted"
+	case podStartFailed:
+		return "start failed"
+	default:
+		return "wait failed"
+	}
+}
+
+// podResult is the result of waiting for a transcode pod to finish
+type podResult struct {
+	outcome podOutcome
+	// exit code of the transcoder, -1 when it didn't terminate
+	exitCode int32
+	// short machine readable reason and human readable message
+	reason  string
+	message string
+	// typed error explaining why the pod couldn't start
+	cause error
+}
+
+// err returns nil when the pod succeeded and a typed error describing the
+// result otherwise
+func (r podResult) err() error {
+	switch r.outcome {
+	case podSucceeded:
+		return nil
+	case podFailed:
+		return &ErrTranscoder{ExitCode: int(r.exitCode), Reason: r.reason, Message: r.message}
+	case podEvicted, podNodeLost, podDeleted:
+		return fmt.Errorf("%w: %s", ErrDisrupted, r.describe())
+	case podStartFailed:
+		return r.cause
+	}
+	return fmt.Errorf("%s", r.describe())
+}
+
+func (r podResult) describe() string {
+	msg := fmt.Sprintf("pod %s", r.outcome)
+	if r.reason != "" {
+		msg += ": " + r.reason
+	}
+	if r.exitCode >= 0 {
+		msg += fmt.Sprintf(" (exit code %d)", r.exitCode)
+	}
+	if r.message != "" {
+		msg += ": " + r.message
+	}
+	return msg
+}
+
+// nodeLostTimeout is how long a pod may stay in the Unknown phase before
+// its node is considered lost
+const nodeLostTimeout = time.Minute
+
+// waitOptions control how waitForPodCompletion follows the pod
+type waitOptions struct {
+	// how often the pod status is read
+	pollInterval time.Duration
+	// how long the pod may stay stuck on a known reason, 0 waits forever
+	stuckTimeout time.Duration
+	// how long the pod may stay unschedulable instead, while the node
+	// autoscaler scales a node pool up, the stuck timeout applies when 0
+	scaleUpTimeout time.Duration
+	// how long the transcoder may take to start, 0 waits forever
+	startTimeout time.Duration
+	// how many times the transcoder of a pod restarting OnFailure may be
+	// restarted before the session fails
+	maxRestarts int32
+}
+
+// waitForPodCompletion polls the pod until it finishes, looking at container
+// statuses and conditions rather than just the phase. A pod stuck before its
+// transcoder starts, unschedulable, failing to pull its image or to create
+// its containers, fails once the stuck timeout elapsed, and any pod whose
+// transcoder didn't start fails after the start timeout.
+func waitForPodCompletion(ctx context.Context, cl kubernetes.Interface, pod *corev1.Pod, opts waitOptions) podResult {
+	var unknownSince, stuckSince time.Time
+	begin := time.Now()
+	started := false
+	for {
+		select {
+		case <-ctx.Done():
+			return podResult{outcome: podWaitFailed, exitCode: -1, reason: "context cancelled"}
+		case <-time.After(opts.pollInterval):
+			pod, err := cl.CoreV1().Pods(pod.Namespace).Get(ctx, pod.Name, metav1.GetOptions{})
+			if apierrors.IsNotFound(err) {
+				return podResult{outcome: podDeleted, exitCode: -1}
+			}
+			if err != nil {
+				return podResult{outcome: podWaitFailed, exitCode: -1, message: err.Error()}
+			}
+
+			if pod.Status.Phase == corev1.PodUnknown {
+				if unknownSince.IsZero() {
+					log.Printf("warning: pod %q is in an unknown state", pod.Name)
+					unknownSince = time.Now()
+				}
+				if time.Since(unknownSince) > nodeLostTimeout {
+					return podResult{outcome: podNodeLost, exitCode: -1, reason: pod.Status.Reason, message: pod.Status.Message}
+				}
+				continue
+			}
+			unknownSince = time.Time{}
+
+			if result, done := podStatusResult(pod); done {
+				return result
+			}
+			if result, done := restartsResult(pod, opts.maxRestarts); done {
+				return result
+			}
+			started = started || transcoderStarted(pod)
+			if !started && opts.startTimeout > 0 && time.Since(begin) > opts.startTimeout {
+				cause := fmt.Errorf("%w within %s", ErrStartTimeout, opts.startTimeout)
+				if pendingErr := pendingPodError(pod); pendingErr != nil {
+					cause = fmt.Errorf("%w: %w", cause, pendingErr)
+				}
+				return podResult{outcome: podStartFailed, exitCode: -1, cause: cause}
+			}
+
+			// sidecars failing once the transcoder runs don't hold the
+			// session back, the transcoder tells how it went
+			var stuckErr error
+			if !started {
+				stuckErr = stuckPodError(pod)
+			}
+			if stuckErr == nil {
+				stuckSince = time.Time{}
+				continue
+			}
+			if errors.Is(stuckErr, errImageInvalid) {
+				return podResult{outcome: podStartFailed, exitCode: -1, cause: stuckErr}
+			}
+			if stuckSince.IsZero() {
+				log.Printf("warning: pod %q is stuck: %s", pod.Name, stuckErr)
+				stuckSince = time.Now()
+			}
+			timeout := opts.stuckTimeout
+			if opts.scaleUpTimeout > 0 && errors.Is(stuckErr, ErrUnschedulable) {
+				timeout = opts.scaleUpTimeout
+			}
+			if timeout > 0 && time.Since(stuckSince) > timeout {
+				cause := fmt.Errorf("%w, stuck for %s", stuckErr, timeout)
+				if !isStartError(stuckErr) {
+					cause = fmt.Errorf("%w: %w", ErrStartTimeout, cause)
+				}
+				return podResult{outcome: podStartFailed, exitCode: -1, cause: cause}
+			}
+		}
+	}
+}
+
+// transcoderStarted reports whether the transcoder container is, or was,
+// running
+func transcoderStarted(pod *corev1.Pod) bool {
+	for _, status := range pod.Status.ContainerStatuses {
+		if status.Name == pod.Spec.Containers[0].Name && (status.State.Running != nil || status.State.Terminated != nil) {
+			return true
+		}
+	}
+	return false
+}
+
+// podStatusResult inspects the status of the pod, returning whether it's done
+func podStatusResult(pod *corev1.Pod) (podResult, bool) {
+	if pod.Status.Reason == "Evicted" || pod.Status.Reason == "NodeLost" {
+		outcome := podEvicted
+		if pod.Status.Reason == "NodeLost" {
+			outcome = podNodeLost
+		}
+		return podResult{outcome: outcome, exitCode: -1, reason: pod.Status.Reason, message: pod.Status.Message}, true
+	}
+	for _, cond := range pod.Status.Conditions {
+		if cond.Type == corev1.DisruptionTarget && cond.Status == corev1.ConditionTrue && pod.Status.Phase == corev1.PodFailed {
+			return podResult{outcome: podEvicted, exitCode: -1, reason: cond.Reason, message: cond.Message}, true
+		}
+	}
+
+	sidecars := map[string]bool{}
+	for _, c := range pod.Spec.InitContainers {
+		if c.RestartPolicy != nil && *c.RestartPolicy == corev1.ContainerRestartPolicyAlways {
+			sidecars[c.Name] = true
+		}
+	}
+	for _, status := range pod.Status.InitContainerStatuses {
+		// sidecars are killed once the transcoder exited, the transcoder
+		// tells how the session went
+		if sidecars[status.Name] {
+			continue
+		}
+		if t := status.State.Terminated; t != nil && t.ExitCode != 0 && pod.Spec.RestartPolicy == corev1.RestartPolicyNever {
+			return podResult{outcome: podInitFailed, exitCode: t.ExitCode, reason: status.Name + ": " + t.Reason, message: t.Message}, true
+		}
+		if w := status.State.Waiting; w != nil && w.Reason == "CrashLoopBackOff" {
+			return podResult{outcome: podInitFailed, exitCode: -1, reason: status.Name + ": " + w.Reason, message: w.Message}, true
+		}
+	}
+
+	for _, status := range pod.Status.ContainerStatuses {
+		t := status.State.Terminated
+		if status.Name != pod.Spec.Containers[0].Name || t == nil {
+			continue
+		}
+		if t.ExitCode == 0 {
+			// the transcoder is done even if the phase, or a previous
+			// restart, says otherwise
+			return podResult{outcome: podSucceeded, exitCode: 0}, true
+		}
+		if pod.Spec.RestartPolicy == corev1.RestartPolicyNever {
+			return podResult{outcome: podFailed, exitCode: t.ExitCode, reason: t.Reason, message: t.Message}, true
+		}
+	}
+
+	switch pod.Status.Phase {
+	case corev1.PodSucceeded:
+		return podResult{outcome: podSucceeded, exitCode: 0}, true
+	case corev1.PodFailed:
+		return podResult{outcome: podFailed, exitCode: -1, reason: pod.Status.Reason, message: pod.Status.Message}, true
+	}
+	return podResult{}, false
+}
+
+// restartsResult fails pods restarting OnFailure once their transcoder
+// restarted more than maxRestarts times, the kubelet would restart it
+// forever otherwise
+func restartsResult(pod *corev1.Pod, maxRestarts int32) (podResult, bool) {
+	if pod.Spec.RestartPolicy != corev1.RestartPolicyOnFailure {
+		return podResult{}, false
+	}
+	for _, status := range pod.Status.ContainerStatuses {
+		if status.Name != pod.Spec.Containers[0].Name || status.RestartCount <= maxRestarts {
+			continue
+		}
+		result := podResult{outcome: podFailed, exitCode: -1, reason: fmt.Sprintf("restarted %d times", status.RestartCount)}
+		if t := status.LastTerminationState.Terminated; t != nil {
+			result.exitCode, result.message = t.ExitCode, t.Message
+			if t.Reason != "" {
+				result.reason += ", last " + t.Reason
+			}
+		}
+		return result, true
+	}
+	return podResult{}, false
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// waitingPod returns a pending pod whose transcoder container is waiting
+// for the reason
+func waitingPod(reason, message string) *corev1.Pod {
+	pod := testPod("a", transcodeLabels(nil), corev1.PodPending)
+	pod.Spec.Containers = []corev1.Container{{Name: "plex"}}
+	pod.Status.ContainerStatuses = []corev1.ContainerStatus{{
+		Name:  "plex",
+		State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: reason, Message: message}},
+	}}
+	return pod
+}
+
+func TestStuckPodError(t *testing.T) {
+	unschedulable := testPod("a", transcodeLabels(nil), corev1.PodPending)
+	unschedulable.Status.Conditions = []corev1.PodCondition{{
+		Type:   corev1.PodScheduled,
+		Status: corev1.ConditionFalse,
+		Reason: corev1.PodReasonUnschedulable,
+	}}
+
+	tests := []struct {
+		name      string
+		pod       *corev1.Pod
+		want      error
+		wantStuck bool
+	}{
+		{name: "running", pod: testPod("a", transcodeLabels(nil), corev1.PodRunning)},
+		{name: "unschedulable", pod: unschedulable, want: ErrUnschedulable, wantStuck: true},
+		{name: "image pull back-off", pod: waitingPod("ImagePullBackOff", ""), want: ErrImagePull, wantStuck: true},
+		{name: "invalid image", pod: waitingPod("InvalidImageName", ""), want: errImageInvalid, wantStuck: true},
+		{
+			name:      "subPath",
+			pod:       waitingPod("CreateContainerConfigError", `failed to prepare subPath for volumeMount "transcode"`),
+			want:      ErrStorage,
+			wantStuck: true,
+		},
+		{
+			name:      "missing secret",
+			pod:       waitingPod("CreateContainerConfigError", `secret "kube-plex-env" not found`),
+			wantStuck: true,
+		},
+		{name: "creating", pod: waitingPod("ContainerCreating", ""), wantStuck: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := stuckPodError(tt.pod)
+			if (err != nil) != tt.wantStuck {
+				t.Fatalf("stuckPodError() = %v, want stuck %t", err, tt.wantStuck)
+			}
+			if tt.want != nil && !errors.Is(err, tt.want) {
+				t.Errorf("stuckPodError() = %v, want %v", err, tt.want)
+			}
+			if tt.want == nil && errors.Is(err, ErrStorage) {
+				t.Errorf("stuckPodError() = %v, classified as a storage error", err)
+			}
+		})
+	}
+}
+
+func TestWaitForPodCompletionStuck(t *testing.T) {
+	always := corev1.ContainerRestartPolicyAlways
+	sidecarPod := func(transcoder corev1.ContainerState) *corev1.Pod {
+		pod := testPod("a", transcodeLabels(nil), corev1.PodPending)
+		pod.Spec.InitContainers = []corev1.Container{{Name: "relay", RestartPolicy: &always}}
+		pod.Spec.Containers = []corev1.Container{{Name: "plex"}}
+		pod.Status.InitContainerStatuses = []corev1.ContainerStatus{{
+			Name:  "relay",
+			State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "ImagePullBackOff"}},
+		}}
+		pod.Status.ContainerStatuses = []corev1.ContainerStatus{{Name: "plex", State: transcoder}}
+		return pod
+	}
+
+	tests := []struct {
+		name    string
+		pod     *corev1.Pod
+		want    podOutcome
+		wantErr error
+	}{
+		{
+			name:    "sidecar stuck before start",
+			pod:     sidecarPod(corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "PodInitializing"}}),
+			want:    podStartFailed,
+			wantErr: ErrImagePull,
+		},
+		{
+			name: "sidecar stuck after start",
+			pod:  sidecarPod(corev1.ContainerState{Running: &corev1.ContainerStateRunning{}}),
+			// still following the transcoder when the wait is cancelled
+			want: podWaitFailed,
+		},
+		{
+			name:    "creating",
+			pod:     waitingPod("ContainerCreating", ""),
+			want:    podStartFailed,
+			wantErr: ErrStartTimeout,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			defer cancel()
+			cl := fake.NewSimpleClientset(tt.pod)
+			opts := waitOptions{pollInterval: 5 * time.Millisecond, stuckTimeout: 20 * time.Millisecond}
+			result := waitForPodCompletion(ctx, cl, tt.pod, opts)
+			if result.outcome != tt.want {
+				t.Fatalf("waitForPodCompletion() = %s, want %s", result.outcome, tt.want)
+			}
+			if tt.wantErr != nil && !errors.Is(result.err(), tt.wantErr) {
+				t.Errorf("waitForPodCompletion() error = %v, want %v", result.err(), tt.wantErr)
+			}
+			if errors.Is(result.err(), ErrStorage) {
+				t.Errorf("waitForPodCompletion() error = %v, classified as a storage error", result.err())
+			}
+		})
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"strconv"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+
+	"github.com/lrascao/kube-plex/pkg/ffmpeg"
+)
+
+// addCacheWarmup reads the beginning of the input files in an init
+// container, so a cold network storage cache is filled before the
+// transcoder starts and the client doesn't sit buffering on its first reads
+func addCacheWarmup(pod *corev1.Pod, args []string) {
+	if cacheWarmupSize == "" {
+		return
+	}
+	files := ffmpeg.Parse(args).LocalInputs()
+	// validated in main
+	size, _ := resource.ParseQuantity(cacheWarmupSize)
+	if len(files) == 0 || size.Sign() <= 0 {
+		return
+	}
+
+	container := pod.Spec.Containers[0]
+	command := []string{"/bin/sh", "-c", `n=$0; for f; do head -c "$n" "$f" > /dev/null; done; true`, strconv.FormatInt(size.Value(), 10)}
+	pod.Spec.InitContainers = append(pod.Spec.InitContainers, corev1.Container{
+		Name:         "cache-warmup",
+		Image:        container.Image,
+		Command:      append(command, files...),
+		VolumeMounts: container.VolumeMounts,
+	})
+}
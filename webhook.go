@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/lrascao/kube-plex/pkg/ffmpeg"
+)
+
+// events notified to the webhooks
+const (
+	webhookStarted  = "started"
+	webhookFinished = "finished"
+	webhookFailed   = "failed"
+)
+
+// webhookPayload is the JSON body posted to the webhooks
+type webhookPayload struct {
+	Event      string    `json:"event"`
+	Time       time.Time `json:"time"`
+	Session    string    `json:"session,omitempty"`
+	User       string    `json:"user,omitempty"`
+	Client     string    `json:"client,omitempty"`
+	Title      string    `json:"title,omitempty"`
+	Namespace  string    `json:"namespace"`
+	Pod        string    `json:"pod"`
+	Node       string    `json:"node,omitempty"`
+	Inputs     []string  `json:"inputs,omitempty"`
+	VideoCodec string    `json:"videoCodec,omitempty"`
+	Height     int       `json:"height,omitempty"`
+	Streaming  bool      `json:"streaming"`
+	LiveTV     bool      `json:"liveTV,omitempty"`
+	// set once the session ended
+	Duration float64 `json:"durationSeconds,omitempty"`
+	Stopped  bool    `json:"stopped,omitempty"`
+	Error    string  `json:"error,omitempty"`
+}
+
+// webhookTargets returns the webhooks notified of event
+func webhookTargets(event string) []string {
+	if webhookURLs == "" {
+		return nil
+	}
+	if webhookEvents != "" {
+		wanted := false
+		for _, e := range strings.Split(webhookEvents, ",") {
+			wanted = wanted || strings.TrimSpace(e) == event
+		}
+		if !wanted {
+			return nil
+		}
+	}
+	var urls []string
+	for _, u := range strings.Split(webhookURLs, ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			urls = append(urls, u)
+		}
+	}
+	return urls
+}
+
+// validateWebhookEvents checks WEBHOOK_EVENTS only names known events
+func validateWebhookEvents() error {
+	if webhookEvents == "" {
+		return nil
+	}
+	for _, e := range strings.Split(webhookEvents, ",") {
+		switch strings.TrimSpace(e) {
+		case webhookStarted, webhookFinished, webhookFailed:
+		default:
+			return fmt.Errorf("unknown webhook event %q, expected %s, %s or %s", e, webhookStarted, webhookFinished, webhookFailed)
+		}
+	}
+	return nil
+}
+
+// newWebhookPayload describes the session running in the pod
+func newWebhookPayload(event string, pod *corev1.Pod, inv ffmpeg.Invocation) webhookPayload {
+	inputs := make([]string, len(inv.Inputs))
+	for i, input := range inv.Inputs {
+		inputs[i] = redact(input)
+	}
+	return webhookPayload{
+		Event:      event,
+		Time:       time.Now(),
+		Session:    inv.SessionID,
+		User:       pod.Annotations[userAnnotation],
+		Client:     pod.Annotations[clientAnnotation],
+		Title:      pod.Annotations[titleAnnotation],
+		Namespace:  pod.Namespace,
+		Pod:        pod.Name,
+		Node:       pod.Spec.NodeName,
+		Inputs:     inputs,
+		VideoCodec: inv.VideoCodec,
+		Height:     inv.Height,
+		Streaming:  inv.Streaming,
+		LiveTV:     inv.LiveTV,
+	}
+}
+
+// notifyWebhooks posts the payload to every webhook subscribed to its event.
+// Webhooks are notified concurrently and synchronously, as the shim exits
+// right after the session ends, failures are only logged.
+func notifyWebhooks(ctx context.Context, payload webhookPayload) {
+	urls := webhookTargets(payload.Event)
+	if len(urls) == 0 {
+		return
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("warning: unable to encode %s webhook: %s", payload.Event, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, target := range urls {
+		wg.Add(1)
+		go func(target string) {
+			defer wg.Done()
+			if err := postWebhook(ctx, target, body); err != nil {
+				// webhook URLs often embed a secret, only the host is logged
+				log.Printf("warning: unable to notify %s webhook of %s: %s", payload.Event, webhookHost(target), err)
+			}
+		}(target)
+	}
+	wg.Wait()
+}
+
+// webhookHost returns the host of the webhook URL
+func webhookHost(s string) string {
+	if u, err := url.Parse(s); err == nil && u.Host != "" {
+		return u.Host
+	}
+	return "invalid URL"
+}
+
+func postWebhook(ctx context.Context, target string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		// leave the URL out
+		return urlErr.Err
+	}
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
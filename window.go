@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// what to do with background conversions outside BACKGROUND_WINDOW
+const (
+	backgroundPolicyDefer = "defer"
+	backgroundPolicySpot  = "spot"
+)
+
+// timeWindow is a daily window of local time, which may span midnight
+type timeWindow struct {
+	// minutes since midnight
+	start, end int
+}
+
+// parseTimeWindow parses a HH:MM-HH:MM window, returning nil when unset
+func parseTimeWindow(s string) (*timeWindow, error) {
+	if s == "" {
+		return nil, nil
+	}
+	from, to, ok := strings.Cut(s, "-")
+	if !ok {
+		return nil, fmt.Errorf("invalid window %q, expected HH:MM-HH:MM", s)
+	}
+	start, err := time.Parse("15:04", strings.TrimSpace(from))
+	if err != nil {
+		return nil, fmt.Errorf("invalid window %q, expected HH:MM-HH:MM", s)
+	}
+	end, err := time.Parse("15:04", strings.TrimSpace(to))
+	if err != nil {
+		return nil, fmt.Errorf("invalid window %q, expected HH:MM-HH:MM", s)
+	}
+	return &timeWindow{
+		start: start.Hour()*60 + start.Minute(),
+		end:   end.Hour()*60 + end.Minute(),
+	}, nil
+}
+
+// contains reports whether t falls in the window
+func (w *timeWindow) contains(t time.Time) bool {
+	m := t.Hour()*60 + t.Minute()
+	if w.start <= w.end {
+		return m >= w.start && m < w.end
+	}
+	return m >= w.start || m < w.end
+}
+
+// next returns the next time the window opens after t
+func (w *timeWindow) next(t time.Time) time.Time {
+	open := time.Date(t.Year(), t.Month(), t.Day(), w.start/60, w.start%60, 0, 0, t.Location())
+	if !open.After(t) {
+		open = open.AddDate(0, 0, 1)
+	}
+	return open
+}
+
+// validateBackgroundWindow checks BACKGROUND_WINDOW and BACKGROUND_POLICY,
+// and the spot node label background conversions are placed with
+func validateBackgroundWindow() error {
+	if _, err := parseTimeWindow(backgroundWindow); err != nil {
+		return err
+	}
+	switch backgroundPolicy {
+	case "", backgroundPolicyDefer:
+		return nil
+	case backgroundPolicySpot:
+	default:
+		return fmt.Errorf("unknown background policy %q, expected %s or %s", backgroundPolicy, backgroundPolicyDefer, backgroundPolicySpot)
+	}
+	if k, _, ok := strings.Cut(spotNodeSelector, "="); !ok || k == "" {
+		return fmt.Errorf("SPOT_NODE_SELECTOR must be a key=value node label")
+	}
+	_, err := parseToleration(spotToleration)
+	return err
+}
+
+// scheduleBackground keeps background conversions started outside
+// BACKGROUND_WINDOW out of peak hours: with the spot policy the pod is
+// required to run on spot nodes, otherwise the conversion is deferred until
+// the window opens
+func scheduleBackground(pod *corev1.Pod, stopCh <-chan struct{}) error {
+	// validated in main
+	window, _ := parseTimeWindow(backgroundWindow)
+	now := time.Now()
+	if window == nil || window.contains(now) {
+		return nil
+	}
+	if backgroundPolicy == backgroundPolicySpot {
+		placeOnSpot(pod, spotNodesRequire)
+		return nil
+	}
+
+	open := window.next(now)
+	log.Printf("deferring background conversion until %s", open.Format("15:04"))
+	select {
+	case <-stopCh:
+		return fmt.Errorf("exit requested while waiting for the background window")
+	case <-time.After(time.Until(open)):
+		return nil
+	}
+}